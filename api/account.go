@@ -0,0 +1,365 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"server/auth"
+	"server/catcherr"
+	"server/database"
+	"server/password"
+	"server/request"
+	"server/response"
+	"server/user"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func changePasswordFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	login := auth.ContextUser(ctx).Login
+
+	sessionID, err := auth.SessionID(r)
+	if err != nil {
+		return catcherr.Unauthorized.Wrap(err)
+	}
+
+	var req changePasswordRequest
+	err = request.Decode(w, r, &req)
+	if err != nil {
+		return err
+	}
+
+	err = user.ChangePassword(ctx, login, req.Password, req.NewPassword, sessionID)
+	if err != nil {
+		return accountError(err)
+	}
+
+	return response.NoContent(w)
+}
+
+func changeLoginFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	login := auth.ContextUser(ctx).Login
+
+	var req changeLoginRequest
+	err := request.Decode(w, r, &req)
+	if err != nil {
+		return err
+	}
+
+	token, err := user.ChangeLogin(ctx, login, req.Password, req.NewLogin)
+	if errors.Is(err, user.ErrInvalidLogin) {
+		return catcherr.ValidationFailed.WithFields(catcherr.FieldError{
+			Field:   `new_login`,
+			Code:    `invalid`,
+			Message: err.Error(),
+		}).Wrap(err)
+	}
+	if err != nil {
+		return accountError(err)
+	}
+
+	return response.Send(w, r, http.StatusOK, token)
+}
+
+func changeEmailFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	login := auth.ContextUser(ctx).Login
+
+	var req changeEmailRequest
+	err := request.Decode(w, r, &req)
+	if err != nil {
+		return err
+	}
+
+	err = user.ChangeEmail(ctx, login, req.Password, req.Email)
+	if err != nil {
+		return accountError(err)
+	}
+
+	return response.NoContent(w)
+}
+
+func resendVerificationFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	login := auth.ContextUser(ctx).Login
+
+	err := user.ResendVerification(ctx, login)
+	if err != nil {
+		return accountError(err)
+	}
+
+	return response.NoContent(w)
+}
+
+func deleteAccountFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	login := auth.ContextUser(ctx).Login
+
+	var req deleteAccountRequest
+	err := request.Decode(w, r, &req)
+	if err != nil {
+		return err
+	}
+
+	err = user.DeleteAccount(ctx, login, req.Password)
+	if err != nil {
+		return accountError(err)
+	}
+
+	return response.NoContent(w)
+}
+
+// tokenResponse returns a new personal token. It can't be read later.
+type tokenResponse struct {
+	Token         string                 `json:"token"`
+	PersonalToken database.PersonalToken `json:"personal_token"`
+}
+
+func tokenListFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	uid := auth.ContextUser(ctx).ID
+
+	tokens, err := database.GetPersonalTokens(ctx, uid)
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
+
+	return response.Send(w, r, http.StatusOK, tokens)
+}
+
+// createTokenFunc mints a personal token for scripts and clients
+// that can't go through the login.
+func createTokenFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	uid := auth.ContextUser(ctx).ID
+
+	var req tokenRequest
+	err := request.Decode(w, r, &req)
+	if err != nil {
+		return err
+	}
+
+	// Validated by the request, so the only error is an empty string.
+	ttl, _ := time.ParseDuration(req.ExpiresIn)
+
+	token, t, err := auth.CreatePersonalToken(ctx, uid, req.Name, ttl)
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
+
+	return response.Send(w, r, http.StatusCreated, tokenResponse{Token: token, PersonalToken: t})
+}
+
+func deleteTokenFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	uid := auth.ContextUser(ctx).ID
+
+	err := database.DeletePersonalToken(ctx, uid, pathID(r))
+	if err != nil {
+		return notFoundError(err)
+	}
+
+	return response.NoContent(w)
+}
+
+// appPasswordResponse returns a new app password. It can't be read later.
+type appPasswordResponse struct {
+	Password    string               `json:"password"`
+	AppPassword database.AppPassword `json:"app_password"`
+}
+
+func appPasswordListFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	uid := auth.ContextUser(ctx).ID
+
+	passwords, err := database.GetAppPasswords(ctx, uid)
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
+
+	return response.Send(w, r, http.StatusOK, passwords)
+}
+
+// createAppPasswordFunc generates a password for WebDAV and other clients
+// that only speak Basic auth.
+func createAppPasswordFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	uid := auth.ContextUser(ctx).ID
+
+	var req appPasswordRequest
+	err := request.Decode(w, r, &req)
+	if err != nil {
+		return err
+	}
+
+	password, p, err := auth.CreateAppPassword(ctx, uid, req.Name)
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
+
+	return response.Send(w, r, http.StatusCreated, appPasswordResponse{Password: password, AppPassword: p})
+}
+
+func deleteAppPasswordFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	uid := auth.ContextUser(ctx).ID
+
+	err := database.DeleteAppPassword(ctx, uid, pathID(r))
+	if err != nil {
+		return notFoundError(err)
+	}
+
+	return response.NoContent(w)
+}
+
+// accessKeyResponse returns a new access key. Its secret can't be read later.
+type accessKeyResponse struct {
+	SecretAccessKey string             `json:"secret_access_key"`
+	AccessKey       database.AccessKey `json:"access_key"`
+}
+
+func accessKeyListFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	uid := auth.ContextUser(ctx).ID
+
+	keys, err := database.GetAccessKeys(ctx, uid)
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
+
+	return response.Send(w, r, http.StatusOK, keys)
+}
+
+// createAccessKeyFunc generates a key pair for S3 clients.
+func createAccessKeyFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	uid := auth.ContextUser(ctx).ID
+
+	var req accessKeyRequest
+	err := request.Decode(w, r, &req)
+	if err != nil {
+		return err
+	}
+
+	secret, k, err := auth.CreateAccessKey(ctx, uid, req.Name)
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
+
+	return response.Send(w, r, http.StatusCreated, accessKeyResponse{SecretAccessKey: secret, AccessKey: k})
+}
+
+func deleteAccessKeyFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	uid := auth.ContextUser(ctx).ID
+
+	err := database.DeleteAccessKey(ctx, uid, pathID(r))
+	if err != nil {
+		return notFoundError(err)
+	}
+
+	return response.NoContent(w)
+}
+
+func sshKeyListFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	uid := auth.ContextUser(ctx).ID
+
+	keys, err := database.GetSSHKeys(ctx, uid)
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
+
+	return response.Send(w, r, http.StatusOK, keys)
+}
+
+// createSSHKeyFunc registers a public key for the SFTP server.
+func createSSHKeyFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	uid := auth.ContextUser(ctx).ID
+
+	var req sshKeyRequest
+	err := request.Decode(w, r, &req)
+	if err != nil {
+		return err
+	}
+
+	k, err := user.AddSSHKey(ctx, uid, req.Name, req.PublicKey)
+	if err != nil {
+		return accountError(err)
+	}
+
+	return response.Send(w, r, http.StatusCreated, k)
+}
+
+func deleteSSHKeyFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	uid := auth.ContextUser(ctx).ID
+
+	err := database.DeleteSSHKey(ctx, uid, pathID(r))
+	if err != nil {
+		return notFoundError(err)
+	}
+
+	return response.NoContent(w)
+}
+
+// accountError maps errors returned by the user package to responses.
+func accountError(err error) error {
+	switch {
+	case password.IsPolicyError(err):
+		return catcherr.WeakPassword.WithDetail(err.Error()).Wrap(err)
+	case errors.Is(err, user.ErrInvalidEmail):
+		return catcherr.ValidationFailed.WithFields(catcherr.FieldError{
+			Field:   `email`,
+			Code:    `invalid`,
+			Message: err.Error(),
+		}).Wrap(err)
+	case errors.Is(err, user.ErrInvalidLogin):
+		return catcherr.ValidationFailed.WithFields(catcherr.FieldError{
+			Field:   `login`,
+			Code:    `invalid`,
+			Message: err.Error(),
+		}).Wrap(err)
+	case errors.Is(err, user.ErrInvalidSSHKey):
+		return catcherr.ValidationFailed.WithFields(catcherr.FieldError{
+			Field:   `public_key`,
+			Code:    `invalid`,
+			Message: err.Error(),
+		}).Wrap(err)
+	case errors.Is(err, user.ErrInvalidToken):
+		return catcherr.InvalidToken.Wrap(err)
+	case errors.Is(err, database.ErrLoginTaken):
+		return catcherr.LoginTaken.Wrap(err)
+	case errors.Is(err, database.ErrEmailTaken):
+		return catcherr.EmailTaken.Wrap(err)
+	case errors.Is(err, database.ErrDuplicate):
+		return catcherr.Conflict.Wrap(err)
+	case errors.Is(err, user.ErrRegistrationClosed):
+		return catcherr.RegistrationClosed.Wrap(err)
+	case errors.Is(err, database.ErrInvalidInvite):
+		return catcherr.InvalidInvite.Wrap(err)
+	case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+		return catcherr.WrongPassword.Wrap(err)
+	}
+	return catcherr.InternalServerError.Wrap(err)
+}
@@ -0,0 +1,354 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/audit"
+	"server/auth"
+	"server/catcherr"
+	"server/database"
+	"server/password"
+	"server/request"
+	"server/response"
+	"server/throttle"
+	"server/user"
+
+	"github.com/gorilla/mux"
+)
+
+type inviteResponse struct {
+	Code   string          `json:"code"`
+	Invite database.Invite `json:"invite"`
+}
+
+type userResponse struct {
+	ID            int64           `json:"id"`
+	Login         string          `json:"login"`
+	Email         string          `json:"email,omitempty"`
+	EmailVerified bool            `json:"email_verified"`
+	Status        string          `json:"status"`
+	Role          string          `json:"role"`
+	Disabled      bool            `json:"disabled"`
+	Quota         int64           `json:"quota"`
+	Usage         *database.Usage `json:"usage,omitempty"`
+}
+
+func newUserResponse(u database.User) userResponse {
+	return userResponse{
+		ID:            u.ID,
+		Login:         u.Login,
+		Email:         u.Email,
+		EmailVerified: u.EmailVerified,
+		Status:        u.Status,
+		Role:          u.Role,
+		Disabled:      u.Disabled,
+		Quota:         u.Quota,
+	}
+}
+
+func adminUnlockFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	login := auth.ContextUser(ctx).Login
+
+	var req unlockRequest
+	err := request.Decode(w, r, &req)
+	if err != nil {
+		return err
+	}
+
+	err = throttle.Unlock(ctx, req.Login, req.IP, login)
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
+
+	return response.NoContent(w)
+}
+
+func createInviteFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	login := auth.ContextUser(ctx).Login
+
+	var req inviteRequest
+	err := request.Decode(w, r, &req)
+	if err != nil {
+		return err
+	}
+
+	// Validated by the request, so the only error is an empty string.
+	ttl, _ := time.ParseDuration(req.ExpiresIn)
+
+	code, invite, err := user.CreateInvite(ctx, login, req.MaxUses, ttl)
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
+
+	return response.Send(w, r, http.StatusCreated, inviteResponse{Code: code, Invite: invite})
+}
+
+func inviteListFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	invites, err := database.GetInvites(ctx)
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
+
+	return response.Send(w, r, http.StatusOK, invites)
+}
+
+func deleteInviteFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	err := database.DeleteInvite(ctx, pathID(r))
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
+
+	return response.NoContent(w)
+}
+
+func userListFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	query := userListQuery{pageQuery: defaultPage, Sort: `id`}
+	err := request.DecodeQuery(r, &query)
+	if err != nil {
+		return err
+	}
+
+	users, err := database.SearchUsers(ctx, query.Query, query.options(query.Sort))
+	if err != nil {
+		return pageError(err)
+	}
+
+	list := database.Page[userResponse]{
+		Items:      make([]userResponse, 0, len(users.Items)),
+		Total:      users.Total,
+		NextCursor: users.NextCursor,
+	}
+	for _, u := range users.Items {
+		list.Items = append(list.Items, newUserResponse(u))
+	}
+
+	return response.Send(w, r, http.StatusOK, list)
+}
+
+// userInfoFunc returns the user together with its storage usage.
+func userInfoFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	u, err := database.GetUserByID(ctx, pathID(r))
+	if err != nil {
+		return notFoundError(err)
+	}
+
+	usage, err := database.GetUsage(ctx, u.ID)
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
+
+	info := newUserResponse(u)
+	info.Usage = &usage
+
+	return response.Send(w, r, http.StatusOK, info)
+}
+
+func disableUserFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	err := database.SetDisabled(ctx, pathID(r), true)
+	if err != nil {
+		return notFoundError(err)
+	}
+
+	recordAdminEvent(r, audit.UserDisable, ``)
+	return sendUser(w, r)
+}
+
+func enableUserFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	err := database.SetDisabled(ctx, pathID(r), false)
+	if err != nil {
+		return notFoundError(err)
+	}
+
+	recordAdminEvent(r, audit.UserEnable, ``)
+	return sendUser(w, r)
+}
+
+func resetUserPasswordFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	var req adminPasswordRequest
+	err := request.Decode(w, r, &req)
+	if err != nil {
+		return err
+	}
+
+	err = user.SetPassword(ctx, pathID(r), req.NewPassword)
+	if err != nil {
+		return adminUserError(err)
+	}
+
+	recordAdminEvent(r, audit.UserPasswordReset, ``)
+	return sendUser(w, r)
+}
+
+func setUserQuotaFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	var req quotaRequest
+	err := request.Decode(w, r, &req)
+	if err != nil {
+		return err
+	}
+
+	err = database.SetQuota(ctx, pathID(r), *req.Quota)
+	if err != nil {
+		return notFoundError(err)
+	}
+
+	recordAdminEvent(r, audit.UserQuota, fmt.Sprintf(`quota=%d`, *req.Quota))
+	return sendUser(w, r)
+}
+
+func setUserRoleFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	var req roleRequest
+	err := request.Decode(w, r, &req)
+	if err != nil {
+		return err
+	}
+
+	err = database.SetRole(ctx, pathID(r), req.Role)
+	if err != nil {
+		return notFoundError(err)
+	}
+
+	recordAdminEvent(r, audit.UserRole, `role=`+req.Role)
+	return sendUser(w, r)
+}
+
+// logoutUserFunc revokes every session of the user.
+func logoutUserFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	err := database.RevokeSessions(ctx, pathID(r), ``)
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
+
+	recordAdminEvent(r, audit.UserLogout, ``)
+	return sendUser(w, r)
+}
+
+func registrationListFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	users, err := database.GetPendingUsers(ctx)
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
+
+	list := make([]userResponse, 0, len(users))
+	for _, u := range users {
+		list = append(list, newUserResponse(u))
+	}
+
+	return response.Send(w, r, http.StatusOK, list)
+}
+
+func approveRegistrationFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	u, err := database.ApproveUser(ctx, pathID(r))
+	if err != nil {
+		return notFoundError(err)
+	}
+
+	return response.Send(w, r, http.StatusOK, newUserResponse(u))
+}
+
+func rejectRegistrationFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	err := database.RejectUser(ctx, pathID(r))
+	if err != nil {
+		return notFoundError(err)
+	}
+
+	return response.NoContent(w)
+}
+
+// sendUser responds with the user from the {id} route variable.
+func sendUser(w http.ResponseWriter, r *http.Request) error {
+	u, err := database.GetUserByID(r.Context(), pathID(r))
+	if err != nil {
+		return notFoundError(err)
+	}
+
+	return response.Send(w, r, http.StatusOK, newUserResponse(u))
+}
+
+// recordAdminEvent audits an action of the admin on the user from the route.
+func recordAdminEvent(r *http.Request, eventType, details string) {
+	ctx := r.Context()
+	admin := auth.ContextUser(ctx)
+
+	target := strconv.FormatInt(pathID(r), 10)
+	if u, err := database.GetUserByID(ctx, pathID(r)); err == nil {
+		target = u.Login
+	}
+
+	audit.Record(ctx, database.AuditEvent{
+		Type:    eventType,
+		Login:   target,
+		IP:      auth.ClientIP(r.RemoteAddr),
+		Details: strings.TrimSpace(fmt.Sprintf(`by %s %s`, admin.Login, details)),
+	})
+}
+
+func adminUserError(err error) error {
+	if password.IsPolicyError(err) {
+		return catcherr.WeakPassword.WithDetail(err.Error()).Wrap(err)
+	}
+	return notFoundError(err)
+}
+
+// pathID returns the {id} route variable. The routes only match digits,
+// so the error can only be an overflow and is treated as a missing id.
+func pathID(r *http.Request) int64 {
+	id, _ := strconv.ParseInt(mux.Vars(r)[`id`], 10, 64)
+	return id
+}
+
+func notFoundError(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return catcherr.NotFound.Wrap(err)
+	}
+	return catcherr.InternalServerError.Wrap(err)
+}
@@ -17,164 +17,413 @@ limitations under the License.
 package api
 
 import (
-	"encoding/json"
-	"io"
+	"database/sql"
+	"errors"
+	"mime/multipart"
 	"net/http"
+	"strconv"
 
 	"server/auth"
 	"server/catcherr"
 	"server/database"
+	"server/deadline"
 	"server/directory"
+	"server/request"
 	"server/response"
+	"server/throttle"
 	"server/user"
 
 	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
 )
 
+var (
+	public  = allow()
+	anyone  = allow(database.RoleAdmin, database.RoleUser, database.RoleReadOnly)
+	writers = allow(database.RoleAdmin, database.RoleUser)
+	admins  = allow(database.RoleAdmin)
+
+	publicStream = stream()
+	anyoneStream = stream(database.RoleAdmin, database.RoleUser, database.RoleReadOnly)
+
+	// uploaders is writers for handlers reading file content.
+	uploaders = extended(writers)
+)
+
+// allow wraps a handler so only logged in users with one of the roles reach it,
+// or anyone when no roles are given.
+func allow(roles ...string) func(catcherr.HandlerFunc) http.Handler {
+	guard := guard(roles)
+	return func(f catcherr.HandlerFunc) http.Handler {
+		return catcherr.Handle(response.Negotiate(guard(f)))
+	}
+}
+
+// stream is allow for handlers that send file content rather than
+// an envelope, so the Accept header isn't negotiated.
+func stream(roles ...string) func(catcherr.HandlerFunc) http.Handler {
+	guard := guard(roles)
+	return extended(func(f catcherr.HandlerFunc) http.Handler {
+		return catcherr.Handle(guard(f))
+	})
+}
+
+// extended lets the handlers made by wrap transfer file content for as
+// long as it keeps moving, see deadline.Extend.
+func extended(wrap func(catcherr.HandlerFunc) http.Handler) func(catcherr.HandlerFunc) http.Handler {
+	return func(f catcherr.HandlerFunc) http.Handler {
+		return deadline.Extend(wrap(f))
+	}
+}
+
+func guard(roles []string) func(catcherr.HandlerFunc) catcherr.HandlerFunc {
+	if len(roles) == 0 {
+		return func(f catcherr.HandlerFunc) catcherr.HandlerFunc { return f }
+	}
+	return auth.RequireRole(roles...)
+}
+
 func Handle(r *mux.Router) {
 	// Auth
-	r.HandleFunc(directory.APIAuthCheck, authCheckFunc).Methods(http.MethodGet)
-	r.HandleFunc(directory.APIRegister, registerFunc).Methods(http.MethodPost)
-	r.HandleFunc(directory.APILogin, loginFunc).Methods(http.MethodPost)
+	r.Handle(directory.APIAuthCheck, anyone(authCheckFunc)).Methods(http.MethodGet)
+	r.Handle(directory.APIRegister, public(registerFunc)).Methods(http.MethodPost)
+	r.Handle(directory.APILogin, public(loginFunc)).Methods(http.MethodPost)
+	r.Handle(directory.APIRefresh, public(refreshFunc)).Methods(http.MethodPost)
+	r.Handle(directory.APIVerifyEmail, public(verifyEmailFunc)).Methods(http.MethodPost)
+	r.Handle(directory.APIPasswordResetRequest, public(passwordResetRequestFunc)).Methods(http.MethodPost)
+	r.Handle(directory.APIPasswordReset, public(passwordResetFunc)).Methods(http.MethodPost)
 
 	// Files
-	r.HandleFunc(directory.APIFileUpload, fileUploadFunc).Methods(http.MethodPut)
-	r.HandleFunc(directory.APIFileDelete, fileDeleteFunc).Methods(http.MethodDelete)
-	r.HandleFunc(directory.APIFileList, fileListFunc).Methods(http.MethodGet)
+	r.Handle(directory.APIFileUpload, uploaders(fileUploadFunc)).Methods(http.MethodPut)
+	r.Handle(directory.APIFileDelete, writers(fileDeleteFunc)).Methods(http.MethodDelete)
+	r.Handle(directory.APIFileList, anyone(fileListFunc)).Methods(http.MethodGet)
+	r.Handle(directory.APIFile, writers(fileMoveFunc)).Methods(http.MethodPatch)
+	r.Handle(directory.APIFile, writers(fileRemoveFunc)).Methods(http.MethodDelete)
+	r.Handle(directory.APIFileData, anyoneStream(fileContentFunc)).Methods(http.MethodGet, http.MethodHead)
+	r.Handle(directory.APIThumbnail, anyoneStream(thumbnailFunc)).Methods(http.MethodGet, http.MethodHead)
+	r.Handle(directory.APIMetadata, anyone(metadataFunc)).Methods(http.MethodGet)
+	r.Handle(directory.APITimeline, anyone(timelineFunc)).Methods(http.MethodGet)
+
+	// Folders
+	r.Handle(directory.APIFolders, anyone(folderListFunc)).Methods(http.MethodGet)
+	r.Handle(directory.APIFolders, writers(createFolderFunc)).Methods(http.MethodPost)
+	r.Handle(directory.APIFolder, writers(deleteFolderFunc)).Methods(http.MethodDelete)
+	r.Handle(directory.APIArchive, anyoneStream(archiveFunc)).Methods(http.MethodGet)
+
+	// Change feed
+	r.Handle(directory.APIChanges, anyone(changesFunc)).Methods(http.MethodGet)
+
+	// Resumable uploads
+	r.Handle(directory.APIUploads, writers(createUploadFunc)).Methods(http.MethodPost)
+	r.Handle(directory.APIUpload, writers(uploadInfoFunc)).Methods(http.MethodGet)
+	r.Handle(directory.APIUpload, uploaders(appendUploadFunc)).Methods(http.MethodPatch)
+	r.Handle(directory.APIUpload, writers(cancelUploadFunc)).Methods(http.MethodDelete)
+
+	// Shares
+	r.Handle(directory.APIShares, anyone(shareListFunc)).Methods(http.MethodGet)
+	r.Handle(directory.APIShares, writers(createShareFunc)).Methods(http.MethodPost)
+	r.Handle(directory.APIShare, writers(deleteShareFunc)).Methods(http.MethodDelete)
+	r.Handle(directory.APIShared, publicStream(sharedContentFunc)).Methods(http.MethodGet, http.MethodHead)
+	r.Handle(directory.APISharedInfo, public(sharedInfoFunc)).Methods(http.MethodGet)
+
+	// Account
+	r.Handle(directory.APIAccountPassword, anyone(changePasswordFunc)).Methods(http.MethodPut)
+	r.Handle(directory.APIAccountLogin, anyone(changeLoginFunc)).Methods(http.MethodPut)
+	r.Handle(directory.APIAccountEmail, anyone(changeEmailFunc)).Methods(http.MethodPut)
+	r.Handle(directory.APIAccountVerify, anyone(resendVerificationFunc)).Methods(http.MethodPost)
+	r.Handle(directory.APIAccount, anyone(deleteAccountFunc)).Methods(http.MethodDelete)
+	r.Handle(directory.APIAccountTokens, anyone(tokenListFunc)).Methods(http.MethodGet)
+	r.Handle(directory.APIAccountTokens, anyone(createTokenFunc)).Methods(http.MethodPost)
+	r.Handle(directory.APIAccountToken, anyone(deleteTokenFunc)).Methods(http.MethodDelete)
+	r.Handle(directory.APIAccountAppPasswords, anyone(appPasswordListFunc)).Methods(http.MethodGet)
+	r.Handle(directory.APIAccountAppPasswords, anyone(createAppPasswordFunc)).Methods(http.MethodPost)
+	r.Handle(directory.APIAccountAppPassword, anyone(deleteAppPasswordFunc)).Methods(http.MethodDelete)
+	r.Handle(directory.APIAccountAccessKeys, anyone(accessKeyListFunc)).Methods(http.MethodGet)
+	r.Handle(directory.APIAccountAccessKeys, anyone(createAccessKeyFunc)).Methods(http.MethodPost)
+	r.Handle(directory.APIAccountAccessKey, anyone(deleteAccessKeyFunc)).Methods(http.MethodDelete)
+	r.Handle(directory.APIAccountSSHKeys, anyone(sshKeyListFunc)).Methods(http.MethodGet)
+	r.Handle(directory.APIAccountSSHKeys, anyone(createSSHKeyFunc)).Methods(http.MethodPost)
+	r.Handle(directory.APIAccountSSHKey, anyone(deleteSSHKeyFunc)).Methods(http.MethodDelete)
+
+	// Admin
+	r.Handle(directory.APIAdminUnlock, admins(adminUnlockFunc)).Methods(http.MethodPost)
+	r.Handle(directory.APIAdminInvites, admins(createInviteFunc)).Methods(http.MethodPost)
+	r.Handle(directory.APIAdminInvites, admins(inviteListFunc)).Methods(http.MethodGet)
+	r.Handle(directory.APIAdminInvite, admins(deleteInviteFunc)).Methods(http.MethodDelete)
+	r.Handle(directory.APIAdminRegistrations, admins(registrationListFunc)).Methods(http.MethodGet)
+	r.Handle(directory.APIAdminApprove, admins(approveRegistrationFunc)).Methods(http.MethodPost)
+	r.Handle(directory.APIAdminRegistration, admins(rejectRegistrationFunc)).Methods(http.MethodDelete)
+	r.Handle(directory.APIAdminUsers, admins(userListFunc)).Methods(http.MethodGet)
+	r.Handle(directory.APIAdminUser, admins(userInfoFunc)).Methods(http.MethodGet)
+	r.Handle(directory.APIAdminUserDisable, admins(disableUserFunc)).Methods(http.MethodPost)
+	r.Handle(directory.APIAdminUserEnable, admins(enableUserFunc)).Methods(http.MethodPost)
+	r.Handle(directory.APIAdminUserPassword, admins(resetUserPasswordFunc)).Methods(http.MethodPut)
+	r.Handle(directory.APIAdminUserQuota, admins(setUserQuotaFunc)).Methods(http.MethodPut)
+	r.Handle(directory.APIAdminUserRole, admins(setUserRoleFunc)).Methods(http.MethodPut)
+	r.Handle(directory.APIAdminUserLogout, admins(logoutUserFunc)).Methods(http.MethodPost)
 }
 
-func fileListFunc(w http.ResponseWriter, r *http.Request) {
-	defer catcherr.Recover(`api.fileListFunc()`)
+func fileListFunc(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
+	uid := auth.ContextUser(ctx).ID
 
-	login, err := auth.GetLoginFromCookie(r)
-	catcherr.HandleAndResponse(w, catcherr.Unathorized, err)
+	query := fileListQuery{pageQuery: defaultPage, Sort: `name`}
+	err := request.DecodeQuery(r, &query)
+	if err != nil {
+		return err
+	}
 
-	err = auth.VerifyUser(r, login)
-	catcherr.HandleAndResponse(w, catcherr.Unathorized, err)
+	files, err := database.ListFiles(ctx, uid, query.filter(), query.options(query.Sort))
+	if err != nil {
+		return pageError(err)
+	}
 
-	files, err := database.GetFileList(ctx, login)
-	catcherr.HandleAndResponse(w, catcherr.InternalServerError, err)
+	return response.Send(w, r, http.StatusOK, files)
+}
 
-	fileList, err := json.Marshal(files)
-	catcherr.HandleAndResponse(w, catcherr.InternalServerError, err)
+// authCheckFunc returns the logged in user and the storage it uses.
+func authCheckFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	u := auth.ContextUser(ctx)
+
+	usage, err := database.GetUsage(ctx, u.ID)
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
 
-	err = response.Send(w, response.Data{StatusCode: http.StatusOK, Data: fileList})
-	catcherr.HandleError(err)
+	info := newUserResponse(u)
+	info.Usage = &usage
+
+	return response.Send(w, r, http.StatusOK, info)
 }
 
-func authCheckFunc(w http.ResponseWriter, r *http.Request) {
-	defer catcherr.Recover(`api.authCheckFunc()`)
+func registerFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	var req registerRequest
+	err := request.Decode(w, r, &req)
+	if err != nil {
+		return err
+	}
 
-	login, err := auth.GetLoginFromCookie(r)
-	catcherr.HandleAndResponse(w, catcherr.Unathorized, err)
+	token, err := user.Register(ctx, req.user(), req.Invite)
+	if err != nil {
+		return accountError(err)
+	}
 
-	err = auth.VerifyUser(r, login)
-	catcherr.HandleAndResponse(w, catcherr.Unathorized, err)
+	if token.Token == `` {
+		return response.Send(w, r, http.StatusAccepted, pendingResponse{Status: database.StatusPending})
+	}
 
-	statusText := http.StatusText(http.StatusOK)
-	err = response.Send(w, response.Data{
-		StatusCode: http.StatusOK,
-		Data:       statusText,
-	})
-	catcherr.HandleError(err)
+	return response.Send(w, r, http.StatusOK, token)
 }
 
-func registerFunc(w http.ResponseWriter, r *http.Request) {
-	defer catcherr.Recover(`api.registerFunc()`)
+func loginFunc(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 
-	bodyBuffer, err := io.ReadAll(r.Body)
-	catcherr.HandleAndResponse(w, catcherr.InternalServerError, err)
+	var req loginRequest
+	err := request.Decode(w, r, &req)
+	if err != nil {
+		return err
+	}
 
-	var u database.User
-	err = json.Unmarshal(bodyBuffer, &u)
-	catcherr.HandleAndResponse(w, catcherr.InternalServerError, err)
+	ip := auth.ClientIP(r.RemoteAddr)
+	err = throttle.Check(ctx, req.Login, ip)
+	if err != nil {
+		return auth.ThrottleError(w, err, auth.Problems)
+	}
 
-	token, err := user.Register(ctx, u)
-	catcherr.HandleAndResponse(w, catcherr.InternalServerError, err)
+	token, err := user.Login(ctx, database.User{Login: req.Login, Password: req.Password})
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) || errors.Is(err, sql.ErrNoRows) {
+		failureErr := throttle.Failure(ctx, req.Login, ip)
+		if failureErr != nil {
+			return catcherr.InternalServerError.Wrap(failureErr)
+		}
+	}
+	if err != nil {
+		return loginError(err)
+	}
 
-	err = response.Send(w, response.Data{StatusCode: http.StatusOK, Data: token})
-	catcherr.HandleError(err)
+	err = throttle.Success(ctx, req.Login)
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
+
+	return response.Send(w, r, http.StatusOK, token)
 }
 
-func loginFunc(w http.ResponseWriter, r *http.Request) {
-	defer catcherr.Recover(`api.loginFunc()`)
+// refreshFunc trades the refresh token of a session for a new token pair.
+func refreshFunc(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 
-	bodyBuffer, err := io.ReadAll(r.Body)
-	catcherr.HandleAndResponse(w, catcherr.InternalServerError, err)
+	var req refreshRequest
+	err := request.Decode(w, r, &req)
+	if err != nil {
+		return err
+	}
 
-	var u database.User
-	err = json.Unmarshal(bodyBuffer, &u)
-	catcherr.HandleAndResponse(w, catcherr.InternalServerError, err)
+	token, err := auth.Refresh(ctx, req.RefreshToken)
+	if errors.Is(err, sql.ErrNoRows) {
+		return catcherr.Unauthorized.WithDetail(`refresh token is invalid or expired`).Wrap(err)
+	}
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
 
-	token, err := user.Login(ctx, u)
-	catcherr.HandleAndResponse(w, catcherr.Unathorized, err)
+	return response.Send(w, r, http.StatusOK, token)
+}
 
-	err = response.Send(w, response.Data{StatusCode: http.StatusOK, Data: token})
-	catcherr.HandleError(err)
+// pendingResponse tells the client that the account waits for approval.
+type pendingResponse struct {
+	Status string `json:"status"`
 }
 
-func fileUploadFunc(w http.ResponseWriter, r *http.Request) {
-	defer catcherr.Recover(`api.fileUploadFunc()`)
-	ctx := r.Context()
+func loginError(err error) error {
+	switch {
+	case errors.Is(err, user.ErrPendingApproval):
+		return catcherr.AccountPending.Wrap(err)
+	case errors.Is(err, user.ErrDisabled):
+		return catcherr.AccountDisabled.Wrap(err)
+	}
+	return catcherr.InvalidCredentials.Wrap(err)
+}
 
-	login, err := auth.GetLoginFromCookie(r)
-	catcherr.HandleAndResponse(w, catcherr.Unathorized, err)
+// pageError maps errors of listings, a bad cursor is the client's fault.
+func pageError(err error) error {
+	if errors.Is(err, database.ErrInvalidCursor) {
+		return catcherr.ValidationFailed.WithFields(catcherr.FieldError{
+			Field:   `cursor`,
+			Code:    `invalid`,
+			Message: `cursor is invalid or was issued for another sort order`,
+		}).Wrap(err)
+	}
+	return catcherr.InternalServerError.Wrap(err)
+}
 
-	err = auth.VerifyUser(r, login)
-	catcherr.HandleAndResponse(w, catcherr.Unathorized, err)
+func quotaError(err error) error {
+	if errors.Is(err, user.ErrQuotaExceeded) {
+		return catcherr.QuotaExceeded.Wrap(err)
+	}
+	return catcherr.InternalServerError.Wrap(err)
+}
 
-	err = r.ParseMultipartForm(32 << 20) // 32 MB
-	catcherr.HandleAndResponse(w, catcherr.InternalServerError, err)
+// nameError reports a file name that user.ValidateName rejected.
+func nameError(err error) error {
+	return catcherr.ValidationFailed.WithFields(invalidName()).Wrap(err)
+}
+
+// extractError reports why an archive couldn't be unpacked.
+func extractError(err error) error {
+	switch {
+	case errors.Is(err, user.ErrArchiveInvalid), errors.Is(err, user.ErrArchiveUnsafe):
+		return catcherr.InvalidArchive.WithDetail(err.Error()).Wrap(err)
+	case errors.Is(err, user.ErrArchiveTooLarge):
+		return catcherr.PayloadTooLarge.WithDetail(err.Error()).Wrap(err)
+	}
+	return quotaError(err)
+}
+
+func fileUploadFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	u := auth.ContextUser(ctx)
+
+	err := r.ParseMultipartForm(32 << 20) // 32 MB
+	if err != nil {
+		return catcherr.BadRequest.WithDetail(`expected a multipart form`).Wrap(err)
+	}
 
 	fileList := r.MultipartForm.File[`file`]
+	if extract, _ := strconv.ParseBool(r.FormValue(`extract`)); extract {
+		return extractUploadFunc(w, r, fileList)
+	}
+
+	var size int64
 	for _, fileHeader := range fileList {
-		checksum, err := user.SaveFile(ctx, fileHeader)
-		catcherr.HandleAndResponse(w, catcherr.InternalServerError, err)
+		size += fileHeader.Size
+	}
+	err = user.CheckQuota(ctx, u, size)
+	if err != nil {
+		return quotaError(err)
+	}
 
-		// ToDo: delete the file if catch an error
-		err = database.SaveFileInfo(ctx, login, fileHeader.Filename, checksum)
-		catcherr.HandleAndResponse(w, catcherr.InternalServerError, err)
+	folder := user.CleanFolder(r.FormValue(`folder`))
+	err = database.EnsureFolder(ctx, u.ID, folder)
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
+
+	for _, fileHeader := range fileList {
+		f, err := user.SaveFile(ctx, u.Login, folder, fileHeader)
+		if errors.Is(err, user.ErrInvalidName) {
+			return catcherr.ValidationFailed.WithFields(catcherr.FieldError{
+				Field:   `file`,
+				Code:    `invalid`,
+				Message: err.Error(),
+			}).Wrap(err)
+		}
+		if err != nil {
+			return catcherr.InternalServerError.Wrap(err)
+		}
+		user.QueueThumbnails(f)
 	}
 
-	statusText := http.StatusText(http.StatusOK)
-	err = response.Send(w, response.Data{StatusCode: http.StatusOK, Data: statusText})
-	catcherr.HandleError(err)
+	return response.NoContent(w)
 }
 
-func fileDeleteFunc(w http.ResponseWriter, r *http.Request) {
-	defer catcherr.Recover(`api.fileDeleteFunc()`)
+// extractUploadFunc unpacks the uploaded archives into the folder instead
+// of storing them, and returns the files that came out.
+func extractUploadFunc(w http.ResponseWriter, r *http.Request, fileList []*multipart.FileHeader) error {
 	ctx := r.Context()
+	u := auth.ContextUser(ctx)
 
-	login, err := auth.GetLoginFromCookie(r)
-	catcherr.HandleAndResponse(w, catcherr.Unathorized, err)
+	folder := user.CleanFolder(r.FormValue(`folder`))
+	files := []database.File{}
+	for _, fileHeader := range fileList {
+		archive, err := fileHeader.Open()
+		if err != nil {
+			return catcherr.InternalServerError.Wrap(err)
+		}
 
-	err = auth.VerifyUser(r, login)
-	catcherr.HandleAndResponse(w, catcherr.Unathorized, err)
+		extracted, err := user.ExtractArchive(ctx, u, folder, archive, fileHeader.Size)
+		archive.Close()
+		if err != nil {
+			return extractError(err)
+		}
+		files = append(files, extracted...)
+	}
 
-	files, err := database.GetFileList(ctx, login)
-	catcherr.HandleAndResponse(w, catcherr.InternalServerError, err)
+	return response.Send(w, r, http.StatusCreated, files)
+}
 
-	bodyBuffer, err := io.ReadAll(r.Body)
-	catcherr.HandleAndResponse(w, catcherr.InternalServerError, err)
+func fileDeleteFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	login := auth.ContextUser(ctx).Login
 
-	var file database.File
-	err = json.Unmarshal(bodyBuffer, &file)
-	catcherr.HandleAndResponse(w, catcherr.InternalServerError, err)
+	var req fileDeleteRequest
+	err := request.Decode(w, r, &req)
+	if err != nil {
+		return err
+	}
 
-	for _, v := range files {
-		if v.Checksum == file.Checksum {
-			err = user.RemoveFile(ctx, v.Checksum)
-			catcherr.HandleAndResponse(w, catcherr.InternalServerError, err)
+	files, err := database.GetFileList(ctx, login)
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
 
+	for _, v := range files {
+		if v.Checksum == req.Checksum {
 			err = database.RemoveFileInfo(ctx, login, v.Checksum)
-			catcherr.HandleAndResponse(w, catcherr.InternalServerError, err)
+			if err != nil {
+				return catcherr.InternalServerError.Wrap(err)
+			}
+
+			// Blobs are shared by checksum, another file may still use it.
+			err = user.RemoveUnusedFile(ctx, v.Checksum)
+			if err != nil {
+				return catcherr.InternalServerError.Wrap(err)
+			}
 			break
 		}
 	}
-	statusText := http.StatusText(http.StatusOK)
-	err = response.Send(w, response.Data{StatusCode: http.StatusOK, Data: statusText})
-	catcherr.HandleError(err)
+	return response.NoContent(w)
 }
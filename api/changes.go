@@ -0,0 +1,87 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"server/auth"
+	"server/catcherr"
+	"server/database"
+	"server/request"
+	"server/response"
+)
+
+// changesFunc returns the changes to the files after the cursor. With
+// wait it holds the request until a change arrives or the wait is over.
+func changesFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	uid := auth.ContextUser(ctx).ID
+
+	query := changesQuery{Limit: 100}
+	err := request.DecodeQuery(r, &query)
+	if err != nil {
+		return err
+	}
+
+	// Validated by the query, so the only error is an empty string.
+	wait, _ := time.ParseDuration(query.Wait)
+
+	// Watch first, a change committed while reading must end the wait.
+	changed, stop := database.WatchChanges(uid)
+	defer stop()
+
+	feed, err := database.GetChanges(ctx, uid, query.Cursor, query.Limit)
+	if err != nil {
+		return changesError(err)
+	}
+
+	if len(feed.Changes) == 0 && query.Cursor != `` && wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+
+		select {
+		case <-ctx.Done():
+			// The client is gone.
+			return nil
+		case <-timer.C:
+		case <-changed:
+			feed, err = database.GetChanges(ctx, uid, query.Cursor, query.Limit)
+			if err != nil {
+				return changesError(err)
+			}
+		}
+	}
+
+	return response.Send(w, r, http.StatusOK, feed)
+}
+
+func changesError(err error) error {
+	switch {
+	case errors.Is(err, database.ErrCursorExpired):
+		return catcherr.ResyncRequired.WithDetail(`list the files again and start over without a cursor`).Wrap(err)
+	case errors.Is(err, database.ErrInvalidCursor):
+		return catcherr.ValidationFailed.WithFields(catcherr.FieldError{
+			Field:   `cursor`,
+			Code:    `invalid`,
+			Message: `cursor is invalid`,
+		}).Wrap(err)
+	}
+	return catcherr.InternalServerError.Wrap(err)
+}
@@ -0,0 +1,281 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+
+	"server/auth"
+	"server/catcherr"
+	"server/database"
+	"server/request"
+	"server/response"
+	"server/user"
+)
+
+// fileMoveFunc renames the file, moves it to another folder, or both.
+func fileMoveFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	uid := auth.ContextUser(ctx).ID
+
+	var req fileMoveRequest
+	err := request.Decode(w, r, &req)
+	if err != nil {
+		return err
+	}
+
+	f, err := database.GetFile(ctx, uid, pathID(r))
+	if err != nil {
+		return notFoundError(err)
+	}
+
+	folder, name := f.Folder, f.Name
+	if req.Folder != nil {
+		folder = user.CleanFolder(*req.Folder)
+	}
+	if req.Name != nil {
+		name = *req.Name
+	}
+
+	err = database.EnsureFolder(ctx, uid, folder)
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
+
+	f, err = user.MoveFile(ctx, uid, f.ID, folder, name)
+	if errors.Is(err, user.ErrInvalidName) {
+		return nameError(err)
+	}
+	if err != nil {
+		return notFoundError(err)
+	}
+
+	return response.Send(w, r, http.StatusOK, f)
+}
+
+// fileRemoveFunc deletes one file. Unlike fileDeleteFunc it can tell
+// apart files with the same content.
+func fileRemoveFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	uid := auth.ContextUser(ctx).ID
+
+	f, err := database.DeleteFile(ctx, uid, pathID(r))
+	if err != nil {
+		return notFoundError(err)
+	}
+
+	// Blobs are shared by checksum, another file may still use it.
+	err = user.RemoveUnusedFile(ctx, f.Checksum)
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
+
+	return response.NoContent(w)
+}
+
+// fileContentFunc sends the content of the file, honouring Range
+// and conditional requests.
+func fileContentFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	uid := auth.ContextUser(ctx).ID
+
+	f, err := database.GetFile(ctx, uid, pathID(r))
+	if err != nil {
+		return notFoundError(err)
+	}
+
+	return serveFile(w, r, f)
+}
+
+// serveFile sends the blob of the file as an attachment. The checksum
+// makes a strong ETag, so clients can resume downloads with If-Range.
+func serveFile(w http.ResponseWriter, r *http.Request, f database.File) error {
+	return serveContent(w, r, f, false)
+}
+
+// serveContent is serveFile, but sends photos without their location
+// if stripGPS is set. Stripping always gives the same content, so it
+// gets an ETag of its own too.
+func serveContent(w http.ResponseWriter, r *http.Request, f database.File, stripGPS bool) error {
+	c, err := user.OpenContent(f, stripGPS)
+	if errors.Is(err, user.ErrLocationKept) {
+		return catcherr.LocationKept.Wrap(err)
+	}
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
+	defer c.Close()
+
+	etag := f.Checksum
+	if c.Stripped {
+		etag += `-nogps`
+	}
+
+	w.Header().Set(`Content-Type`, f.MimeType)
+	w.Header().Set(`ETag`, `"`+etag+`"`)
+	w.Header().Set(`Content-Disposition`, mime.FormatMediaType(`attachment`, map[string]string{`filename`: f.Name}))
+	http.ServeContent(w, r, f.Name, f.ModifiedAt, c)
+	return nil
+}
+
+// thumbnailFunc sends a thumbnail of the image, made on the spot if the
+// background job hasn't got to it yet. A file never changes its content,
+// so browsers may keep the thumbnail as long as they like.
+func thumbnailFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	uid := auth.ContextUser(ctx).ID
+
+	query := thumbnailQuery{Size: `medium`}
+	err := request.DecodeQuery(r, &query)
+	if err != nil {
+		return err
+	}
+
+	f, err := database.GetFile(ctx, uid, pathID(r))
+	if err != nil {
+		return notFoundError(err)
+	}
+
+	thumb, err := user.OpenThumbnail(f, query.Size)
+	if errors.Is(err, user.ErrNoThumbnail) {
+		return catcherr.NotFound.WithDetail(err.Error()).Wrap(err)
+	}
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
+	defer thumb.Close()
+
+	info, err := thumb.Stat()
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
+
+	w.Header().Set(`ETag`, `"`+f.Checksum+`-`+query.Size+`"`)
+	w.Header().Set(`Cache-Control`, `private, max-age=31536000, immutable`)
+	http.ServeContent(w, r, ``, info.ModTime(), thumb)
+	return nil
+}
+
+// archiveFunc streams a folder or a selection of files as one archive.
+func archiveFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	uid := auth.ContextUser(ctx).ID
+
+	query := archiveQuery{archiveFormatQuery: defaultArchiveFormat}
+	err := request.DecodeQuery(r, &query)
+	if err != nil {
+		return err
+	}
+
+	var a user.Archive
+	if query.Folder != `` {
+		a, err = user.FolderArchive(ctx, uid, query.Folder)
+	} else {
+		a, err = user.SelectionArchive(ctx, uid, query.FileIDs)
+	}
+	if err != nil {
+		return notFoundError(err)
+	}
+
+	return sendArchive(w, r, a, query.Format)
+}
+
+// sendArchive writes the archive as it goes, so its size isn't known and
+// Range isn't supported. Errors after the first byte can only be logged.
+func sendArchive(w http.ResponseWriter, r *http.Request, a user.Archive, format string) error {
+	name := a.Name + `.` + format
+	w.Header().Set(`Content-Type`, user.ArchiveTypes[format])
+	w.Header().Set(`Content-Disposition`, mime.FormatMediaType(`attachment`, map[string]string{`filename`: name}))
+	if r.Method == http.MethodHead {
+		return nil
+	}
+
+	err := a.Write(w, format)
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
+	return nil
+}
+
+func folderListFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	uid := auth.ContextUser(ctx).ID
+
+	var query folderListQuery
+	err := request.DecodeQuery(r, &query)
+	if err != nil {
+		return err
+	}
+
+	folders, err := database.GetFolders(ctx, uid, user.CleanFolder(query.Parent))
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
+
+	return response.Send(w, r, http.StatusOK, folders)
+}
+
+// createFolderFunc creates the folder and its missing parents.
+// Creating a folder that exists is not an error.
+func createFolderFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	uid := auth.ContextUser(ctx).ID
+
+	var req folderRequest
+	err := request.Decode(w, r, &req)
+	if err != nil {
+		return err
+	}
+
+	folder := user.CleanFolder(req.Path)
+	if folder == `/` {
+		return catcherr.ValidationFailed.WithFields(catcherr.FieldError{
+			Field:   `path`,
+			Code:    `invalid`,
+			Message: `the root folder always exists`,
+		})
+	}
+
+	err = database.EnsureFolder(ctx, uid, folder)
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
+
+	f, err := database.GetFolder(ctx, uid, folder)
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
+
+	return response.Send(w, r, http.StatusCreated, f)
+}
+
+func deleteFolderFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	uid := auth.ContextUser(ctx).ID
+
+	err := database.DeleteFolder(ctx, uid, pathID(r))
+	if errors.Is(err, database.ErrNotEmpty) {
+		return catcherr.Conflict.WithDetail(err.Error()).Wrap(err)
+	}
+	if err != nil {
+		return notFoundError(err)
+	}
+
+	return response.NoContent(w)
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"server/auth"
+	"server/catcherr"
+	"server/database"
+	"server/request"
+	"server/response"
+	"server/user"
+)
+
+// metadataResponse is what was read from a file. Photos have the EXIF
+// fields, audio and video the tags; duration is in seconds.
+type metadataResponse struct {
+	TakenAt     *time.Time `json:"taken_at,omitempty"`
+	CameraMake  string     `json:"camera_make,omitempty"`
+	CameraModel string     `json:"camera_model,omitempty"`
+	Orientation int        `json:"orientation,omitempty"`
+	Latitude    *float64   `json:"latitude,omitempty"`
+	Longitude   *float64   `json:"longitude,omitempty"`
+	Width       int        `json:"width,omitempty"`
+	Height      int        `json:"height,omitempty"`
+	Title       string     `json:"title,omitempty"`
+	Artist      string     `json:"artist,omitempty"`
+	Album       string     `json:"album,omitempty"`
+	Year        int        `json:"year,omitempty"`
+	Duration    float64    `json:"duration,omitempty"`
+}
+
+// timelineResponse holds days with photos, newest first.
+type timelineResponse struct {
+	Days       []timelineDay `json:"days"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+type timelineDay struct {
+	Date   string          `json:"date"`
+	Photos []timelinePhoto `json:"photos"`
+}
+
+// timelinePhoto is a photo with when it was taken, or last modified if
+// that isn't known.
+type timelinePhoto struct {
+	database.File
+	TakenAt     time.Time `json:"taken_at"`
+	Width       int       `json:"width,omitempty"`
+	Height      int       `json:"height,omitempty"`
+	Orientation int       `json:"orientation,omitempty"`
+}
+
+// metadataFunc returns the metadata of the file, read on the spot if the
+// background job hasn't got to it yet.
+func metadataFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	uid := auth.ContextUser(ctx).ID
+
+	f, err := database.GetFile(ctx, uid, pathID(r))
+	if err != nil {
+		return notFoundError(err)
+	}
+
+	m, err := user.Metadata(ctx, f)
+	if errors.Is(err, user.ErrNoMetadata) {
+		return catcherr.NotFound.WithDetail(err.Error()).Wrap(err)
+	}
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
+
+	res := metadataResponse{
+		CameraMake:  m.CameraMake,
+		CameraModel: m.CameraModel,
+		Orientation: m.Orientation,
+		Latitude:    m.Latitude,
+		Longitude:   m.Longitude,
+		Width:       m.Width,
+		Height:      m.Height,
+		Title:       m.Title,
+		Artist:      m.Artist,
+		Album:       m.Album,
+		Year:        m.Year,
+		Duration:    m.Duration,
+	}
+	if !m.TakenAt.IsZero() {
+		takenAt := m.TakenAt.UTC()
+		res.TakenAt = &takenAt
+	}
+	return response.Send(w, r, http.StatusOK, res)
+}
+
+// timelineFunc returns the photos of the user grouped by the day they
+// were taken, a page of days at a time.
+func timelineFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	uid := auth.ContextUser(ctx).ID
+
+	query := timelineQuery{Limit: 30}
+	err := request.DecodeQuery(r, &query)
+	if err != nil {
+		return err
+	}
+
+	days, next, err := database.GetTimeline(ctx, uid, query.Cursor, query.Limit)
+	if err != nil {
+		return pageError(err)
+	}
+
+	res := timelineResponse{Days: make([]timelineDay, len(days)), NextCursor: next}
+	for i, d := range days {
+		res.Days[i] = timelineDay{Date: d.Date, Photos: make([]timelinePhoto, len(d.Photos))}
+		for j, p := range d.Photos {
+			photo := timelinePhoto{File: p.File, TakenAt: p.TakenAt()}
+			if p.Metadata != nil {
+				photo.Width, photo.Height, photo.Orientation = p.Metadata.Width, p.Metadata.Height, p.Metadata.Orientation
+			}
+			res.Days[i].Photos[j] = photo
+		}
+	}
+	return response.Send(w, r, http.StatusOK, res)
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"net/http"
+
+	"server/catcherr"
+	"server/request"
+	"server/response"
+	"server/user"
+)
+
+func verifyEmailFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	var req verifyEmailRequest
+	err := request.Decode(w, r, &req)
+	if err != nil {
+		return err
+	}
+
+	err = user.VerifyEmail(ctx, req.Token)
+	if err != nil {
+		return accountError(err)
+	}
+
+	return response.NoContent(w)
+}
+
+func passwordResetRequestFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	var req forgotPasswordRequest
+	err := request.Decode(w, r, &req)
+	if err != nil {
+		return err
+	}
+
+	err = user.RequestPasswordReset(ctx, req.Login, req.Email)
+	if err != nil {
+		return catcherr.InternalServerError.Wrap(err)
+	}
+
+	return response.NoContent(w)
+}
+
+func passwordResetFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	var req passwordResetRequest
+	err := request.Decode(w, r, &req)
+	if err != nil {
+		return err
+	}
+
+	err = user.ResetPassword(ctx, req.Token, req.NewPassword)
+	if err != nil {
+		return accountError(err)
+	}
+
+	return response.NoContent(w)
+}
@@ -0,0 +1,323 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"strings"
+	"time"
+
+	"server/catcherr"
+	"server/database"
+	"server/user"
+)
+
+// Request bodies. They are decoded with request.Decode, which rejects
+// unknown fields and checks the validate tags.
+
+type registerRequest struct {
+	Login    string `json:"login" validate:"required,max=64"`
+	Password string `json:"password" validate:"required"`
+	Email    string `json:"email" validate:"email,max=254"`
+	Invite   string `json:"invite"`
+}
+
+func (req registerRequest) user() database.User {
+	return database.User{Login: req.Login, Password: req.Password, Email: req.Email}
+}
+
+type loginRequest struct {
+	Login    string `json:"login" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+type fileDeleteRequest struct {
+	Checksum string `json:"checksum" validate:"required,len=64,hex"`
+}
+
+type changePasswordRequest struct {
+	Password    string `json:"password" validate:"required"`
+	NewPassword string `json:"new_password" validate:"required"`
+}
+
+type changeLoginRequest struct {
+	Password string `json:"password" validate:"required"`
+	NewLogin string `json:"new_login" validate:"required,max=64"`
+}
+
+type changeEmailRequest struct {
+	Password string `json:"password" validate:"required"`
+	Email    string `json:"email" validate:"required,email,max=254"`
+}
+
+type deleteAccountRequest struct {
+	Password string `json:"password" validate:"required"`
+}
+
+type tokenRequest struct {
+	Name      string `json:"name" validate:"required,max=64"`
+	ExpiresIn string `json:"expires_in" validate:"duration"`
+}
+
+type appPasswordRequest struct {
+	Name string `json:"name" validate:"required,max=64"`
+}
+
+type accessKeyRequest struct {
+	Name string `json:"name" validate:"required,max=64"`
+}
+
+type sshKeyRequest struct {
+	Name      string `json:"name" validate:"required,max=64"`
+	PublicKey string `json:"public_key" validate:"required,max=16384"`
+}
+
+type fileMoveRequest struct {
+	Folder *string `json:"folder"`
+	Name   *string `json:"filename" validate:"max=255"`
+}
+
+func (req fileMoveRequest) Validate() []catcherr.FieldError {
+	switch {
+	case req.Folder == nil && req.Name == nil:
+		return []catcherr.FieldError{requiredOneOf(`folder`, `filename`)}
+	case req.Name != nil && strings.TrimSpace(*req.Name) == ``:
+		return []catcherr.FieldError{{Field: `filename`, Code: `required`, Message: `is required`}}
+	case req.Name != nil && user.ValidateName(*req.Name) != nil:
+		return []catcherr.FieldError{invalidName()}
+	}
+	return nil
+}
+
+type folderRequest struct {
+	Path string `json:"path" validate:"required,max=1024"`
+}
+
+type uploadRequest struct {
+	Folder   string `json:"folder"`
+	Name     string `json:"filename" validate:"required,max=255"`
+	MimeType string `json:"mime_type" validate:"max=255"`
+	Size     *int64 `json:"size" validate:"required,min=0"`
+	Extract  bool   `json:"extract"`
+}
+
+func (req uploadRequest) Validate() []catcherr.FieldError {
+	if user.ValidateName(req.Name) != nil {
+		return []catcherr.FieldError{invalidName()}
+	}
+	return nil
+}
+
+type shareRequest struct {
+	FileID    int64  `json:"file_id" validate:"min=1"`
+	FolderID  int64  `json:"folder_id" validate:"min=1"`
+	ExpiresIn string `json:"expires_in" validate:"duration"`
+	StripGPS  bool   `json:"strip_gps"`
+}
+
+func (req shareRequest) Validate() []catcherr.FieldError {
+	switch {
+	case req.FileID == 0 && req.FolderID == 0:
+		return []catcherr.FieldError{requiredOneOf(`file_id`, `folder_id`)}
+	case req.FileID != 0 && req.FolderID != 0:
+		return []catcherr.FieldError{onlyOneOf(`file_id`, `folder_id`)}
+	}
+	return nil
+}
+
+type verifyEmailRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type forgotPasswordRequest struct {
+	Login string `json:"login"`
+	Email string `json:"email" validate:"email"`
+}
+
+func (req forgotPasswordRequest) Validate() []catcherr.FieldError {
+	if req.Login == `` && req.Email == `` {
+		return []catcherr.FieldError{requiredOneOf(`login`, `email`)}
+	}
+	return nil
+}
+
+type passwordResetRequest struct {
+	Token       string `json:"token" validate:"required"`
+	NewPassword string `json:"new_password" validate:"required"`
+}
+
+type unlockRequest struct {
+	Login string `json:"login"`
+	IP    string `json:"ip" validate:"ip"`
+}
+
+func (req unlockRequest) Validate() []catcherr.FieldError {
+	if req.Login == `` && req.IP == `` {
+		return []catcherr.FieldError{requiredOneOf(`login`, `ip`)}
+	}
+	return nil
+}
+
+type inviteRequest struct {
+	MaxUses   int    `json:"max_uses" validate:"min=0"`
+	ExpiresIn string `json:"expires_in" validate:"duration"`
+}
+
+type adminPasswordRequest struct {
+	NewPassword string `json:"new_password" validate:"required"`
+}
+
+type quotaRequest struct {
+	Quota *int64 `json:"quota" validate:"required,min=0"` // bytes, 0 is unlimited
+}
+
+type roleRequest struct {
+	Role string `json:"role" validate:"required,oneof=admin user readonly"`
+}
+
+func requiredOneOf(field, other string) catcherr.FieldError {
+	return catcherr.FieldError{
+		Field:   field,
+		Code:    `required`,
+		Message: `either ` + field + ` or ` + other + ` is required`,
+	}
+}
+
+func onlyOneOf(field, other string) catcherr.FieldError {
+	return catcherr.FieldError{
+		Field:   field,
+		Code:    `invalid`,
+		Message: `can't be given together with ` + other,
+	}
+}
+
+func invalidName() catcherr.FieldError {
+	return catcherr.FieldError{
+		Field:   `filename`,
+		Code:    `invalid`,
+		Message: user.ErrInvalidName.Error(),
+	}
+}
+
+// Query strings of listings, decoded with request.DecodeQuery.
+
+type pageQuery struct {
+	Limit  int    `json:"limit" validate:"min=1,max=1000"`
+	Cursor string `json:"cursor"`
+	Order  string `json:"order" validate:"oneof=asc desc"`
+}
+
+func (q pageQuery) options(sort string) database.PageOptions {
+	return database.PageOptions{Limit: q.Limit, Cursor: q.Cursor, Sort: sort, Desc: q.Order == `desc`}
+}
+
+var defaultPage = pageQuery{Limit: 50, Order: `asc`}
+
+type fileListQuery struct {
+	pageQuery
+	Sort           string    `json:"sort" validate:"oneof=name size modified"`
+	Folder         string    `json:"folder"`
+	Mime           string    `json:"mime"`
+	MinSize        *int64    `json:"min_size" validate:"min=0"`
+	MaxSize        *int64    `json:"max_size" validate:"min=0"`
+	ModifiedAfter  time.Time `json:"modified_after"`
+	ModifiedBefore time.Time `json:"modified_before"`
+}
+
+func (q fileListQuery) filter() database.FileFilter {
+	f := database.FileFilter{
+		MimePrefix:     q.Mime,
+		MinSize:        q.MinSize,
+		MaxSize:        q.MaxSize,
+		ModifiedAfter:  q.ModifiedAfter,
+		ModifiedBefore: q.ModifiedBefore,
+	}
+	if q.Folder != `` {
+		f.Folder = user.CleanFolder(q.Folder)
+	}
+	return f
+}
+
+type thumbnailQuery struct {
+	Size string `json:"size" validate:"oneof=small medium large"`
+}
+
+type folderListQuery struct {
+	Parent string `json:"parent"`
+}
+
+type shareListQuery struct {
+	pageQuery
+	FileID   int64 `json:"file_id" validate:"min=0"`
+	FolderID int64 `json:"folder_id" validate:"min=0"`
+}
+
+type archiveFormatQuery struct {
+	Format string `json:"format" validate:"oneof=zip tar.gz"`
+}
+
+var defaultArchiveFormat = archiveFormatQuery{Format: user.ArchiveZip}
+
+type archiveQuery struct {
+	archiveFormatQuery
+	Folder  string  `json:"folder"`
+	FileIDs []int64 `json:"file_id" validate:"max=1000"`
+}
+
+func (q archiveQuery) Validate() []catcherr.FieldError {
+	switch {
+	case q.Folder == `` && len(q.FileIDs) == 0:
+		return []catcherr.FieldError{requiredOneOf(`folder`, `file_id`)}
+	case q.Folder != `` && len(q.FileIDs) > 0:
+		return []catcherr.FieldError{onlyOneOf(`folder`, `file_id`)}
+	}
+	return nil
+}
+
+type timelineQuery struct {
+	Cursor string `json:"cursor"`
+	Limit  int    `json:"limit" validate:"min=1,max=100"`
+}
+
+// maxChangeWait keeps long polls below the write timeout of the server.
+const maxChangeWait = 10 * time.Second
+
+type changesQuery struct {
+	Cursor string `json:"cursor"`
+	Limit  int    `json:"limit" validate:"min=1,max=1000"`
+	Wait   string `json:"wait" validate:"duration"`
+}
+
+func (q changesQuery) Validate() []catcherr.FieldError {
+	wait, _ := time.ParseDuration(q.Wait)
+	if wait < 0 || wait > maxChangeWait {
+		return []catcherr.FieldError{{
+			Field:   `wait`,
+			Code:    `out_of_range`,
+			Message: `must be between 0s and ` + maxChangeWait.String(),
+		}}
+	}
+	return nil
+}
+
+type userListQuery struct {
+	pageQuery
+	Sort  string `json:"sort" validate:"oneof=id login"`
+	Query string `json:"q"`
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"server/auth"
+	"server/catcherr"
+	"server/database"
+	"server/request"
+	"server/response"
+	"server/user"
+
+	"github.com/gorilla/mux"
+)
+
+// shareResponse returns the token of a new share. It can't be read later.
+type shareResponse struct {
+	Token string         `json:"token"`
+	URL   string         `json:"url"`
+	Share database.Share `json:"share"`
+}
+
+// sharedFileResponse describes a shared file to anyone with the link.
+// For folders, size and files count everything inside.
+type sharedFileResponse struct {
+	Name       string    `json:"filename"`
+	Folder     bool      `json:"folder,omitempty"`
+	Files      int       `json:"files,omitempty"`
+	Size       int64     `json:"size"`
+	MimeType   string    `json:"mime_type,omitempty"`
+	ModifiedAt time.Time `json:"modified_at"`
+	ExpiresAt  time.Time `json:"expires_at,omitempty"`
+}
+
+func shareListFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	uid := auth.ContextUser(ctx).ID
+
+	query := shareListQuery{pageQuery: defaultPage}
+	err := request.DecodeQuery(r, &query)
+	if err != nil {
+		return err
+	}
+
+	shares, err := database.GetShares(ctx, uid, query.FileID, query.FolderID, query.options(`id`))
+	if err != nil {
+		return pageError(err)
+	}
+
+	return response.Send(w, r, http.StatusOK, shares)
+}
+
+func createShareFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	u := auth.ContextUser(ctx)
+
+	var req shareRequest
+	err := request.Decode(w, r, &req)
+	if err != nil {
+		return err
+	}
+
+	// Validated by the request, so the only error is an empty string.
+	ttl, _ := time.ParseDuration(req.ExpiresIn)
+
+	var (
+		token string
+		share database.Share
+	)
+	if req.FolderID != 0 {
+		token, share, err = user.CreateFolderShare(ctx, u, req.FolderID, ttl, req.StripGPS)
+	} else {
+		token, share, err = user.CreateShare(ctx, u, req.FileID, ttl, req.StripGPS)
+	}
+	if errors.Is(err, user.ErrLocationKept) {
+		return catcherr.LocationKept.Wrap(err)
+	}
+	if err != nil {
+		return notFoundError(err)
+	}
+
+	return response.Send(w, r, http.StatusCreated, shareResponse{
+		Token: token,
+		URL:   user.ShareLink(token),
+		Share: share,
+	})
+}
+
+func deleteShareFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	uid := auth.ContextUser(ctx).ID
+
+	err := database.DeleteShare(ctx, uid, pathID(r))
+	if err != nil {
+		return notFoundError(err)
+	}
+
+	return response.NoContent(w)
+}
+
+// sharedContentFunc sends the shared file to anyone with the link, or
+// the shared folder as an archive. Only complete GET requests count as
+// downloads, not resumed ones.
+func sharedContentFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	shared, err := user.GetSharedFile(ctx, mux.Vars(r)[`token`])
+	if err != nil {
+		return notFoundError(err)
+	}
+
+	var a user.Archive
+	query := defaultArchiveFormat
+	if shared.FolderID != 0 {
+		err = request.DecodeQuery(r, &query)
+		if err != nil {
+			return err
+		}
+
+		a, err = user.FolderArchive(ctx, shared.UserID, shared.Folder.Path)
+		if err != nil {
+			return notFoundError(err)
+		}
+		a.StripGPS = shared.StripGPS
+	}
+
+	if r.Method == http.MethodGet && r.Header.Get(`Range`) == `` {
+		err = database.CountShareDownload(ctx, shared.ID)
+		if err != nil {
+			return catcherr.InternalServerError.Wrap(err)
+		}
+	}
+
+	if shared.FolderID != 0 {
+		return sendArchive(w, r, a, query.Format)
+	}
+	return serveContent(w, r, *shared.File, shared.StripGPS)
+}
+
+func sharedInfoFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	shared, err := user.GetSharedFile(ctx, mux.Vars(r)[`token`])
+	if err != nil {
+		return notFoundError(err)
+	}
+
+	if shared.FolderID != 0 {
+		a, err := user.FolderArchive(ctx, shared.UserID, shared.Folder.Path)
+		if err != nil {
+			return notFoundError(err)
+		}
+		return response.Send(w, r, http.StatusOK, sharedFolderResponse(a, shared))
+	}
+
+	return response.Send(w, r, http.StatusOK, sharedFileResponse{
+		Name:       shared.File.Name,
+		Size:       shared.File.Size,
+		MimeType:   shared.File.MimeType,
+		ModifiedAt: shared.File.ModifiedAt,
+		ExpiresAt:  shared.ExpiresAt,
+	})
+}
+
+// sharedFolderResponse sums up the archive of a shared folder. It was
+// modified when the newest file in it was.
+func sharedFolderResponse(a user.Archive, shared database.SharedFile) sharedFileResponse {
+	res := sharedFileResponse{
+		Name:       shared.Folder.Name,
+		Folder:     true,
+		ModifiedAt: shared.Folder.CreatedAt,
+		ExpiresAt:  shared.ExpiresAt,
+	}
+	for _, e := range a.Entries {
+		if e.File == nil {
+			continue
+		}
+		res.Files++
+		res.Size += e.File.Size
+		if e.ModifiedAt.After(res.ModifiedAt) {
+			res.ModifiedAt = e.ModifiedAt
+		}
+	}
+	return res
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"server/auth"
+	"server/catcherr"
+	"server/database"
+	"server/directory"
+	"server/request"
+	"server/response"
+	"server/user"
+
+	"github.com/gorilla/mux"
+)
+
+// uploadOffsetHeader carries the number of bytes an upload received,
+// in requests that append data and in every response about an upload.
+const uploadOffsetHeader = `Upload-Offset`
+
+// uploadResponse describes an upload after data was appended.
+// File is set once the last byte arrived.
+type uploadResponse struct {
+	Upload database.Upload `json:"upload"`
+	File   *database.File  `json:"file,omitempty"`
+	Files  []database.File `json:"files,omitempty"`
+}
+
+// createUploadFunc starts a resumable upload. The data is sent
+// afterwards in one or more PATCH requests to the returned location.
+func createUploadFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	u := auth.ContextUser(ctx)
+
+	var req uploadRequest
+	err := request.Decode(w, r, &req)
+	if err != nil {
+		return err
+	}
+
+	upload, err := user.CreateUpload(ctx, u, req.Folder, req.Name, req.MimeType, *req.Size, req.Extract)
+	if errors.Is(err, user.ErrInvalidName) {
+		return nameError(err)
+	}
+	if err != nil {
+		return quotaError(err)
+	}
+
+	w.Header().Set(`Location`, directory.APIUploads+`/`+upload.ID)
+	w.Header().Set(uploadOffsetHeader, `0`)
+	return response.Send(w, r, http.StatusCreated, upload)
+}
+
+// uploadInfoFunc tells how many bytes the upload received,
+// which is where a client resumes after an interruption.
+func uploadInfoFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	u := auth.ContextUser(ctx)
+
+	upload, err := user.GetUpload(ctx, u, mux.Vars(r)[`id`])
+	if err != nil {
+		return notFoundError(err)
+	}
+
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(upload.Offset, 10))
+	return response.Send(w, r, http.StatusOK, upload)
+}
+
+// appendUploadFunc writes the raw body at the offset in the Upload-Offset
+// header, which has to match the bytes received so far.
+func appendUploadFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	u := auth.ContextUser(ctx)
+
+	offset, err := strconv.ParseInt(r.Header.Get(uploadOffsetHeader), 10, 64)
+	if err != nil || offset < 0 {
+		return catcherr.BadRequest.WithDetail(`the Upload-Offset header must hold the bytes received so far`).Wrap(err)
+	}
+
+	upload, files, err := user.AppendUpload(ctx, u, mux.Vars(r)[`id`], offset, r.Body)
+	if upload.ID != `` {
+		w.Header().Set(uploadOffsetHeader, strconv.FormatInt(upload.Offset, 10))
+	}
+	if err != nil {
+		return uploadError(err)
+	}
+
+	res := uploadResponse{Upload: upload}
+	switch {
+	case upload.Extract:
+		res.Files = files
+	case len(files) == 1:
+		res.File = &files[0]
+	}
+	return response.Send(w, r, http.StatusOK, res)
+}
+
+func cancelUploadFunc(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	u := auth.ContextUser(ctx)
+
+	err := user.CancelUpload(ctx, u, mux.Vars(r)[`id`])
+	if err != nil {
+		return notFoundError(err)
+	}
+
+	return response.NoContent(w)
+}
+
+func uploadError(err error) error {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return catcherr.NotFound.Wrap(err)
+	case errors.Is(err, user.ErrUploadOffset):
+		return catcherr.Conflict.WithDetail(err.Error()).Wrap(err)
+	case errors.Is(err, user.ErrUploadTooLarge):
+		return catcherr.PayloadTooLarge.WithDetail(err.Error()).Wrap(err)
+	}
+	return extractError(err)
+}
@@ -0,0 +1,46 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"context"
+	"log"
+	"server/database"
+)
+
+const (
+	LoginLockout = `login.lockout`
+	LoginUnlock  = `login.unlock`
+
+	UserDisable       = `user.disable`
+	UserEnable        = `user.enable`
+	UserPasswordReset = `user.password_reset`
+	UserQuota         = `user.quota`
+	UserRole          = `user.role`
+	UserLogout        = `user.logout`
+)
+
+// Record stores the event and writes it to the log. A failure to store
+// the event is only logged, so auditing never breaks the request.
+func Record(ctx context.Context, e database.AuditEvent) {
+	const template = `[ Audit: %s ]: login=%q ip=%q %s`
+	log.Printf(template, e.Type, e.Login, e.IP, e.Details)
+
+	if err := database.SaveAuditEvent(ctx, e); err != nil {
+		log.Printf(`[ Audit: %s ]: can't save event: %v`, e.Type, err)
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+
+	"server/config"
+	"server/database"
+)
+
+// AccessKeyPrefix starts every S3 access key id.
+const AccessKeyPrefix = `DXC`
+
+var ErrSealBroken = errors.New(`access key secret can't be opened, was access_key_seal changed?`)
+
+// CreateAccessKey generates an S3 access key for the user. The secret
+// is only returned here, the database keeps it sealed with the
+// access_key_seal from config.yml.
+func CreateAccessKey(ctx context.Context, uid int64, name string) (secret string, k database.AccessKey, err error) {
+	b := make([]byte, 11+30)
+	if _, err = rand.Read(b); err != nil {
+		return ``, database.AccessKey{}, err
+	}
+
+	// 20 characters like AWS key ids, 40 like their secrets.
+	keyID := AccessKeyPrefix + base32.StdEncoding.EncodeToString(b[:11])[:17]
+	secret = base64.RawStdEncoding.EncodeToString(b[11:])
+
+	sealed, err := sealSecret(keyID, secret)
+	if err != nil {
+		return ``, database.AccessKey{}, err
+	}
+
+	k, err = database.CreateAccessKey(ctx, database.AccessKey{
+		UserID:       uid,
+		Name:         name,
+		KeyID:        keyID,
+		SealedSecret: sealed,
+	})
+	return secret, k, err
+}
+
+// AccessKeySecret opens the sealed secret of the key.
+func AccessKeySecret(k database.AccessKey) (string, error) {
+	aead, err := sealCipher()
+	if err != nil {
+		return ``, err
+	}
+
+	size := aead.NonceSize()
+	if len(k.SealedSecret) < size {
+		return ``, ErrSealBroken
+	}
+
+	nonce, sealed := k.SealedSecret[:size], k.SealedSecret[size:]
+	secret, err := aead.Open(nil, nonce, sealed, []byte(k.KeyID))
+	if err != nil {
+		return ``, ErrSealBroken
+	}
+	return string(secret), nil
+}
+
+// sealSecret encrypts the secret, bound to the key id,
+// and prepends the random nonce.
+func sealSecret(keyID, secret string) ([]byte, error) {
+	aead, err := sealCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, []byte(secret), []byte(keyID)), nil
+}
+
+func sealCipher() (cipher.AEAD, error) {
+	key := sha256.Sum256(config.Bytes(config.AccessKeySeal))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
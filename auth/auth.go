@@ -18,8 +18,15 @@ package auth
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"net/http"
 	"server/config"
+	"server/database"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
@@ -32,21 +39,73 @@ type (
 	}
 
 	Token struct {
-		Login   string `json:"login"`
-		Token   string `json:"token"`
-		Expires string `json:"expires"`
+		Login        string `json:"login"`
+		Token        string `json:"token"`
+		Expires      string `json:"expires"`
+		RefreshToken string `json:"refresh_token,omitempty"`
 	}
 )
 
-/*
- * ToDo: Refresh token
- */
+var (
+	ErrNoToken      = errors.New(`no token in the request`)
+	ErrLoginChanged = errors.New(`token was issued for another login`)
+	ErrNoBasicAuth  = errors.New(`no basic credentials in the request`)
+)
 
+// CreateToken opens a new session for the user and signs a token bound to it.
+// The refresh token keeps the session alive for session_ttl after each use.
 func CreateToken(ctx context.Context, login string) (t Token, err error) {
-	expirationTime := jwt.NewNumericDate(time.Now().Add(15 * time.Minute))
+	u, err := database.GetUser(ctx, login)
+	if err != nil {
+		return Token{}, err
+	}
+
+	refresh, err := newSecret()
+	if err != nil {
+		return Token{}, err
+	}
+
+	expires := time.Now().Add(config.Duration(config.SessionTTL))
+	session, err := database.CreateSession(ctx, u.ID, hashSecret(refresh), expires)
+	if err != nil {
+		return Token{}, err
+	}
+
+	t, err = signToken(login, session.ID)
+	t.RefreshToken = refresh
+	return t, err
+}
+
+// Refresh spends the refresh token of a session and returns a new access
+// token together with the refresh token to use next time.
+func Refresh(ctx context.Context, refreshToken string) (t Token, err error) {
+	refresh, err := newSecret()
+	if err != nil {
+		return Token{}, err
+	}
+
+	expires := time.Now().Add(config.Duration(config.SessionTTL))
+	session, err := database.RefreshSession(ctx, hashSecret(refreshToken), hashSecret(refresh), expires)
+	if err != nil {
+		return Token{}, err
+	}
+
+	u, err := database.GetUserByID(ctx, session.UserID)
+	if err != nil {
+		return Token{}, err
+	}
+
+	t, err = signToken(u.Login, session.ID)
+	t.RefreshToken = refresh
+	return t, err
+}
+
+func signToken(login, sessionID string) (Token, error) {
+	expirationTime := jwt.NewNumericDate(time.Now().Add(config.Duration(config.AccessTokenTTL)))
 	claims := &jwtClaims{
 		Login: login,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        sessionID,
 			ExpiresAt: expirationTime,
 		},
 	}
@@ -58,7 +117,7 @@ func CreateToken(ctx context.Context, login string) (t Token, err error) {
 	}
 
 	expires := expirationTime.UTC().Format(http.TimeFormat)
-	t = Token{
+	t := Token{
 		Login:   login,
 		Token:   token,
 		Expires: expires,
@@ -66,18 +125,72 @@ func CreateToken(ctx context.Context, login string) (t Token, err error) {
 	return t, nil
 }
 
-func GetLoginFromCookie(r *http.Request) (string, error) {
-	lc, err := r.Cookie(`login`)
+// Authenticate returns the user the request is made by. Requests carry
+// either a personal token or an access token in the Authorization header,
+// or an access token in the token cookie next to the login cookie.
+func Authenticate(r *http.Request) (database.User, error) {
+	ctx := r.Context()
+
+	bearer := bearerToken(r)
+	if strings.HasPrefix(bearer, PersonalTokenPrefix) {
+		return database.UsePersonalToken(ctx, hashSecret(bearer))
+	}
+
+	claims, err := parseToken(r)
 	if err != nil {
-		return ``, err
+		return database.User{}, err
 	}
-	return lc.Value, nil
+
+	if bearer == `` {
+		lc, err := r.Cookie(`login`)
+		if err != nil {
+			return database.User{}, err
+		}
+		if lc.Value != claims.Login {
+			return database.User{}, ErrLoginChanged
+		}
+	}
+
+	// Tokens are only valid as long as their session exists,
+	// so revoking a session logs the token out immediately.
+	_, err = database.GetSession(ctx, claims.ID, claims.Login)
+	if err != nil {
+		return database.User{}, err
+	}
+	return database.GetUser(ctx, claims.Login)
 }
 
-func VerifyUser(r *http.Request, login string) error {
-	tokenCookie, err := r.Cookie(`token`)
+// SessionID returns the session the request token is bound to, or an
+// empty string for personal tokens, which have no session.
+func SessionID(r *http.Request) (string, error) {
+	if strings.HasPrefix(bearerToken(r), PersonalTokenPrefix) {
+		return ``, nil
+	}
+
+	claims, err := parseToken(r)
 	if err != nil {
-		return err
+		return ``, err
+	}
+	return claims.ID, nil
+}
+
+func bearerToken(r *http.Request) string {
+	const prefix = `Bearer `
+	header := r.Header.Get(`Authorization`)
+	if len(header) > len(prefix) && strings.EqualFold(header[:len(prefix)], prefix) {
+		return strings.TrimSpace(header[len(prefix):])
+	}
+	return ``
+}
+
+func parseToken(r *http.Request) (*jwtClaims, error) {
+	tokenString := bearerToken(r)
+	if tokenString == `` {
+		tokenCookie, err := r.Cookie(`token`)
+		if err != nil {
+			return nil, ErrNoToken
+		}
+		tokenString = tokenCookie.Value
 	}
 
 	var (
@@ -86,16 +199,27 @@ func VerifyUser(r *http.Request, login string) error {
 		keyfunc = func(tkn *jwt.Token) (any, error) { return key, nil }
 	)
 
-	token, err := jwt.ParseWithClaims(tokenCookie.Value, claims, keyfunc)
+	token, err := jwt.ParseWithClaims(tokenString, claims, keyfunc)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	switch {
-	case claims.Login != login:
-		return jwt.ErrSignatureInvalid
-	case !token.Valid:
-		return jwt.ErrSignatureInvalid
+	if !token.Valid {
+		return nil, jwt.ErrSignatureInvalid
 	}
-	return nil
+	return claims, nil
+}
+
+// newSecret returns 32 random bytes, base64 encoded for URLs.
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return ``, err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
 }
@@ -0,0 +1,113 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+	"server/catcherr"
+	"server/database"
+	"server/throttle"
+	"strconv"
+)
+
+// Failures are the errors a frontend answers failed sign ins with,
+// each in the format of its protocol.
+type Failures struct {
+	Unauthorized       *catcherr.Error // no credentials
+	InvalidCredentials *catcherr.Error
+	RateLimited        *catcherr.Error
+	AccountLocked      *catcherr.Error
+	Internal           *catcherr.Error
+
+	// Challenge is sent in WWW-Authenticate with Unauthorized and
+	// InvalidCredentials, unless it is empty.
+	Challenge string
+}
+
+// Problems are the failures of frontends answering with problem documents.
+var Problems = Failures{
+	Unauthorized:       catcherr.Unauthorized,
+	InvalidCredentials: catcherr.InvalidCredentials,
+	RateLimited:        catcherr.RateLimited,
+	AccountLocked:      catcherr.AccountLocked,
+	Internal:           catcherr.InternalServerError,
+}
+
+// AuthenticateBasicThrottled checks the Basic credentials of the request
+// like AuthenticateBasic, throttled like logins.
+func AuthenticateBasicThrottled(w http.ResponseWriter, r *http.Request, f Failures) (database.User, error) {
+	ctx := r.Context()
+
+	login, _, ok := r.BasicAuth()
+	if !ok {
+		f.challenge(w)
+		return database.User{}, f.Unauthorized
+	}
+
+	ip := ClientIP(r.RemoteAddr)
+	if err := throttle.Check(ctx, login, ip); err != nil {
+		return database.User{}, ThrottleError(w, err, f)
+	}
+
+	u, err := AuthenticateBasic(r)
+	if errors.Is(err, sql.ErrNoRows) || errors.Is(err, ErrLoginChanged) {
+		if failureErr := throttle.Failure(ctx, login, ip); failureErr != nil {
+			return database.User{}, f.Internal.Wrap(failureErr)
+		}
+		f.challenge(w)
+		return database.User{}, f.InvalidCredentials.Wrap(err)
+	}
+	if err != nil {
+		return database.User{}, f.Internal.Wrap(err)
+	}
+	return u, nil
+}
+
+func (f Failures) challenge(w http.ResponseWriter) {
+	if f.Challenge != `` {
+		w.Header().Set(`WWW-Authenticate`, f.Challenge)
+	}
+}
+
+// ThrottleError answers an error of throttle.Check. Throttled attempts
+// get Retry-After, and a locked account is told apart from a client
+// that only has to slow down.
+func ThrottleError(w http.ResponseWriter, err error, f Failures) error {
+	var throttled *throttle.Error
+	if !errors.As(err, &throttled) {
+		return f.Internal.Wrap(err)
+	}
+
+	w.Header().Set(`Retry-After`, strconv.Itoa(throttled.Seconds()))
+	if throttled.Locked {
+		return f.AccountLocked.WithDetail(throttled.Error()).Wrap(err)
+	}
+	return f.RateLimited.WithDetail(throttled.Error()).Wrap(err)
+}
+
+// ClientIP returns the host of a remote address, which counts the failed
+// sign ins of the client.
+func ClientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"net/http"
+	"server/catcherr"
+	"server/database"
+)
+
+type userKey struct{}
+
+// RequireRole authenticates the request and passes it on only if the user
+// has one of the roles. The user is stored in the request context.
+func RequireRole(roles ...string) func(catcherr.HandlerFunc) catcherr.HandlerFunc {
+	return func(next catcherr.HandlerFunc) catcherr.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			ctx := r.Context()
+
+			u, err := Authenticate(r)
+			if err != nil {
+				return catcherr.Unauthorized.Wrap(err)
+			}
+			catcherr.SetLogin(ctx, u.Login)
+
+			if !hasRole(u, roles) {
+				return catcherr.Forbidden
+			}
+
+			ctx = context.WithValue(ctx, userKey{}, u)
+			return next(w, r.WithContext(ctx))
+		}
+	}
+}
+
+// ContextUser returns the user stored by RequireRole.
+func ContextUser(ctx context.Context) database.User {
+	u, _ := ctx.Value(userKey{}).(database.User)
+	return u
+}
+
+func hasRole(u database.User, roles []string) bool {
+	for _, role := range roles {
+		if u.Role == role {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"server/config"
+	"server/database"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// registryAudience marks registry tokens, so they are never taken for
+// access tokens of the API and the other way round.
+const registryAudience = `registry`
+
+// RegistryAccess is a resource of the container registry and the
+// actions a token allows on it, like pull and push on a repository.
+type RegistryAccess struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+type registryClaims struct {
+	jwt.RegisteredClaims
+	Access []RegistryAccess `json:"access"`
+}
+
+// CreateRegistryToken signs a token of the user for the container
+// registry granting the access. It expires after access_token_ttl.
+func CreateRegistryToken(u database.User, access []RegistryAccess) (token string, expires time.Time, err error) {
+	now := time.Now()
+	expires = now.Add(config.Duration(config.AccessTokenTTL))
+
+	claims := &registryClaims{
+		Access: access,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   u.Login,
+			Audience:  jwt.ClaimStrings{registryAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
+	}
+
+	token, err = jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(config.Bytes(config.JWTKey))
+	return token, expires, err
+}
+
+// AuthenticateRegistry returns the user of a request with a registry
+// token and the access the token grants. Users that are disabled or
+// waiting for approval are treated as if they didn't exist.
+func AuthenticateRegistry(r *http.Request) (database.User, []RegistryAccess, error) {
+	tokenString := bearerToken(r)
+	if tokenString == `` {
+		return database.User{}, nil, ErrNoToken
+	}
+
+	var (
+		claims  = &registryClaims{}
+		key     = config.Bytes(config.JWTKey)
+		keyfunc = func(tkn *jwt.Token) (any, error) { return key, nil }
+	)
+
+	token, err := jwt.ParseWithClaims(tokenString, claims, keyfunc)
+	if err != nil {
+		return database.User{}, nil, err
+	}
+	if !token.Valid || !claims.VerifyAudience(registryAudience, true) {
+		return database.User{}, nil, jwt.ErrTokenInvalidAudience
+	}
+
+	u, err := database.GetUser(r.Context(), claims.Subject)
+	if err != nil {
+		return database.User{}, nil, err
+	}
+	if u.Disabled || u.Status != database.StatusActive {
+		return database.User{}, nil, sql.ErrNoRows
+	}
+	return u, claims.Access, nil
+}
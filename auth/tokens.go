@@ -0,0 +1,101 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"net/http"
+	"strings"
+	"time"
+
+	"server/database"
+)
+
+// PersonalTokenPrefix starts every personal token, which tells them
+// apart from access tokens and makes leaked ones easy to search for.
+const PersonalTokenPrefix = `dxc_`
+
+// CreatePersonalToken mints a token for the user. It never expires when
+// ttl is zero. The token is only returned here, just its hash is stored.
+func CreatePersonalToken(ctx context.Context, uid int64, name string, ttl time.Duration) (token string, t database.PersonalToken, err error) {
+	secret, err := newSecret()
+	if err != nil {
+		return ``, database.PersonalToken{}, err
+	}
+	token = PersonalTokenPrefix + secret
+
+	t = database.PersonalToken{
+		UserID: uid,
+		Name:   name,
+		Hash:   hashSecret(token),
+	}
+	if ttl > 0 {
+		t.ExpiresAt = time.Now().Add(ttl)
+	}
+
+	t, err = database.CreatePersonalToken(ctx, t)
+	return token, t, err
+}
+
+// CreateAppPassword generates a password for a client of the user that
+// signs in with Basic auth. It is only returned here, just its hash is
+// stored. Dashes split it into groups that are easy to type.
+func CreateAppPassword(ctx context.Context, uid int64, name string) (password string, p database.AppPassword, err error) {
+	b := make([]byte, 15)
+	if _, err = rand.Read(b); err != nil {
+		return ``, database.AppPassword{}, err
+	}
+
+	secret := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+	groups := make([]string, 0, 4)
+	for i := 0; i < len(secret); i += 6 {
+		groups = append(groups, secret[i:i+6])
+	}
+	password = strings.Join(groups, `-`)
+
+	p, err = database.CreateAppPassword(ctx, database.AppPassword{
+		UserID: uid,
+		Name:   name,
+		Hash:   hashSecret(password),
+	})
+	return password, p, err
+}
+
+// AuthenticateBasic returns the user of a request with Basic credentials.
+// The password is either an app password or a personal token of the user,
+// the account password is refused as clients keep it in plain text.
+func AuthenticateBasic(r *http.Request) (database.User, error) {
+	login, secret, ok := r.BasicAuth()
+	if !ok {
+		return database.User{}, ErrNoBasicAuth
+	}
+
+	if !strings.HasPrefix(secret, PersonalTokenPrefix) {
+		return database.UseAppPassword(r.Context(), login, hashSecret(secret))
+	}
+
+	u, err := database.UsePersonalToken(r.Context(), hashSecret(secret))
+	if err != nil {
+		return database.User{}, err
+	}
+	if !strings.EqualFold(u.Login, login) {
+		return database.User{}, ErrLoginChanged
+	}
+	return u, nil
+}
@@ -17,50 +17,195 @@ limitations under the License.
 package catcherr
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
 )
 
-func init() {
-	Unathorized.Unathorized()
-	Forbidden.Forbidden()
-	InternalServerError.InternalServerError()
+// HandlerFunc is an http.HandlerFunc that reports failures by returning them.
+type HandlerFunc func(w http.ResponseWriter, r *http.Request) error
+
+type requestKey struct{}
+
+type request struct {
+	id    string
+	login string
 }
 
-func HandleError(err any) {
-	if err != nil {
-		panic(err)
+// Protocol is how errors are reported to clients. The native API sends
+// problem documents; protocols with error documents of their own, like
+// S3, bring a Renderer and the error standing in for unexpected failures.
+type Protocol struct {
+	// Internal is reported for errors that aren't an *Error, like panics.
+	Internal *Error
+	// Render writes the error. It isn't called once the response started.
+	Render Renderer
+	// IDHeader also carries the request id, besides X-Request-ID.
+	IDHeader string
+}
+
+// Renderer writes the error to the client in the format of a protocol.
+type Renderer func(w http.ResponseWriter, r *http.Request, e *Error, requestID string)
+
+// api is the protocol of the native API.
+var api = Protocol{Internal: InternalServerError, Render: sendProblem}
+
+// Handle adapts f to http.Handler. Errors returned by f are sent to the client
+// and logged together with the request, and panics are recovered and reported
+// as internal errors.
+func Handle(f HandlerFunc) http.Handler {
+	return api.Handle(f)
+}
+
+// Handle is like the Handle function, but reports errors the way the
+// protocol does.
+func (p Protocol) Handle(f HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &request{id: requestID()}
+		r = r.WithContext(context.WithValue(r.Context(), requestKey{}, req))
+
+		rw := &responseWriter{ResponseWriter: w}
+		rw.Header().Set(`X-Request-ID`, req.id)
+		if p.IDHeader != `` {
+			rw.Header().Set(p.IDHeader, req.id)
+		}
+
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			err := p.Internal.Wrap(fmt.Errorf(`panic: %v`, v))
+			p.report(rw, r, err, debug.Stack())
+		}()
+
+		if err := f(rw, r); err != nil {
+			p.report(rw, r, p.as(err), nil)
+		}
+	})
+}
+
+// Respond is a handler answering every request with the error,
+// e.g. for routes that don't exist.
+func Respond(e *Error) http.Handler {
+	return Handle(func(w http.ResponseWriter, r *http.Request) error { return e })
+}
+
+// SetLogin attaches the authenticated login to the request log context.
+func SetLogin(ctx context.Context, login string) {
+	if req, ok := ctx.Value(requestKey{}).(*request); ok {
+		req.login = login
 	}
 }
 
-func HandleAndResponse(w http.ResponseWriter, c CustomError, err any) {
-	if err != nil {
-		sendErrorData(w, c)
-		panic(err)
+// report logs the error and, unless the handler already started
+// the response, sends it to the client.
+func (p Protocol) report(w *responseWriter, r *http.Request, e *Error, stack []byte) {
+	req, _ := r.Context().Value(requestKey{}).(*request)
+	if req == nil {
+		req = &request{}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `[ %d %s ] %s %s request=%s ip=%s`,
+		e.Status, e.Code, r.Method, r.URL.Path, req.id, remoteIP(r))
+	if req.login != `` {
+		fmt.Fprintf(&b, ` login=%s`, req.login)
 	}
+	fmt.Fprintf(&b, `: %v`, e)
+
+	// Client errors are expected, the stack only helps with server ones.
+	if e.Status >= http.StatusInternalServerError {
+		switch {
+		case stack != nil:
+			fmt.Fprintf(&b, "\n%s", stack)
+		case e.stack != nil:
+			b.WriteString(formatStack(e.stack))
+		}
+	}
+	log.Print(b.String())
+
+	if w.written {
+		return
+	}
+	p.Render(w, r, e, req.id)
 }
 
-func Recover(sender string) {
-	if r := recover(); r != nil {
-		logError(sender, r)
+func sendProblem(w http.ResponseWriter, r *http.Request, e *Error, requestID string) {
+	problem := *e
+	problem.Instance = r.URL.RequestURI()
+	problem.RequestID = requestID
+
+	w.Header().Set(`Content-Type`, `application/problem+json`)
+	w.WriteHeader(e.Status)
+
+	if err := json.NewEncoder(w).Encode(&problem); err != nil {
+		log.Printf(`[ catcherr ]: can't send error to the client: %v`, err)
 	}
 }
 
-func logError(sender string, data any) {
-	const template = `[ Sender: %s ]: %v `
-	log.Printf(template, sender, data)
+func formatStack(pc []uintptr) string {
+	var b strings.Builder
+	frames := runtime.CallersFrames(pc)
+	for {
+		f, more := frames.Next()
+		fmt.Fprintf(&b, "\n\t%s\n\t\t%s:%d", f.Function, f.File, f.Line)
+		if !more {
+			return b.String()
+		}
+	}
 }
 
-func sendErrorData(w http.ResponseWriter, c CustomError) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(c.StatusCode)
+func requestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return `unknown`
+	}
+	return hex.EncodeToString(b)
+}
 
-	err := json.NewEncoder(w).Encode(c)
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		const sender = `catcherr.sendErrorData()`
-		const template = `Can't send data to user. Reason: %v`
-		logError(sender, fmt.Sprintf(template, err))
+		return r.RemoteAddr
 	}
+	return host
 }
+
+// responseWriter remembers whether the response was started,
+// after which an error can only be logged.
+type responseWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	w.written = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseWriter) Flush() {
+	w.written = true
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
@@ -16,30 +16,161 @@ limitations under the License.
 
 package catcherr
 
-import "net/http"
+import (
+	"errors"
+	"net/http"
+	"runtime"
+)
+
+// TypePrefix is prepended to the code to build the problem type URI.
+const TypePrefix = `urn:dexcloud:problem:`
+
+// Error is an application error rendered as an RFC 7807 problem.
+// Code is stable and documented in docs/errors.md, Detail is safe to show
+// to anyone, while Err is the underlying cause and only ends up in the log.
+type Error struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+
+	Err error `json:"-"`
+
+	stack []uintptr
+}
 
-type CustomError struct {
-	StatusCode  int
-	Description string
+// FieldError describes one invalid field of the request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
 
+// The catalogue. Codes are part of the API and must never change,
+// see docs/errors.md.
 var (
-	Unathorized         CustomError
-	Forbidden           CustomError
-	InternalServerError CustomError
+	BadRequest           = newError(http.StatusBadRequest, `bad_request`, `Bad request`)
+	InvalidJSON          = newError(http.StatusBadRequest, `invalid_json`, `Request body is not valid JSON`)
+	InvalidToken         = newError(http.StatusBadRequest, `invalid_token`, `Token is invalid or expired`)
+	Unauthorized         = newError(http.StatusUnauthorized, `unauthorized`, `Authentication required`)
+	InvalidCredentials   = newError(http.StatusUnauthorized, `invalid_credentials`, `Wrong login or password`)
+	Forbidden            = newError(http.StatusForbidden, `forbidden`, `Access denied`)
+	WrongPassword        = newError(http.StatusForbidden, `wrong_password`, `Current password is wrong`)
+	AccountDisabled      = newError(http.StatusForbidden, `account_disabled`, `Account is disabled`)
+	AccountPending       = newError(http.StatusForbidden, `account_pending`, `Account is waiting for approval`)
+	RegistrationClosed   = newError(http.StatusForbidden, `registration_closed`, `Registration is disabled`)
+	InvalidInvite        = newError(http.StatusForbidden, `invalid_invite`, `Invite code is invalid, expired or used up`)
+	NotFound             = newError(http.StatusNotFound, `not_found`, `Resource not found`)
+	MethodNotAllowed     = newError(http.StatusMethodNotAllowed, `method_not_allowed`, `Method not allowed`)
+	NotAcceptable        = newError(http.StatusNotAcceptable, `not_acceptable`, `None of the accepted formats is supported`)
+	Conflict             = newError(http.StatusConflict, `conflict`, `Resource already exists`)
+	LoginTaken           = newError(http.StatusConflict, `login_taken`, `Login is already taken`)
+	EmailTaken           = newError(http.StatusConflict, `email_taken`, `Email is already taken`)
+	ResyncRequired       = newError(http.StatusGone, `resync_required`, `Change cursor has expired`)
+	PayloadTooLarge      = newError(http.StatusRequestEntityTooLarge, `payload_too_large`, `Request body is too large`)
+	UnsupportedMediaType = newError(http.StatusUnsupportedMediaType, `unsupported_media_type`, `Unsupported content type`)
+	ValidationFailed     = newError(http.StatusUnprocessableEntity, `validation_failed`, `Request is invalid`)
+	InvalidArchive       = newError(http.StatusUnprocessableEntity, `invalid_archive`, `Archive can't be extracted`)
+	LocationKept         = newError(http.StatusUnprocessableEntity, `location_kept`, `Location can't be removed from the file type`)
+	WeakPassword         = newError(http.StatusUnprocessableEntity, `weak_password`, `Password does not satisfy the policy`)
+	RateLimited          = newError(http.StatusTooManyRequests, `rate_limited`, `Too many requests`)
+	AccountLocked        = newError(http.StatusTooManyRequests, `account_locked`, `Too many failed attempts`)
+	InternalServerError  = newError(http.StatusInternalServerError, `internal_error`, `Internal server error`)
+	QuotaExceeded        = newError(http.StatusInsufficientStorage, `quota_exceeded`, `Storage quota exceeded`)
 )
 
-func (e *CustomError) Unathorized() {
-	e.StatusCode = http.StatusUnauthorized
-	e.Description = http.StatusText(http.StatusUnauthorized)
+// New returns an error of another protocol than the native API, with
+// the code and title that protocol uses. See Protocol.
+func New(status int, code, title string) *Error {
+	return newError(status, code, title)
+}
+
+func newError(status int, code, title string) *Error {
+	return &Error{
+		Type:   TypePrefix + code,
+		Title:  title,
+		Status: status,
+		Code:   code,
+	}
+}
+
+func (e *Error) Error() string {
+	msg := e.Title
+	if e.Detail != `` {
+		msg += `: ` + e.Detail
+	}
+	if e.Err != nil {
+		msg += `: ` + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// Wrap returns a copy of the error caused by err
+// and remembers where it was called from.
+func (e *Error) Wrap(err error) *Error {
+	c := e.copy()
+	c.Err = err
+	return c
+}
+
+// WithDetail returns a copy of the error explaining this occurrence.
+func (e *Error) WithDetail(detail string) *Error {
+	c := e.copy()
+	c.Detail = detail
+	return c
+}
+
+// WithFields returns a copy of the error listing the invalid fields.
+func (e *Error) WithFields(fields ...FieldError) *Error {
+	c := e.copy()
+	c.Errors = append(c.Errors[:len(c.Errors):len(c.Errors)], fields...)
+	return c
+}
+
+func (e *Error) copy() *Error {
+	c := *e
+	if c.stack == nil {
+		c.stack = callers()
+	}
+	return &c
+}
+
+// As returns err as an *Error. Oversized bodies become PayloadTooLarge,
+// errors of any other type are treated as internal errors caused by err.
+func As(err error) *Error {
+	return api.as(err)
+}
+
+func (p Protocol) as(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return PayloadTooLarge.Wrap(err)
+	}
+	return p.Internal.Wrap(err)
 }
 
-func (e *CustomError) Forbidden() {
-	e.StatusCode = http.StatusForbidden
-	e.Description = http.StatusText(http.StatusForbidden)
+// Message is what the client is told: the detail, or the title if the
+// error has none.
+func (e *Error) Message() string {
+	if e.Detail != `` {
+		return e.Detail
+	}
+	return e.Title
 }
 
-func (e *CustomError) InternalServerError() {
-	e.StatusCode = http.StatusInternalServerError
-	e.Description = http.StatusText(http.StatusInternalServerError)
+func callers() []uintptr {
+	pc := make([]uintptr, 32)
+	n := runtime.Callers(4, pc)
+	return pc[:n]
 }
@@ -0,0 +1,129 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Users returns one page of users whose login or email contains query.
+// Sort is id (default) or login. Admins only, like the rest of this file.
+func (c *Client) Users(ctx context.Context, query string, opts ListOptions) (Page[User], error) {
+	values := opts.values()
+	if query != `` {
+		values.Set(`q`, query)
+	}
+
+	var page Page[User]
+	err := c.do(ctx, request{method: http.MethodGet, path: apiVersion + `/admin/users`, query: values}, &page)
+	return page, err
+}
+
+// User returns the user with the storage it uses.
+func (c *Client) User(ctx context.Context, id int64) (User, error) {
+	var u User
+	err := c.do(ctx, request{method: http.MethodGet, path: pathf(`/admin/users/%d`, id)}, &u)
+	return u, err
+}
+
+// DisableUser disables the user and logs out every session.
+func (c *Client) DisableUser(ctx context.Context, id int64) (User, error) {
+	return c.userAction(ctx, http.MethodPost, pathf(`/admin/users/%d/disable`, id), nil)
+}
+
+func (c *Client) EnableUser(ctx context.Context, id int64) (User, error) {
+	return c.userAction(ctx, http.MethodPost, pathf(`/admin/users/%d/enable`, id), nil)
+}
+
+func (c *Client) SetUserPassword(ctx context.Context, id int64, newPassword string) (User, error) {
+	return c.userAction(ctx, http.MethodPut, pathf(`/admin/users/%d/password`, id), map[string]any{`new_password`: newPassword})
+}
+
+// SetUserQuota limits the storage of the user to quota bytes, 0 is unlimited.
+func (c *Client) SetUserQuota(ctx context.Context, id int64, quota int64) (User, error) {
+	return c.userAction(ctx, http.MethodPut, pathf(`/admin/users/%d/quota`, id), map[string]any{`quota`: quota})
+}
+
+// SetUserRole sets the role to admin, user or readonly.
+func (c *Client) SetUserRole(ctx context.Context, id int64, role string) (User, error) {
+	return c.userAction(ctx, http.MethodPut, pathf(`/admin/users/%d/role`, id), map[string]any{`role`: role})
+}
+
+func (c *Client) LogoutUser(ctx context.Context, id int64) (User, error) {
+	return c.userAction(ctx, http.MethodPost, pathf(`/admin/users/%d/logout`, id), nil)
+}
+
+func (c *Client) userAction(ctx context.Context, method, path string, body any) (User, error) {
+	var u User
+	err := c.do(ctx, request{method: method, path: path, body: body}, &u)
+	return u, err
+}
+
+// Registrations returns the accounts waiting for approval.
+func (c *Client) Registrations(ctx context.Context) ([]User, error) {
+	var users []User
+	err := c.do(ctx, request{method: http.MethodGet, path: apiVersion + `/admin/registrations`}, &users)
+	return users, err
+}
+
+func (c *Client) ApproveRegistration(ctx context.Context, id int64) (User, error) {
+	return c.userAction(ctx, http.MethodPost, pathf(`/admin/registrations/%d/approve`, id), nil)
+}
+
+func (c *Client) RejectRegistration(ctx context.Context, id int64) error {
+	return c.do(ctx, request{method: http.MethodDelete, path: pathf(`/admin/registrations/%d`, id)}, nil)
+}
+
+func (c *Client) Invites(ctx context.Context) ([]Invite, error) {
+	var invites []Invite
+	err := c.do(ctx, request{method: http.MethodGet, path: apiVersion + `/admin/invites`}, &invites)
+	return invites, err
+}
+
+// CreateInvite returns a registration code usable maxUses times,
+// never expiring when ttl is zero. The code can't be read again later.
+func (c *Client) CreateInvite(ctx context.Context, maxUses int, ttl time.Duration) (string, Invite, error) {
+	req := map[string]any{`max_uses`: maxUses}
+	if ttl > 0 {
+		req[`expires_in`] = ttl.String()
+	}
+
+	var res struct {
+		Code   string `json:"code"`
+		Invite Invite `json:"invite"`
+	}
+	err := c.do(ctx, request{method: http.MethodPost, path: apiVersion + `/admin/invites`, body: req}, &res)
+	return res.Code, res.Invite, err
+}
+
+func (c *Client) DeleteInvite(ctx context.Context, id int64) error {
+	return c.do(ctx, request{method: http.MethodDelete, path: pathf(`/admin/invites/%d`, id)}, nil)
+}
+
+// Unlock lifts the lockout of a login, an address, or both.
+func (c *Client) Unlock(ctx context.Context, login, ip string) error {
+	req := map[string]string{}
+	if login != `` {
+		req[`login`] = login
+	}
+	if ip != `` {
+		req[`ip`] = ip
+	}
+	return c.do(ctx, request{method: http.MethodPost, path: apiVersion + `/admin/unlock`, body: req}, nil)
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Register creates an account and logs it in. It returns
+// ErrPendingApproval if the account has to be approved first.
+func (c *Client) Register(ctx context.Context, reg Registration) (Token, error) {
+	resp, err := c.send(ctx, request{
+		method: http.MethodPost,
+		path:   apiVersion + `/auth/register`,
+		body:   reg,
+		public: true,
+	})
+	if err != nil {
+		return Token{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusAccepted {
+		return Token{}, ErrPendingApproval
+	}
+
+	var t Token
+	if err = decodeData(resp, &t); err != nil {
+		return Token{}, err
+	}
+
+	c.setToken(t)
+	return t, nil
+}
+
+// Login starts a session. Save the returned token, or use OnTokenRefresh,
+// to resume the session with WithSession later.
+func (c *Client) Login(ctx context.Context, login, password string) (Token, error) {
+	var t Token
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   apiVersion + `/auth/login`,
+		body:   map[string]string{`login`: login, `password`: password},
+		public: true,
+	}, &t)
+	if err != nil {
+		return Token{}, err
+	}
+
+	c.setToken(t)
+	return t, nil
+}
+
+// Refresh trades the refresh token of the session for a new pair.
+// Requests do that on their own, this is for keeping idle sessions alive.
+func (c *Client) Refresh(ctx context.Context) (Token, error) {
+	if err := c.refresh(ctx, c.Session().Token); err != nil {
+		return Token{}, err
+	}
+	return c.Session(), nil
+}
+
+// Me returns the logged in user with the storage it uses.
+func (c *Client) Me(ctx context.Context) (User, error) {
+	var u User
+	err := c.do(ctx, request{method: http.MethodGet, path: apiVersion + `/auth/check`}, &u)
+	return u, err
+}
+
+// CreateToken mints a personal token for WithPersonalToken. It never
+// expires when ttl is zero. The token can't be read again later.
+func (c *Client) CreateToken(ctx context.Context, name string, ttl time.Duration) (string, PersonalToken, error) {
+	req := map[string]string{`name`: name}
+	if ttl > 0 {
+		req[`expires_in`] = ttl.String()
+	}
+
+	var res struct {
+		Token         string        `json:"token"`
+		PersonalToken PersonalToken `json:"personal_token"`
+	}
+	err := c.do(ctx, request{method: http.MethodPost, path: apiVersion + `/account/tokens`, body: req}, &res)
+	return res.Token, res.PersonalToken, err
+}
+
+func (c *Client) Tokens(ctx context.Context) ([]PersonalToken, error) {
+	var tokens []PersonalToken
+	err := c.do(ctx, request{method: http.MethodGet, path: apiVersion + `/account/tokens`}, &tokens)
+	return tokens, err
+}
+
+func (c *Client) DeleteToken(ctx context.Context, id int64) error {
+	return c.do(ctx, request{method: http.MethodDelete, path: pathf(`/account/tokens/%d`, id)}, nil)
+}
+
+// CreateAppPassword generates a password for WebDAV and other clients
+// that sign in with Basic auth. It can't be read again later.
+func (c *Client) CreateAppPassword(ctx context.Context, name string) (string, AppPassword, error) {
+	var res struct {
+		Password    string      `json:"password"`
+		AppPassword AppPassword `json:"app_password"`
+	}
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   apiVersion + `/account/app-passwords`,
+		body:   map[string]string{`name`: name},
+	}, &res)
+	return res.Password, res.AppPassword, err
+}
+
+func (c *Client) AppPasswords(ctx context.Context) ([]AppPassword, error) {
+	var passwords []AppPassword
+	err := c.do(ctx, request{method: http.MethodGet, path: apiVersion + `/account/app-passwords`}, &passwords)
+	return passwords, err
+}
+
+func (c *Client) DeleteAppPassword(ctx context.Context, id int64) error {
+	return c.do(ctx, request{method: http.MethodDelete, path: pathf(`/account/app-passwords/%d`, id)}, nil)
+}
+
+// CreateAccessKey generates a key pair for S3 clients and returns
+// the secret with it. The secret can't be read again later.
+func (c *Client) CreateAccessKey(ctx context.Context, name string) (string, AccessKey, error) {
+	var res struct {
+		SecretAccessKey string    `json:"secret_access_key"`
+		AccessKey       AccessKey `json:"access_key"`
+	}
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   apiVersion + `/account/access-keys`,
+		body:   map[string]string{`name`: name},
+	}, &res)
+	return res.SecretAccessKey, res.AccessKey, err
+}
+
+func (c *Client) AccessKeys(ctx context.Context) ([]AccessKey, error) {
+	var keys []AccessKey
+	err := c.do(ctx, request{method: http.MethodGet, path: apiVersion + `/account/access-keys`}, &keys)
+	return keys, err
+}
+
+func (c *Client) DeleteAccessKey(ctx context.Context, id int64) error {
+	return c.do(ctx, request{method: http.MethodDelete, path: pathf(`/account/access-keys/%d`, id)}, nil)
+}
+
+// AddSSHKey registers a line of authorized_keys for the SFTP server.
+func (c *Client) AddSSHKey(ctx context.Context, name, publicKey string) (SSHKey, error) {
+	var k SSHKey
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   apiVersion + `/account/ssh-keys`,
+		body:   map[string]string{`name`: name, `public_key`: publicKey},
+	}, &k)
+	return k, err
+}
+
+func (c *Client) SSHKeys(ctx context.Context) ([]SSHKey, error) {
+	var keys []SSHKey
+	err := c.do(ctx, request{method: http.MethodGet, path: apiVersion + `/account/ssh-keys`}, &keys)
+	return keys, err
+}
+
+func (c *Client) DeleteSSHKey(ctx context.Context, id int64) error {
+	return c.do(ctx, request{method: http.MethodDelete, path: pathf(`/account/ssh-keys/%d`, id)}, nil)
+}
+
+// ChangePassword logs out every other session.
+func (c *Client) ChangePassword(ctx context.Context, current, newPassword string) error {
+	return c.do(ctx, request{
+		method: http.MethodPut,
+		path:   apiVersion + `/account/password`,
+		body:   map[string]string{`password`: current, `new_password`: newPassword},
+	}, nil)
+}
+
+// ChangeLogin renames the account. Every session is logged out,
+// the client continues with the new one returned.
+func (c *Client) ChangeLogin(ctx context.Context, password, newLogin string) (Token, error) {
+	var t Token
+	err := c.do(ctx, request{
+		method: http.MethodPut,
+		path:   apiVersion + `/account/login`,
+		body:   map[string]string{`password`: password, `new_login`: newLogin},
+	}, &t)
+	if err != nil {
+		return Token{}, err
+	}
+
+	c.setToken(t)
+	return t, nil
+}
+
+// ChangeEmail sets a new address, which has to be verified again.
+func (c *Client) ChangeEmail(ctx context.Context, password, email string) error {
+	return c.do(ctx, request{
+		method: http.MethodPut,
+		path:   apiVersion + `/account/email`,
+		body:   map[string]string{`password`: password, `email`: email},
+	}, nil)
+}
+
+func (c *Client) ResendVerification(ctx context.Context) error {
+	return c.do(ctx, request{method: http.MethodPost, path: apiVersion + `/account/email/verify`}, nil)
+}
+
+// DeleteAccount deletes the account and every file in it.
+func (c *Client) DeleteAccount(ctx context.Context, password string) error {
+	return c.do(ctx, request{
+		method: http.MethodDelete,
+		path:   apiVersion + `/account`,
+		body:   map[string]string{`password`: password},
+	}, nil)
+}
@@ -0,0 +1,407 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package client is a Go client for the DexCloud API.
+//
+// A Client logs in with a login and password, a saved session, or a personal
+// token. Access tokens are refreshed before they expire, and requests that
+// are safe to repeat are retried with backoff when the server is
+// unavailable or rate limits them.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	apiVersion = `/api/v1`
+
+	defaultRetries   = 3
+	defaultBackoff   = 500 * time.Millisecond
+	maxBackoff       = 30 * time.Second
+	defaultChunkSize = 8 << 20
+
+	// refreshMargin refreshes access tokens that expire this soon,
+	// so requests don't fail on their way to the server.
+	refreshMargin = 30 * time.Second
+)
+
+// Client talks to one server. It is safe for concurrent use.
+type Client struct {
+	baseURL   string
+	http      *http.Client
+	retries   int
+	backoff   time.Duration
+	chunkSize int64
+
+	mu       sync.Mutex
+	token    Token
+	personal string
+	onToken  func(Token)
+}
+
+type Option func(*Client)
+
+// WithHTTPClient sends requests with hc instead of http.DefaultClient.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.http = hc }
+}
+
+// WithSession resumes a session saved from an earlier Login.
+func WithSession(t Token) Option {
+	return func(c *Client) { c.token = t }
+}
+
+// WithPersonalToken authenticates every request with a personal token
+// instead of a session.
+func WithPersonalToken(token string) Option {
+	return func(c *Client) { c.personal = token }
+}
+
+// WithRetries retries failed requests up to n times, waiting backoff
+// before the first retry and twice as long before each next one.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(c *Client) { c.retries, c.backoff = n, backoff }
+}
+
+// WithChunkSize sets how many bytes each request of an upload carries.
+func WithChunkSize(n int64) Option {
+	return func(c *Client) { c.chunkSize = n }
+}
+
+// OnTokenRefresh calls f with every new token pair, so it can be saved
+// and passed to WithSession later. Refresh tokens can only be used once.
+func OnTokenRefresh(f func(Token)) Option {
+	return func(c *Client) { c.onToken = f }
+}
+
+// New returns a client of the server at baseURL, like https://cloud.example.com.
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:   strings.TrimSuffix(baseURL, `/`),
+		http:      http.DefaultClient,
+		retries:   defaultRetries,
+		backoff:   defaultBackoff,
+		chunkSize: defaultChunkSize,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Session returns the current token pair, to be saved for WithSession.
+func (c *Client) Session() Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
+
+// request describes one API call.
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	header http.Header
+
+	// body is sent as JSON, raw as is. Both are kept
+	// in memory so the request can be repeated.
+	body any
+	raw  []byte
+
+	// public requests carry no credentials.
+	public bool
+}
+
+// do sends the request and decodes the data of the envelope into out,
+// unless out is nil.
+func (c *Client) do(ctx context.Context, req request, out any) error {
+	resp, err := c.send(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return decodeData(resp, out)
+}
+
+// decodeData decodes the data of the envelope in the response into out.
+func decodeData(resp *http.Response, out any) error {
+	envelope := struct {
+		Data any `json:"data"`
+	}{Data: out}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf(`client: decoding %s %s: %w`, resp.Request.Method, resp.Request.URL.Path, err)
+	}
+	return nil
+}
+
+// send sends the request and returns the response of a successful one,
+// whose body the caller closes. Errors of the server are returned as *Error.
+func (c *Client) send(ctx context.Context, req request) (*http.Response, error) {
+	var body []byte
+	switch {
+	case req.body != nil:
+		b, err := json.Marshal(req.body)
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	case req.raw != nil:
+		body = req.raw
+	}
+
+	refreshed := false
+	for attempt := 0; ; attempt++ {
+		httpReq, err := c.newRequest(ctx, req, body)
+		if err != nil {
+			return nil, err
+		}
+
+		var stale string
+		if !req.public {
+			if stale, err = c.authorize(ctx, httpReq); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := c.http.Do(httpReq)
+		if err != nil {
+			if attempt < c.retries && idempotent(req.method) && retryable(ctx, err) {
+				if err = c.wait(ctx, attempt, 0); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			return nil, err
+		}
+
+		if resp.StatusCode < http.StatusBadRequest {
+			return resp, nil
+		}
+
+		apiErr := readError(resp)
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized && stale != `` && !refreshed:
+			// The session may have been refreshed elsewhere or the access
+			// token expired early. Either way one refresh is worth a try.
+			refreshed = true
+			if err = c.refresh(ctx, stale); err != nil {
+				return nil, apiErr
+			}
+			attempt--
+			continue
+		case attempt < c.retries && retryStatus(req.method, resp.StatusCode):
+			if err = c.wait(ctx, attempt, apiErr.RetryAfter); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return nil, apiErr
+	}
+}
+
+func (c *Client) newRequest(ctx context.Context, req request, body []byte) (*http.Request, error) {
+	u := c.baseURL + req.path
+	if len(req.query) > 0 {
+		u += `?` + req.query.Encode()
+	}
+
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, u, r)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range req.header {
+		httpReq.Header[k] = v
+	}
+	httpReq.Header.Set(`Accept`, `application/json`)
+	if req.body != nil {
+		httpReq.Header.Set(`Content-Type`, `application/json`)
+	}
+	return httpReq, nil
+}
+
+// authorize adds the credentials to the request, refreshing an access
+// token about to expire first. It returns the access token it used.
+func (c *Client) authorize(ctx context.Context, r *http.Request) (access string, err error) {
+	c.mu.Lock()
+	personal, t := c.personal, c.token
+	c.mu.Unlock()
+
+	if personal != `` {
+		r.Header.Set(`Authorization`, `Bearer `+personal)
+		return ``, nil
+	}
+	if t.Token == `` {
+		return ``, ErrNotLoggedIn
+	}
+
+	if t.RefreshToken != `` && time.Until(t.ExpiresAt()) < refreshMargin {
+		if err = c.refresh(ctx, t.Token); err != nil {
+			return ``, err
+		}
+		t = c.Session()
+	}
+
+	r.Header.Set(`Authorization`, `Bearer `+t.Token)
+	return t.Token, nil
+}
+
+// refresh trades the refresh token for a new pair, unless the access
+// token is no longer stale because another request refreshed it already.
+func (c *Client) refresh(ctx context.Context, stale string) error {
+	c.mu.Lock()
+	if c.token.Token != stale {
+		c.mu.Unlock()
+		return nil
+	}
+	if c.token.RefreshToken == `` {
+		c.mu.Unlock()
+		return ErrNotLoggedIn
+	}
+
+	// The lock is held during the request, so concurrent requests
+	// don't spend the same refresh token twice.
+	var t Token
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   apiVersion + `/auth/refresh`,
+		body:   map[string]string{`refresh_token`: c.token.RefreshToken},
+		public: true,
+	}, &t)
+	if err == nil {
+		c.token = t
+	}
+	c.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	c.saved(t)
+	return nil
+}
+
+// setToken starts the session of a login.
+func (c *Client) setToken(t Token) {
+	c.mu.Lock()
+	c.token = t
+	c.mu.Unlock()
+	c.saved(t)
+}
+
+func (c *Client) saved(t Token) {
+	if c.onToken != nil {
+		c.onToken(t)
+	}
+}
+
+// wait sleeps before the next attempt: as long as the server asked for,
+// or an exponential backoff with jitter.
+func (c *Client) wait(ctx context.Context, attempt int, retryAfter time.Duration) error {
+	d := retryAfter
+	if d <= 0 {
+		d = c.backoff << attempt
+		if d > maxBackoff || d <= 0 {
+			d = maxBackoff
+		}
+		d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// idempotent methods can be repeated when the response was lost.
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// retryStatus tells whether the request is worth repeating. Rate limited
+// requests were never processed, so they are repeated whatever the method.
+func retryStatus(method string, status int) bool {
+	switch status {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return idempotent(method)
+	}
+	return false
+}
+
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+func retryAfter(h http.Header) time.Duration {
+	v := h.Get(`Retry-After`)
+	if v == `` {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(v); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// pathf builds an API path, escaping the arguments.
+func pathf(format string, args ...any) string {
+	for i, arg := range args {
+		if s, ok := arg.(string); ok {
+			args[i] = url.PathEscape(s)
+		}
+	}
+	return apiVersion + fmt.Sprintf(format, args...)
+}
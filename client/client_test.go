@@ -0,0 +1,586 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"server/api"
+	"server/catcherr"
+	"server/client"
+	"server/config"
+	"server/database"
+	"server/directory"
+	"server/mailer"
+	"server/password"
+	"server/throttle"
+	"server/user"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// configEnv names the config file of the server the tests run. The tests
+// create and delete accounts in its database, so they are skipped unless
+// it is set.
+const configEnv = `DEXCLOUD_TEST_CONFIG`
+
+const testPassword = `correct horse battery staple`
+
+var router *mux.Router
+
+func TestMain(m *testing.M) {
+	if path := os.Getenv(configEnv); path != `` {
+		if err := start(path); err != nil {
+			log.Fatal(err)
+		}
+	}
+	os.Exit(m.Run())
+}
+
+// start initializes the server like main does, with the user data in a
+// temporary folder, and builds the API router.
+func start(path string) error {
+	ctx := context.Background()
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if err = config.Load(path); err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp(``, `dexcloud-client-test`)
+	if err != nil {
+		return err
+	}
+	if err = os.Chdir(dir); err != nil {
+		return err
+	}
+
+	for _, initialize := range []func() error{directory.Init, password.Load, throttle.Init, mailer.Init} {
+		if err = initialize(); err != nil {
+			return err
+		}
+	}
+	if err = database.Open(ctx); err != nil {
+		return err
+	}
+	if err = user.Init(ctx); err != nil {
+		return err
+	}
+
+	router = mux.NewRouter()
+	api.Handle(router)
+	router.NotFoundHandler = catcherr.Respond(catcherr.NotFound)
+	router.MethodNotAllowedHandler = catcherr.Respond(catcherr.MethodNotAllowed)
+	return nil
+}
+
+// server serves the router, failing the requests it was told to
+// before they or their responses reach the client.
+type server struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	faults []*fault
+	hits   map[string]int
+}
+
+type fault struct {
+	method, prefix string
+	skip           int // matching requests to let through first
+	serve          func(w http.ResponseWriter, r *http.Request)
+}
+
+func newServer(t *testing.T) *server {
+	t.Helper()
+	if router == nil {
+		t.Skip(configEnv + ` is not set`)
+	}
+
+	s := &server{hits: make(map[string]int)}
+	s.Server = httptest.NewServer(s)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.hits[r.Method+` `+r.URL.Path]++
+	var serve func(w http.ResponseWriter, r *http.Request)
+	for i, f := range s.faults {
+		if f.method != r.Method || !strings.HasPrefix(r.URL.Path, f.prefix) {
+			continue
+		}
+		if f.skip > 0 {
+			f.skip--
+			break
+		}
+		serve = f.serve
+		s.faults = append(s.faults[:i], s.faults[i+1:]...)
+		break
+	}
+	s.mu.Unlock()
+
+	if serve == nil {
+		serve = router.ServeHTTP
+	}
+	serve(w, r)
+}
+
+// fail makes the matching request after skip others fail with serve.
+func (s *server) fail(method, prefix string, skip int, serve func(w http.ResponseWriter, r *http.Request)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &fault{method: method, prefix: prefix, skip: skip, serve: serve})
+}
+
+func (s *server) count(method, path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hits[method+` `+path]
+}
+
+// rateLimited answers without processing the request.
+func rateLimited(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set(`Content-Type`, `application/problem+json`)
+	w.Header().Set(`Retry-After`, `1`)
+	w.WriteHeader(http.StatusTooManyRequests)
+	fmt.Fprint(w, `{"title":"Too Many Requests","status":429,"code":"rate_limited"}`)
+}
+
+// lostResponse processes the request, but the response is lost
+// on its way back, like behind a proxy that timed out.
+func lostResponse(w http.ResponseWriter, r *http.Request) {
+	router.ServeHTTP(httptest.NewRecorder(), r)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// cutBody sends half of the body and drops the connection.
+func cutBody(w http.ResponseWriter, r *http.Request) {
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, r)
+
+	for k, v := range rec.Header() {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(rec.Code)
+	body := rec.Body.Bytes()
+	w.Write(body[:len(body)/2])
+	w.(http.Flusher).Flush()
+	panic(http.ErrAbortHandler)
+}
+
+// register signs a new account up and deletes it after the test.
+func register(t *testing.T, s *server, opts ...client.Option) *client.Client {
+	t.Helper()
+	ctx := context.Background()
+
+	login := fmt.Sprintf(`client-test-%d`, time.Now().UnixNano())
+	c := client.New(s.URL, opts...)
+	if _, err := c.Register(ctx, client.Registration{Login: login, Password: testPassword}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		// The test may have spent the session, so a new one is used.
+		c := client.New(s.URL)
+		if _, err := c.Login(ctx, login, testPassword); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := c.DeleteAccount(ctx, testPassword); err != nil {
+			t.Error(err)
+		}
+	})
+	return c
+}
+
+func upload(t *testing.T, c *client.Client, name string, content []byte) client.File {
+	t.Helper()
+	f, err := c.Upload(context.Background(), bytes.NewReader(content), int64(len(content)), client.UploadOptions{
+		Folder:   `/`,
+		Name:     name,
+		MimeType: `text/plain`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func download(t *testing.T, c *client.Client, id int64) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := c.Download(context.Background(), id, &buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// content returns n bytes that differ at every offset within 256 bytes,
+// so misplaced chunks show.
+func content(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = 'a' + byte(i%26) + byte(i/26%4)
+	}
+	return b
+}
+
+func TestRefresh(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	c := register(t, s)
+
+	session, err := c.Refresh(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Token == `` || session.RefreshToken == `` {
+		t.Fatalf(`refreshed session %+v lacks a token`, session)
+	}
+
+	// An access token the server doesn't take is refreshed once and
+	// the request sent again.
+	var saved client.Token
+	stale := session
+	stale.Token = `stale`
+	stale.Expires = time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	c = client.New(s.URL, client.WithSession(stale), client.OnTokenRefresh(func(t client.Token) { saved = t }))
+
+	u, err := c.Me(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Login != session.Login {
+		t.Errorf(`logged in as %q, want %q`, u.Login, session.Login)
+	}
+	if saved.Token == `` || saved.RefreshToken == session.RefreshToken {
+		t.Errorf(`OnTokenRefresh got %+v, want a new pair`, saved)
+	}
+	if n := s.count(http.MethodGet, directory.APIAuthCheck); n != 2 {
+		t.Errorf(`%s was requested %d times, want 2`, directory.APIAuthCheck, n)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	s := newServer(t)
+	c := register(t, s)
+	s.fail(http.MethodGet, directory.APIAuthCheck, 0, rateLimited)
+
+	start := time.Now()
+	if _, err := c.Me(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf(`retried after %v, the server asked for 1s`, elapsed)
+	}
+	if n := s.count(http.MethodGet, directory.APIAuthCheck); n != 2 {
+		t.Errorf(`%s was requested %d times, want 2`, directory.APIAuthCheck, n)
+	}
+}
+
+func TestRetryAfterGivesUp(t *testing.T) {
+	s := newServer(t)
+	c := register(t, s, client.WithRetries(0, time.Millisecond))
+	s.fail(http.MethodGet, directory.APIAuthCheck, 0, rateLimited)
+
+	_, err := c.Me(context.Background())
+	var e *client.Error
+	if !errors.As(err, &e) || e.Code != client.CodeRateLimited || e.RetryAfter != time.Second {
+		t.Fatalf(`got %v, want %s with a retry after 1s`, err, client.CodeRateLimited)
+	}
+}
+
+func TestPersonalTokens(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	c := register(t, s)
+
+	secret, token, err := c.CreateToken(ctx, `ci`, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := c.Tokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].ID != token.ID || tokens[0].Name != `ci` {
+		t.Fatalf(`tokens are %+v, want only %+v`, tokens, token)
+	}
+
+	pc := client.New(s.URL, client.WithPersonalToken(secret))
+	if _, err = pc.Me(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.DeleteToken(ctx, token.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = pc.Me(ctx); client.ErrorCode(err) != client.CodeUnauthorized {
+		t.Fatalf(`deleted token got %v, want %s`, err, client.CodeUnauthorized)
+	}
+}
+
+func TestFolders(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	c := register(t, s)
+
+	folder, err := c.CreateFolder(ctx, `/docs/2024`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if folder.Path != `/docs/2024` || folder.Name != `2024` {
+		t.Fatalf(`created %+v, want /docs/2024`, folder)
+	}
+	again, err := c.CreateFolder(ctx, `/docs/2024`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != folder.ID {
+		t.Errorf(`creating an existing folder made %+v, want %+v`, again, folder)
+	}
+
+	folders, err := c.Folders(ctx, `/docs`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(folders) != 1 || folders[0].ID != folder.ID {
+		t.Fatalf(`/docs holds %+v, want only %+v`, folders, folder)
+	}
+
+	if err = c.DeleteFolder(ctx, folder.ID); err != nil {
+		t.Fatal(err)
+	}
+	if folders, err = c.Folders(ctx, `/docs`); err != nil || len(folders) != 0 {
+		t.Fatalf(`/docs holds %+v (%v) after the delete, want nothing`, folders, err)
+	}
+}
+
+func TestMoveFile(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	c := register(t, s)
+	f := upload(t, c, `notes.txt`, []byte(`moved`))
+
+	moved, err := c.MoveFile(ctx, f.ID, `/archive/old`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.ID != f.ID || moved.Folder != `/archive/old` || moved.Name != f.Name {
+		t.Fatalf(`moved to %+v, want %s in /archive/old`, moved, f.Name)
+	}
+
+	// Missing folders are created on the way.
+	folders, err := c.Folders(ctx, `/archive`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(folders) != 1 || folders[0].Path != `/archive/old` {
+		t.Errorf(`/archive holds %+v, want /archive/old`, folders)
+	}
+
+	page, err := c.ListFiles(ctx, client.FileFilter{Folder: `/archive/old`}, client.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 1 || page.Items[0].ID != f.ID {
+		t.Errorf(`/archive/old lists %+v, want only the moved file`, page.Items)
+	}
+	if got := download(t, c, f.ID); string(got) != `moved` {
+		t.Errorf(`moved file holds %q`, got)
+	}
+}
+
+// A chunk whose response got lost is not sent twice: the client asks
+// for the offset and goes on from there.
+func TestUploadLostResponse(t *testing.T) {
+	s := newServer(t)
+	c := register(t, s, client.WithChunkSize(16), client.WithRetries(3, time.Millisecond))
+	want := content(100)
+	s.fail(http.MethodPatch, directory.APIUploads+`/`, 1, lostResponse)
+
+	f := upload(t, c, `flaky.txt`, want)
+	if f.Size != int64(len(want)) {
+		t.Errorf(`uploaded %d bytes, want %d`, f.Size, len(want))
+	}
+	if got := download(t, c, f.ID); !bytes.Equal(got, want) {
+		t.Errorf(`uploaded %q, want %q`, got, want)
+	}
+}
+
+func TestResumeUpload(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	c := register(t, s, client.WithChunkSize(16), client.WithRetries(0, time.Millisecond))
+	want := content(100)
+
+	u, err := c.CreateUpload(ctx, int64(len(want)), client.UploadOptions{Folder: `/`, Name: `resumed.txt`, MimeType: `text/plain`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second chunk arrives but the client doesn't learn of it.
+	s.fail(http.MethodPatch, directory.APIUploads+`/`, 1, lostResponse)
+	if _, err = c.ResumeUpload(ctx, u.ID, bytes.NewReader(want)); err == nil {
+		t.Fatal(`upload went through a lost response without retries`)
+	}
+
+	if u, err = c.GetUpload(ctx, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if u.Offset != 32 {
+		t.Fatalf(`upload is at %d, want 32`, u.Offset)
+	}
+
+	f, err := c.ResumeUpload(ctx, u.ID, bytes.NewReader(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := download(t, c, f.ID); !bytes.Equal(got, want) {
+		t.Errorf(`uploaded %q, want %q`, got, want)
+	}
+
+	// The finished upload is gone.
+	if _, err = c.GetUpload(ctx, u.ID); client.ErrorCode(err) != client.CodeNotFound {
+		t.Errorf(`finished upload got %v, want %s`, err, client.CodeNotFound)
+	}
+}
+
+func TestCancelUpload(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	c := register(t, s)
+
+	u, err := c.CreateUpload(ctx, 10, client.UploadOptions{Folder: `/`, Name: `cancelled.txt`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.CancelUpload(ctx, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.GetUpload(ctx, u.ID); client.ErrorCode(err) != client.CodeNotFound {
+		t.Errorf(`cancelled upload got %v, want %s`, err, client.CodeNotFound)
+	}
+}
+
+func TestDownloadRange(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	c := register(t, s)
+	want := content(100)
+	f := upload(t, c, `range.txt`, want)
+
+	tests := []struct {
+		offset, length int64
+		want           []byte
+	}{
+		{0, 10, want[:10]},
+		{40, 25, want[40:65]},
+		{90, -1, want[90:]},
+	}
+	for _, tt := range tests {
+		body, err := c.DownloadRange(ctx, f.ID, tt.offset, tt.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf(`range %d+%d is %q, want %q`, tt.offset, tt.length, got, tt.want)
+		}
+	}
+}
+
+// A download that breaks off goes on with a range request.
+func TestDownloadResumes(t *testing.T) {
+	s := newServer(t)
+	c := register(t, s, client.WithRetries(3, time.Millisecond))
+	want := content(100)
+	f := upload(t, c, `resumed.txt`, want)
+
+	path := fmt.Sprintf(`%s/file/%d/content`, directory.APIVersion, f.ID)
+	s.fail(http.MethodGet, path, 0, cutBody)
+
+	if got := download(t, c, f.ID); !bytes.Equal(got, want) {
+		t.Errorf(`downloaded %q, want %q`, got, want)
+	}
+	if n := s.count(http.MethodGet, path); n != 2 {
+		t.Errorf(`%s was requested %d times, want 2`, path, n)
+	}
+}
+
+func TestShares(t *testing.T) {
+	ctx := context.Background()
+	s := newServer(t)
+	c := register(t, s)
+	f := upload(t, c, `shared.txt`, []byte(`for everyone`))
+
+	link, err := c.CreateShare(ctx, f.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := c.Shares(ctx, f.ID, client.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 1 || page.Items[0].ID != link.Share.ID {
+		t.Fatalf(`shares are %+v, want only %+v`, page.Items, link.Share)
+	}
+
+	anonymous := client.New(s.URL)
+	info, err := anonymous.SharedFile(ctx, link.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != f.Name || info.Size != f.Size {
+		t.Errorf(`shared file is %+v, want %s of %d bytes`, info, f.Name, f.Size)
+	}
+
+	var buf bytes.Buffer
+	if _, err = anonymous.DownloadShared(ctx, link.Token, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != `for everyone` {
+		t.Errorf(`shared file holds %q`, buf.String())
+	}
+
+	if err = c.DeleteShare(ctx, link.Share.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = anonymous.SharedFile(ctx, link.Token); client.ErrorCode(err) != client.CodeNotFound {
+		t.Errorf(`deleted share got %v, want %s`, err, client.CodeNotFound)
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+var (
+	// ErrNotLoggedIn is returned by requests that need a session
+	// before Login, Register or WithSession provided one.
+	ErrNotLoggedIn = errors.New(`client: not logged in`)
+
+	// ErrPendingApproval is returned by Register when the account
+	// waits for an administrator.
+	ErrPendingApproval = errors.New(`client: account is waiting for approval`)
+)
+
+// Codes of errors clients commonly handle. docs/errors.md lists them all.
+const (
+	CodeUnauthorized       = `unauthorized`
+	CodeInvalidCredentials = `invalid_credentials`
+	CodeNotFound           = `not_found`
+	CodeConflict           = `conflict`
+	CodeResyncRequired     = `resync_required`
+	CodeValidationFailed   = `validation_failed`
+	CodeRateLimited        = `rate_limited`
+	CodeAccountLocked      = `account_locked`
+	CodeQuotaExceeded      = `quota_exceeded`
+)
+
+// Error is a problem document returned by the server.
+type Error struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+
+	// RetryAfter is how long the server asked to wait, if it did.
+	RetryAfter time.Duration `json:"-"`
+}
+
+// FieldError tells what is wrong with one field of the request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf(`%d %s`, e.Status, e.Title)
+	if e.Detail != `` {
+		msg += `: ` + e.Detail
+	}
+	for _, f := range e.Errors {
+		msg += fmt.Sprintf(`; %s %s`, f.Field, f.Message)
+	}
+	return msg
+}
+
+// ErrorCode returns the code of the problem err wraps, or an empty string.
+func ErrorCode(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ``
+}
+
+// readError reads the problem document of a failed response and closes
+// the body. Responses from proxies that aren't problem documents keep
+// just their status.
+func readError(resp *http.Response) *Error {
+	defer resp.Body.Close()
+
+	e := &Error{}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if json.Unmarshal(body, e) != nil || e.Code == `` {
+		e = &Error{}
+	}
+
+	e.Status = resp.StatusCode
+	if e.Title == `` {
+		e.Title = http.StatusText(resp.StatusCode)
+	}
+	e.RetryAfter = retryAfter(resp.Header)
+	return e
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ListFiles returns one page of files. Sort is name (default), size or modified.
+func (c *Client) ListFiles(ctx context.Context, filter FileFilter, opts ListOptions) (Page[File], error) {
+	query := opts.values()
+	filter.addTo(query)
+
+	var page Page[File]
+	err := c.do(ctx, request{method: http.MethodGet, path: apiVersion + `/file/list`, query: query}, &page)
+	return page, err
+}
+
+// EachFile calls fn with every file matching the filter, page by page.
+// It stops at the first error of fn and returns it.
+func (c *Client) EachFile(ctx context.Context, filter FileFilter, opts ListOptions, fn func(File) error) error {
+	return each(opts, func(opts ListOptions) (Page[File], error) {
+		return c.ListFiles(ctx, filter, opts)
+	}, fn)
+}
+
+// MoveFile moves the file to the folder, creating missing folders.
+func (c *Client) MoveFile(ctx context.Context, id int64, folder string) (File, error) {
+	return c.patchFile(ctx, id, map[string]string{`folder`: folder})
+}
+
+func (c *Client) RenameFile(ctx context.Context, id int64, name string) (File, error) {
+	return c.patchFile(ctx, id, map[string]string{`filename`: name})
+}
+
+func (c *Client) patchFile(ctx context.Context, id int64, body map[string]string) (File, error) {
+	var f File
+	err := c.do(ctx, request{method: http.MethodPatch, path: pathf(`/file/%d`, id), body: body}, &f)
+	return f, err
+}
+
+// DeleteFile deletes the file and its shares.
+func (c *Client) DeleteFile(ctx context.Context, id int64) error {
+	return c.do(ctx, request{method: http.MethodDelete, path: pathf(`/file/%d`, id)}, nil)
+}
+
+// Changes returns the changes after the cursor. Without a cursor it
+// returns the cursor of the latest change, to be taken right after
+// listing the files. A positive wait, at most 10s, waits for a change
+// when there is none yet. An expired cursor fails with the code
+// CodeResyncRequired: list the files again and start over.
+func (c *Client) Changes(ctx context.Context, cursor string, wait time.Duration) (ChangeFeed, error) {
+	query := url.Values{}
+	if cursor != `` {
+		query.Set(`cursor`, cursor)
+	}
+	if wait > 0 {
+		query.Set(`wait`, wait.String())
+	}
+
+	var feed ChangeFeed
+	err := c.do(ctx, request{method: http.MethodGet, path: apiVersion + `/changes`, query: query}, &feed)
+	return feed, err
+}
+
+// Download writes the content of the file to w. A download that breaks
+// off is resumed where it stopped, as long as the file didn't change.
+func (c *Client) Download(ctx context.Context, id int64, w io.Writer) (int64, error) {
+	return c.download(ctx, request{method: http.MethodGet, path: pathf(`/file/%d/content`, id)}, w)
+}
+
+// DownloadRange returns length bytes of the file starting at offset,
+// or everything after offset when length is negative.
+func (c *Client) DownloadRange(ctx context.Context, id int64, offset, length int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if length < 0 {
+		header.Set(`Range`, fmt.Sprintf(`bytes=%d-`, offset))
+	} else {
+		header.Set(`Range`, fmt.Sprintf(`bytes=%d-%d`, offset, offset+length-1))
+	}
+
+	resp, err := c.send(ctx, request{method: http.MethodGet, path: pathf(`/file/%d/content`, id), header: header})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// download copies the response body of req to w, resuming with a range
+// request bound to the ETag when reading the body fails.
+func (c *Client) download(ctx context.Context, req request, w io.Writer) (written int64, err error) {
+	var etag string
+	for attempt := 0; ; attempt++ {
+		if written > 0 {
+			req.header = http.Header{}
+			req.header.Set(`Range`, fmt.Sprintf(`bytes=%d-`, written))
+			req.header.Set(`If-Range`, etag)
+		}
+
+		resp, err := c.send(ctx, req)
+		if err != nil {
+			return written, err
+		}
+		if written > 0 && resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			return written, fmt.Errorf(`client: %s changed during the download`, req.path)
+		}
+
+		etag = resp.Header.Get(`ETag`)
+		body := &bodyReader{r: resp.Body}
+		n, err := io.Copy(w, body)
+		resp.Body.Close()
+		written += n
+
+		switch {
+		case err == nil:
+			return written, nil
+		case body.err == nil, etag == ``, attempt >= c.retries, !retryable(ctx, body.err):
+			// Writing failed, or the download can't be resumed.
+			return written, err
+		}
+
+		if err = c.wait(ctx, attempt, 0); err != nil {
+			return written, err
+		}
+	}
+}
+
+// bodyReader remembers read errors, telling them apart from write errors.
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// Folders returns the folders directly inside parent, the root if empty.
+func (c *Client) Folders(ctx context.Context, parent string) ([]Folder, error) {
+	query := url.Values{}
+	if parent != `` {
+		query.Set(`parent`, parent)
+	}
+
+	var folders []Folder
+	err := c.do(ctx, request{method: http.MethodGet, path: apiVersion + `/folders`, query: query}, &folders)
+	return folders, err
+}
+
+// CreateFolder creates the folder and its missing parents.
+// It returns the folder if it exists already.
+func (c *Client) CreateFolder(ctx context.Context, path string) (Folder, error) {
+	var f Folder
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   apiVersion + `/folders`,
+		body:   map[string]string{`path`: path},
+	}, &f)
+	return f, err
+}
+
+// DeleteFolder deletes an empty folder.
+func (c *Client) DeleteFolder(ctx context.Context, id int64) error {
+	return c.do(ctx, request{method: http.MethodDelete, path: pathf(`/folders/%d`, id)}, nil)
+}
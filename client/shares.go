@@ -0,0 +1,69 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Shares returns one page of shares, only those of the file
+// unless fileID is zero.
+func (c *Client) Shares(ctx context.Context, fileID int64, opts ListOptions) (Page[Share], error) {
+	query := opts.values()
+	if fileID != 0 {
+		query.Set(`file_id`, strconv.FormatInt(fileID, 10))
+	}
+
+	var page Page[Share]
+	err := c.do(ctx, request{method: http.MethodGet, path: apiVersion + `/shares`, query: query}, &page)
+	return page, err
+}
+
+// CreateShare makes a public link to the file. It never expires
+// when ttl is zero.
+func (c *Client) CreateShare(ctx context.Context, fileID int64, ttl time.Duration) (ShareLink, error) {
+	req := map[string]any{`file_id`: fileID}
+	if ttl > 0 {
+		req[`expires_in`] = ttl.String()
+	}
+
+	var link ShareLink
+	err := c.do(ctx, request{method: http.MethodPost, path: apiVersion + `/shares`, body: req}, &link)
+	return link, err
+}
+
+func (c *Client) DeleteShare(ctx context.Context, id int64) error {
+	return c.do(ctx, request{method: http.MethodDelete, path: pathf(`/shares/%d`, id)}, nil)
+}
+
+// SharedFile describes the file behind the token of a share link.
+// It needs no login.
+func (c *Client) SharedFile(ctx context.Context, token string) (SharedFile, error) {
+	var f SharedFile
+	err := c.do(ctx, request{method: http.MethodGet, path: pathf(`/s/%s/info`, token), public: true}, &f)
+	return f, err
+}
+
+// DownloadShared writes the file behind the token of a share link to w.
+// It needs no login.
+func (c *Client) DownloadShared(ctx context.Context, token string, w io.Writer) (int64, error) {
+	return c.download(ctx, request{method: http.MethodGet, path: pathf(`/s/%s`, token), public: true}, w)
+}
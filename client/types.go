@@ -0,0 +1,268 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Token is a session: a short lived access token and the refresh token
+// that trades for the next pair.
+type Token struct {
+	Login        string `json:"login"`
+	Token        string `json:"token"`
+	Expires      string `json:"expires"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// ExpiresAt returns when the access token expires, or the zero time
+// if the server didn't say.
+func (t Token) ExpiresAt() time.Time {
+	expires, _ := http.ParseTime(t.Expires)
+	return expires
+}
+
+type User struct {
+	ID            int64  `json:"id"`
+	Login         string `json:"login"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified"`
+	Status        string `json:"status"`
+	Role          string `json:"role"`
+	Disabled      bool   `json:"disabled"`
+	Quota         int64  `json:"quota"` // bytes, 0 is unlimited
+	Usage         *Usage `json:"usage,omitempty"`
+}
+
+type Usage struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// Registration holds what Register needs. Email and Invite are optional,
+// depending on the configuration of the server.
+type Registration struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+	Email    string `json:"email,omitempty"`
+	Invite   string `json:"invite,omitempty"`
+}
+
+type PersonalToken struct {
+	ID         int64     `json:"id"`
+	Name       string    `json:"name"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at,omitempty"`
+	LastUsedAt time.Time `json:"last_used_at,omitempty"`
+}
+
+type AppPassword struct {
+	ID         int64     `json:"id"`
+	Name       string    `json:"name"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at,omitempty"`
+}
+
+type AccessKey struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	AccessKeyID string    `json:"access_key_id"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastUsedAt  time.Time `json:"last_used_at,omitempty"`
+}
+
+type SSHKey struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	PublicKey   string    `json:"public_key"`
+	Fingerprint string    `json:"fingerprint"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastUsedAt  time.Time `json:"last_used_at,omitempty"`
+}
+
+type File struct {
+	ID         int64     `json:"id"`
+	Folder     string    `json:"folder"`
+	Name       string    `json:"filename"`
+	Checksum   string    `json:"checksum"` // hex encoded SHA-256
+	Size       int64     `json:"size"`
+	MimeType   string    `json:"mime_type"`
+	ModifiedAt time.Time `json:"modified_at"`
+}
+
+type Folder struct {
+	ID        int64     `json:"id"`
+	Parent    string    `json:"parent"`
+	Name      string    `json:"name"`
+	Path      string    `json:"path"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Upload is a resumable upload. Offset is the number of bytes received.
+// Change is a file after it was created, updated, moved or deleted.
+// Moves also tell where the file was.
+type Change struct {
+	Seq       int64     `json:"seq"`
+	Op        string    `json:"op"` // create, update, move or delete
+	FileID    int64     `json:"file_id"`
+	FolderID  int64     `json:"folder_id,omitempty"` // set for changes of folders
+	Folder    string    `json:"folder"`
+	Name      string    `json:"filename"`
+	OldFolder string    `json:"old_folder,omitempty"`
+	OldName   string    `json:"old_filename,omitempty"`
+	Checksum  string    `json:"checksum"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ChangeFeed is the changes after a cursor, oldest first. Pass Cursor
+// to the next call; HasMore means more changes are waiting.
+type ChangeFeed struct {
+	Changes []Change `json:"changes"`
+	Cursor  string   `json:"cursor"`
+	HasMore bool     `json:"has_more"`
+}
+
+type Upload struct {
+	ID        string    `json:"id"`
+	Folder    string    `json:"folder"`
+	Name      string    `json:"filename"`
+	MimeType  string    `json:"mime_type"`
+	Size      int64     `json:"size"`
+	Offset    int64     `json:"offset"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type Share struct {
+	ID        int64     `json:"id"`
+	FileID    int64     `json:"file_id"`
+	Downloads int64     `json:"downloads"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+// ShareLink is a new share. The token can't be read again later.
+type ShareLink struct {
+	Token string `json:"token"`
+	URL   string `json:"url"`
+	Share Share  `json:"share"`
+}
+
+// SharedFile is what anyone with the link sees of a shared file.
+type SharedFile struct {
+	Name       string    `json:"filename"`
+	Size       int64     `json:"size"`
+	MimeType   string    `json:"mime_type"`
+	ModifiedAt time.Time `json:"modified_at"`
+	ExpiresAt  time.Time `json:"expires_at,omitempty"`
+}
+
+type Invite struct {
+	ID        int64     `json:"id"`
+	MaxUses   int       `json:"max_uses"` // 0 is unlimited
+	Uses      int       `json:"uses"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedBy int64     `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Page is one page of a listing. NextCursor is empty on the last page.
+type Page[T any] struct {
+	Items      []T    `json:"items"`
+	Total      int64  `json:"total"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// ListOptions select a page of a listing. The zero value is the
+// first page in the default order.
+type ListOptions struct {
+	Limit  int
+	Cursor string
+	Sort   string
+	Desc   bool
+}
+
+func (o ListOptions) values() url.Values {
+	v := url.Values{}
+	if o.Limit > 0 {
+		v.Set(`limit`, strconv.Itoa(o.Limit))
+	}
+	if o.Cursor != `` {
+		v.Set(`cursor`, o.Cursor)
+	}
+	if o.Sort != `` {
+		v.Set(`sort`, o.Sort)
+	}
+	if o.Desc {
+		v.Set(`order`, `desc`)
+	}
+	return v
+}
+
+// FileFilter narrows ListFiles down. Zero fields match every file.
+type FileFilter struct {
+	Folder         string
+	MimePrefix     string
+	MinSize        *int64
+	MaxSize        *int64
+	ModifiedAfter  time.Time
+	ModifiedBefore time.Time
+}
+
+func (f FileFilter) addTo(v url.Values) {
+	if f.Folder != `` {
+		v.Set(`folder`, f.Folder)
+	}
+	if f.MimePrefix != `` {
+		v.Set(`mime`, f.MimePrefix)
+	}
+	if f.MinSize != nil {
+		v.Set(`min_size`, strconv.FormatInt(*f.MinSize, 10))
+	}
+	if f.MaxSize != nil {
+		v.Set(`max_size`, strconv.FormatInt(*f.MaxSize, 10))
+	}
+	if !f.ModifiedAfter.IsZero() {
+		v.Set(`modified_after`, f.ModifiedAfter.Format(time.RFC3339Nano))
+	}
+	if !f.ModifiedBefore.IsZero() {
+		v.Set(`modified_before`, f.ModifiedBefore.Format(time.RFC3339Nano))
+	}
+}
+
+// each calls fn with every item of a listing, fetching page after page.
+func each[T any](opts ListOptions, list func(ListOptions) (Page[T], error), fn func(T) error) error {
+	for {
+		page, err := list(opts)
+		if err != nil {
+			return err
+		}
+		for _, item := range page.Items {
+			if err = fn(item); err != nil {
+				return err
+			}
+		}
+		if page.NextCursor == `` {
+			return nil
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// UploadOptions say where an upload goes. MimeType is guessed by the
+// server from the name when empty.
+type UploadOptions struct {
+	Folder   string
+	Name     string
+	MimeType string
+}
+
+// Upload streams size bytes of r to a new file in chunks. Chunks that
+// fail are sent again, so a flaky connection doesn't restart the upload.
+func (c *Client) Upload(ctx context.Context, r io.Reader, size int64, opts UploadOptions) (File, error) {
+	u, err := c.CreateUpload(ctx, size, opts)
+	if err != nil {
+		return File{}, err
+	}
+	return c.sendUpload(ctx, u, r)
+}
+
+// UploadFile uploads the local file into the folder under its own name.
+func (c *Client) UploadFile(ctx context.Context, name, folder string) (File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return File{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return File{}, err
+	}
+
+	return c.Upload(ctx, f, info.Size(), UploadOptions{Folder: folder, Name: filepath.Base(name)})
+}
+
+// CreateUpload starts a resumable upload. Send the content with
+// ResumeUpload, also after the program restarted, until the upload expires.
+func (c *Client) CreateUpload(ctx context.Context, size int64, opts UploadOptions) (Upload, error) {
+	var u Upload
+	err := c.do(ctx, request{
+		method: http.MethodPost,
+		path:   apiVersion + `/uploads`,
+		body: map[string]any{
+			`folder`:    opts.Folder,
+			`filename`:  opts.Name,
+			`mime_type`: opts.MimeType,
+			`size`:      size,
+		},
+	}, &u)
+	return u, err
+}
+
+// GetUpload returns the upload, whose Offset tells how much was received.
+func (c *Client) GetUpload(ctx context.Context, id string) (Upload, error) {
+	var u Upload
+	err := c.do(ctx, request{method: http.MethodGet, path: pathf(`/uploads/%s`, id)}, &u)
+	return u, err
+}
+
+// ResumeUpload sends the rest of the upload, reading it from r
+// after seeking to what the server already received.
+func (c *Client) ResumeUpload(ctx context.Context, id string, r io.ReadSeeker) (File, error) {
+	u, err := c.GetUpload(ctx, id)
+	if err != nil {
+		return File{}, err
+	}
+
+	if _, err = r.Seek(u.Offset, io.SeekStart); err != nil {
+		return File{}, err
+	}
+	return c.sendUpload(ctx, u, r)
+}
+
+func (c *Client) CancelUpload(ctx context.Context, id string) error {
+	return c.do(ctx, request{method: http.MethodDelete, path: pathf(`/uploads/%s`, id)}, nil)
+}
+
+// sendUpload sends the content from r, which starts at the offset of the
+// upload, chunk by chunk. After a failure the server is asked what it
+// received, and the chunk is sent again from there.
+func (c *Client) sendUpload(ctx context.Context, u Upload, r io.Reader) (File, error) {
+	var (
+		buf     = make([]byte, c.chunkSize)
+		chunk   []byte // read from r but not yet received by the server
+		chunkAt = u.Offset
+		offset  = u.Offset
+		fails   int
+	)
+
+	for {
+		if offset == chunkAt+int64(len(chunk)) {
+			n := c.chunkSize
+			if left := u.Size - offset; left < n {
+				n = left
+			}
+			m, err := io.ReadFull(r, buf[:n])
+			if err != nil && n > 0 {
+				return File{}, fmt.Errorf(`client: reading the upload: %w`, err)
+			}
+			chunk, chunkAt = buf[:m], offset
+		}
+
+		res, err := c.appendUpload(ctx, u.ID, offset, chunk[offset-chunkAt:])
+		if err == nil {
+			if res.File != nil {
+				return *res.File, nil
+			}
+			offset, fails = res.Upload.Offset, 0
+			continue
+		}
+
+		if fails >= c.retries || !resumable(ctx, err) {
+			return File{}, err
+		}
+		fails++
+		if err = c.wait(ctx, fails-1, 0); err != nil {
+			return File{}, err
+		}
+
+		current, err := c.GetUpload(ctx, u.ID)
+		if err != nil {
+			return File{}, err
+		}
+		if current.Offset < chunkAt || current.Offset > chunkAt+int64(len(chunk)) {
+			return File{}, fmt.Errorf(`client: upload %s is at %d, outside the chunk at %d`, u.ID, current.Offset, chunkAt)
+		}
+		offset = current.Offset
+	}
+}
+
+type uploadResult struct {
+	Upload Upload `json:"upload"`
+	File   *File  `json:"file,omitempty"`
+}
+
+func (c *Client) appendUpload(ctx context.Context, id string, offset int64, data []byte) (uploadResult, error) {
+	header := http.Header{}
+	header.Set(`Content-Type`, `application/offset+octet-stream`)
+	header.Set(`Upload-Offset`, strconv.FormatInt(offset, 10))
+
+	if data == nil {
+		data = []byte{}
+	}
+
+	var res uploadResult
+	err := c.do(ctx, request{
+		method: http.MethodPatch,
+		path:   pathf(`/uploads/%s`, id),
+		header: header,
+		raw:    data,
+	}, &res)
+	return res, err
+}
+
+// resumable tells whether asking for the offset and sending the rest
+// may help: the connection broke, the server failed, or the offset
+// was off because an earlier response got lost.
+func resumable(ctx context.Context, err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		switch e.Status {
+		case http.StatusConflict, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	return retryable(ctx, err)
+}
@@ -0,0 +1,358 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+
+	"server/client"
+
+	"golang.org/x/term"
+)
+
+const dateFormat = `2006-01-02 15:04`
+
+func loginCmd(ctx context.Context, a *app, args []string) error {
+	fs := flags(`login`)
+	token := fs.String(`token`, ``, `use a personal token instead of a password`)
+	passwordStdin := fs.Bool(`password-stdin`, false, `read the password from the standard input`)
+	if err := parse(fs, args, 1, 2); err != nil {
+		return err
+	}
+
+	cfg := config{Server: strings.TrimSuffix(fs.Arg(0), `/`)}
+	if *token != `` {
+		cfg.PersonalToken = *token
+		u, err := client.New(cfg.Server, client.WithPersonalToken(cfg.PersonalToken)).Me(ctx)
+		if err != nil {
+			return err
+		}
+		return a.loggedIn(cfg, u.Login)
+	}
+
+	login := fs.Arg(1)
+	if login == `` {
+		return usageError{errors.New(`login requires LOGIN unless -token is given`)}
+	}
+
+	password, err := readPassword(a, *passwordStdin)
+	if err != nil {
+		return err
+	}
+
+	session, err := client.New(cfg.Server).Login(ctx, login, password)
+	if err != nil {
+		return err
+	}
+	cfg.Session = &session
+	return a.loggedIn(cfg, login)
+}
+
+func (a *app) loggedIn(cfg config, login string) error {
+	a.mu.Lock()
+	a.cfg = cfg
+	err := cfg.save(a.configPath)
+	a.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return a.print(map[string]string{`server`: cfg.Server, `login`: login}, func(w io.Writer) {
+		fmt.Fprintf(w, "Logged in to %s as %s\n", cfg.Server, login)
+	})
+}
+
+// readPassword prompts on the terminal without echo,
+// or reads the first line of the standard input.
+func readPassword(a *app, fromStdin bool) (string, error) {
+	if !fromStdin {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return ``, usageError{errors.New(`no terminal to ask for the password, use -password-stdin`)}
+		}
+		fmt.Fprint(a.stderr, `Password: `)
+		b, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(a.stderr)
+		return string(b), err
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return ``, err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func logoutCmd(ctx context.Context, a *app, args []string) error {
+	if err := parse(flags(`logout`), args, 0, 0); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cfg = config{}
+	err := os.Remove(a.configPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// listing is what ls prints for one argument.
+type listing struct {
+	Path    string          `json:"path"`
+	Folders []client.Folder `json:"folders"`
+	Files   []client.File   `json:"files"`
+}
+
+func lsCmd(ctx context.Context, a *app, args []string) error {
+	fs := flags(`ls`)
+	long := fs.Bool(`l`, false, `show sizes, dates and ids`)
+	if err := parse(fs, args, 0, -1); err != nil {
+		return err
+	}
+
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+
+	paths := fs.Args()
+	if len(paths) == 0 {
+		paths = []string{`/`}
+	}
+
+	var listings []listing
+	for _, p := range paths {
+		l, err := list(ctx, c, p)
+		if err != nil {
+			return err
+		}
+		listings = append(listings, l)
+	}
+
+	return a.print(listings, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+		for i, l := range listings {
+			if len(listings) > 1 {
+				if i > 0 {
+					fmt.Fprintln(tw)
+				}
+				fmt.Fprintf(tw, "%s:\n", l.Path)
+			}
+			for _, f := range l.Folders {
+				if *long {
+					fmt.Fprintf(tw, "\t-\t%s\t%d\t %s/\n", f.CreatedAt.Local().Format(dateFormat), f.ID, f.Name)
+				} else {
+					fmt.Fprintf(tw, "%s/\n", f.Name)
+				}
+			}
+			for _, f := range l.Files {
+				if *long {
+					fmt.Fprintf(tw, "\t%s\t%s\t%d\t %s\n", formatSize(f.Size), f.ModifiedAt.Local().Format(dateFormat), f.ID, f.Name)
+				} else {
+					fmt.Fprintf(tw, "%s\n", f.Name)
+				}
+			}
+		}
+		tw.Flush()
+	})
+}
+
+// list returns the contents of a folder, or the files a glob matches.
+func list(ctx context.Context, c *client.Client, p string) (l listing, err error) {
+	p = cleanPath(p)
+	l = listing{Path: p, Folders: []client.Folder{}, Files: []client.File{}}
+
+	if isGlob(path.Base(p)) {
+		l.Files, err = expand(ctx, c, p)
+		return l, err
+	}
+
+	folders, err := c.Folders(ctx, p)
+	if err != nil {
+		return l, err
+	}
+	l.Folders = append(l.Folders, folders...)
+	err = c.EachFile(ctx, client.FileFilter{Folder: p}, client.ListOptions{Limit: 1000}, func(f client.File) error {
+		l.Files = append(l.Files, f)
+		return nil
+	})
+	return l, err
+}
+
+func rmCmd(ctx context.Context, a *app, args []string) error {
+	fs := flags(`rm`)
+	force := fs.Bool(`f`, false, `ignore paths that match nothing`)
+	if err := parse(fs, args, 1, -1); err != nil {
+		return err
+	}
+
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+
+	var removed []client.File
+	for _, p := range fs.Args() {
+		files, err := expand(ctx, c, p)
+		if *force && exitCode(err) == exitNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			if err = c.DeleteFile(ctx, f.ID); err != nil {
+				return fmt.Errorf(`%s: %w`, path.Join(f.Folder, f.Name), err)
+			}
+			removed = append(removed, f)
+		}
+	}
+
+	return a.print(removed, func(w io.Writer) {
+		for _, f := range removed {
+			fmt.Fprintf(w, "removed %s\n", path.Join(f.Folder, f.Name))
+		}
+	})
+}
+
+// mvCmd renames one file, or moves files into the folder DEST when
+// it ends with a slash, already exists, or more files are given.
+func mvCmd(ctx context.Context, a *app, args []string) error {
+	fs := flags(`mv`)
+	if err := parse(fs, args, 2, -1); err != nil {
+		return err
+	}
+
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+
+	srcs, dest := fs.Args()[:fs.NArg()-1], fs.Arg(fs.NArg()-1)
+	var files []client.File
+	for _, p := range srcs {
+		matched, err := expand(ctx, c, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, matched...)
+	}
+
+	intoFolder := strings.HasSuffix(dest, `/`) || len(files) > 1
+	dest = cleanPath(dest)
+	if !intoFolder {
+		if intoFolder, err = folderExists(ctx, c, dest); err != nil {
+			return err
+		}
+	}
+
+	var moved []client.File
+	for _, f := range files {
+		folder, name := dest, f.Name
+		if !intoFolder {
+			folder, name = path.Dir(dest), path.Base(dest)
+		}
+
+		if folder != f.Folder {
+			if f, err = c.MoveFile(ctx, f.ID, folder); err != nil {
+				return err
+			}
+		}
+		if name != f.Name {
+			if f, err = c.RenameFile(ctx, f.ID, name); err != nil {
+				return err
+			}
+		}
+		moved = append(moved, f)
+	}
+
+	return a.print(moved, func(w io.Writer) {
+		for _, f := range moved {
+			fmt.Fprintf(w, "moved to %s\n", path.Join(f.Folder, f.Name))
+		}
+	})
+}
+
+func shareCmd(ctx context.Context, a *app, args []string) error {
+	fs := flags(`share`)
+	expires := fs.Duration(`expires`, 0, `how long the link works, like 72h; forever by default`)
+	if err := parse(fs, args, 1, 1); err != nil {
+		return err
+	}
+
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+
+	files, err := expand(ctx, c, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if len(files) > 1 {
+		return usageError{fmt.Errorf(`%s matches %d files, share one at a time`, fs.Arg(0), len(files))}
+	}
+
+	link, err := c.CreateShare(ctx, files[0].ID, *expires)
+	if err != nil {
+		return err
+	}
+
+	return a.print(link, func(w io.Writer) {
+		fmt.Fprintln(w, link.URL)
+	})
+}
+
+func quotaCmd(ctx context.Context, a *app, args []string) error {
+	if err := parse(flags(`quota`), args, 0, 0); err != nil {
+		return err
+	}
+
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+
+	u, err := c.Me(ctx)
+	if err != nil {
+		return err
+	}
+
+	usage := client.Usage{}
+	if u.Usage != nil {
+		usage = *u.Usage
+	}
+
+	return a.print(map[string]int64{`used`: usage.Bytes, `files`: usage.Files, `quota`: u.Quota}, func(w io.Writer) {
+		if u.Quota == 0 {
+			fmt.Fprintf(w, "%s used in %d files, no quota\n", formatSize(usage.Bytes), usage.Files)
+			return
+		}
+		fmt.Fprintf(w, "%s of %s used (%.0f%%) in %d files\n",
+			formatSize(usage.Bytes), formatSize(u.Quota), float64(usage.Bytes)*100/float64(u.Quota), usage.Files)
+	})
+}
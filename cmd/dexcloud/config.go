@@ -0,0 +1,88 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"server/client"
+)
+
+// config holds the saved credentials. Sessions are refreshed as they
+// are used, so the file is rewritten now and then.
+type config struct {
+	Server        string        `json:"server"`
+	Session       *client.Token `json:"session,omitempty"`
+	PersonalToken string        `json:"personal_token,omitempty"`
+}
+
+// defaultConfigPath is $DEXCLOUD_CONFIG, or dexcloud/config.json in the
+// user config directory, like ~/.config on Linux.
+func defaultConfigPath() string {
+	if p := os.Getenv(`DEXCLOUD_CONFIG`); p != `` {
+		return p
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = `.`
+	}
+	return filepath.Join(dir, `dexcloud`, `config.json`)
+}
+
+// loadConfig returns an empty config if the file doesn't exist yet.
+func loadConfig(name string) (cfg config, err error) {
+	b, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return config{}, nil
+	}
+	if err != nil {
+		return config{}, err
+	}
+	return cfg, json.Unmarshal(b, &cfg)
+}
+
+// save writes the config readable by the owner only. It replaces
+// the file at once, so a crash never leaves half of it.
+func (cfg config) save(name string) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0o700); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(cfg, ``, `  `)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), `.config-*`)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
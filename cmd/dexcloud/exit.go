@@ -0,0 +1,105 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+
+	"server/client"
+)
+
+// Exit codes. Scripts can tell the common failures apart
+// without parsing the output.
+const (
+	exitOK          = 0
+	exitFailure     = 1 // anything not listed below
+	exitUsage       = 2 // wrong flags or arguments
+	exitAuth        = 3 // not logged in, bad credentials or expired session
+	exitForbidden   = 4 // the account may not do this
+	exitNotFound    = 5 // no such file, folder or link
+	exitConflict    = 6 // the resource exists or changed
+	exitInvalid     = 7 // the server rejected the request
+	exitRateLimited = 8 // too many attempts, try later
+	exitQuota       = 9 // the storage quota is full
+)
+
+// exitCodes maps the codes of the API errors, see docs/errors.md.
+var exitCodes = map[string]int{
+	`unauthorized`:           exitAuth,
+	`invalid_credentials`:    exitAuth,
+	`invalid_token`:          exitAuth,
+	`forbidden`:              exitForbidden,
+	`wrong_password`:         exitForbidden,
+	`account_disabled`:       exitForbidden,
+	`account_pending`:        exitForbidden,
+	`registration_closed`:    exitForbidden,
+	`invalid_invite`:         exitForbidden,
+	`not_found`:              exitNotFound,
+	`conflict`:               exitConflict,
+	`login_taken`:            exitConflict,
+	`email_taken`:            exitConflict,
+	`resync_required`:        exitConflict,
+	`bad_request`:            exitInvalid,
+	`invalid_json`:           exitInvalid,
+	`validation_failed`:      exitInvalid,
+	`weak_password`:          exitInvalid,
+	`payload_too_large`:      exitInvalid,
+	`unsupported_media_type`: exitInvalid,
+	`rate_limited`:           exitRateLimited,
+	`account_locked`:         exitRateLimited,
+	`quota_exceeded`:         exitQuota,
+}
+
+// usageError is a mistake in the command line.
+type usageError struct{ err error }
+
+// errUsage is a usageError the flag package already explained.
+var errUsage = usageError{errors.New(`usage`)}
+
+func (e usageError) Error() string { return e.err.Error() }
+
+// exitError fails with a code of its own, for errors found by the
+// command rather than the server.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+func exitCode(err error) int {
+	var (
+		usageErr usageError
+		exitErr  *exitError
+	)
+	switch {
+	case errors.As(err, &usageErr):
+		return exitUsage
+	case errors.As(err, &exitErr):
+		return exitErr.code
+	case errors.Is(err, client.ErrNotLoggedIn):
+		return exitAuth
+	case errors.Is(err, client.ErrPendingApproval):
+		return exitForbidden
+	}
+
+	if code, ok := exitCodes[client.ErrorCode(err)]; ok {
+		return code
+	}
+	return exitFailure
+}
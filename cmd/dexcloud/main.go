@@ -0,0 +1,238 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command dexcloud uploads, downloads and manages files on a DexCloud
+// server from the shell. Run it without arguments for the commands.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+
+	"server/client"
+
+	"golang.org/x/term"
+)
+
+// command is a subcommand like ls or put. It parses its own flags.
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(ctx context.Context, a *app, args []string) error
+}
+
+var commands []command
+
+// The list is filled in init because the commands print it in their usage.
+func init() {
+	commands = []command{
+		{`login`, `[-token TOKEN] [-password-stdin] SERVER [LOGIN]`, `log in and save the credentials`, loginCmd},
+		{`logout`, ``, `forget the saved credentials`, logoutCmd},
+		{`ls`, `[-l] [PATH|GLOB]...`, `list folders and files`, lsCmd},
+		{`put`, `[-r] [-j N] [-to FOLDER] LOCAL...`, `upload files and directories`, putCmd},
+		{`get`, `[-j N] [-o DIR] PATH|GLOB...`, `download files`, getCmd},
+		{`rm`, `[-f] PATH|GLOB...`, `delete files`, rmCmd},
+		{`mv`, `PATH|GLOB... DEST`, `rename a file or move files to a folder`, mvCmd},
+		{`share`, `[-expires DURATION] PATH`, `create a public link to a file`, shareCmd},
+		{`quota`, ``, `show the used storage and the quota`, quotaCmd},
+		{`sync`, `[-once] [-interval DURATION] LOCAL REMOTE`, `keep a local directory and a folder in sync`, syncCmd},
+	}
+}
+
+// app is the state shared by the commands.
+type app struct {
+	json       bool
+	quiet      bool
+	configPath string
+
+	mu  sync.Mutex
+	cfg config
+
+	stdout io.Writer
+	stderr *os.File
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	a := &app{stdout: os.Stdout, stderr: os.Stderr}
+
+	fs := flag.NewFlagSet(`dexcloud`, flag.ContinueOnError)
+	fs.BoolVar(&a.json, `json`, false, `print results as JSON`)
+	fs.BoolVar(&a.quiet, `q`, false, `don't show progress`)
+	fs.StringVar(&a.configPath, `config`, defaultConfigPath(), `file the credentials are saved in`)
+	fs.Usage = func() { usage(fs) }
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if fs.NArg() == 0 {
+		usage(fs)
+		return exitUsage
+	}
+
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == fs.Arg(0) {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(a.stderr, "dexcloud: unknown command %q\n", fs.Arg(0))
+		usage(fs)
+		return exitUsage
+	}
+
+	cfg, err := loadConfig(a.configPath)
+	if err != nil {
+		return a.fail(err)
+	}
+	a.cfg = cfg
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err = cmd.run(ctx, a, fs.Args()[1:]); err != nil {
+		return a.fail(err)
+	}
+	return exitOK
+}
+
+func usage(fs *flag.FlagSet) {
+	w := fs.Output()
+	fmt.Fprintf(w, "Usage: dexcloud [-json] [-q] [-config FILE] COMMAND [ARGS]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-7s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(w, "\nRun dexcloud COMMAND -h for the arguments of a command.\n\nFlags:\n")
+	fs.PrintDefaults()
+}
+
+// flags returns the flag set of the command, whose usage
+// prints the arguments of the command.
+func flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		for _, cmd := range commands {
+			if cmd.name == name {
+				fmt.Fprintf(fs.Output(), "Usage: dexcloud %s %s\n\n%s.\n", name, cmd.args, strings.ToUpper(cmd.summary[:1])+cmd.summary[1:])
+			}
+		}
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parse parses the flags of a command and checks the number of arguments.
+func parse(fs *flag.FlagSet, args []string, min, max int) error {
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if n := fs.NArg(); n < min || (max >= 0 && n > max) {
+		fs.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+// client returns a client authenticated with the saved credentials,
+// or with the DEXCLOUD_SERVER and DEXCLOUD_TOKEN variables if set.
+func (a *app) client() (*client.Client, error) {
+	a.mu.Lock()
+	cfg := a.cfg
+	a.mu.Unlock()
+
+	if s := os.Getenv(`DEXCLOUD_SERVER`); s != `` {
+		cfg.Server = s
+	}
+	if t := os.Getenv(`DEXCLOUD_TOKEN`); t != `` {
+		cfg.PersonalToken, cfg.Session = t, nil
+	}
+
+	if cfg.Server == `` || (cfg.PersonalToken == `` && cfg.Session == nil) {
+		return nil, client.ErrNotLoggedIn
+	}
+
+	opts := []client.Option{client.OnTokenRefresh(a.saveSession)}
+	if cfg.PersonalToken != `` {
+		opts = append(opts, client.WithPersonalToken(cfg.PersonalToken))
+	} else {
+		opts = append(opts, client.WithSession(*cfg.Session))
+	}
+	return client.New(cfg.Server, opts...), nil
+}
+
+// saveSession saves a refreshed session, the old refresh token is spent.
+func (a *app) saveSession(t client.Token) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.cfg.Session = &t
+	if err := a.cfg.save(a.configPath); err != nil {
+		fmt.Fprintf(a.stderr, "dexcloud: saving the session: %v\n", err)
+	}
+}
+
+// print writes v as JSON in JSON mode, else calls human.
+func (a *app) print(v any, human func(w io.Writer)) error {
+	if a.json {
+		enc := json.NewEncoder(a.stdout)
+		enc.SetIndent(``, `  `)
+		return enc.Encode(v)
+	}
+	human(a.stdout)
+	return nil
+}
+
+// fail reports the error and returns the exit code for it.
+func (a *app) fail(err error) int {
+	code := exitCode(err)
+	if errors.Is(err, errUsage) {
+		return code
+	}
+
+	if a.json {
+		json.NewEncoder(a.stderr).Encode(map[string]any{
+			`error`: err.Error(),
+			`code`:  client.ErrorCode(err),
+			`exit`:  code,
+		})
+		return code
+	}
+
+	msg := err.Error()
+	if errors.Is(err, client.ErrNotLoggedIn) {
+		msg = `not logged in, run dexcloud login first`
+	}
+	fmt.Fprintf(a.stderr, "dexcloud: %s\n", msg)
+	return code
+}
+
+// showProgress tells whether progress bars go to the terminal.
+func (a *app) showProgress() bool {
+	return !a.quiet && term.IsTerminal(int(a.stderr.Fd()))
+}
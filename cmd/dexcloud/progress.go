@@ -0,0 +1,164 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progress draws a bar of the bytes and files transferred on the
+// terminal, and prints the reports of finished transfers above it.
+type progress struct {
+	out   io.Writer // reports, nil in JSON mode
+	term  *os.File  // the bar, nil when not drawn
+	total int64
+	files int
+
+	bytes     atomic.Int64
+	filesDone atomic.Int64
+
+	mu   sync.Mutex
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (a *app) newProgress(total int64, files int) *progress {
+	p := &progress{total: total, files: files}
+	if !a.json {
+		p.out = a.stdout
+	}
+	if !a.showProgress() {
+		return p
+	}
+
+	p.term = a.stderr
+	p.stop = make(chan struct{})
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				p.mu.Lock()
+				p.draw()
+				p.mu.Unlock()
+			}
+		}
+	}()
+	return p
+}
+
+// reader counts the bytes read from r.
+func (p *progress) reader(r io.Reader) io.Reader {
+	return &countingReader{r: r, n: &p.bytes}
+}
+
+// writer counts the bytes written to w.
+func (p *progress) writer(w io.Writer) io.Writer {
+	return &countingWriter{w: w, n: &p.bytes}
+}
+
+// done reports a finished transfer.
+func (p *progress) done(format string, args ...any) {
+	p.filesDone.Add(1)
+	if p.out != nil {
+		p.print(p.out, format, args...)
+	}
+}
+
+// log reports a failure.
+func (p *progress) log(format string, args ...any) {
+	p.print(os.Stderr, format, args...)
+}
+
+func (p *progress) print(w io.Writer, format string, args ...any) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.clear()
+	fmt.Fprintf(w, format+"\n", args...)
+	p.draw()
+}
+
+// finish stops drawing and removes the bar.
+func (p *progress) finish() {
+	if p.term == nil {
+		return
+	}
+	close(p.stop)
+	p.wg.Wait()
+	p.clear()
+}
+
+func (p *progress) clear() {
+	if p.term != nil {
+		fmt.Fprint(p.term, "\r\x1b[K")
+	}
+}
+
+func (p *progress) draw() {
+	if p.term == nil {
+		return
+	}
+
+	const width = 30
+	n := p.bytes.Load()
+	fraction := 1.0
+	if p.total > 0 {
+		fraction = float64(n) / float64(p.total)
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	filled := int(fraction * width)
+
+	fmt.Fprintf(p.term, "\r\x1b[K[%s%s] %3.0f%%  %s / %s  %d/%d files",
+		strings.Repeat(`#`, filled), strings.Repeat(`.`, width-filled), fraction*100,
+		formatSize(n), formatSize(p.total), p.filesDone.Load(), p.files)
+}
+
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n.Add(int64(n))
+	return n, err
+}
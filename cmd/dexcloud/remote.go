@@ -0,0 +1,92 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"server/client"
+)
+
+// cleanPath turns a remote path into a clean absolute one.
+func cleanPath(p string) string {
+	return path.Clean(`/` + p)
+}
+
+func isGlob(p string) bool {
+	return strings.ContainsAny(p, `*?[`)
+}
+
+// expand returns the files a remote path names. The last element may
+// be a glob like *.jpg, folders above it have to be spelled out.
+func expand(ctx context.Context, c *client.Client, p string) ([]client.File, error) {
+	p = cleanPath(p)
+	folder, pattern := path.Dir(p), path.Base(p)
+	if _, err := path.Match(pattern, ``); err != nil {
+		return nil, usageError{fmt.Errorf(`%s: %w`, p, err)}
+	}
+
+	var files []client.File
+	err := c.EachFile(ctx, client.FileFilter{Folder: folder}, client.ListOptions{Limit: 1000}, func(f client.File) error {
+		if ok, _ := path.Match(pattern, f.Name); ok {
+			files = append(files, f)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, &exitError{exitNotFound, fmt.Errorf(`%s: no such file`, p)}
+	}
+	return files, nil
+}
+
+func folderExists(ctx context.Context, c *client.Client, p string) (bool, error) {
+	if p == `/` {
+		return true, nil
+	}
+
+	folders, err := c.Folders(ctx, path.Dir(p))
+	if err != nil {
+		return false, err
+	}
+	for _, f := range folders {
+		if f.Path == p {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf(`%d B`, n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf(`%.1f %ciB`, float64(n)/float64(div), `KMGTPE`[exp])
+}
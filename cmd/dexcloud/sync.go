@@ -0,0 +1,85 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"server/syncer"
+)
+
+func syncCmd(ctx context.Context, a *app, args []string) error {
+	flagSet := flags(`sync`)
+	once := flagSet.Bool(`once`, false, `make one pass and exit instead of watching`)
+	interval := flagSet.Duration(`interval`, 30*time.Second, `how often to look for changes on the server`)
+	if err := parse(flagSet, args, 2, 2); err != nil {
+		return err
+	}
+
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+
+	s, err := syncer.New(c, flagSet.Arg(0), cleanPath(flagSet.Arg(1)))
+	if errors.Is(err, syncer.ErrOtherRemote) {
+		return &exitError{exitConflict, err}
+	}
+	if err != nil {
+		return err
+	}
+	s.Report = a.reportChange
+
+	if *once {
+		return s.Sync(ctx)
+	}
+	return s.Watch(ctx, *interval)
+}
+
+var changeVerbs = map[syncer.Op]string{
+	syncer.Uploaded:      `uploaded`,
+	syncer.Downloaded:    `downloaded`,
+	syncer.DeletedLocal:  `deleted locally`,
+	syncer.DeletedRemote: `deleted on the server`,
+	syncer.Conflicted:    `changed on both sides, kept a conflict copy of`,
+}
+
+// reportChange prints a change of the sync as it happens,
+// one JSON object per line in JSON mode.
+func (a *app) reportChange(c syncer.Change) {
+	if a.json {
+		v := map[string]string{`op`: string(c.Op), `path`: c.Path}
+		if c.Err != nil {
+			v[`error`] = c.Err.Error()
+		}
+		json.NewEncoder(a.stdout).Encode(v)
+		return
+	}
+
+	switch {
+	case c.Err != nil && c.Path != ``:
+		fmt.Fprintf(a.stderr, "dexcloud: %s: %v\n", c.Path, c.Err)
+	case c.Err != nil:
+		fmt.Fprintf(a.stderr, "dexcloud: %v\n", c.Err)
+	default:
+		fmt.Fprintf(a.stdout, "%s %s\n", changeVerbs[c.Op], c.Path)
+	}
+}
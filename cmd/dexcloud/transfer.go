@@ -0,0 +1,287 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"server/client"
+)
+
+// upload is one local file and the remote folder it goes to.
+type upload struct {
+	local  string
+	folder string
+	size   int64
+}
+
+func putCmd(ctx context.Context, a *app, args []string) error {
+	flagSet := flags(`put`)
+	recursive := flagSet.Bool(`r`, false, `upload directories with everything in them`)
+	jobs := flagSet.Int(`j`, 4, `files to upload at the same time`)
+	to := flagSet.String(`to`, `/`, `remote folder to upload into`)
+	if err := parse(flagSet, args, 1, -1); err != nil {
+		return err
+	}
+
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+
+	uploads, err := collectUploads(flagSet.Args(), cleanPath(*to), *recursive)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, u := range uploads {
+		total += u.size
+	}
+
+	var (
+		mu       sync.Mutex
+		uploaded []client.File
+	)
+	p := a.newProgress(total, len(uploads))
+	err = parallel(ctx, *jobs, len(uploads), p, func(ctx context.Context, i int) error {
+		u := uploads[i]
+		f, err := os.Open(u.local)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		file, err := c.Upload(ctx, p.reader(f), u.size, client.UploadOptions{
+			Folder: u.folder,
+			Name:   filepath.Base(u.local),
+		})
+		if err != nil {
+			return fmt.Errorf(`%s: %w`, u.local, err)
+		}
+
+		mu.Lock()
+		uploaded = append(uploaded, file)
+		mu.Unlock()
+		p.done(`uploaded %s`, path.Join(file.Folder, file.Name))
+		return nil
+	})
+	p.finish()
+
+	return a.printTransfers(uploaded, err)
+}
+
+// collectUploads expands the arguments into files. Directories keep
+// their name and structure inside folder.
+func collectUploads(args []string, folder string, recursive bool) ([]upload, error) {
+	var uploads []upload
+	for _, arg := range args {
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, usageError{err}
+		}
+		if matches == nil {
+			// Not a pattern, or one that matched nothing: let Stat explain.
+			matches = []string{arg}
+		}
+
+		for _, local := range matches {
+			info, err := os.Stat(local)
+			if err != nil {
+				return nil, &exitError{exitNotFound, err}
+			}
+
+			if !info.IsDir() {
+				uploads = append(uploads, upload{local: local, folder: folder, size: info.Size()})
+				continue
+			}
+			if !recursive {
+				return nil, usageError{fmt.Errorf(`%s is a directory, use -r to upload it`, local)}
+			}
+
+			base := filepath.Dir(filepath.Clean(local))
+			err = filepath.WalkDir(local, func(name string, d fs.DirEntry, err error) error {
+				if err != nil || !d.Type().IsRegular() {
+					return err
+				}
+
+				info, err := d.Info()
+				if err != nil {
+					return err
+				}
+
+				rel, err := filepath.Rel(base, filepath.Dir(name))
+				if err != nil {
+					return err
+				}
+				uploads = append(uploads, upload{
+					local:  name,
+					folder: path.Join(folder, filepath.ToSlash(rel)),
+					size:   info.Size(),
+				})
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return uploads, nil
+}
+
+// download is a remote file and where it is saved.
+type download struct {
+	File client.File `json:"file"`
+	Path string      `json:"path"`
+}
+
+func getCmd(ctx context.Context, a *app, args []string) error {
+	flagSet := flags(`get`)
+	jobs := flagSet.Int(`j`, 4, `files to download at the same time`)
+	out := flagSet.String(`o`, `.`, `local directory to save into`)
+	if err := parse(flagSet, args, 1, -1); err != nil {
+		return err
+	}
+
+	c, err := a.client()
+	if err != nil {
+		return err
+	}
+
+	var downloads []download
+	var total int64
+	for _, p := range flagSet.Args() {
+		files, err := expand(ctx, c, p)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			downloads = append(downloads, download{File: f, Path: filepath.Join(*out, f.Name)})
+			total += f.Size
+		}
+	}
+
+	if err = os.MkdirAll(*out, 0o755); err != nil {
+		return err
+	}
+
+	var (
+		mu         sync.Mutex
+		downloaded []download
+	)
+	p := a.newProgress(total, len(downloads))
+	err = parallel(ctx, *jobs, len(downloads), p, func(ctx context.Context, i int) error {
+		d := downloads[i]
+		if err := saveFile(ctx, c, d, p); err != nil {
+			return fmt.Errorf(`%s: %w`, path.Join(d.File.Folder, d.File.Name), err)
+		}
+
+		mu.Lock()
+		downloaded = append(downloaded, d)
+		mu.Unlock()
+		p.done(`downloaded %s`, d.Path)
+		return nil
+	})
+	p.finish()
+
+	return a.printTransfers(downloaded, err)
+}
+
+// printTransfers prints what was transferred in JSON mode, also when some
+// transfers failed. Otherwise each transfer was reported as it finished.
+func (a *app) printTransfers(v any, err error) error {
+	if a.json {
+		if printErr := a.print(v, nil); printErr != nil {
+			return printErr
+		}
+	}
+	return err
+}
+
+// saveFile downloads into a temporary file next to the destination,
+// which replaces the destination once complete.
+func saveFile(ctx context.Context, c *client.Client, d download, p *progress) error {
+	tmp, err := os.CreateTemp(filepath.Dir(d.Path), `.`+filepath.Base(d.Path)+`-*.part`)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err = c.Download(ctx, d.File.ID, p.writer(tmp)); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), d.Path)
+}
+
+// parallel runs fn for 0..n-1 in up to jobs goroutines. Failures are
+// reported as they happen and don't stop the other transfers; the
+// first one is returned. Interrupting stops everything.
+func parallel(ctx context.Context, jobs, n int, p *progress, fn func(ctx context.Context, i int) error) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		first error
+		next  = make(chan int)
+	)
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				err := fn(ctx, i)
+				if err == nil {
+					continue
+				}
+
+				mu.Lock()
+				if first == nil {
+					first = err
+				}
+				mu.Unlock()
+				if !errors.Is(err, context.Canceled) {
+					p.log(`dexcloud: %v`, err)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < n && ctx.Err() == nil; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	if first == nil {
+		first = ctx.Err()
+	}
+	return first
+}
@@ -17,31 +17,138 @@ limitations under the License.
 package config
 
 import (
-	"server/catcherr"
+	"time"
 
 	"github.com/knadh/koanf"
 	"github.com/knadh/koanf/parsers/yaml"
+	"github.com/knadh/koanf/providers/confmap"
 	"github.com/knadh/koanf/providers/file"
 )
 
 const (
-	JWTKey = `jwt_key`
-	Host   = `host`
+	JWTKey        = `jwt_key`
+	AccessKeySeal = `access_key_seal`
+	Host          = `host`
+
+	AccessTokenTTL = `access_token_ttl`
+	SessionTTL     = `session_ttl`
 
 	DBHost     = `db_host`
 	DBUser     = `db_user`
 	DBPassword = `db_pass`
 	DBSSLMode  = `db_sslmode`
 	DBName     = `db_name`
+
+	PasswordMinLength     = `password_min_length`
+	PasswordMaxLength     = `password_max_length`
+	PasswordBreachedList  = `password_breached_list`
+	PasswordMaxSimilarity = `password_max_similarity`
+
+	Admins = `admins`
+
+	RegistrationMode = `registration_mode`
+	DefaultQuota     = `default_quota`
+
+	ThrottleStore         = `throttle_store`
+	ThrottleMaxFailures   = `throttle_max_failures`
+	ThrottleIPMaxFailures = `throttle_ip_max_failures`
+	ThrottleLockout       = `throttle_lockout`
+	ThrottleBackoffBase   = `throttle_backoff_base`
+	ThrottleBackoffMax    = `throttle_backoff_max`
+	ThrottleResetAfter    = `throttle_reset_after`
+
+	PublicURL        = `public_url`
+	EmailVerifyTTL   = `email_verify_ttl`
+	PasswordResetTTL = `password_reset_ttl`
+
+	MailDriver   = `mail_driver`
+	MailFrom     = `mail_from`
+	MailSMTPHost = `mail_smtp_host`
+	MailSMTPUser = `mail_smtp_user`
+	MailSMTPPass = `mail_smtp_pass`
+	MailDir      = `mail_dir`
+
+	RequestMaxBody = `request_max_body`
+	UploadTTL      = `upload_ttl`
+
+	ExtractMaxSize  = `extract_max_size`
+	ExtractMaxRatio = `extract_max_ratio`
+	ExtractMaxFiles = `extract_max_files`
+
+	ChangeRetention = `change_retention`
+
+	SFTPHost    = `sftp_host`
+	SFTPHostKey = `sftp_host_key`
+
+	ResticAppendOnly = `restic_append_only`
 )
 
-var cfg *koanf.Koanf
+// defaults are applied before config.yml, so every key above
+// can be omitted from the file.
+var defaults = map[string]any{
+	AccessTokenTTL: `15m`,
+	SessionTTL:     `720h`,
+
+	PasswordMinLength:     8,
+	PasswordMaxLength:     72, // bcrypt ignores everything after 72 bytes
+	PasswordBreachedList:  ``,
+	PasswordMaxSimilarity: 0.7,
+
+	Admins: []string{},
+
+	RegistrationMode: `open`,
+	DefaultQuota:     0,
+
+	ThrottleStore:         `memory`,
+	ThrottleMaxFailures:   5,
+	ThrottleIPMaxFailures: 50,
+	ThrottleLockout:       `15m`,
+	ThrottleBackoffBase:   `1s`,
+	ThrottleBackoffMax:    `1m`,
+	ThrottleResetAfter:    `1h`,
+
+	PublicURL:        `http://localhost`,
+	EmailVerifyTTL:   `24h`,
+	PasswordResetTTL: `1h`,
+
+	MailDriver:   `log`,
+	MailFrom:     `dexcloud@localhost`,
+	MailSMTPHost: `localhost:25`,
+	MailSMTPUser: ``,
+	MailSMTPPass: ``,
+	MailDir:      `mail`,
+
+	RequestMaxBody: 1 << 20,
+	UploadTTL:      `24h`,
+
+	ExtractMaxSize:  10 << 30,
+	ExtractMaxRatio: 100,
+	ExtractMaxFiles: 10000,
+
+	ChangeRetention: `720h`,
+
+	SFTPHost:    ``,
+	SFTPHostKey: `sftp_host_key`,
+
+	ResticAppendOnly: false,
+}
+
+var cfg = koanf.New(`.`)
 
-func init() {
-	cfg = koanf.New(`.`)
-	err := cfg.Load(file.Provider(`config.yml`), yaml.Parser())
-	catcherr.HandleError(err)
+// Load reads the config file on top of the defaults.
+// It has to be called before anything else is initialized.
+func Load(path string) error {
+	if err := cfg.Load(confmap.Provider(defaults, `.`), nil); err != nil {
+		return err
+	}
+	return cfg.Load(file.Provider(path), yaml.Parser())
 }
 
-func String(path string) string { return cfg.String(path) }
-func Bytes(path string) []byte  { return cfg.Bytes(path) }
+func String(path string) string          { return cfg.String(path) }
+func Bytes(path string) []byte           { return cfg.Bytes(path) }
+func Bool(path string) bool              { return cfg.Bool(path) }
+func Int(path string) int                { return cfg.Int(path) }
+func Int64(path string) int64            { return cfg.Int64(path) }
+func Float64(path string) float64        { return cfg.Float64(path) }
+func Strings(path string) []string       { return cfg.Strings(path) }
+func Duration(path string) time.Duration { return cfg.Duration(path) }
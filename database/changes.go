@@ -0,0 +1,309 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package database
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/driver/pgdriver"
+)
+
+// Ops of the change journal. Update is a change that kept the path.
+const (
+	ChangeCreate = `create`
+	ChangeUpdate = `update`
+	ChangeMove   = `move`
+	ChangeDelete = `delete`
+)
+
+// changesChannel carries the id of users whose changes were committed,
+// so every server answering long polls learns about them.
+const changesChannel = `dexcloud_changes`
+
+// ErrCursorExpired means changes after the cursor were pruned, or the
+// cursor is from the future. The client has to list everything again.
+var ErrCursorExpired = errors.New(`change cursor expired`)
+
+// ChangeFeed is the changes after a cursor, oldest first. Cursor points
+// after the last of them; HasMore says that more changes are waiting.
+type ChangeFeed struct {
+	Changes []Change `json:"changes"`
+	Cursor  string   `json:"cursor"`
+	HasMore bool     `json:"has_more"`
+}
+
+type changeCursor struct {
+	UserID int64 `json:"u"`
+	Seq    int64 `json:"s"`
+}
+
+func fileChange(op string, f File) Change {
+	return Change{
+		Op:       op,
+		FileID:   f.ID,
+		Folder:   f.Folder,
+		Name:     f.Name,
+		Checksum: f.Checksum,
+		Size:     f.Size,
+	}
+}
+
+func folderChange(op string, f Folder) Change {
+	return Change{
+		Op:       op,
+		FolderID: f.ID,
+		Folder:   f.Parent,
+		Name:     f.Name,
+	}
+}
+
+// movedFolderChange is the move of the folder from the tree at from
+// into the tree at to, where f is now.
+func movedFolderChange(f Folder, from, to string) Change {
+	old := from + strings.TrimPrefix(f.Path, to)
+	c := folderChange(ChangeMove, f)
+	c.OldFolder, c.OldName = path.Dir(old), path.Base(old)
+	return c
+}
+
+// journal records the changes of the user in the transaction. They are
+// numbered by a counter on the user row, whose lock makes the numbers
+// commit in order.
+func journal(ctx context.Context, tx bun.Tx, uid int64, changes ...Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	var seq int64
+	_, err := tx.NewUpdate().Model((*User)(nil)).
+		Set(`change_seq = change_seq + ?`, len(changes)).
+		Where(`id = ?`, uid).
+		Returning(`change_seq`).
+		Exec(ctx, &seq)
+	if err != nil {
+		return err
+	}
+
+	first := seq - int64(len(changes)) + 1
+	for i := range changes {
+		changes[i].UserID = uid
+		changes[i].Seq = first + int64(i)
+	}
+	if _, err = tx.NewInsert().Model(&changes).Exec(ctx); err != nil {
+		return err
+	}
+
+	// Delivered on commit.
+	_, err = tx.ExecContext(ctx, `SELECT pg_notify(?, ?)`, changesChannel, strconv.FormatInt(uid, 10))
+	return err
+}
+
+// GetChanges returns up to limit changes of the user after the cursor.
+// Without a cursor it returns no changes and a cursor pointing after the
+// latest one, for clients that have just listed everything.
+func GetChanges(ctx context.Context, uid int64, cursor string, limit int) (feed ChangeFeed, err error) {
+	var latest int64
+	err = db.NewSelect().Model((*User)(nil)).Column(`change_seq`).
+		Where(`id = ?`, uid).Scan(ctx, &latest)
+	if err != nil {
+		return ChangeFeed{}, err
+	}
+
+	after := latest
+	if cursor != `` {
+		c, err := decodeChangeCursor(cursor)
+		if err != nil || c.UserID != uid {
+			return ChangeFeed{}, ErrInvalidCursor
+		}
+		if c.Seq > latest {
+			return ChangeFeed{}, ErrCursorExpired
+		}
+		after = c.Seq
+	}
+
+	feed.Changes = []Change{}
+	if after < latest {
+		err = db.NewSelect().Model(&feed.Changes).
+			Where(`ch.uid = ?`, uid).
+			Where(`ch.seq > ?`, after).
+			Order(`ch.seq ASC`).
+			Limit(limit).Scan(ctx)
+		if err != nil {
+			return ChangeFeed{}, err
+		}
+
+		// Numbers have no gaps, so a missing one was pruned.
+		if len(feed.Changes) == 0 || feed.Changes[0].Seq != after+1 {
+			return ChangeFeed{}, ErrCursorExpired
+		}
+		after = feed.Changes[len(feed.Changes)-1].Seq
+	}
+
+	feed.HasMore = after < latest
+	feed.Cursor, err = encodeChangeCursor(changeCursor{UserID: uid, Seq: after})
+	return feed, err
+}
+
+// DeleteChangesBefore prunes the journal, expiring the cursors
+// of clients that haven't synced since.
+func DeleteChangesBefore(ctx context.Context, t time.Time) error {
+	_, err := db.NewDelete().Model((*Change)(nil)).Where(`created_at < ?`, t).Exec(ctx)
+	return err
+}
+
+func encodeChangeCursor(c changeCursor) (string, error) {
+	buf, err := json.Marshal(c)
+	if err != nil {
+		return ``, err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func decodeChangeCursor(s string) (c changeCursor, err error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return changeCursor{}, err
+	}
+
+	err = json.Unmarshal(buf, &c)
+	return c, err
+}
+
+// watchers are the channels of long polls by user.
+var watchers = struct {
+	sync.Mutex
+	m map[int64]map[chan struct{}]bool
+}{m: map[int64]map[chan struct{}]bool{}}
+
+// WatchChanges returns a channel that receives when changes of the user
+// are committed. Call stop once done. Watch before reading the changes,
+// so none committed in between are missed.
+func WatchChanges(uid int64) (changed <-chan struct{}, stop func()) {
+	ch := make(chan struct{}, 1)
+
+	watchers.Lock()
+	if watchers.m[uid] == nil {
+		watchers.m[uid] = map[chan struct{}]bool{}
+	}
+	watchers.m[uid][ch] = true
+	watchers.Unlock()
+
+	return ch, func() {
+		watchers.Lock()
+		delete(watchers.m[uid], ch)
+		if len(watchers.m[uid]) == 0 {
+			delete(watchers.m, uid)
+		}
+		watchers.Unlock()
+	}
+}
+
+func notifyWatchers(uid int64) {
+	watchers.Lock()
+	defer watchers.Unlock()
+
+	for ch := range watchers.m[uid] {
+		wake(ch)
+	}
+}
+
+func notifyAllWatchers() {
+	watchers.Lock()
+	defer watchers.Unlock()
+
+	for _, chans := range watchers.m {
+		for ch := range chans {
+			wake(ch)
+		}
+	}
+}
+
+func wake(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// listenChanges wakes the watchers of users whose changes were
+// committed, by this server or another one sharing the database.
+// It listens again, waiting longer after each failure, until ctx is done.
+func listenChanges(ctx context.Context) {
+	const maxBackoff = time.Minute
+
+	for backoff := time.Second; ; {
+		listened, err := listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf(`[ Sender: database.listenChanges() ]: %v`, err)
+
+		if listened {
+			backoff = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// listen delivers notifications until ctx is done or the listener fails.
+// It tells whether it got to listen at all. Once listening, the listener
+// reconnects by itself.
+func listen(ctx context.Context) (bool, error) {
+	ln := pgdriver.NewListener(db)
+	defer ln.Close()
+
+	if err := ln.Listen(ctx, changesChannel); err != nil {
+		return false, err
+	}
+	// Changes committed while nobody listened woke no one.
+	notifyAllWatchers()
+
+	ch := ln.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return true, ctx.Err()
+		case n, ok := <-ch:
+			if !ok {
+				return true, errors.New(`listener closed`)
+			}
+			if n.Channel != changesChannel {
+				continue
+			}
+			if uid, err := strconv.ParseInt(n.Payload, 10, 64); err == nil {
+				notifyWatchers(uid)
+			}
+		}
+	}
+}
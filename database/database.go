@@ -19,9 +19,12 @@ package database
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"net/url"
-	"server/catcherr"
 	"server/config"
+	"strings"
+	"time"
 
 	"github.com/uptrace/bun"
 	"github.com/uptrace/bun/dialect/pgdialect"
@@ -31,9 +34,8 @@ import (
 
 var db *bun.DB
 
-func init() {
-	ctx := context.Background()
-
+// Open connects to PostgreSQL and brings the schema up to date.
+func Open(ctx context.Context) error {
 	var (
 		host     = config.String(config.DBHost)
 		username = config.String(config.DBUser)
@@ -66,27 +68,91 @@ func init() {
 	// Print all queries to stdout.
 	db.AddQueryHook(bundebug.NewQueryHook(bundebug.WithVerbose(true)))
 
-	_, err := db.NewCreateTable().Model((*User)(nil)).IfNotExists().Exec(ctx)
-	catcherr.HandleError(err)
+	if err := migrate(ctx); err != nil {
+		return err
+	}
 
-	_, err = db.NewCreateTable().Model((*File)(nil)).IfNotExists().Exec(ctx)
-	catcherr.HandleError(err)
+	go listenChanges(ctx)
+	return nil
 }
 
+var (
+	ErrDuplicate     = errors.New(`already exists`)
+	ErrLoginTaken    = fmt.Errorf(`login %w`, ErrDuplicate)
+	ErrEmailTaken    = fmt.Errorf(`email %w`, ErrDuplicate)
+	ErrInvalidInvite = errors.New(`invalid, expired or used up invite code`)
+)
+
 func RegisterUser(ctx context.Context, u User) (user User, err error) {
 	_, err = db.NewInsert().Model(&u).Exec(ctx)
+	if err != nil {
+		return User{}, uniqueViolation(err)
+	}
+	return GetUser(ctx, u.Login)
+}
+
+// RegisterInvitedUser spends one use of the invite and creates the user
+// in one transaction, so a failed registration doesn't waste the invite.
+func RegisterInvitedUser(ctx context.Context, u User, inviteHash string) (user User, err error) {
+	err = db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		res, err := tx.NewUpdate().Model((*Invite)(nil)).
+			Set(`uses = uses + 1`).
+			Where(`hash = ?`, inviteHash).
+			Where(`uses < max_uses`).
+			Where(`expires_at IS NULL OR expires_at > now()`).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return ErrInvalidInvite
+		}
+
+		_, err = tx.NewInsert().Model(&u).Exec(ctx)
+		return uniqueViolation(err)
+	})
 	if err != nil {
 		return User{}, err
 	}
 	return GetUser(ctx, u.Login)
 }
 
+// uniqueViolation replaces unique constraint errors with ErrDuplicate,
+// or with ErrLoginTaken and ErrEmailTaken for the users table.
+func uniqueViolation(err error) error {
+	var pgErr pgdriver.Error
+	if !errors.As(err, &pgErr) || pgErr.Field('C') != `23505` {
+		return err
+	}
+
+	switch pgErr.Field('n') {
+	case `users_login_key`:
+		return ErrLoginTaken
+	case `users_email_key`:
+		return ErrEmailTaken
+	}
+	return ErrDuplicate
+}
+
 func GetUser(ctx context.Context, login string) (user User, err error) {
 	u := new(User)
 	err = db.NewSelect().Model(u).Where(`login = ?`, login).Scan(ctx)
 	return *u, err
 }
 
+func GetUserByEmail(ctx context.Context, email string) (user User, err error) {
+	u := new(User)
+	err = db.NewSelect().Model(u).Where(`lower(email) = lower(?)`, email).Scan(ctx)
+	return *u, err
+}
+
+func GetUserByID(ctx context.Context, uid int64) (user User, err error) {
+	u := new(User)
+	err = db.NewSelect().Model(u).Where(`id = ?`, uid).Scan(ctx)
+	return *u, err
+}
+
 func GetFileList(ctx context.Context, login string) (files []File, err error) {
 	u, err := GetUser(ctx, login)
 	if err != nil {
@@ -97,35 +163,733 @@ func GetFileList(ctx context.Context, login string) (files []File, err error) {
 	return files, err
 }
 
-func SaveFileInfo(ctx context.Context, login, filename, checksum string) error {
+// FileFilter narrows a file listing, zero fields match every file.
+type FileFilter struct {
+	Folder         string
+	MimePrefix     string
+	MinSize        *int64
+	MaxSize        *int64
+	ModifiedAfter  time.Time
+	ModifiedBefore time.Time
+}
+
+var fileSortKeys = map[string]sortKey[File]{
+	`name`:     sortBy(`f.name`, func(f File) string { return f.Name }),
+	`size`:     sortBy(`f.size`, func(f File) int64 { return f.Size }),
+	`modified`: sortBy(`f.modified_at`, func(f File) time.Time { return f.ModifiedAt }),
+}
+
+// ListFiles returns one page of the files of the user matching the filter.
+// Sort is one of name, size or modified.
+func ListFiles(ctx context.Context, uid int64, filter FileFilter, opts PageOptions) (Page[File], error) {
+	q := db.NewSelect().Model((*File)(nil)).Where(`f.uid = ?`, uid)
+
+	if filter.Folder != `` {
+		q = q.Where(`f.folder = ?`, filter.Folder)
+	}
+	if filter.MimePrefix != `` {
+		q = q.Where(`f.mime_type LIKE ?`, escapeLike(filter.MimePrefix)+`%`)
+	}
+	if filter.MinSize != nil {
+		q = q.Where(`f.size >= ?`, *filter.MinSize)
+	}
+	if filter.MaxSize != nil {
+		q = q.Where(`f.size <= ?`, *filter.MaxSize)
+	}
+	if !filter.ModifiedAfter.IsZero() {
+		q = q.Where(`f.modified_at >= ?`, filter.ModifiedAfter)
+	}
+	if !filter.ModifiedBefore.IsZero() {
+		q = q.Where(`f.modified_at < ?`, filter.ModifiedBefore)
+	}
+
+	return paginate(ctx, q, opts, fileSortKeys, `f.id`, func(f File) int64 { return f.ID })
+}
+
+// SaveFileInfo adds the file to the files of the user.
+// ModifiedAt defaults to now.
+func SaveFileInfo(ctx context.Context, login string, f File) (File, error) {
 	u, err := GetUser(ctx, login)
 	if err != nil {
-		return err
+		return File{}, err
 	}
 
-	f := new(File)
 	f.UserID = u.ID
-	f.Name = filename
-	f.Checksum = checksum
+	if f.ModifiedAt.IsZero() {
+		f.ModifiedAt = time.Now()
+	}
+
+	err = db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewInsert().Model(&f).Returning(`*`).Exec(ctx)
+		if err != nil {
+			return err
+		}
+		return journal(ctx, tx, u.ID, fileChange(ChangeCreate, f))
+	})
+	return f, err
+}
 
-	_, err = db.NewInsert().Model(f).Exec(ctx)
+func RemoveFileInfo(ctx context.Context, login, checksum string) error {
+	u, err := GetUser(ctx, login)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	// Links to the file go away with it.
+	return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewDelete().Model((*Share)(nil)).
+			Where(`file_id IN (SELECT id FROM files WHERE uid = ? AND checksum = ?)`, u.ID, checksum).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		var files []File
+		_, err = tx.NewDelete().Model(&files).Where(`uid = ?`, u.ID).
+			Where(`checksum = ?`, checksum).
+			Returning(`*`).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		changes := make([]Change, len(files))
+		for i, f := range files {
+			changes[i] = fileChange(ChangeDelete, f)
+		}
+		return journal(ctx, tx, u.ID, changes...)
+	})
 }
 
-func RemoveFileInfo(ctx context.Context, login, checksum string) error {
-	u, err := GetUser(ctx, login)
+// DeleteFile deletes the file of the user with the id and its links,
+// and returns it so the caller can purge the blob.
+func DeleteFile(ctx context.Context, uid, id int64) (f File, err error) {
+	err = db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewDelete().Model((*Share)(nil)).
+			Where(`uid = ?`, uid).
+			Where(`file_id = ?`, id).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.NewDelete().Model(&f).
+			Where(`uid = ?`, uid).
+			Where(`id = ?`, id).
+			Returning(`*`).Exec(ctx)
+		if err == nil && f.ID == 0 {
+			err = sql.ErrNoRows
+		}
+		if err != nil {
+			return err
+		}
+		return journal(ctx, tx, uid, fileChange(ChangeDelete, f))
+	})
+	return f, err
+}
+
+// GetFile returns the file of the user with the id.
+func GetFile(ctx context.Context, uid, id int64) (f File, err error) {
+	err = db.NewSelect().Model(&f).Where(`f.uid = ?`, uid).Where(`f.id = ?`, id).Scan(ctx)
+	return f, err
+}
+
+// MoveFile renames the file of the user and moves it to another folder.
+func MoveFile(ctx context.Context, uid, id int64, folder, name string) (f File, err error) {
+	err = db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		var old File
+		err := tx.NewSelect().Model(&old).
+			Where(`f.uid = ?`, uid).
+			Where(`f.id = ?`, id).
+			For(`UPDATE`).Scan(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.NewUpdate().Model(&f).
+			Set(`folder = ?`, folder).
+			Set(`name = ?`, name).
+			Set(`modified_at = now()`).
+			Where(`id = ?`, id).
+			Returning(`*`).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		change := fileChange(ChangeUpdate, f)
+		if old.Folder != f.Folder || old.Name != f.Name {
+			change.Op, change.OldFolder, change.OldName = ChangeMove, old.Folder, old.Name
+		}
+		return journal(ctx, tx, uid, change)
+	})
+	return f, err
+}
+
+// GetFilesAt returns the files of the user with the name in the folder,
+// newest first. Uploads don't replace files, so there may be several.
+func GetFilesAt(ctx context.Context, uid int64, folder, name string) (files []File, err error) {
+	err = db.NewSelect().Model(&files).
+		Where(`f.uid = ?`, uid).
+		Where(`f.folder = ?`, folder).
+		Where(`f.name = ?`, name).
+		Order(`f.modified_at DESC`, `f.id DESC`).Scan(ctx)
+	return files, err
+}
+
+// GetFilesIn returns the files of the user directly inside the folder.
+func GetFilesIn(ctx context.Context, uid int64, folder string) (files []File, err error) {
+	err = db.NewSelect().Model(&files).
+		Where(`f.uid = ?`, uid).
+		Where(`f.folder = ?`, folder).
+		Order(`f.name`, `f.modified_at DESC`, `f.id DESC`).Scan(ctx)
+	return files, err
+}
+
+// GetFilesBelow returns the files of the user in the folder at the path
+// and the folders inside it, however deep, ordered like GetFilesIn
+// within each folder.
+func GetFilesBelow(ctx context.Context, uid int64, folder string) (files []File, err error) {
+	q := db.NewSelect().Model(&files).Where(`f.uid = ?`, uid)
+	if folder != `/` {
+		q = q.WhereGroup(` AND `, func(q *bun.SelectQuery) *bun.SelectQuery {
+			return q.Where(`f.folder = ?`, folder).WhereOr(`f.folder LIKE ?`, escapeLike(folder)+`/%`)
+		})
+	}
+	err = q.Order(`f.folder`, `f.name`, `f.modified_at DESC`, `f.id DESC`).Scan(ctx)
+	return files, err
+}
+
+// GetTypesBelow returns the MIME types of the files of the user in the
+// folder and the folders below it.
+func GetTypesBelow(ctx context.Context, uid int64, folder string) (types []string, err error) {
+	q := db.NewSelect().Model((*File)(nil)).ColumnExpr(`DISTINCT f.mime_type`).Where(`f.uid = ?`, uid)
+	if folder != `/` {
+		q = q.WhereGroup(` AND `, func(q *bun.SelectQuery) *bun.SelectQuery {
+			return q.Where(`f.folder = ?`, folder).WhereOr(`f.folder LIKE ?`, escapeLike(folder)+`/%`)
+		})
+	}
+	err = q.Scan(ctx, &types)
+	return types, err
+}
+
+// GetFilesByID returns the files of the user with the ids, ordered like
+// GetFilesBelow. Ids of other users' files or of missing files are skipped.
+func GetFilesByID(ctx context.Context, uid int64, ids []int64) (files []File, err error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	err = db.NewSelect().Model(&files).
+		Where(`f.uid = ?`, uid).
+		Where(`f.id IN (?)`, bun.In(ids)).
+		Order(`f.folder`, `f.name`, `f.modified_at DESC`, `f.id DESC`).Scan(ctx)
+	return files, err
+}
+
+// objectKey orders files by their full path byte by byte, as S3 lists keys.
+const objectKey = `(f.folder || '/' || f.name) COLLATE "C"`
+
+// ListObjects returns up to limit files of the user whose path starts with
+// prefix and sorts after after, or from after on if inclusive. Files are in
+// byte order of their path, the newest first among files with one path.
+func ListObjects(ctx context.Context, uid int64, prefix, after string, inclusive bool, limit int) (files []File, err error) {
+	q := db.NewSelect().Model(&files).
+		Where(`f.uid = ?`, uid).
+		Where(`f.folder || '/' || f.name LIKE ?`, escapeLike(prefix)+`%`)
+	if after != `` {
+		op := ` > ?`
+		if inclusive {
+			op = ` >= ?`
+		}
+		q = q.Where(objectKey+op, after)
+	}
+
+	err = q.OrderExpr(objectKey).
+		Order(`f.modified_at DESC`, `f.id DESC`).
+		Limit(limit).Scan(ctx)
+	return files, err
+}
+
+// DeleteFilesAt deletes the files of the user with the name in the folder,
+// except the one with the id keep, and their links. It returns them so the
+// caller can purge the blobs.
+func DeleteFilesAt(ctx context.Context, uid int64, folder, name string, keep int64) (files []File, err error) {
+	err = db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewDelete().Model((*Share)(nil)).
+			Where(`file_id IN (SELECT id FROM files WHERE uid = ? AND folder = ? AND name = ? AND id != ?)`,
+				uid, folder, name, keep).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.NewDelete().Model(&files).
+			Where(`uid = ?`, uid).
+			Where(`folder = ?`, folder).
+			Where(`name = ?`, name).
+			Where(`id != ?`, keep).
+			Returning(`*`).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		changes := make([]Change, len(files))
+		for i, f := range files {
+			changes[i] = fileChange(ChangeDelete, f)
+		}
+		return journal(ctx, tx, uid, changes...)
+	})
+	return files, err
+}
+
+func UpdatePassword(ctx context.Context, uid int64, hash string) error {
+	_, err := db.NewUpdate().Model((*User)(nil)).Set(`password = ?`, hash).
+		Where(`id = ?`, uid).Exec(ctx)
+	return err
+}
+
+// UpdateEmail sets a new, not yet verified email address.
+func UpdateEmail(ctx context.Context, uid int64, email string) error {
+	_, err := db.NewUpdate().Model((*User)(nil)).
+		Set(`email = NULLIF(?, '')`, email).
+		Set(`email_verified = FALSE`).
+		Where(`id = ?`, uid).Exec(ctx)
+	return uniqueViolation(err)
+}
+
+// VerifyEmail marks the email as verified, unless it changed in the meantime.
+func VerifyEmail(ctx context.Context, uid int64, email string) error {
+	_, err := db.NewUpdate().Model((*User)(nil)).
+		Set(`email_verified = TRUE`).
+		Where(`id = ?`, uid).
+		Where(`lower(email) = lower(?)`, email).Exec(ctx)
+	return err
+}
+
+func UpdateLogin(ctx context.Context, uid int64, login string) error {
+	_, err := db.NewUpdate().Model((*User)(nil)).Set(`login = ?`, login).
+		Where(`id = ?`, uid).Exec(ctx)
+	return uniqueViolation(err)
+}
+
+// DeleteUser removes the user together with its sessions, tokens and file records.
+// It returns the checksums of the removed files, so the caller can purge
+// blobs that are no longer referenced.
+func DeleteUser(ctx context.Context, uid int64) (checksums []string, err error) {
+	err = db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		err := tx.NewSelect().Model((*File)(nil)).Column(`checksum`).
+			Where(`uid = ?`, uid).
+			UnionAll(tx.NewSelect().Model((*LFSObject)(nil)).Column(`oid`).Where(`uid = ?`, uid)).
+			UnionAll(tx.NewSelect().Model((*RegistryBlob)(nil)).Column(`checksum`).Where(`uid = ?`, uid)).
+			UnionAll(tx.NewSelect().Model((*RegistryManifest)(nil)).Column(`checksum`).Where(`uid = ?`, uid)).
+			UnionAll(tx.NewSelect().Model((*ResticObject)(nil)).Column(`checksum`).Where(`uid = ?`, uid)).
+			Scan(ctx, &checksums)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.NewDelete().Model((*File)(nil)).Where(`uid = ?`, uid).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.NewDelete().Model((*Session)(nil)).Where(`uid = ?`, uid).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.NewDelete().Model((*MultipartPart)(nil)).
+			Where(`upload_id IN (SELECT id FROM multipart_uploads WHERE uid = ?)`, uid).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		// Partial uploads are left to PruneUploads with the rest of the orphans.
+		for _, model := range []any{
+			(*UserToken)(nil), (*PersonalToken)(nil), (*Folder)(nil), (*Upload)(nil), (*Share)(nil), (*Change)(nil),
+			(*AppPassword)(nil), (*DAVProperty)(nil), (*DAVLock)(nil),
+			(*AccessKey)(nil), (*MultipartUpload)(nil), (*SSHKey)(nil),
+			(*LFSObject)(nil), (*LFSLock)(nil),
+			(*RegistryBlob)(nil), (*RegistryManifest)(nil), (*RegistryReference)(nil),
+			(*RegistryTag)(nil), (*RegistryUpload)(nil), (*ResticObject)(nil), (*FileMetadata)(nil),
+		} {
+			_, err = tx.NewDelete().Model(model).Where(`uid = ?`, uid).Exec(ctx)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.NewDelete().Model((*User)(nil)).Where(`id = ?`, uid).Exec(ctx)
+		return err
+	})
+	return checksums, err
+}
+
+// GetChecksumsOfType returns up to limit checksums after after, in order,
+// of the files with one of the MIME types.
+func GetChecksumsOfType(ctx context.Context, mimeTypes []string, after string, limit int) (checksums []string, err error) {
+	err = db.NewSelect().Model((*File)(nil)).
+		Distinct().Column(`checksum`).
+		Where(`mime_type IN (?)`, bun.In(mimeTypes)).
+		Where(`checksum > ?`, after).
+		Order(`checksum`).
+		Limit(limit).Scan(ctx, &checksums)
+	return checksums, err
+}
+
+// ChecksumInUse tells whether a file, an LFS object, a blob or manifest
+// of a container repository or a restic object uses the blob.
+func ChecksumInUse(ctx context.Context, checksum string) (bool, error) {
+	used, err := db.NewSelect().Model((*File)(nil)).
+		Where(`checksum = ?`, checksum).Exists(ctx)
+	if err != nil || used {
+		return used, err
+	}
+
+	used, err = db.NewSelect().Model((*LFSObject)(nil)).
+		Where(`oid = ?`, checksum).Exists(ctx)
+	if err != nil || used {
+		return used, err
+	}
+
+	used, err = db.NewSelect().Model((*RegistryBlob)(nil)).
+		Where(`checksum = ?`, checksum).Exists(ctx)
+	if err != nil || used {
+		return used, err
+	}
+
+	used, err = db.NewSelect().Model((*RegistryManifest)(nil)).
+		Where(`checksum = ?`, checksum).Exists(ctx)
+	if err != nil || used {
+		return used, err
+	}
+
+	return db.NewSelect().Model((*ResticObject)(nil)).
+		Where(`checksum = ?`, checksum).Exists(ctx)
+}
+
+func CreateSession(ctx context.Context, uid int64, refreshHash string, expires time.Time) (s Session, err error) {
+	id, err := randomID()
 	if err != nil {
+		return Session{}, err
+	}
+
+	s = Session{
+		ID:          id,
+		UserID:      uid,
+		RefreshHash: refreshHash,
+		ExpiresAt:   expires,
+	}
+	_, err = db.NewInsert().Model(&s).Exec(ctx)
+	return s, err
+}
+
+// GetSession returns the session only if it is still valid
+// and belongs to login, whose account must not be disabled.
+func GetSession(ctx context.Context, id, login string) (s Session, err error) {
+	err = db.NewSelect().Model(&s).
+		Join(`JOIN users AS u ON u.id = s.uid`).
+		Where(`s.id = ?`, id).
+		Where(`u.login = ?`, login).
+		Where(`NOT u.disabled`).
+		Where(`s.expires_at > now()`).
+		Scan(ctx)
+	return s, err
+}
+
+// RefreshSession replaces the refresh token of a valid session and extends
+// it. Each refresh token can only be used once, a reused or unknown one
+// fails with sql.ErrNoRows, as does a session of a disabled account.
+func RefreshSession(ctx context.Context, oldHash, newHash string, expires time.Time) (s Session, err error) {
+	_, err = db.NewUpdate().Model(&s).
+		Set(`refresh_hash = ?`, newHash).
+		Set(`expires_at = ?`, expires).
+		Where(`refresh_hash = ?`, oldHash).
+		Where(`expires_at > now()`).
+		Where(`uid NOT IN (SELECT id FROM users WHERE disabled)`).
+		Returning(`*`).
+		Exec(ctx)
+	if err == nil && s.ID == `` {
+		err = sql.ErrNoRows
+	}
+	return s, err
+}
+
+// RevokeSessions deletes every session of the user except the one with
+// the given id. Pass an empty id to revoke all of them.
+func RevokeSessions(ctx context.Context, uid int64, except string) error {
+	q := db.NewDelete().Model((*Session)(nil)).Where(`uid = ?`, uid)
+	if except != `` {
+		q = q.Where(`id != ?`, except)
+	}
+	_, err := q.Exec(ctx)
+	return err
+}
+
+func GetLoginAttempt(ctx context.Context, key string) (a LoginAttempt, err error) {
+	err = db.NewSelect().Model(&a).Where(`key = ?`, key).Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return LoginAttempt{Key: key}, nil
+	}
+	return a, err
+}
+
+// FailLogin atomically counts a failed attempt. Failures that happened
+// before since are forgotten and the counter starts over.
+func FailLogin(ctx context.Context, key string, now, since time.Time) (a LoginAttempt, err error) {
+	a = LoginAttempt{Key: key, Failures: 1, LastFailure: now}
+	_, err = db.NewInsert().Model(&a).
+		On(`CONFLICT (key) DO UPDATE`).
+		Set(`failures = CASE WHEN la.last_failure < ? THEN 1 ELSE la.failures + 1 END`, since).
+		Set(`last_failure = EXCLUDED.last_failure`).
+		Returning(`*`).
+		Exec(ctx)
+	return a, err
+}
+
+func LockLogin(ctx context.Context, key string, until time.Time) error {
+	_, err := db.NewUpdate().Model((*LoginAttempt)(nil)).
+		Set(`locked_until = ?`, until).
+		Where(`key = ?`, key).Exec(ctx)
+	return err
+}
+
+func ResetLoginAttempts(ctx context.Context, key string) error {
+	_, err := db.NewDelete().Model((*LoginAttempt)(nil)).
+		Where(`key = ?`, key).Exec(ctx)
+	return err
+}
+
+func SaveAuditEvent(ctx context.Context, e AuditEvent) error {
+	_, err := db.NewInsert().Model(&e).Exec(ctx)
+	return err
+}
+
+func CreateUserToken(ctx context.Context, t UserToken) error {
+	_, err := db.NewInsert().Model(&t).Exec(ctx)
+	return err
+}
+
+// UseUserToken marks the token as used and returns it. It fails with
+// sql.ErrNoRows if the token doesn't exist, expired or was already used.
+func UseUserToken(ctx context.Context, kind, hash string) (t UserToken, err error) {
+	_, err = db.NewUpdate().Model(&t).
+		Set(`used_at = now()`).
+		Where(`kind = ?`, kind).
+		Where(`hash = ?`, hash).
+		Where(`used_at IS NULL`).
+		Where(`expires_at > now()`).
+		Returning(`*`).
+		Exec(ctx)
+	if err == nil && t.ID == 0 {
+		err = sql.ErrNoRows
+	}
+	return t, err
+}
+
+// GetUserToken returns the token without using it. It fails with
+// sql.ErrNoRows if the token doesn't exist, expired or was already used.
+func GetUserToken(ctx context.Context, kind, hash string) (t UserToken, err error) {
+	err = db.NewSelect().Model(&t).
+		Where(`kind = ?`, kind).
+		Where(`hash = ?`, hash).
+		Where(`used_at IS NULL`).
+		Where(`expires_at > now()`).Scan(ctx)
+	return t, err
+}
+
+// ResetPassword marks the token as used and sets the password hash of its
+// user in one transaction, deleting the other tokens of its kind. It fails
+// with sql.ErrNoRows if the token was used or expired in the meantime.
+func ResetPassword(ctx context.Context, t UserToken, hash string) error {
+	return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		res, err := tx.NewUpdate().Model((*UserToken)(nil)).
+			Set(`used_at = now()`).
+			Where(`id = ?`, t.ID).
+			Where(`used_at IS NULL`).
+			Where(`expires_at > now()`).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return sql.ErrNoRows
+		}
+
+		_, err = tx.NewUpdate().Model((*User)(nil)).Set(`password = ?`, hash).
+			Where(`id = ?`, t.UserID).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.NewDelete().Model((*UserToken)(nil)).
+			Where(`uid = ?`, t.UserID).
+			Where(`kind = ?`, t.Kind).
+			Where(`id != ?`, t.ID).Exec(ctx)
 		return err
+	})
+}
+
+// DeleteUserTokens removes all tokens of the given kind, used or not.
+func DeleteUserTokens(ctx context.Context, uid int64, kind string) error {
+	_, err := db.NewDelete().Model((*UserToken)(nil)).
+		Where(`uid = ?`, uid).
+		Where(`kind = ?`, kind).Exec(ctx)
+	return err
+}
+
+func CreateInvite(ctx context.Context, i Invite) (invite Invite, err error) {
+	_, err = db.NewInsert().Model(&i).Returning(`*`).Exec(ctx)
+	return i, err
+}
+
+func GetInvites(ctx context.Context) (invites []Invite, err error) {
+	err = db.NewSelect().Model(&invites).Order(`id`).Scan(ctx)
+	return invites, err
+}
+
+func DeleteInvite(ctx context.Context, id int64) error {
+	_, err := db.NewDelete().Model((*Invite)(nil)).Where(`id = ?`, id).Exec(ctx)
+	return err
+}
+
+func GetPendingUsers(ctx context.Context) (users []User, err error) {
+	err = db.NewSelect().Model(&users).
+		Where(`status = ?`, StatusPending).Order(`id`).Scan(ctx)
+	return users, err
+}
+
+// ApproveUser activates a pending user. It fails with sql.ErrNoRows
+// if there is no pending user with the id.
+func ApproveUser(ctx context.Context, uid int64) (user User, err error) {
+	_, err = db.NewUpdate().Model(&user).
+		Set(`status = ?`, StatusActive).
+		Where(`id = ?`, uid).
+		Where(`status = ?`, StatusPending).
+		Returning(`*`).
+		Exec(ctx)
+	if err == nil && user.ID == 0 {
+		err = sql.ErrNoRows
 	}
+	return user, err
+}
+
+// RejectUser deletes a pending registration together with its tokens.
+func RejectUser(ctx context.Context, uid int64) error {
+	return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		res, err := tx.NewDelete().Model((*User)(nil)).
+			Where(`id = ?`, uid).
+			Where(`status = ?`, StatusPending).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return sql.ErrNoRows
+		}
+
+		_, err = tx.NewDelete().Model((*UserToken)(nil)).Where(`uid = ?`, uid).Exec(ctx)
+		return err
+	})
+}
+
+type Usage struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
 
-	f := new(File)
-	_, err = db.NewDelete().Model(f).Where(`uid = ?`, u.ID).
-		Where(`checksum = ?`, checksum).Exec(ctx)
+// GetUsage counts the files of the user. The bytes include LFS objects,
+// container images and restic repositories, which count against the
+// quota like files.
+func GetUsage(ctx context.Context, uid int64) (u Usage, err error) {
+	err = db.NewSelect().Model((*File)(nil)).
+		ColumnExpr(`count(*)`).
+		ColumnExpr(`coalesce(sum(size), 0)`+
+			` + (SELECT coalesce(sum(size), 0) FROM lfs_objects WHERE uid = ?0)`+
+			` + (SELECT coalesce(sum(size), 0) FROM registry_blobs WHERE uid = ?0)`+
+			` + (SELECT coalesce(sum(size), 0) FROM registry_manifests WHERE uid = ?0)`+
+			` + (SELECT coalesce(sum(size), 0) FROM restic_objects WHERE uid = ?0)`, uid).
+		Where(`uid = ?`, uid).
+		Scan(ctx, &u.Files, &u.Bytes)
+	return u, err
+}
+
+var userSortKeys = map[string]sortKey[User]{
+	`id`:    sortBy(`u.id`, func(u User) int64 { return u.ID }),
+	`login`: sortBy(`u.login`, func(u User) string { return u.Login }),
+}
+
+// SearchUsers returns one page of the users whose login or email contains
+// the query. An empty query matches every user. Sort is id or login.
+func SearchUsers(ctx context.Context, query string, opts PageOptions) (Page[User], error) {
+	q := db.NewSelect().Model((*User)(nil))
+	if query != `` {
+		pattern := `%` + escapeLike(query) + `%`
+		q = q.WhereGroup(` AND `, func(q *bun.SelectQuery) *bun.SelectQuery {
+			return q.Where(`u.login ILIKE ?`, pattern).WhereOr(`u.email ILIKE ?`, pattern)
+		})
+	}
+
+	return paginate(ctx, q, opts, userSortKeys, `u.id`, func(u User) int64 { return u.ID })
+}
+
+// SetDisabled disables or enables the account.
+// Disabling also revokes every session of the user.
+func SetDisabled(ctx context.Context, uid int64, disabled bool) error {
+	return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		res, err := tx.NewUpdate().Model((*User)(nil)).
+			Set(`disabled = ?`, disabled).
+			Where(`id = ?`, uid).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return sql.ErrNoRows
+		}
+
+		if !disabled {
+			return nil
+		}
+		_, err = tx.NewDelete().Model((*Session)(nil)).Where(`uid = ?`, uid).Exec(ctx)
+		return err
+	})
+}
+
+func SetQuota(ctx context.Context, uid, quota int64) error {
+	return updateUser(ctx, uid, `quota = ?`, quota)
+}
+
+func SetRole(ctx context.Context, uid int64, role string) error {
+	return updateUser(ctx, uid, `role = ?`, role)
+}
+
+// GrantRole sets the role of every existing user with one of the logins.
+func GrantRole(ctx context.Context, logins []string, role string) error {
+	if len(logins) == 0 {
+		return nil
+	}
+	_, err := db.NewUpdate().Model((*User)(nil)).
+		Set(`role = ?`, role).
+		Where(`login IN (?)`, bun.In(logins)).Exec(ctx)
+	return err
+}
+
+// updateUser applies the set expression to the user,
+// failing with sql.ErrNoRows if there is no such user.
+func updateUser(ctx context.Context, uid int64, set string, args ...any) error {
+	res, err := db.NewUpdate().Model((*User)(nil)).
+		Set(set, args...).
+		Where(`id = ?`, uid).Exec(ctx)
 	if err != nil {
 		return err
 	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return sql.ErrNoRows
+	}
 	return nil
 }
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+	"unicode/utf8"
+
+	"github.com/uptrace/bun"
+)
+
+var ErrLocked = errors.New(`path is locked`)
+
+// PropPatch sets or, if Remove, removes dead properties.
+type PropPatch struct {
+	Remove bool
+	Props  []DAVProperty
+}
+
+// GetDeadProps returns the dead properties of the user at the path.
+func GetDeadProps(ctx context.Context, uid int64, p string) (props []DAVProperty, err error) {
+	err = db.NewSelect().Model(&props).
+		Where(`uid = ?`, uid).
+		Where(`path = ?`, p).Scan(ctx)
+	return props, err
+}
+
+// PatchDeadProps applies the patches in order, all or none of them.
+func PatchDeadProps(ctx context.Context, uid int64, p string, patches []PropPatch) error {
+	return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		for _, patch := range patches {
+			for _, prop := range patch.Props {
+				prop.UserID, prop.Path = uid, p
+
+				var err error
+				if patch.Remove {
+					_, err = tx.NewDelete().Model(&prop).WherePK().Exec(ctx)
+				} else {
+					_, err = tx.NewInsert().Model(&prop).
+						On(`CONFLICT (uid, path, space, local) DO UPDATE`).
+						Set(`lang = EXCLUDED.lang`).
+						Set(`inner_xml = EXCLUDED.inner_xml`).Exec(ctx)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteDeadProps deletes the dead properties of the user
+// at the path and below it.
+func DeleteDeadProps(ctx context.Context, uid int64, p string) error {
+	_, err := db.NewDelete().Model((*DAVProperty)(nil)).
+		Where(`uid = ?`, uid).
+		WhereGroup(` AND `, func(q *bun.DeleteQuery) *bun.DeleteQuery {
+			return q.Where(`path = ?`, p).WhereOr(`path LIKE ?`, escapeLike(p)+`/%`)
+		}).Exec(ctx)
+	return err
+}
+
+// MoveDeadProps moves the dead properties of the user at from and below
+// it to to, replacing the ones that were there.
+func MoveDeadProps(ctx context.Context, uid int64, from, to string) error {
+	return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewDelete().Model((*DAVProperty)(nil)).
+			Where(`uid = ?`, uid).
+			WhereGroup(` AND `, func(q *bun.DeleteQuery) *bun.DeleteQuery {
+				return q.Where(`path = ?`, to).WhereOr(`path LIKE ?`, escapeLike(to)+`/%`)
+			}).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.NewUpdate().Model((*DAVProperty)(nil)).
+			Set(`path = ? || substr(path, ?)`, to, utf8.RuneCountInString(from)+1).
+			Where(`uid = ?`, uid).
+			WhereGroup(` AND `, func(q *bun.UpdateQuery) *bun.UpdateQuery {
+				return q.Where(`path = ?`, from).WhereOr(`path LIKE ?`, escapeLike(from)+`/%`)
+			}).Exec(ctx)
+		return err
+	})
+}
+
+// CreateDAVLock stores the lock unless it conflicts with another
+// unexpired lock of the user, in which case it fails with ErrLocked.
+// A lock conflicts with locks on the same path, with depth infinity
+// locks above it and, if it has depth infinity itself, with locks below.
+func CreateDAVLock(ctx context.Context, l DAVLock, now time.Time) error {
+	return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		// The user row serializes the conflict check.
+		_, err := tx.NewSelect().Model((*User)(nil)).Column(`id`).
+			Where(`id = ?`, l.UserID).
+			For(`UPDATE`).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.NewDelete().Model((*DAVLock)(nil)).
+			Where(`uid = ?`, l.UserID).
+			Where(`expires_at <= ?`, now).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		locked, err := tx.NewSelect().Model((*DAVLock)(nil)).
+			Where(`uid = ?`, l.UserID).
+			WhereGroup(` AND `, func(q *bun.SelectQuery) *bun.SelectQuery {
+				q = q.Where(`root = ?`, l.Root).
+					WhereOr(`NOT zero_depth AND (root = '/' OR left(?, length(root) + 1) = root || '/')`, l.Root)
+				if !l.ZeroDepth {
+					q = q.WhereOr(`? = '/' OR root LIKE ?`, l.Root, escapeLike(l.Root)+`/%`)
+				}
+				return q
+			}).Exists(ctx)
+		if err != nil {
+			return err
+		}
+		if locked {
+			return ErrLocked
+		}
+
+		_, err = tx.NewInsert().Model(&l).Exec(ctx)
+		return err
+	})
+}
+
+// GetDAVLocks returns the unexpired locks of the user with the tokens.
+func GetDAVLocks(ctx context.Context, uid int64, tokens []string, now time.Time) (locks []DAVLock, err error) {
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	err = db.NewSelect().Model(&locks).
+		Where(`uid = ?`, uid).
+		Where(`token IN (?)`, bun.In(tokens)).
+		Where(`expires_at > ?`, now).Scan(ctx)
+	return locks, err
+}
+
+// RefreshDAVLock extends the unexpired lock of the user with the token.
+func RefreshDAVLock(ctx context.Context, uid int64, token string, timeout int64, expires, now time.Time) (l DAVLock, err error) {
+	_, err = db.NewUpdate().Model(&l).
+		Set(`timeout = ?`, timeout).
+		Set(`expires_at = ?`, expires).
+		Where(`uid = ?`, uid).
+		Where(`token = ?`, token).
+		Where(`expires_at > ?`, now).
+		Returning(`*`).Exec(ctx)
+	if err == nil && l.Token == `` {
+		err = sql.ErrNoRows
+	}
+	return l, err
+}
+
+// DeleteDAVLock fails with sql.ErrNoRows if the user has no unexpired lock with the token.
+func DeleteDAVLock(ctx context.Context, uid int64, token string, now time.Time) error {
+	res, err := db.NewDelete().Model((*DAVLock)(nil)).
+		Where(`uid = ?`, uid).
+		Where(`token = ?`, token).
+		Where(`expires_at > ?`, now).Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
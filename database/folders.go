@@ -0,0 +1,255 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/uptrace/bun"
+)
+
+var ErrNotEmpty = errors.New(`folder is not empty`)
+
+// EnsureFolder creates the folder of the user at the slash separated
+// absolute path together with its missing parents.
+func EnsureFolder(ctx context.Context, uid int64, folderPath string) error {
+	var folders []Folder
+	for p := folderPath; p != `/`; p = path.Dir(p) {
+		folders = append(folders, Folder{
+			UserID: uid,
+			Parent: path.Dir(p),
+			Name:   path.Base(p),
+			Path:   p,
+		})
+	}
+	if len(folders) == 0 {
+		return nil
+	}
+
+	return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		// Only the folders that were missing are returned.
+		var created []Folder
+		_, err := tx.NewInsert().Model(&folders).
+			On(`CONFLICT (uid, path) DO NOTHING`).
+			Returning(`*`).Exec(ctx, &created)
+		if err != nil {
+			return err
+		}
+
+		// Parents first.
+		sort.Slice(created, func(i, j int) bool { return created[i].Path < created[j].Path })
+		changes := make([]Change, len(created))
+		for i, f := range created {
+			changes[i] = folderChange(ChangeCreate, f)
+		}
+		return journal(ctx, tx, uid, changes...)
+	})
+}
+
+// GetFolder returns the folder of the user with the path.
+func GetFolder(ctx context.Context, uid int64, folderPath string) (f Folder, err error) {
+	err = db.NewSelect().Model(&f).
+		Where(`uid = ?`, uid).
+		Where(`path = ?`, folderPath).Scan(ctx)
+	return f, err
+}
+
+// GetFolders returns the folders of the user directly inside parent.
+func GetFolders(ctx context.Context, uid int64, parent string) (folders []Folder, err error) {
+	err = db.NewSelect().Model(&folders).
+		Where(`uid = ?`, uid).
+		Where(`parent = ?`, parent).
+		Order(`name`).Scan(ctx)
+	return folders, err
+}
+
+// GetFolderByID returns the folder of the user with the id.
+func GetFolderByID(ctx context.Context, uid, id int64) (f Folder, err error) {
+	err = db.NewSelect().Model(&f).
+		Where(`uid = ?`, uid).
+		Where(`id = ?`, id).Scan(ctx)
+	return f, err
+}
+
+// GetFoldersBelow returns the folders of the user inside the folder
+// at the path, however deep, ordered by path.
+func GetFoldersBelow(ctx context.Context, uid int64, folderPath string) (folders []Folder, err error) {
+	q := db.NewSelect().Model(&folders).Where(`uid = ?`, uid)
+	if folderPath != `/` {
+		q = q.Where(`path LIKE ?`, escapeLike(folderPath)+`/%`)
+	}
+	err = q.Order(`path`).Scan(ctx)
+	return folders, err
+}
+
+// DeleteFolder deletes the folder of the user with the id. It fails with
+// ErrNotEmpty while files or other folders are inside.
+func DeleteFolder(ctx context.Context, uid, id int64) error {
+	return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		var f Folder
+		err := tx.NewSelect().Model(&f).
+			Where(`uid = ?`, uid).
+			Where(`id = ?`, id).
+			For(`UPDATE`).Scan(ctx)
+		if err != nil {
+			return err
+		}
+
+		inside := escapeLike(f.Path) + `/%`
+		hasFolders, err := tx.NewSelect().Model((*Folder)(nil)).
+			Where(`uid = ?`, uid).
+			Where(`path LIKE ?`, inside).Exists(ctx)
+		if err != nil {
+			return err
+		}
+
+		hasFiles, err := tx.NewSelect().Model((*File)(nil)).
+			Where(`uid = ?`, uid).
+			WhereGroup(` AND `, func(q *bun.SelectQuery) *bun.SelectQuery {
+				return q.Where(`folder = ?`, f.Path).WhereOr(`folder LIKE ?`, inside)
+			}).Exists(ctx)
+		if err != nil {
+			return err
+		}
+
+		if hasFolders || hasFiles {
+			return ErrNotEmpty
+		}
+
+		_, err = tx.NewDelete().Model((*Share)(nil)).Where(`folder_id = ?`, f.ID).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		res, err := tx.NewDelete().Model((*Folder)(nil)).Where(`id = ?`, f.ID).Exec(ctx)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return sql.ErrNoRows
+		}
+		return journal(ctx, tx, uid, folderChange(ChangeDelete, f))
+	})
+}
+
+// DeleteTree deletes the folder of the user at the path with everything
+// inside, and the links to the files and folders. It returns the files so the caller
+// can purge the blobs.
+func DeleteTree(ctx context.Context, uid int64, folderPath string) (files []File, err error) {
+	inside := escapeLike(folderPath) + `/%`
+	err = db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewDelete().Model((*Share)(nil)).
+			Where(`file_id IN (SELECT id FROM files WHERE uid = ? AND (folder = ? OR folder LIKE ?))`,
+				uid, folderPath, inside).
+			WhereOr(`folder_id IN (SELECT id FROM folders WHERE uid = ? AND (path = ? OR path LIKE ?))`,
+				uid, folderPath, inside).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.NewDelete().Model(&files).
+			Where(`uid = ?`, uid).
+			WhereGroup(` AND `, func(q *bun.DeleteQuery) *bun.DeleteQuery {
+				return q.Where(`folder = ?`, folderPath).WhereOr(`folder LIKE ?`, inside)
+			}).
+			Returning(`*`).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		var folders []Folder
+		_, err = tx.NewDelete().Model(&folders).
+			Where(`uid = ?`, uid).
+			WhereGroup(` AND `, func(q *bun.DeleteQuery) *bun.DeleteQuery {
+				return q.Where(`path = ?`, folderPath).WhereOr(`path LIKE ?`, inside)
+			}).
+			Returning(`*`).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		// The files, then the folders from the deepest up.
+		sort.Slice(folders, func(i, j int) bool { return folders[i].Path > folders[j].Path })
+		changes := make([]Change, 0, len(files)+len(folders))
+		for _, f := range files {
+			changes = append(changes, fileChange(ChangeDelete, f))
+		}
+		for _, f := range folders {
+			changes = append(changes, folderChange(ChangeDelete, f))
+		}
+		return journal(ctx, tx, uid, changes...)
+	})
+	return files, err
+}
+
+// MoveTree moves the folder of the user at from with everything inside
+// to the path to, whose parent must exist.
+func MoveTree(ctx context.Context, uid int64, from, to string) error {
+	var (
+		inside = escapeLike(from) + `/%`
+		// substr counts characters, not bytes.
+		rest = utf8.RuneCountInString(from) + 1
+	)
+	return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		// SET sees the old row, so path and parent are compared before the update.
+		var folders []Folder
+		_, err := tx.NewUpdate().Model(&folders).
+			Set(`path = ? || substr(path, ?)`, to, rest).
+			Set(`parent = CASE WHEN path = ? THEN ? ELSE ? || substr(parent, ?) END`, from, path.Dir(to), to, rest).
+			Set(`name = CASE WHEN path = ? THEN ? ELSE name END`, from, path.Base(to)).
+			Where(`uid = ?`, uid).
+			WhereGroup(` AND `, func(q *bun.UpdateQuery) *bun.UpdateQuery {
+				return q.Where(`path = ?`, from).WhereOr(`path LIKE ?`, inside)
+			}).
+			Returning(`*`).Exec(ctx)
+		if err != nil {
+			return uniqueViolation(err)
+		}
+
+		var files []File
+		_, err = tx.NewUpdate().Model(&files).
+			Set(`folder = ? || substr(folder, ?)`, to, rest).
+			Where(`uid = ?`, uid).
+			WhereGroup(` AND `, func(q *bun.UpdateQuery) *bun.UpdateQuery {
+				return q.Where(`folder = ?`, from).WhereOr(`folder LIKE ?`, inside)
+			}).
+			Returning(`*`).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		// The folders from the top down, then the files.
+		sort.Slice(folders, func(i, j int) bool { return folders[i].Path < folders[j].Path })
+		changes := make([]Change, 0, len(folders)+len(files))
+		for _, f := range folders {
+			changes = append(changes, movedFolderChange(f, from, to))
+		}
+		for _, f := range files {
+			c := fileChange(ChangeMove, f)
+			c.OldFolder = from + strings.TrimPrefix(f.Folder, to)
+			c.OldName = f.Name
+			changes = append(changes, c)
+		}
+		return journal(ctx, tx, uid, changes...)
+	})
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package database
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/uptrace/bun"
+)
+
+// GetLFSObjects returns the objects of the repository among the oids.
+func GetLFSObjects(ctx context.Context, uid int64, repo string, oids []string) (objects []LFSObject, err error) {
+	if len(oids) == 0 {
+		return nil, nil
+	}
+
+	err = db.NewSelect().Model(&objects).
+		Where(`uid = ?`, uid).
+		Where(`repo = ?`, repo).
+		Where(`oid IN (?)`, bun.In(oids)).Scan(ctx)
+	return objects, err
+}
+
+func GetLFSObject(ctx context.Context, uid int64, repo, oid string) (o LFSObject, err error) {
+	err = db.NewSelect().Model(&o).
+		Where(`uid = ?`, uid).
+		Where(`repo = ?`, repo).
+		Where(`oid = ?`, oid).Scan(ctx)
+	return o, err
+}
+
+// SaveLFSObject records the object unless the repository has it already.
+func SaveLFSObject(ctx context.Context, o LFSObject) error {
+	_, err := db.NewInsert().Model(&o).
+		On(`CONFLICT (uid, repo, oid) DO NOTHING`).Exec(ctx)
+	return err
+}
+
+// CreateLFSLock fails with ErrDuplicate if the path is locked already.
+func CreateLFSLock(ctx context.Context, l LFSLock) (lock LFSLock, err error) {
+	_, err = db.NewInsert().Model(&l).Returning(`*`).Exec(ctx)
+	return l, uniqueViolation(err)
+}
+
+func GetLFSLockAt(ctx context.Context, uid int64, repo, path string) (l LFSLock, err error) {
+	err = db.NewSelect().Model(&l).
+		Where(`uid = ?`, uid).
+		Where(`repo = ?`, repo).
+		Where(`path = ?`, path).Scan(ctx)
+	return l, err
+}
+
+// LFSLockFilter narrows a listing of locks to the path or the id if set.
+type LFSLockFilter struct {
+	Path string
+	ID   int64
+}
+
+// GetLFSLocks returns up to limit locks of the repository
+// with ids greater than after, by id.
+func GetLFSLocks(ctx context.Context, uid int64, repo string, filter LFSLockFilter, after int64, limit int) (locks []LFSLock, err error) {
+	q := db.NewSelect().Model(&locks).
+		Where(`uid = ?`, uid).
+		Where(`repo = ?`, repo).
+		Where(`id > ?`, after)
+	if filter.Path != `` {
+		q = q.Where(`path = ?`, filter.Path)
+	}
+	if filter.ID != 0 {
+		q = q.Where(`id = ?`, filter.ID)
+	}
+
+	err = q.Order(`id`).Limit(limit).Scan(ctx)
+	return locks, err
+}
+
+// DeleteLFSLock deletes the lock of the repository with the id and
+// returns it. It fails with sql.ErrNoRows if there is none.
+func DeleteLFSLock(ctx context.Context, uid int64, repo string, id int64) (l LFSLock, err error) {
+	_, err = db.NewDelete().Model(&l).
+		Where(`uid = ?`, uid).
+		Where(`repo = ?`, repo).
+		Where(`id = ?`, id).
+		Returning(`*`).Exec(ctx)
+	if err == nil && l.ID == 0 {
+		err = sql.ErrNoRows
+	}
+	return l, err
+}
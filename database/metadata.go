@@ -0,0 +1,152 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+func GetFileMetadata(ctx context.Context, fileID int64) (m FileMetadata, err error) {
+	err = db.NewSelect().Model(&m).Where(`file_id = ?`, fileID).Scan(ctx)
+	return m, err
+}
+
+// SaveFileMetadata stores the metadata of a file, replacing what was
+// read from it before.
+func SaveFileMetadata(ctx context.Context, m FileMetadata) error {
+	_, err := db.NewInsert().Model(&m).
+		On(`CONFLICT (file_id) DO UPDATE`).
+		Set(`taken_at = EXCLUDED.taken_at`).
+		Set(`camera_make = EXCLUDED.camera_make`).
+		Set(`camera_model = EXCLUDED.camera_model`).
+		Set(`orientation = EXCLUDED.orientation`).
+		Set(`latitude = EXCLUDED.latitude`).
+		Set(`longitude = EXCLUDED.longitude`).
+		Set(`width = EXCLUDED.width`).
+		Set(`height = EXCLUDED.height`).
+		Set(`title = EXCLUDED.title`).
+		Set(`artist = EXCLUDED.artist`).
+		Set(`album = EXCLUDED.album`).
+		Set(`year = EXCLUDED.year`).
+		Set(`duration = EXCLUDED.duration`).
+		Exec(ctx)
+	return err
+}
+
+// GetFilesWithoutMetadata returns up to limit files with one of the MIME
+// types that haven't been read yet, in order of their ids after after.
+func GetFilesWithoutMetadata(ctx context.Context, mimeTypes []string, after int64, limit int) (files []File, err error) {
+	err = db.NewSelect().Model(&files).
+		Where(`f.mime_type IN (?)`, bun.In(mimeTypes)).
+		Where(`f.id > ?`, after).
+		Where(`NOT EXISTS (SELECT 1 FROM file_metadata AS fm WHERE fm.file_id = f.id)`).
+		OrderExpr(`f.id ASC`).
+		Limit(limit).
+		Scan(ctx)
+	return files, err
+}
+
+// DeleteOrphanMetadata removes the metadata of files that are gone.
+func DeleteOrphanMetadata(ctx context.Context) error {
+	_, err := db.NewDelete().Model((*FileMetadata)(nil)).
+		Where(`NOT EXISTS (SELECT 1 FROM files AS f WHERE f.id = fm.file_id)`).
+		Exec(ctx)
+	return err
+}
+
+// TimelinePhoto is a photo with its metadata, if it has been read.
+type TimelinePhoto struct {
+	File     `bun:",extend"`
+	Metadata *FileMetadata `bun:"rel:has-one,join:id=file_id"`
+}
+
+// TakenAt is when the photo shows up in the timeline: when it was taken
+// or, if that isn't known, when it was last modified.
+func (p TimelinePhoto) TakenAt() time.Time {
+	if p.Metadata != nil && !p.Metadata.TakenAt.IsZero() {
+		return p.Metadata.TakenAt.UTC()
+	}
+	return p.ModifiedAt.UTC()
+}
+
+// TimelineDay is a day of the timeline, as YYYY-MM-DD, with its photos
+// newest first.
+type TimelineDay struct {
+	Date   string
+	Photos []TimelinePhoto
+}
+
+// timelineDay is the day of a photo in the timeline. The times photos were
+// taken are the cameras' wall clocks, stored as UTC, so days are in UTC.
+const timelineDay = `to_char(coalesce("metadata".taken_at, f.modified_at) AT TIME ZONE 'UTC', 'YYYY-MM-DD')`
+
+// GetTimeline returns up to limit days with photos of the user, newest
+// first, before the day given as the cursor. The cursor for the next
+// days is returned if there are more.
+func GetTimeline(ctx context.Context, uid int64, cursor string, limit int) (days []TimelineDay, next string, err error) {
+	if cursor != `` {
+		if _, err := time.Parse(`2006-01-02`, cursor); err != nil {
+			return nil, ``, ErrInvalidCursor
+		}
+	}
+
+	q := db.NewSelect().Model((*File)(nil)).
+		ColumnExpr(`DISTINCT `+timelineDay+` AS day`).
+		Join(`LEFT JOIN file_metadata AS "metadata" ON "metadata".file_id = f.id`).
+		Where(`f.uid = ?`, uid).
+		Where(`f.mime_type LIKE 'image/%'`)
+	if cursor != `` {
+		q = q.Where(timelineDay+` < ?`, cursor)
+	}
+	var dates []string
+	// One extra day tells whether there are more.
+	err = q.OrderExpr(`day DESC`).Limit(limit+1).Scan(ctx, &dates)
+	if err != nil || len(dates) == 0 {
+		return []TimelineDay{}, ``, err
+	}
+	if len(dates) > limit {
+		dates = dates[:limit]
+		next = dates[limit-1]
+	}
+
+	var list []TimelinePhoto
+	err = db.NewSelect().Model(&list).
+		Relation(`Metadata`).
+		Where(`f.uid = ?`, uid).
+		Where(`f.mime_type LIKE 'image/%'`).
+		Where(timelineDay+` BETWEEN ? AND ?`, dates[len(dates)-1], dates[0]).
+		OrderExpr(`coalesce("metadata".taken_at, f.modified_at) DESC, f.id DESC`).
+		Scan(ctx)
+	if err != nil {
+		return nil, ``, err
+	}
+
+	days = make([]TimelineDay, len(dates))
+	index := make(map[string]int, len(dates))
+	for i, d := range dates {
+		days[i].Date, index[d] = d, i
+	}
+	for _, p := range list {
+		if i, ok := index[p.TakenAt().Format(`2006-01-02`)]; ok {
+			days[i].Photos = append(days[i].Photos, p)
+		}
+	}
+	return days, next, nil
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package database
+
+import "context"
+
+// models get their tables created if they don't exist yet.
+var models = []any{
+	(*User)(nil),
+	(*File)(nil),
+	(*Session)(nil),
+	(*LoginAttempt)(nil),
+	(*AuditEvent)(nil),
+	(*UserToken)(nil),
+	(*Invite)(nil),
+	(*PersonalToken)(nil),
+	(*Folder)(nil),
+	(*Upload)(nil),
+	(*Share)(nil),
+	(*Change)(nil),
+	(*AppPassword)(nil),
+	(*DAVProperty)(nil),
+	(*DAVLock)(nil),
+	(*AccessKey)(nil),
+	(*MultipartUpload)(nil),
+	(*MultipartPart)(nil),
+	(*SSHKey)(nil),
+	(*LFSObject)(nil),
+	(*LFSLock)(nil),
+	(*RegistryBlob)(nil),
+	(*RegistryManifest)(nil),
+	(*RegistryReference)(nil),
+	(*RegistryTag)(nil),
+	(*RegistryUpload)(nil),
+	(*ResticObject)(nil),
+	(*FileMetadata)(nil),
+}
+
+// migrations bring tables created by older versions up to date.
+// They run on every start, so each statement must be idempotent.
+var migrations = []string{
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS email VARCHAR`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT FALSE`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS users_email_key ON users (lower(email))`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS status VARCHAR NOT NULL DEFAULT 'active'`,
+	// Fails if the table already contains duplicate logins,
+	// they have to be renamed by hand before upgrading.
+	`CREATE UNIQUE INDEX IF NOT EXISTS users_login_key ON users (login)`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR NOT NULL DEFAULT 'user'`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS quota BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE files ADD COLUMN IF NOT EXISTS size BIGINT NOT NULL DEFAULT 0`,
+	// Existing rows get numbered, the index stands in for the primary key.
+	`ALTER TABLE files ADD COLUMN IF NOT EXISTS id BIGSERIAL`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS files_id_key ON files (id)`,
+	`ALTER TABLE files ADD COLUMN IF NOT EXISTS folder VARCHAR NOT NULL DEFAULT '/'`,
+	`ALTER TABLE files ADD COLUMN IF NOT EXISTS mime_type VARCHAR NOT NULL DEFAULT 'application/octet-stream'`,
+	`ALTER TABLE files ADD COLUMN IF NOT EXISTS modified_at TIMESTAMPTZ NOT NULL DEFAULT current_timestamp`,
+	`CREATE INDEX IF NOT EXISTS files_uid_folder_idx ON files (uid, folder)`,
+	`ALTER TABLE sessions ADD COLUMN IF NOT EXISTS refresh_hash VARCHAR`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS sessions_refresh_hash_key ON sessions (refresh_hash)`,
+	`CREATE INDEX IF NOT EXISTS folders_uid_parent_idx ON folders (uid, parent)`,
+	`CREATE INDEX IF NOT EXISTS shares_file_id_idx ON shares (file_id)`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS change_seq BIGINT NOT NULL DEFAULT 0`,
+	`CREATE INDEX IF NOT EXISTS changes_created_at_idx ON changes (created_at)`,
+	`CREATE INDEX IF NOT EXISTS dav_locks_uid_idx ON dav_locks (uid)`,
+	`CREATE INDEX IF NOT EXISTS registry_references_checksum_idx ON registry_references (uid, repo, checksum)`,
+	// Shares link to either a file or a folder.
+	`ALTER TABLE shares ALTER COLUMN file_id DROP NOT NULL`,
+	`ALTER TABLE shares ADD COLUMN IF NOT EXISTS folder_id BIGINT`,
+	`CREATE INDEX IF NOT EXISTS shares_folder_id_idx ON shares (folder_id)`,
+	`ALTER TABLE uploads ADD COLUMN IF NOT EXISTS extract BOOLEAN NOT NULL DEFAULT FALSE`,
+	`CREATE INDEX IF NOT EXISTS file_metadata_uid_taken_at_idx ON file_metadata (uid, taken_at)`,
+	`ALTER TABLE shares ADD COLUMN IF NOT EXISTS strip_gps BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE changes ADD COLUMN IF NOT EXISTS folder_id BIGINT`,
+}
+
+func migrate(ctx context.Context) error {
+	for _, model := range models {
+		_, err := db.NewCreateTable().Model(model).IfNotExists().Exec(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, query := range migrations {
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -16,18 +16,381 @@ limitations under the License.
 
 package database
 
-import "github.com/uptrace/bun"
+import (
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+const (
+	StatusActive  = `active`
+	StatusPending = `pending`
+
+	RoleAdmin    = `admin`
+	RoleUser     = `user`
+	RoleReadOnly = `readonly`
+)
 
 type User struct {
 	bun.BaseModel `bun:"table:users,alias:u"`
 	ID            int64  `bun:"id,pk,autoincrement"`
-	Login         string `bun:"login,notnull" json:"login"`
+	Login         string `bun:"login,notnull,unique" json:"login"`
 	Password      string `bun:"password,notnull" json:"password"`
+	Email         string `bun:"email,nullzero" json:"email"`
+	EmailVerified bool   `bun:"email_verified,notnull,default:false" json:"-"`
+	Status        string `bun:"status,notnull,default:'active'" json:"-"`
+	Role          string `bun:"role,notnull,default:'user'" json:"-"`
+	Disabled      bool   `bun:"disabled,notnull,default:false" json:"-"`
+	Quota         int64  `bun:"quota,notnull,default:0" json:"-"`      // bytes, 0 is unlimited
+	ChangeSeq     int64  `bun:"change_seq,notnull,default:0" json:"-"` // number of the last change
 }
 
+// File is an entry in a folder of the user, its content is the blob
+// named after the checksum. Folders are slash separated absolute paths.
 type File struct {
 	bun.BaseModel `bun:"table:files,alias:f"`
-	UserID        int64  `bun:"uid,notnull"`
-	Name          string `bun:"name,notnull" json:"filename"`
-	Checksum      string `bun:"checksum,notnull" json:"checksum"`
+	ID            int64     `bun:"id,pk,autoincrement" json:"id"`
+	UserID        int64     `bun:"uid,notnull" json:"-"`
+	Folder        string    `bun:"folder,notnull,default:'/'" json:"folder"`
+	Name          string    `bun:"name,notnull" json:"filename"`
+	Checksum      string    `bun:"checksum,notnull" json:"checksum"`
+	Size          int64     `bun:"size,notnull,default:0" json:"size"`
+	MimeType      string    `bun:"mime_type,notnull,default:'application/octet-stream'" json:"mime_type"`
+	ModifiedAt    time.Time `bun:"modified_at,notnull,default:current_timestamp" json:"modified_at"`
+}
+
+// Session is a login. Access tokens name it and are only valid while it
+// exists; the refresh token, of which only the hash is stored, renews it.
+type Session struct {
+	bun.BaseModel `bun:"table:sessions,alias:s"`
+	ID            string    `bun:"id,pk"`
+	UserID        int64     `bun:"uid,notnull"`
+	RefreshHash   string    `bun:"refresh_hash,nullzero,unique"`
+	CreatedAt     time.Time `bun:"created_at,notnull,default:current_timestamp"`
+	ExpiresAt     time.Time `bun:"expires_at,notnull"`
+}
+
+// PersonalToken is a long lived API token for scripts and other clients.
+// Only the SHA-256 hash of the token is stored.
+type PersonalToken struct {
+	bun.BaseModel `bun:"table:personal_tokens,alias:pt"`
+	ID            int64     `bun:"id,pk,autoincrement" json:"id"`
+	UserID        int64     `bun:"uid,notnull" json:"-"`
+	Name          string    `bun:"name,notnull" json:"name"`
+	Hash          string    `bun:"hash,notnull,unique" json:"-"`
+	CreatedAt     time.Time `bun:"created_at,notnull,default:current_timestamp" json:"created_at"`
+	ExpiresAt     time.Time `bun:"expires_at,nullzero" json:"expires_at,omitempty"`
+	LastUsedAt    time.Time `bun:"last_used_at,nullzero" json:"last_used_at,omitempty"`
+}
+
+// AppPassword lets WebDAV and other clients that only speak Basic auth
+// sign in without the account password. Only the SHA-256 hash is stored.
+type AppPassword struct {
+	bun.BaseModel `bun:"table:app_passwords,alias:ap"`
+	ID            int64     `bun:"id,pk,autoincrement" json:"id"`
+	UserID        int64     `bun:"uid,notnull" json:"-"`
+	Name          string    `bun:"name,notnull" json:"name"`
+	Hash          string    `bun:"hash,notnull,unique" json:"-"`
+	CreatedAt     time.Time `bun:"created_at,notnull,default:current_timestamp" json:"created_at"`
+	LastUsedAt    time.Time `bun:"last_used_at,nullzero" json:"last_used_at,omitempty"`
+}
+
+// AccessKey signs S3 requests of the user. SigV4 needs the secret itself
+// to check signatures, so it is stored sealed instead of hashed.
+type AccessKey struct {
+	bun.BaseModel `bun:"table:access_keys,alias:ak"`
+	ID            int64     `bun:"id,pk,autoincrement" json:"id"`
+	UserID        int64     `bun:"uid,notnull" json:"-"`
+	Name          string    `bun:"name,notnull" json:"name"`
+	KeyID         string    `bun:"key_id,notnull,unique" json:"access_key_id"`
+	SealedSecret  []byte    `bun:"sealed_secret,notnull" json:"-"`
+	CreatedAt     time.Time `bun:"created_at,notnull,default:current_timestamp" json:"created_at"`
+	LastUsedAt    time.Time `bun:"last_used_at,nullzero" json:"last_used_at,omitempty"`
+}
+
+// SSHKey lets the user sign in to the SFTP server with the private key.
+// PublicKey is in authorized_keys format, without the comment.
+type SSHKey struct {
+	bun.BaseModel `bun:"table:ssh_keys,alias:sk"`
+	ID            int64     `bun:"id,pk,autoincrement" json:"id"`
+	UserID        int64     `bun:"uid,notnull,unique:ssh_keys_uid_fingerprint_key" json:"-"`
+	Name          string    `bun:"name,notnull" json:"name"`
+	PublicKey     string    `bun:"public_key,notnull" json:"public_key"`
+	Fingerprint   string    `bun:"fingerprint,notnull,unique:ssh_keys_uid_fingerprint_key" json:"fingerprint"`
+	CreatedAt     time.Time `bun:"created_at,notnull,default:current_timestamp" json:"created_at"`
+	LastUsedAt    time.Time `bun:"last_used_at,nullzero" json:"last_used_at,omitempty"`
+}
+
+// LFSObject is a Git LFS object of a repository of the user. The object
+// id is the SHA-256 of the content, so it is stored as a blob like files.
+type LFSObject struct {
+	bun.BaseModel `bun:"table:lfs_objects,alias:lo"`
+	ID            int64     `bun:"id,pk,autoincrement"`
+	UserID        int64     `bun:"uid,notnull,unique:lfs_objects_uid_repo_oid_key"`
+	Repo          string    `bun:"repo,notnull,unique:lfs_objects_uid_repo_oid_key"`
+	OID           string    `bun:"oid,notnull,unique:lfs_objects_uid_repo_oid_key"`
+	Size          int64     `bun:"size,notnull"`
+	CreatedAt     time.Time `bun:"created_at,notnull,default:current_timestamp"`
+}
+
+// LFSLock is a Git LFS lock on a path of a repository of the user.
+type LFSLock struct {
+	bun.BaseModel `bun:"table:lfs_locks,alias:ll"`
+	ID            int64     `bun:"id,pk,autoincrement"`
+	UserID        int64     `bun:"uid,notnull,unique:lfs_locks_uid_repo_path_key"`
+	Repo          string    `bun:"repo,notnull,unique:lfs_locks_uid_repo_path_key"`
+	Path          string    `bun:"path,notnull,unique:lfs_locks_uid_repo_path_key"`
+	LockedAt      time.Time `bun:"locked_at,notnull,default:current_timestamp"`
+}
+
+// RegistryBlob is a layer or config blob of a container repository of
+// the user. Like files it is stored as the blob named after its checksum.
+type RegistryBlob struct {
+	bun.BaseModel `bun:"table:registry_blobs,alias:rb"`
+	ID            int64     `bun:"id,pk,autoincrement"`
+	UserID        int64     `bun:"uid,notnull,unique:registry_blobs_uid_repo_checksum_key"`
+	Repo          string    `bun:"repo,notnull,unique:registry_blobs_uid_repo_checksum_key"`
+	Checksum      string    `bun:"checksum,notnull,unique:registry_blobs_uid_repo_checksum_key"`
+	Size          int64     `bun:"size,notnull"`
+	CreatedAt     time.Time `bun:"created_at,notnull,default:current_timestamp"`
+}
+
+// RegistryManifest is an image manifest or index of a container
+// repository of the user, stored as a blob like layers.
+type RegistryManifest struct {
+	bun.BaseModel `bun:"table:registry_manifests,alias:rm"`
+	ID            int64     `bun:"id,pk,autoincrement"`
+	UserID        int64     `bun:"uid,notnull,unique:registry_manifests_uid_repo_checksum_key"`
+	Repo          string    `bun:"repo,notnull,unique:registry_manifests_uid_repo_checksum_key"`
+	Checksum      string    `bun:"checksum,notnull,unique:registry_manifests_uid_repo_checksum_key"`
+	MediaType     string    `bun:"media_type,notnull"`
+	Size          int64     `bun:"size,notnull"`
+	CreatedAt     time.Time `bun:"created_at,notnull,default:current_timestamp"`
+}
+
+// RegistryReference is a blob or manifest a manifest refers to. Blobs
+// without references are collected as garbage.
+type RegistryReference struct {
+	bun.BaseModel `bun:"table:registry_references,alias:rr"`
+	UserID        int64  `bun:"uid,pk"`
+	Repo          string `bun:"repo,pk"`
+	Manifest      string `bun:"manifest,pk"`
+	Checksum      string `bun:"checksum,pk"`
+}
+
+// RegistryTag names a manifest of a container repository of the user.
+type RegistryTag struct {
+	bun.BaseModel `bun:"table:registry_tags,alias:rt"`
+	UserID        int64     `bun:"uid,pk"`
+	Repo          string    `bun:"repo,pk"`
+	Tag           string    `bun:"tag,pk"`
+	Manifest      string    `bun:"manifest,notnull"`
+	UpdatedAt     time.Time `bun:"updated_at,notnull,default:current_timestamp"`
+}
+
+// RegistryUpload is a blob upload to a container repository in progress.
+// The received bytes are kept in a file named after the id.
+type RegistryUpload struct {
+	bun.BaseModel `bun:"table:registry_uploads,alias:ru"`
+	ID            string    `bun:"id,pk"`
+	UserID        int64     `bun:"uid,notnull"`
+	Repo          string    `bun:"repo,notnull"`
+	Offset        int64     `bun:"received,notnull,default:0"`
+	CreatedAt     time.Time `bun:"created_at,notnull,default:current_timestamp"`
+	ExpiresAt     time.Time `bun:"expires_at,notnull"`
+}
+
+// ResticObject is a file of a restic repository of the user: the config,
+// a key, a lock, a snapshot, an index or a pack of data. It is stored as
+// the blob named after its checksum, which restic uses as name but for
+// the config.
+type ResticObject struct {
+	bun.BaseModel `bun:"table:restic_objects,alias:ro"`
+	ID            int64     `bun:"id,pk,autoincrement"`
+	UserID        int64     `bun:"uid,notnull,unique:restic_objects_uid_repo_type_name_key"`
+	Repo          string    `bun:"repo,notnull,unique:restic_objects_uid_repo_type_name_key"`
+	Type          string    `bun:"type,notnull,unique:restic_objects_uid_repo_type_name_key"`
+	Name          string    `bun:"name,notnull,unique:restic_objects_uid_repo_type_name_key"`
+	Checksum      string    `bun:"checksum,notnull"`
+	Size          int64     `bun:"size,notnull"`
+	CreatedAt     time.Time `bun:"created_at,notnull,default:current_timestamp"`
+}
+
+// Folder is a folder of the user. Files refer to it by path, the root
+// folder "/" always exists and has no row.
+type Folder struct {
+	bun.BaseModel `bun:"table:folders,alias:fo"`
+	ID            int64     `bun:"id,pk,autoincrement" json:"id"`
+	UserID        int64     `bun:"uid,notnull,unique:folders_uid_path_key" json:"-"`
+	Parent        string    `bun:"parent,notnull" json:"parent"`
+	Name          string    `bun:"name,notnull" json:"name"`
+	Path          string    `bun:"path,notnull,unique:folders_uid_path_key" json:"path"`
+	CreatedAt     time.Time `bun:"created_at,notnull,default:current_timestamp" json:"created_at"`
+}
+
+// Upload is a resumable upload in progress. The received bytes are kept
+// in a file named after the id until Offset reaches Size.
+type Upload struct {
+	bun.BaseModel `bun:"table:uploads,alias:up"`
+	ID            string    `bun:"id,pk" json:"id"`
+	UserID        int64     `bun:"uid,notnull" json:"-"`
+	Folder        string    `bun:"folder,notnull" json:"folder"`
+	Name          string    `bun:"name,notnull" json:"filename"`
+	MimeType      string    `bun:"mime_type,notnull" json:"mime_type"`
+	Size          int64     `bun:"size,notnull" json:"size"`
+	Offset        int64     `bun:"received,notnull,default:0" json:"offset"`
+	Extract       bool      `bun:"extract,notnull,default:false" json:"extract,omitempty"`
+	CreatedAt     time.Time `bun:"created_at,notnull,default:current_timestamp" json:"created_at"`
+	ExpiresAt     time.Time `bun:"expires_at,notnull" json:"expires_at"`
+}
+
+// Share is a public link to a file or a folder. Only the SHA-256 hash of the token
+// in the link is stored. StripGPS removes the location from shared photos.
+type Share struct {
+	bun.BaseModel `bun:"table:shares,alias:sh"`
+	ID            int64     `bun:"id,pk,autoincrement" json:"id"`
+	UserID        int64     `bun:"uid,notnull" json:"-"`
+	FileID        int64     `bun:"file_id,nullzero" json:"file_id,omitempty"`
+	FolderID      int64     `bun:"folder_id,nullzero" json:"folder_id,omitempty"`
+	StripGPS      bool      `bun:"strip_gps,notnull,default:false" json:"strip_gps,omitempty"`
+	Hash          string    `bun:"hash,notnull,unique" json:"-"`
+	Downloads     int64     `bun:"downloads,notnull,default:0" json:"downloads"`
+	CreatedAt     time.Time `bun:"created_at,notnull,default:current_timestamp" json:"created_at"`
+	ExpiresAt     time.Time `bun:"expires_at,nullzero" json:"expires_at,omitempty"`
+}
+
+type LoginAttempt struct {
+	bun.BaseModel `bun:"table:login_attempts,alias:la"`
+	Key           string    `bun:"key,pk"`
+	Failures      int       `bun:"failures,notnull"`
+	LastFailure   time.Time `bun:"last_failure,notnull"`
+	LockedUntil   time.Time `bun:"locked_until,nullzero"`
+}
+
+type AuditEvent struct {
+	bun.BaseModel `bun:"table:audit_events,alias:ae"`
+	ID            int64     `bun:"id,pk,autoincrement" json:"id"`
+	Type          string    `bun:"type,notnull" json:"type"`
+	Login         string    `bun:"login" json:"login"`
+	IP            string    `bun:"ip" json:"ip"`
+	Details       string    `bun:"details" json:"details"`
+	CreatedAt     time.Time `bun:"created_at,notnull,default:current_timestamp" json:"created_at"`
+}
+
+// UserToken is a single-use secret sent to the user by email.
+// Only the SHA-256 hash of the secret is stored.
+type UserToken struct {
+	bun.BaseModel `bun:"table:user_tokens,alias:ut"`
+	ID            int64     `bun:"id,pk,autoincrement"`
+	UserID        int64     `bun:"uid,notnull"`
+	Kind          string    `bun:"kind,notnull"`
+	Hash          string    `bun:"hash,notnull,unique"`
+	Email         string    `bun:"email,nullzero"`
+	ExpiresAt     time.Time `bun:"expires_at,notnull"`
+	UsedAt        time.Time `bun:"used_at,nullzero"`
+}
+
+// Invite is a registration code minted by an admin.
+// Only the SHA-256 hash of the code is stored.
+type Invite struct {
+	bun.BaseModel `bun:"table:invites,alias:i"`
+	ID            int64     `bun:"id,pk,autoincrement" json:"id"`
+	Hash          string    `bun:"hash,notnull,unique" json:"-"`
+	MaxUses       int       `bun:"max_uses,notnull" json:"max_uses"`
+	Uses          int       `bun:"uses,notnull,default:0" json:"uses"`
+	ExpiresAt     time.Time `bun:"expires_at,nullzero" json:"expires_at"`
+	CreatedBy     int64     `bun:"created_by,notnull" json:"created_by"`
+	CreatedAt     time.Time `bun:"created_at,notnull,default:current_timestamp" json:"created_at"`
+}
+
+// Change is an entry of the journal of the changes to the files and
+// folders of a user. Seq numbers the changes of each user without gaps.
+// The entry describes the file after the change, OldFolder and OldName
+// where it was before a move. Changes of folders have a FolderID instead
+// of a FileID, Folder is their parent and Name their own name.
+type Change struct {
+	bun.BaseModel `bun:"table:changes,alias:ch"`
+	UserID        int64     `bun:"uid,pk" json:"-"`
+	Seq           int64     `bun:"seq,pk" json:"seq"`
+	Op            string    `bun:"op,notnull" json:"op"`
+	FileID        int64     `bun:"file_id,notnull" json:"file_id"`
+	FolderID      int64     `bun:"folder_id,nullzero" json:"folder_id,omitempty"`
+	Folder        string    `bun:"folder,notnull" json:"folder"`
+	Name          string    `bun:"name,notnull" json:"filename"`
+	OldFolder     string    `bun:"old_folder,nullzero" json:"old_folder,omitempty"`
+	OldName       string    `bun:"old_name,nullzero" json:"old_filename,omitempty"`
+	Checksum      string    `bun:"checksum,notnull" json:"checksum"`
+	Size          int64     `bun:"size,notnull" json:"size"`
+	CreatedAt     time.Time `bun:"created_at,notnull,default:current_timestamp" json:"created_at"`
+}
+
+// MultipartUpload is an S3 multipart upload in progress. Its parts are
+// kept in files named after the id and the part number until it completes.
+type MultipartUpload struct {
+	bun.BaseModel `bun:"table:multipart_uploads,alias:mu"`
+	ID            string    `bun:"id,pk"`
+	UserID        int64     `bun:"uid,notnull"`
+	Folder        string    `bun:"folder,notnull"`
+	Name          string    `bun:"name,notnull"`
+	MimeType      string    `bun:"mime_type,notnull"`
+	CreatedAt     time.Time `bun:"created_at,notnull,default:current_timestamp"`
+	ExpiresAt     time.Time `bun:"expires_at,notnull"`
+}
+
+// MultipartPart is a received part of a multipart upload. ETag is the
+// MD5 of the part, which is what S3 clients expect back.
+type MultipartPart struct {
+	bun.BaseModel `bun:"table:multipart_parts,alias:mp"`
+	UploadID      string `bun:"upload_id,pk"`
+	Number        int    `bun:"number,pk"`
+	ETag          string `bun:"etag,notnull"`
+	Size          int64  `bun:"size,notnull"`
+}
+
+// DAVProperty is a dead property a WebDAV client stored on a path of the
+// user. InnerXML is kept verbatim, the server never looks into it.
+type DAVProperty struct {
+	bun.BaseModel `bun:"table:dav_properties,alias:dp"`
+	UserID        int64  `bun:"uid,pk"`
+	Path          string `bun:"path,pk"`
+	Space         string `bun:"space,pk"`
+	Local         string `bun:"local,pk"`
+	Lang          string `bun:"lang,notnull"`
+	InnerXML      string `bun:"inner_xml,notnull"`
+}
+
+// DAVLock is a WebDAV write lock on Root and, unless ZeroDepth,
+// everything below it. Timeout is in seconds, as sent by the client.
+type DAVLock struct {
+	bun.BaseModel `bun:"table:dav_locks,alias:dl"`
+	Token         string    `bun:"token,pk"`
+	UserID        int64     `bun:"uid,notnull"`
+	Root          string    `bun:"root,notnull"`
+	ZeroDepth     bool      `bun:"zero_depth,notnull"`
+	OwnerXML      string    `bun:"owner_xml,notnull"`
+	Timeout       int64     `bun:"timeout,notnull"`
+	ExpiresAt     time.Time `bun:"expires_at,notnull"`
+}
+
+// FileMetadata is what was read from the content of a file: EXIF data of
+// photos, tags of audio and video. Files that were read get a row even if
+// nothing was found in them, so they aren't read again. Duration is in
+// seconds.
+type FileMetadata struct {
+	bun.BaseModel `bun:"table:file_metadata,alias:fm"`
+	FileID        int64     `bun:"file_id,pk"`
+	UserID        int64     `bun:"uid,notnull"`
+	TakenAt       time.Time `bun:"taken_at,nullzero"`
+	CameraMake    string    `bun:"camera_make,notnull,default:''"`
+	CameraModel   string    `bun:"camera_model,notnull,default:''"`
+	Orientation   int       `bun:"orientation,notnull,default:0"`
+	Latitude      *float64  `bun:"latitude"`
+	Longitude     *float64  `bun:"longitude"`
+	Width         int       `bun:"width,notnull,default:0"`
+	Height        int       `bun:"height,notnull,default:0"`
+	Title         string    `bun:"title,notnull,default:''"`
+	Artist        string    `bun:"artist,notnull,default:''"`
+	Album         string    `bun:"album,notnull,default:''"`
+	Year          int       `bun:"year,notnull,default:0"`
+	Duration      float64   `bun:"duration,notnull,default:0"`
 }
@@ -0,0 +1,93 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package database
+
+import (
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+func CreateMultipartUpload(ctx context.Context, u MultipartUpload) (upload MultipartUpload, err error) {
+	u.ID, err = randomID()
+	if err != nil {
+		return MultipartUpload{}, err
+	}
+
+	_, err = db.NewInsert().Model(&u).Returning(`*`).Exec(ctx)
+	return u, err
+}
+
+// GetMultipartUpload returns the unexpired multipart upload of the user with the id.
+func GetMultipartUpload(ctx context.Context, uid int64, id string) (u MultipartUpload, err error) {
+	err = db.NewSelect().Model(&u).
+		Where(`id = ?`, id).
+		Where(`uid = ?`, uid).
+		Where(`expires_at > now()`).Scan(ctx)
+	return u, err
+}
+
+// SaveMultipartPart records the part, replacing one sent before with the number.
+func SaveMultipartPart(ctx context.Context, p MultipartPart) error {
+	_, err := db.NewInsert().Model(&p).
+		On(`CONFLICT (upload_id, number) DO UPDATE`).
+		Set(`etag = EXCLUDED.etag`).
+		Set(`size = EXCLUDED.size`).Exec(ctx)
+	return err
+}
+
+// GetMultipartParts returns the parts of the upload by number.
+func GetMultipartParts(ctx context.Context, id string) (parts []MultipartPart, err error) {
+	err = db.NewSelect().Model(&parts).
+		Where(`upload_id = ?`, id).
+		Order(`number`).Scan(ctx)
+	return parts, err
+}
+
+// DeleteMultipartUpload deletes the upload with its parts.
+func DeleteMultipartUpload(ctx context.Context, id string) error {
+	return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewDelete().Model((*MultipartPart)(nil)).Where(`upload_id = ?`, id).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.NewDelete().Model((*MultipartUpload)(nil)).Where(`id = ?`, id).Exec(ctx)
+		return err
+	})
+}
+
+// DeleteExpiredMultipartUploads deletes the expired multipart uploads and
+// returns the ids of every upload left, so part files of uploads without
+// a row can be removed.
+func DeleteExpiredMultipartUploads(ctx context.Context) (active []string, err error) {
+	err = db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewDelete().Model((*MultipartPart)(nil)).
+			Where(`upload_id IN (SELECT id FROM multipart_uploads WHERE expires_at <= now())`).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.NewDelete().Model((*MultipartUpload)(nil)).Where(`expires_at <= now()`).Exec(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.NewSelect().Model((*MultipartUpload)(nil)).Column(`id`).Scan(ctx, &active)
+	return active, err
+}
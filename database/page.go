@@ -0,0 +1,163 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package database
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"github.com/uptrace/bun"
+)
+
+var (
+	ErrInvalidCursor = errors.New(`invalid cursor`)
+	ErrInvalidSort   = errors.New(`invalid sort key`)
+)
+
+// PageOptions select one page of a listing. Cursor is the NextCursor of
+// the previous page and is only valid with the same Sort and Desc.
+type PageOptions struct {
+	Limit  int
+	Cursor string
+	Sort   string
+	Desc   bool
+}
+
+// Page is one page of a listing. Total counts every match of the filters,
+// not only the items on this page.
+type Page[T any] struct {
+	Items      []T    `json:"items"`
+	Total      int    `json:"total"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// sortKey is a column a listing can be sorted by. Rows are ordered by the
+// column and then by id, so pages don't skip or repeat rows sharing a value.
+type sortKey[T any] struct {
+	column string
+	value  func(item T) any
+	parse  func(raw json.RawMessage) (any, error)
+}
+
+func sortBy[T, V any](column string, value func(item T) V) sortKey[T] {
+	return sortKey[T]{
+		column: column,
+		value:  func(item T) any { return value(item) },
+		parse: func(raw json.RawMessage) (any, error) {
+			var v V
+			err := json.Unmarshal(raw, &v)
+			return v, err
+		},
+	}
+}
+
+// cursor points right after the last row of a page.
+type cursor struct {
+	Sort  string          `json:"s"`
+	Desc  bool            `json:"d,omitempty"`
+	Value json.RawMessage `json:"v"`
+	ID    int64           `json:"id"`
+}
+
+// paginate runs q, a filtered select of T, for the page described by opts.
+func paginate[T any](ctx context.Context, q *bun.SelectQuery, opts PageOptions,
+	keys map[string]sortKey[T], idColumn string, id func(item T) int64,
+) (page Page[T], err error) {
+	key, ok := keys[opts.Sort]
+	if !ok {
+		return Page[T]{}, ErrInvalidSort
+	}
+
+	page.Total, err = q.Count(ctx)
+	if err != nil {
+		return Page[T]{}, err
+	}
+
+	if opts.Cursor != `` {
+		c, err := decodeCursor(opts.Cursor)
+		if err != nil || c.Sort != opts.Sort || c.Desc != opts.Desc {
+			return Page[T]{}, ErrInvalidCursor
+		}
+
+		value, err := key.parse(c.Value)
+		if err != nil {
+			return Page[T]{}, ErrInvalidCursor
+		}
+
+		op := `>`
+		if opts.Desc {
+			op = `<`
+		}
+		q = q.Where(`(?, ?) `+op+` (?, ?)`, bun.Ident(key.column), bun.Ident(idColumn), value, c.ID)
+	}
+
+	direction := ` ASC`
+	if opts.Desc {
+		direction = ` DESC`
+	}
+	q = q.OrderExpr(`?`+direction+`, ?`+direction, bun.Ident(key.column), bun.Ident(idColumn))
+
+	// One extra row tells whether there is a next page.
+	err = q.Limit(opts.Limit+1).Scan(ctx, &page.Items)
+	if err != nil {
+		return Page[T]{}, err
+	}
+
+	if len(page.Items) > opts.Limit {
+		page.Items = page.Items[:opts.Limit]
+		last := page.Items[len(page.Items)-1]
+
+		page.NextCursor, err = encodeCursor(cursor{
+			Sort: opts.Sort,
+			Desc: opts.Desc,
+			ID:   id(last),
+		}, key.value(last))
+		if err != nil {
+			return Page[T]{}, err
+		}
+	}
+
+	if page.Items == nil {
+		page.Items = []T{}
+	}
+	return page, nil
+}
+
+func encodeCursor(c cursor, value any) (string, error) {
+	var err error
+	c.Value, err = json.Marshal(value)
+	if err != nil {
+		return ``, err
+	}
+
+	buf, err := json.Marshal(c)
+	if err != nil {
+		return ``, err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func decodeCursor(s string) (c cursor, err error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor{}, err
+	}
+
+	err = json.Unmarshal(buf, &c)
+	return c, err
+}
@@ -0,0 +1,297 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+func GetRegistryBlob(ctx context.Context, uid int64, repo, checksum string) (b RegistryBlob, err error) {
+	err = db.NewSelect().Model(&b).
+		Where(`uid = ?`, uid).
+		Where(`repo = ?`, repo).
+		Where(`checksum = ?`, checksum).Scan(ctx)
+	return b, err
+}
+
+// SaveRegistryBlob records the blob. If the repository has it already
+// its age starts over, so garbage collection spares it until the
+// manifest that refers to it is pushed.
+func SaveRegistryBlob(ctx context.Context, b RegistryBlob) error {
+	_, err := db.NewInsert().Model(&b).
+		On(`CONFLICT (uid, repo, checksum) DO UPDATE`).
+		Set(`created_at = EXCLUDED.created_at`).Exec(ctx)
+	return err
+}
+
+// DeleteRegistryBlob fails with sql.ErrNoRows if the repository has no blob with the checksum.
+func DeleteRegistryBlob(ctx context.Context, uid int64, repo, checksum string) error {
+	res, err := db.NewDelete().Model((*RegistryBlob)(nil)).
+		Where(`uid = ?`, uid).
+		Where(`repo = ?`, repo).
+		Where(`checksum = ?`, checksum).Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteUnreferencedRegistryBlobs deletes the blobs created before the
+// time that no manifest of their repository refers to, and returns their
+// checksums so the caller can purge blobs that are no longer used.
+func DeleteUnreferencedRegistryBlobs(ctx context.Context, before time.Time) (checksums []string, err error) {
+	_, err = db.NewDelete().Model((*RegistryBlob)(nil)).
+		Where(`created_at < ?`, before).
+		Where(`NOT EXISTS (SELECT 1 FROM registry_references AS rr`+
+			` WHERE rr.uid = rb.uid AND rr.repo = rb.repo AND rr.checksum = rb.checksum)`).
+		Returning(`checksum`).Exec(ctx, &checksums)
+	return checksums, err
+}
+
+// GetRegistryBlobChecksums returns the checksums among the given
+// ones the repository has blobs for.
+func GetRegistryBlobChecksums(ctx context.Context, uid int64, repo string, checksums []string) (found []string, err error) {
+	if len(checksums) == 0 {
+		return nil, nil
+	}
+
+	err = db.NewSelect().Model((*RegistryBlob)(nil)).Column(`checksum`).
+		Where(`uid = ?`, uid).
+		Where(`repo = ?`, repo).
+		Where(`checksum IN (?)`, bun.In(checksums)).Scan(ctx, &found)
+	return found, err
+}
+
+// GetRegistryManifestChecksums returns the checksums among the given
+// ones the repository has manifests for.
+func GetRegistryManifestChecksums(ctx context.Context, uid int64, repo string, checksums []string) (found []string, err error) {
+	if len(checksums) == 0 {
+		return nil, nil
+	}
+
+	err = db.NewSelect().Model((*RegistryManifest)(nil)).Column(`checksum`).
+		Where(`uid = ?`, uid).
+		Where(`repo = ?`, repo).
+		Where(`checksum IN (?)`, bun.In(checksums)).Scan(ctx, &found)
+	return found, err
+}
+
+func GetRegistryManifest(ctx context.Context, uid int64, repo, checksum string) (m RegistryManifest, err error) {
+	err = db.NewSelect().Model(&m).
+		Where(`uid = ?`, uid).
+		Where(`repo = ?`, repo).
+		Where(`checksum = ?`, checksum).Scan(ctx)
+	return m, err
+}
+
+// GetTaggedRegistryManifest returns the manifest the tag names.
+func GetTaggedRegistryManifest(ctx context.Context, uid int64, repo, tag string) (m RegistryManifest, err error) {
+	err = db.NewSelect().Model(&m).
+		Join(`JOIN registry_tags AS rt ON rt.uid = rm.uid AND rt.repo = rm.repo AND rt.manifest = rm.checksum`).
+		Where(`rm.uid = ?`, uid).
+		Where(`rm.repo = ?`, repo).
+		Where(`rt.tag = ?`, tag).Scan(ctx)
+	return m, err
+}
+
+// SaveRegistryManifest records the manifest with the checksums it refers
+// to and, unless tag is empty, points the tag at it.
+func SaveRegistryManifest(ctx context.Context, m RegistryManifest, refs []string, tag string) error {
+	return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewInsert().Model(&m).
+			On(`CONFLICT (uid, repo, checksum) DO NOTHING`).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, checksum := range refs {
+			_, err = tx.NewInsert().Model(&RegistryReference{
+				UserID:   m.UserID,
+				Repo:     m.Repo,
+				Manifest: m.Checksum,
+				Checksum: checksum,
+			}).On(`CONFLICT DO NOTHING`).Exec(ctx)
+			if err != nil {
+				return err
+			}
+		}
+
+		if tag == `` {
+			return nil
+		}
+
+		_, err = tx.NewInsert().Model(&RegistryTag{
+			UserID:    m.UserID,
+			Repo:      m.Repo,
+			Tag:       tag,
+			Manifest:  m.Checksum,
+			UpdatedAt: time.Now(),
+		}).On(`CONFLICT (uid, repo, tag) DO UPDATE`).
+			Set(`manifest = EXCLUDED.manifest`).
+			Set(`updated_at = EXCLUDED.updated_at`).Exec(ctx)
+		return err
+	})
+}
+
+// DeleteRegistryManifest deletes the manifest with its references and
+// the tags naming it. It fails with sql.ErrNoRows if there is none.
+func DeleteRegistryManifest(ctx context.Context, uid int64, repo, checksum string) error {
+	return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		res, err := tx.NewDelete().Model((*RegistryManifest)(nil)).
+			Where(`uid = ?`, uid).
+			Where(`repo = ?`, repo).
+			Where(`checksum = ?`, checksum).Exec(ctx)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return sql.ErrNoRows
+		}
+
+		_, err = tx.NewDelete().Model((*RegistryTag)(nil)).
+			Where(`uid = ?`, uid).
+			Where(`repo = ?`, repo).
+			Where(`manifest = ?`, checksum).Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.NewDelete().Model((*RegistryReference)(nil)).
+			Where(`uid = ?`, uid).
+			Where(`repo = ?`, repo).
+			Where(`manifest = ?`, checksum).Exec(ctx)
+		return err
+	})
+}
+
+// DeleteRegistryTag fails with sql.ErrNoRows if the repository has no such tag.
+func DeleteRegistryTag(ctx context.Context, uid int64, repo, tag string) error {
+	res, err := db.NewDelete().Model((*RegistryTag)(nil)).
+		Where(`uid = ?`, uid).
+		Where(`repo = ?`, repo).
+		Where(`tag = ?`, tag).Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetRegistryTags returns up to limit tags of the repository that sort
+// after the given one, in order. A limit of zero returns all of them.
+func GetRegistryTags(ctx context.Context, uid int64, repo, after string, limit int) (tags []string, err error) {
+	q := db.NewSelect().Model((*RegistryTag)(nil)).Column(`tag`).
+		Where(`uid = ?`, uid).
+		Where(`repo = ?`, repo).
+		Where(`tag > ?`, after).
+		Order(`tag`)
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+
+	err = q.Scan(ctx, &tags)
+	return tags, err
+}
+
+// RegistryRepoExists tells whether the user pushed a manifest to the repository.
+func RegistryRepoExists(ctx context.Context, uid int64, repo string) (bool, error) {
+	return db.NewSelect().Model((*RegistryManifest)(nil)).
+		Where(`uid = ?`, uid).
+		Where(`repo = ?`, repo).Exists(ctx)
+}
+
+// GetRegistryRepos returns up to limit repositories of the user with
+// manifests that sort after the given one, in order. A limit of zero
+// returns all of them.
+func GetRegistryRepos(ctx context.Context, uid int64, after string, limit int) (repos []string, err error) {
+	q := db.NewSelect().Model((*RegistryManifest)(nil)).
+		Distinct().Column(`repo`).
+		Where(`uid = ?`, uid).
+		Where(`repo > ?`, after).
+		Order(`repo`)
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+
+	err = q.Scan(ctx, &repos)
+	return repos, err
+}
+
+func CreateRegistryUpload(ctx context.Context, u RegistryUpload) (upload RegistryUpload, err error) {
+	u.ID, err = randomID()
+	if err != nil {
+		return RegistryUpload{}, err
+	}
+
+	_, err = db.NewInsert().Model(&u).Returning(`*`).Exec(ctx)
+	return u, err
+}
+
+// GetRegistryUpload returns the unexpired upload of the user to the repository with the id.
+func GetRegistryUpload(ctx context.Context, uid int64, repo, id string) (u RegistryUpload, err error) {
+	err = db.NewSelect().Model(&u).
+		Where(`id = ?`, id).
+		Where(`uid = ?`, uid).
+		Where(`repo = ?`, repo).
+		Where(`expires_at > now()`).Scan(ctx)
+	return u, err
+}
+
+// AdvanceRegistryUpload moves the offset of the upload from one value to
+// another. It fails with sql.ErrNoRows if the offset was changed in between.
+func AdvanceRegistryUpload(ctx context.Context, id string, from, to int64) error {
+	res, err := db.NewUpdate().Model((*RegistryUpload)(nil)).
+		Set(`received = ?`, to).
+		Where(`id = ?`, id).
+		Where(`received = ?`, from).Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func DeleteRegistryUpload(ctx context.Context, id string) error {
+	_, err := db.NewDelete().Model((*RegistryUpload)(nil)).Where(`id = ?`, id).Exec(ctx)
+	return err
+}
+
+// DeleteExpiredRegistryUploads deletes the expired uploads and returns the
+// ids of every upload left, so files of uploads without a row can be removed.
+func DeleteExpiredRegistryUploads(ctx context.Context) (active []string, err error) {
+	_, err = db.NewDelete().Model((*RegistryUpload)(nil)).Where(`expires_at <= now()`).Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.NewSelect().Model((*RegistryUpload)(nil)).Column(`id`).Scan(ctx, &active)
+	return active, err
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package database
+
+import (
+	"context"
+	"database/sql"
+)
+
+func GetResticObject(ctx context.Context, uid int64, repo, typ, name string) (o ResticObject, err error) {
+	err = db.NewSelect().Model(&o).
+		Where(`uid = ?`, uid).
+		Where(`repo = ?`, repo).
+		Where(`type = ?`, typ).
+		Where(`name = ?`, name).Scan(ctx)
+	return o, err
+}
+
+// CreateResticObject fails with ErrDuplicate if the repository has
+// an object of the type with the name already.
+func CreateResticObject(ctx context.Context, o ResticObject) error {
+	_, err := db.NewInsert().Model(&o).Exec(ctx)
+	return uniqueViolation(err)
+}
+
+// GetResticObjects returns the names and sizes of the objects
+// of the type in the repository.
+func GetResticObjects(ctx context.Context, uid int64, repo, typ string) (objects []ResticObject, err error) {
+	err = db.NewSelect().Model(&objects).Column(`name`, `size`).
+		Where(`uid = ?`, uid).
+		Where(`repo = ?`, repo).
+		Where(`type = ?`, typ).
+		Order(`name`).Scan(ctx)
+	return objects, err
+}
+
+// DeleteResticObject deletes the object and returns it. It fails
+// with sql.ErrNoRows if there is none.
+func DeleteResticObject(ctx context.Context, uid int64, repo, typ, name string) (o ResticObject, err error) {
+	_, err = db.NewDelete().Model(&o).
+		Where(`uid = ?`, uid).
+		Where(`repo = ?`, repo).
+		Where(`type = ?`, typ).
+		Where(`name = ?`, name).
+		Returning(`*`).Exec(ctx)
+	if err == nil && o.ID == 0 {
+		err = sql.ErrNoRows
+	}
+	return o, err
+}
+
+// DeleteResticRepo deletes every object of the repository and returns
+// their checksums, so the caller can purge blobs that are no longer used.
+func DeleteResticRepo(ctx context.Context, uid int64, repo string) (checksums []string, err error) {
+	_, err = db.NewDelete().Model((*ResticObject)(nil)).
+		Where(`uid = ?`, uid).
+		Where(`repo = ?`, repo).
+		Returning(`checksum`).Exec(ctx, &checksums)
+	return checksums, err
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package database
+
+import (
+	"context"
+	"database/sql"
+)
+
+// SharedFile is a share together with the file or folder it links to.
+type SharedFile struct {
+	Share  `bun:",extend"`
+	File   *File   `bun:"rel:belongs-to,join:file_id=id"`
+	Folder *Folder `bun:"rel:belongs-to,join:folder_id=id"`
+}
+
+func CreateShare(ctx context.Context, s Share) (share Share, err error) {
+	_, err = db.NewInsert().Model(&s).Returning(`*`).Exec(ctx)
+	return s, err
+}
+
+var shareSortKeys = map[string]sortKey[Share]{
+	`id`: sortBy(`sh.id`, func(s Share) int64 { return s.ID }),
+}
+
+// GetShares returns one page of the shares of the user, optionally only
+// those of one file or folder. Sort is id, which is the order of creation.
+func GetShares(ctx context.Context, uid, fileID, folderID int64, opts PageOptions) (Page[Share], error) {
+	q := db.NewSelect().Model((*Share)(nil)).Where(`sh.uid = ?`, uid)
+	if fileID != 0 {
+		q = q.Where(`sh.file_id = ?`, fileID)
+	}
+	if folderID != 0 {
+		q = q.Where(`sh.folder_id = ?`, folderID)
+	}
+	return paginate(ctx, q, opts, shareSortKeys, `sh.id`, func(s Share) int64 { return s.ID })
+}
+
+// DeleteShare fails with sql.ErrNoRows if the user has no share with the id.
+func DeleteShare(ctx context.Context, uid, id int64) error {
+	res, err := db.NewDelete().Model((*Share)(nil)).
+		Where(`uid = ?`, uid).
+		Where(`id = ?`, id).Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetSharedFile returns the unexpired share with the hash and its file
+// or folder, as long as the owner isn't disabled.
+func GetSharedFile(ctx context.Context, hash string) (s SharedFile, err error) {
+	err = db.NewSelect().Model(&s).
+		Relation(`File`).
+		Relation(`Folder`).
+		Where(`sh.hash = ?`, hash).
+		Where(`sh.expires_at IS NULL OR sh.expires_at > now()`).
+		Where(`sh.uid NOT IN (SELECT id FROM users WHERE disabled)`).
+		Scan(ctx)
+	return s, err
+}
+
+// CountShareDownload counts one more download of the share.
+func CountShareDownload(ctx context.Context, id int64) error {
+	_, err := db.NewUpdate().Model((*Share)(nil)).
+		Set(`downloads = downloads + 1`).
+		Where(`id = ?`, id).Exec(ctx)
+	return err
+}
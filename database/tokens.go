@@ -0,0 +1,228 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package database
+
+import (
+	"context"
+	"database/sql"
+)
+
+func CreatePersonalToken(ctx context.Context, t PersonalToken) (token PersonalToken, err error) {
+	_, err = db.NewInsert().Model(&t).Returning(`*`).Exec(ctx)
+	return t, err
+}
+
+func GetPersonalTokens(ctx context.Context, uid int64) (tokens []PersonalToken, err error) {
+	err = db.NewSelect().Model(&tokens).Where(`uid = ?`, uid).Order(`id`).Scan(ctx)
+	return tokens, err
+}
+
+// DeletePersonalToken fails with sql.ErrNoRows if the user has no token with the id.
+func DeletePersonalToken(ctx context.Context, uid, id int64) error {
+	res, err := db.NewDelete().Model((*PersonalToken)(nil)).
+		Where(`uid = ?`, uid).
+		Where(`id = ?`, id).Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// UsePersonalToken returns the owner of the unexpired token with the hash
+// and remembers when it was used. Owners that are disabled or waiting
+// for approval are treated as if the token didn't exist.
+func UsePersonalToken(ctx context.Context, hash string) (user User, err error) {
+	var t PersonalToken
+	_, err = db.NewUpdate().Model(&t).
+		Set(`last_used_at = now()`).
+		Where(`hash = ?`, hash).
+		Where(`expires_at IS NULL OR expires_at > now()`).
+		Returning(`*`).
+		Exec(ctx)
+	if err != nil {
+		return User{}, err
+	}
+	if t.ID == 0 {
+		return User{}, sql.ErrNoRows
+	}
+
+	err = db.NewSelect().Model(&user).
+		Where(`id = ?`, t.UserID).
+		Where(`NOT disabled`).
+		Where(`status = ?`, StatusActive).
+		Scan(ctx)
+	return user, err
+}
+
+func CreateAppPassword(ctx context.Context, p AppPassword) (password AppPassword, err error) {
+	_, err = db.NewInsert().Model(&p).Returning(`*`).Exec(ctx)
+	return p, err
+}
+
+func GetAppPasswords(ctx context.Context, uid int64) (passwords []AppPassword, err error) {
+	err = db.NewSelect().Model(&passwords).Where(`uid = ?`, uid).Order(`id`).Scan(ctx)
+	return passwords, err
+}
+
+// DeleteAppPassword fails with sql.ErrNoRows if the user has no app password with the id.
+func DeleteAppPassword(ctx context.Context, uid, id int64) error {
+	res, err := db.NewDelete().Model((*AppPassword)(nil)).
+		Where(`uid = ?`, uid).
+		Where(`id = ?`, id).Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// UseAppPassword returns the user with the login if the app password with
+// the hash is one of theirs, and remembers when it was used. Users that are
+// disabled or waiting for approval are treated as if it didn't exist.
+func UseAppPassword(ctx context.Context, login, hash string) (user User, err error) {
+	err = db.NewSelect().Model(&user).
+		Where(`login = ?`, login).
+		Where(`NOT disabled`).
+		Where(`status = ?`, StatusActive).
+		Scan(ctx)
+	if err != nil {
+		return User{}, err
+	}
+
+	res, err := db.NewUpdate().Model((*AppPassword)(nil)).
+		Set(`last_used_at = now()`).
+		Where(`uid = ?`, user.ID).
+		Where(`hash = ?`, hash).
+		Exec(ctx)
+	if err != nil {
+		return User{}, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return User{}, sql.ErrNoRows
+	}
+	return user, nil
+}
+
+func CreateAccessKey(ctx context.Context, k AccessKey) (key AccessKey, err error) {
+	_, err = db.NewInsert().Model(&k).Returning(`*`).Exec(ctx)
+	return k, err
+}
+
+func GetAccessKeys(ctx context.Context, uid int64) (keys []AccessKey, err error) {
+	err = db.NewSelect().Model(&keys).Where(`uid = ?`, uid).Order(`id`).Scan(ctx)
+	return keys, err
+}
+
+// DeleteAccessKey fails with sql.ErrNoRows if the user has no access key with the id.
+func DeleteAccessKey(ctx context.Context, uid, id int64) error {
+	res, err := db.NewDelete().Model((*AccessKey)(nil)).
+		Where(`uid = ?`, uid).
+		Where(`id = ?`, id).Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// UseAccessKey returns the access key with the key id and its owner, and
+// remembers when it was used. Owners that are disabled or waiting for
+// approval are treated as if the key didn't exist.
+func UseAccessKey(ctx context.Context, keyID string) (key AccessKey, user User, err error) {
+	_, err = db.NewUpdate().Model(&key).
+		Set(`last_used_at = now()`).
+		Where(`key_id = ?`, keyID).
+		Returning(`*`).
+		Exec(ctx)
+	if err != nil {
+		return AccessKey{}, User{}, err
+	}
+	if key.ID == 0 {
+		return AccessKey{}, User{}, sql.ErrNoRows
+	}
+
+	err = db.NewSelect().Model(&user).
+		Where(`id = ?`, key.UserID).
+		Where(`NOT disabled`).
+		Where(`status = ?`, StatusActive).
+		Scan(ctx)
+	return key, user, err
+}
+
+// CreateSSHKey fails with ErrDuplicate if the user added the key before.
+func CreateSSHKey(ctx context.Context, k SSHKey) (key SSHKey, err error) {
+	_, err = db.NewInsert().Model(&k).Returning(`*`).Exec(ctx)
+	return k, uniqueViolation(err)
+}
+
+func GetSSHKeys(ctx context.Context, uid int64) (keys []SSHKey, err error) {
+	err = db.NewSelect().Model(&keys).Where(`uid = ?`, uid).Order(`id`).Scan(ctx)
+	return keys, err
+}
+
+// DeleteSSHKey fails with sql.ErrNoRows if the user has no SSH key with the id.
+func DeleteSSHKey(ctx context.Context, uid, id int64) error {
+	res, err := db.NewDelete().Model((*SSHKey)(nil)).
+		Where(`uid = ?`, uid).
+		Where(`id = ?`, id).Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// UseSSHKey returns the user with the login if the key with the
+// fingerprint is one of theirs, and remembers when it was used. Users
+// that are disabled or waiting for approval are treated as if it didn't exist.
+func UseSSHKey(ctx context.Context, login, fingerprint string) (user User, err error) {
+	err = db.NewSelect().Model(&user).
+		Where(`login = ?`, login).
+		Where(`NOT disabled`).
+		Where(`status = ?`, StatusActive).
+		Scan(ctx)
+	if err != nil {
+		return User{}, err
+	}
+
+	res, err := db.NewUpdate().Model((*SSHKey)(nil)).
+		Set(`last_used_at = now()`).
+		Where(`uid = ?`, user.ID).
+		Where(`fingerprint = ?`, fingerprint).
+		Exec(ctx)
+	if err != nil {
+		return User{}, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return User{}, sql.ErrNoRows
+	}
+	return user, nil
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package database
+
+import (
+	"context"
+	"database/sql"
+)
+
+func CreateUpload(ctx context.Context, u Upload) (upload Upload, err error) {
+	u.ID, err = randomID()
+	if err != nil {
+		return Upload{}, err
+	}
+
+	_, err = db.NewInsert().Model(&u).Returning(`*`).Exec(ctx)
+	return u, err
+}
+
+// GetUpload returns the unexpired upload of the user with the id.
+func GetUpload(ctx context.Context, uid int64, id string) (u Upload, err error) {
+	err = db.NewSelect().Model(&u).
+		Where(`id = ?`, id).
+		Where(`uid = ?`, uid).
+		Where(`expires_at > now()`).Scan(ctx)
+	return u, err
+}
+
+// AdvanceUpload moves the offset of the upload from one value to another.
+// It fails with sql.ErrNoRows if the offset was changed in between.
+func AdvanceUpload(ctx context.Context, id string, from, to int64) error {
+	res, err := db.NewUpdate().Model((*Upload)(nil)).
+		Set(`received = ?`, to).
+		Where(`id = ?`, id).
+		Where(`received = ?`, from).Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func DeleteUpload(ctx context.Context, id string) error {
+	_, err := db.NewDelete().Model((*Upload)(nil)).Where(`id = ?`, id).Exec(ctx)
+	return err
+}
+
+// DeleteExpiredUploads deletes the expired uploads and returns the ids of
+// every upload left, so files of uploads without a row can be removed.
+func DeleteExpiredUploads(ctx context.Context) (active []string, err error) {
+	_, err = db.NewDelete().Model((*Upload)(nil)).Where(`expires_at <= now()`).Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.NewSelect().Model((*Upload)(nil)).Column(`id`).Scan(ctx, &active)
+	return active, err
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package dav serves the files and folders of the users over WebDAV
+// (RFC 4918), so they can be mounted as a network drive. Clients sign in
+// with Basic auth, sending the login and an app password or a personal
+// token. Dead properties and locks are kept in the database.
+package dav
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"server/auth"
+	"server/catcherr"
+	"server/database"
+	"server/deadline"
+	"server/directory"
+	"server/user"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/webdav"
+)
+
+// readMethods are all read only users may send.
+var readMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	`PROPFIND`:         true,
+}
+
+// Handle mounts the WebDAV server at directory.DAV. It has to come
+// before routes with a prefix that would shadow it.
+func Handle(r *mux.Router) {
+	r.PathPrefix(directory.DAV).Handler(deadline.Extend(catcherr.Handle(serveDAV)))
+}
+
+func serveDAV(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+
+	// The prefix alone would match /davfoo as well.
+	if r.URL.Path != directory.DAV && !strings.HasPrefix(r.URL.Path, directory.DAV+`/`) {
+		return catcherr.NotFound
+	}
+
+	u, err := auth.AuthenticateBasicThrottled(w, r, failures)
+	if err != nil {
+		return err
+	}
+	catcherr.SetLogin(ctx, u.Login)
+
+	if u.Role == database.RoleReadOnly && !readMethods[r.Method] {
+		return catcherr.Forbidden
+	}
+
+	// The handler can't tell the client why storing failed,
+	// so the declared size is checked up front.
+	fsys := &fileSystem{u: u, putSize: -1}
+	if r.Method == http.MethodPut {
+		fsys.putSize = r.ContentLength
+		err = user.CheckQuota(ctx, u, r.ContentLength)
+		if errors.Is(err, user.ErrQuotaExceeded) {
+			return catcherr.QuotaExceeded.Wrap(err)
+		}
+		if err != nil {
+			return catcherr.InternalServerError.Wrap(err)
+		}
+	}
+
+	h := &webdav.Handler{
+		Prefix:     directory.DAV,
+		FileSystem: fsys,
+		LockSystem: &lockSystem{ctx: ctx, uid: u.ID},
+		Logger:     logError,
+	}
+	h.ServeHTTP(w, r)
+	return nil
+}
+
+// failures ask for the credentials again when they are missing or wrong.
+var failures = func() auth.Failures {
+	f := auth.Problems
+	f.Challenge = `Basic realm="dexcloud", charset="UTF-8"`
+	return f
+}()
+
+// logError logs what went wrong in the handler, which answers the client
+// with a bare status. Missing and existing paths are the client's business.
+func logError(r *http.Request, err error) {
+	if err == nil || os.IsNotExist(err) || os.IsExist(err) {
+		return
+	}
+	log.Printf(`[ Sender: dav.serveDAV() ]: %s %s: %v`, r.Method, r.URL.Path, err)
+}
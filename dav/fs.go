@@ -0,0 +1,414 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dav
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"server/database"
+	"server/user"
+
+	"golang.org/x/net/webdav"
+)
+
+var (
+	errIsFolder    = errors.New(`path is a folder`)
+	errNotFolder   = errors.New(`path is not a folder`)
+	errWriteOnly   = errors.New(`file is open for writing`)
+	errIncomplete  = errors.New(`request body ended early`)
+	errMoveIntoOwn = errors.New(`folder can't move into itself`)
+)
+
+// fileSystem maps the folders and files of a user onto a WebDAV tree.
+// The REST API keeps files with the same name side by side, here only
+// the newest is seen and writing a path replaces all of them.
+type fileSystem struct {
+	u database.User
+	// putSize is the Content-Length of a PUT, -1 for other requests.
+	// Files that get less are not stored.
+	putSize int64
+}
+
+func (fsys *fileSystem) Stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	name = user.CleanFolder(name)
+	if name == `/` {
+		return folderInfo{name: `/`}, nil
+	}
+
+	folder, err := database.GetFolder(ctx, fsys.u.ID, name)
+	if err == nil {
+		return folderInfo{name: folder.Name, modTime: folder.CreatedAt}, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	files, err := database.GetFilesAt(ctx, fsys.u.ID, path.Dir(name), path.Base(name))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return fileInfo{files[0]}, nil
+}
+
+func (fsys *fileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name = user.CleanFolder(name)
+	if err := fsys.mustNotExist(ctx, name); err != nil {
+		return err
+	}
+	if err := fsys.requireFolder(ctx, path.Dir(name)); err != nil {
+		return err
+	}
+
+	// A new path doesn't inherit the properties of what was there before.
+	if err := database.DeleteDeadProps(ctx, fsys.u.ID, name); err != nil {
+		return err
+	}
+	return database.EnsureFolder(ctx, fsys.u.ID, name)
+}
+
+func (fsys *fileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = user.CleanFolder(name)
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		return fsys.create(ctx, name, flag)
+	}
+
+	info, err := fsys.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	p := props{ctx: ctx, uid: fsys.u.ID, name: name}
+	if info.IsDir() {
+		return &folder{props: p, info: info}, nil
+	}
+
+	blob, err := user.OpenFile(info.(fileInfo).f.Checksum)
+	if err != nil {
+		return nil, err
+	}
+	return &file{File: blob, props: p, info: info}, nil
+}
+
+// create opens a file for writing. Its content only replaces the
+// files at the path once it is closed.
+func (fsys *fileSystem) create(ctx context.Context, name string, flag int) (webdav.File, error) {
+	info, err := fsys.Stat(ctx, name)
+	exists := err == nil
+	switch {
+	case err != nil && !os.IsNotExist(err):
+		return nil, err
+	case exists && info.IsDir():
+		return nil, errIsFolder
+	case exists && flag&os.O_EXCL != 0:
+		return nil, os.ErrExist
+	case !exists && flag&os.O_CREATE == 0:
+		return nil, os.ErrNotExist
+	}
+
+	if err = fsys.requireFolder(ctx, path.Dir(name)); err != nil {
+		return nil, err
+	}
+
+	// Cleared now rather than on close, COPY sets the properties in between.
+	if !exists {
+		if err = database.DeleteDeadProps(ctx, fsys.u.ID, name); err != nil {
+			return nil, err
+		}
+	}
+
+	fw, err := user.CreateFile(fsys.u, name)
+	if err != nil {
+		return nil, err
+	}
+	return &writer{
+		FileWriter: fw,
+		props:      props{ctx: ctx, uid: fsys.u.ID, name: name},
+		size:       fsys.putSize,
+	}, nil
+}
+
+func (fsys *fileSystem) RemoveAll(ctx context.Context, name string) error {
+	name = user.CleanFolder(name)
+	if name == `/` {
+		return os.ErrPermission
+	}
+
+	info, err := fsys.Stat(ctx, name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var files []database.File
+	if info.IsDir() {
+		files, err = database.DeleteTree(ctx, fsys.u.ID, name)
+	} else {
+		files, err = database.DeleteFilesAt(ctx, fsys.u.ID, path.Dir(name), path.Base(name), 0)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = database.DeleteDeadProps(ctx, fsys.u.ID, name); err != nil {
+		return err
+	}
+	return user.RemoveUnusedFiles(ctx, files)
+}
+
+func (fsys *fileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, newName = user.CleanFolder(oldName), user.CleanFolder(newName)
+	if oldName == `/` || newName == `/` {
+		return os.ErrPermission
+	}
+	if strings.HasPrefix(newName, oldName+`/`) {
+		return errMoveIntoOwn
+	}
+
+	info, err := fsys.Stat(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	if err = fsys.mustNotExist(ctx, newName); err != nil {
+		return err
+	}
+	if err = fsys.requireFolder(ctx, path.Dir(newName)); err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		err = database.MoveTree(ctx, fsys.u.ID, oldName, newName)
+	} else {
+		err = fsys.moveFiles(ctx, oldName, newName)
+	}
+	if err != nil {
+		return err
+	}
+	return database.MoveDeadProps(ctx, fsys.u.ID, oldName, newName)
+}
+
+func (fsys *fileSystem) moveFiles(ctx context.Context, oldName, newName string) error {
+	files, err := database.GetFilesAt(ctx, fsys.u.ID, path.Dir(oldName), path.Base(oldName))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		_, err = user.MoveFile(ctx, fsys.u.ID, f.ID, path.Dir(newName), path.Base(newName))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requireFolder fails with os.ErrNotExist unless a folder is at the path,
+// which is what the handler expects of missing parents.
+func (fsys *fileSystem) requireFolder(ctx context.Context, name string) error {
+	info, err := fsys.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// mustNotExist fails with os.ErrExist if anything is at the path.
+func (fsys *fileSystem) mustNotExist(ctx context.Context, name string) error {
+	_, err := fsys.Stat(ctx, name)
+	switch {
+	case err == nil:
+		return os.ErrExist
+	case os.IsNotExist(err):
+		return nil
+	}
+	return err
+}
+
+// file is a file opened for reading.
+type file struct {
+	*os.File
+	props
+	info fs.FileInfo
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *file) Readdir(count int) ([]fs.FileInfo, error) { return nil, errNotFolder }
+
+// writer is a file opened for writing.
+type writer struct {
+	*user.FileWriter
+	props
+	// size is the number of bytes the client announced, -1 if unknown.
+	size int64
+}
+
+func (w *writer) Read(p []byte) (int, error) { return 0, errWriteOnly }
+
+// Seek only tells the position, which is where the last write ended.
+func (w *writer) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == io.SeekCurrent {
+		return w.Size(), nil
+	}
+	return 0, errWriteOnly
+}
+
+func (w *writer) Readdir(count int) ([]fs.FileInfo, error) { return nil, errNotFolder }
+
+func (w *writer) Stat() (fs.FileInfo, error) {
+	return fileInfo{database.File{
+		Name:       path.Base(w.name),
+		Checksum:   w.Checksum(),
+		Size:       w.Size(),
+		ModifiedAt: time.Now(),
+	}}, nil
+}
+
+// Close stores the file in place of the files at its path. The handler
+// closes files after failed writes too, so short content is dropped.
+func (w *writer) Close() error {
+	if w.size >= 0 && w.Size() != w.size {
+		w.Abort()
+		return errIncomplete
+	}
+
+	f, err := w.Commit(w.ctx)
+	if err != nil {
+		return err
+	}
+	return user.ReplaceFiles(w.ctx, f)
+}
+
+// folder is a folder opened for listing.
+type folder struct {
+	props
+	info    fs.FileInfo
+	entries []fs.FileInfo
+	listed  bool
+}
+
+func (d *folder) Read(p []byte) (int, error)                   { return 0, errIsFolder }
+func (d *folder) Write(p []byte) (int, error)                  { return 0, errIsFolder }
+func (d *folder) Seek(offset int64, whence int) (int64, error) { return 0, errIsFolder }
+func (d *folder) Close() error                                 { return nil }
+func (d *folder) Stat() (fs.FileInfo, error)                   { return d.info, nil }
+
+// Readdir returns the next count entries, or all remaining ones if count
+// isn't positive, like os.File.Readdir.
+func (d *folder) Readdir(count int) ([]fs.FileInfo, error) {
+	if !d.listed {
+		if err := d.list(); err != nil {
+			return nil, err
+		}
+		d.listed = true
+	}
+
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+	entries := d.entries[:count]
+	d.entries = d.entries[count:]
+	return entries, nil
+}
+
+// list reads the entries of the folder. A file can't be seen under the
+// name of a folder, and of several files with one name only the newest.
+func (d *folder) list() error {
+	folders, err := database.GetFolders(d.ctx, d.uid, d.name)
+	if err != nil {
+		return err
+	}
+
+	files, err := database.GetFilesIn(d.ctx, d.uid, d.name)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool, len(folders)+len(files))
+	for _, f := range folders {
+		seen[f.Name] = true
+		d.entries = append(d.entries, folderInfo{name: f.Name, modTime: f.CreatedAt})
+	}
+	for _, f := range files {
+		if !seen[f.Name] {
+			seen[f.Name] = true
+			d.entries = append(d.entries, fileInfo{f})
+		}
+	}
+	return nil
+}
+
+// fileInfo describes a file. The checksum makes a strong ETag.
+type fileInfo struct {
+	f database.File
+}
+
+func (fi fileInfo) Name() string       { return fi.f.Name }
+func (fi fileInfo) Size() int64        { return fi.f.Size }
+func (fi fileInfo) Mode() fs.FileMode  { return 0o644 }
+func (fi fileInfo) ModTime() time.Time { return fi.f.ModifiedAt }
+func (fi fileInfo) IsDir() bool        { return false }
+func (fi fileInfo) Sys() any           { return nil }
+
+func (fi fileInfo) ETag(ctx context.Context) (string, error) {
+	return `"` + fi.f.Checksum + `"`, nil
+}
+
+func (fi fileInfo) ContentType(ctx context.Context) (string, error) {
+	if fi.f.MimeType == `` {
+		return ``, webdav.ErrNotImplemented
+	}
+	return fi.f.MimeType, nil
+}
+
+// folderInfo describes a folder. Folders have no modification time of
+// their own, the creation time stands in for it.
+type folderInfo struct {
+	name    string
+	modTime time.Time
+}
+
+func (fi folderInfo) Name() string       { return fi.name }
+func (fi folderInfo) Size() int64        { return 0 }
+func (fi folderInfo) Mode() fs.FileMode  { return fs.ModeDir | 0o755 }
+func (fi folderInfo) ModTime() time.Time { return fi.modTime }
+func (fi folderInfo) IsDir() bool        { return true }
+func (fi folderInfo) Sys() any           { return nil }
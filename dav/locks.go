@@ -0,0 +1,153 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dav
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"server/database"
+	"server/user"
+
+	"golang.org/x/net/webdav"
+)
+
+// maxLockTimeout caps the lifetime of locks. Clients asking for infinite
+// locks get this and refresh them, so locks of clients that went away,
+// or of a server that stopped mid-request, don't stay forever.
+const maxLockTimeout = time.Hour
+
+// lockSystem keeps the WebDAV locks of a user in the database, so they
+// hold across server instances. It follows the rules of the handler's
+// in-memory lock system.
+type lockSystem struct {
+	ctx context.Context
+	uid int64
+}
+
+// Confirm checks that the conditions name locks of the user covering
+// both names. The locks aren't held in between requests, so release
+// has nothing to do.
+func (ls *lockSystem) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (release func(), err error) {
+	tokens := make([]string, 0, len(conditions))
+	for _, c := range conditions {
+		if c.Token != `` {
+			tokens = append(tokens, c.Token)
+		}
+	}
+
+	locks, err := database.GetDAVLocks(ls.ctx, ls.uid, tokens, now)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range []string{name0, name1} {
+		if name != `` && !covered(locks, user.CleanFolder(name)) {
+			return nil, webdav.ErrConfirmationFailed
+		}
+	}
+	return func() {}, nil
+}
+
+// covered reports whether one of the locks applies to the path.
+func covered(locks []database.DAVLock, name string) bool {
+	for _, l := range locks {
+		if l.Root == name {
+			return true
+		}
+		if !l.ZeroDepth && (l.Root == `/` || strings.HasPrefix(name, l.Root+`/`)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ls *lockSystem) Create(now time.Time, details webdav.LockDetails) (token string, err error) {
+	token, err = lockToken()
+	if err != nil {
+		return ``, err
+	}
+
+	timeout := lockTimeout(details.Duration)
+	err = database.CreateDAVLock(ls.ctx, database.DAVLock{
+		Token:     token,
+		UserID:    ls.uid,
+		Root:      user.CleanFolder(details.Root),
+		ZeroDepth: details.ZeroDepth,
+		OwnerXML:  details.OwnerXML,
+		Timeout:   int64(timeout / time.Second),
+		ExpiresAt: now.Add(timeout),
+	}, now)
+	if errors.Is(err, database.ErrLocked) {
+		return ``, webdav.ErrLocked
+	}
+	return token, err
+}
+
+func (ls *lockSystem) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	timeout := lockTimeout(duration)
+	l, err := database.RefreshDAVLock(ls.ctx, ls.uid, token, int64(timeout/time.Second), now.Add(timeout), now)
+	if errors.Is(err, sql.ErrNoRows) {
+		return webdav.LockDetails{}, webdav.ErrNoSuchLock
+	}
+	if err != nil {
+		return webdav.LockDetails{}, err
+	}
+
+	return webdav.LockDetails{
+		Root:      l.Root,
+		Duration:  time.Duration(l.Timeout) * time.Second,
+		OwnerXML:  l.OwnerXML,
+		ZeroDepth: l.ZeroDepth,
+	}, nil
+}
+
+func (ls *lockSystem) Unlock(now time.Time, token string) error {
+	err := database.DeleteDAVLock(ls.ctx, ls.uid, token, now)
+	if errors.Is(err, sql.ErrNoRows) {
+		return webdav.ErrNoSuchLock
+	}
+	return err
+}
+
+// lockTimeout returns the timeout of a lock the client asked to hold
+// for d, where a negative d means infinite.
+func lockTimeout(d time.Duration) time.Duration {
+	if d < 0 || d > maxLockTimeout {
+		return maxLockTimeout
+	}
+	if d < time.Second {
+		return time.Second
+	}
+	return d
+}
+
+// lockToken returns a random version 4 UUID as an opaquelocktoken URI.
+func lockToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ``, err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf(`opaquelocktoken:%x-%x-%x-%x-%x`, b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dav
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+
+	"server/database"
+
+	"golang.org/x/net/webdav"
+)
+
+// props holds the dead properties of a path, which clients like
+// Finder and Windows Explorer set for their own bookkeeping.
+type props struct {
+	ctx  context.Context
+	uid  int64
+	name string
+}
+
+func (p props) DeadProps() (map[xml.Name]webdav.Property, error) {
+	stored, err := database.GetDeadProps(p.ctx, p.uid, p.name)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[xml.Name]webdav.Property, len(stored))
+	for _, prop := range stored {
+		name := xml.Name{Space: prop.Space, Local: prop.Local}
+		m[name] = webdav.Property{
+			XMLName:  name,
+			Lang:     prop.Lang,
+			InnerXML: []byte(prop.InnerXML),
+		}
+	}
+	return m, nil
+}
+
+// Patch applies all patches or, if storing fails, none of them.
+func (p props) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	var (
+		changes = make([]database.PropPatch, len(patches))
+		done    = webdav.Propstat{Status: http.StatusOK}
+	)
+	for i, patch := range patches {
+		changes[i].Remove = patch.Remove
+		for _, prop := range patch.Props {
+			changes[i].Props = append(changes[i].Props, database.DAVProperty{
+				Space:    prop.XMLName.Space,
+				Local:    prop.XMLName.Local,
+				Lang:     prop.Lang,
+				InnerXML: string(prop.InnerXML),
+			})
+			done.Props = append(done.Props, webdav.Property{XMLName: prop.XMLName})
+		}
+	}
+
+	if err := database.PatchDeadProps(p.ctx, p.uid, p.name, changes); err != nil {
+		return nil, err
+	}
+	return []webdav.Propstat{done}, nil
+}
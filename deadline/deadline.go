@@ -0,0 +1,94 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package deadline lets transfers of files and archives outlast the
+// timeouts of the server, as long as data keeps moving.
+package deadline
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Timeout bounds reading a request and writing its response. Handlers
+// wrapped with Extend get it anew whenever data moves.
+const Timeout = 15 * time.Second
+
+// Extend wraps h, a handler of large bodies or streamed responses, so
+// reading the body and writing the response push the read and write
+// deadlines of the connection Timeout ahead. Clients that stall are
+// still cut off.
+//
+// Both deadlines move together: a long upload would otherwise run out
+// of time to be answered, and a long download would hit the read
+// deadline the server keeps watching for a closed connection.
+func Extend(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := &conn{rc: http.NewResponseController(w)}
+		c.extend()
+
+		r.Body = &body{ReadCloser: r.Body, c: c}
+		h.ServeHTTP(&responseWriter{ResponseWriter: w, c: c}, r)
+	})
+}
+
+type conn struct {
+	rc *http.ResponseController
+	// extended is when the deadlines were last pushed, in Unix
+	// nanoseconds, so they aren't reset on every small write.
+	extended atomic.Int64
+}
+
+func (c *conn) extend() {
+	now := time.Now()
+	if now.UnixNano()-c.extended.Load() < int64(time.Second) {
+		return
+	}
+	c.extended.Store(now.UnixNano())
+
+	// Writers that can't set deadlines keep the ones of the server.
+	c.rc.SetReadDeadline(now.Add(Timeout))
+	c.rc.SetWriteDeadline(now.Add(Timeout))
+}
+
+type body struct {
+	io.ReadCloser
+	c *conn
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	b.c.extend()
+	return b.ReadCloser.Read(p)
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	c *conn
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.c.extend()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseWriter) Flush() {
+	w.c.extend()
+	w.c.rc.Flush()
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
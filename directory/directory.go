@@ -21,33 +21,130 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
-	"server/catcherr"
 )
 
 const (
+	APIVersion = `/api/v1`
+
+	APIOpenAPI = `/api/openapi.json`
+	APIDocs    = `/api/docs`
+
 	APIFileServer = `/api/file/`
 
-	APIAuthCheck = `/api/auth/check`
-	APIRegister  = `/api/auth/register`
-	APILogin     = `/api/auth/login`
+	// DAV serves the files of the users over WebDAV.
+	DAV = `/dav`
+
+	// S3 serves the files of the users over the S3 API.
+	S3 = `/s3`
+
+	// LFS serves the Git LFS objects and locks of the users.
+	LFS = `/lfs`
+
+	// Registry serves the container images of the users. Clients expect
+	// the OCI distribution API at this path.
+	Registry = `/v2`
+
+	// Restic serves the restic repositories of the users.
+	Restic = `/restic`
+
+	// VerifyPage and ResetPage are opened from the links sent by email.
+	VerifyPage = `/verify`
+	ResetPage  = `/reset`
+
+	APIAuthCheck = APIVersion + `/auth/check`
+	APIRegister  = APIVersion + `/auth/register`
+	APILogin     = APIVersion + `/auth/login`
+	APIRefresh   = APIVersion + `/auth/refresh`
+
+	APIVerifyEmail          = APIVersion + `/auth/verify`
+	APIPasswordResetRequest = APIVersion + `/auth/reset/request`
+	APIPasswordReset        = APIVersion + `/auth/reset`
+
+	APIFileUpload = APIVersion + `/file/upload`
+	APIFileList   = APIVersion + `/file/list`
+	APIFileDelete = APIVersion + `/file/delete`
+	APIFile       = APIVersion + `/file/{id:[0-9]+}`
+	APIFileData   = APIVersion + `/file/{id:[0-9]+}/content`
+	APIThumbnail  = APIVersion + `/file/{id:[0-9]+}/thumbnail`
+	APIMetadata   = APIVersion + `/file/{id:[0-9]+}/metadata`
+	APITimeline   = APIVersion + `/timeline`
 
-	APIFileUpload = `/api/file/upload`
-	APIFileList   = `/api/file/list`
-	APIFileDelete = `/api/file/delete`
+	APIChanges = APIVersion + `/changes`
+
+	APIFolders = APIVersion + `/folders`
+	APIFolder  = APIVersion + `/folders/{id:[0-9]+}`
+	APIArchive = APIVersion + `/archive`
+
+	APIUploads = APIVersion + `/uploads`
+	APIUpload  = APIVersion + `/uploads/{id:[0-9a-f]+}`
+
+	APIShares     = APIVersion + `/shares`
+	APIShare      = APIVersion + `/shares/{id:[0-9]+}`
+	APIShared     = APIVersion + `/s/{token}`
+	APISharedInfo = APIVersion + `/s/{token}/info`
+
+	APIAccount         = APIVersion + `/account`
+	APIAccountPassword = APIVersion + `/account/password`
+	APIAccountLogin    = APIVersion + `/account/login`
+	APIAccountEmail    = APIVersion + `/account/email`
+	APIAccountVerify   = APIVersion + `/account/email/verify`
+	APIAccountTokens   = APIVersion + `/account/tokens`
+	APIAccountToken    = APIVersion + `/account/tokens/{id:[0-9]+}`
+
+	APIAccountAppPasswords = APIVersion + `/account/app-passwords`
+	APIAccountAppPassword  = APIVersion + `/account/app-passwords/{id:[0-9]+}`
+	APIAccountAccessKeys   = APIVersion + `/account/access-keys`
+	APIAccountAccessKey    = APIVersion + `/account/access-keys/{id:[0-9]+}`
+	APIAccountSSHKeys      = APIVersion + `/account/ssh-keys`
+	APIAccountSSHKey       = APIVersion + `/account/ssh-keys/{id:[0-9]+}`
+
+	APIAdminUnlock        = APIVersion + `/admin/unlock`
+	APIAdminInvites       = APIVersion + `/admin/invites`
+	APIAdminInvite        = APIVersion + `/admin/invites/{id:[0-9]+}`
+	APIAdminRegistrations = APIVersion + `/admin/registrations`
+	APIAdminRegistration  = APIVersion + `/admin/registrations/{id:[0-9]+}`
+	APIAdminApprove       = APIVersion + `/admin/registrations/{id:[0-9]+}/approve`
+	APIAdminUsers         = APIVersion + `/admin/users`
+	APIAdminUser          = APIVersion + `/admin/users/{id:[0-9]+}`
+	APIAdminUserDisable   = APIVersion + `/admin/users/{id:[0-9]+}/disable`
+	APIAdminUserEnable    = APIVersion + `/admin/users/{id:[0-9]+}/enable`
+	APIAdminUserPassword  = APIVersion + `/admin/users/{id:[0-9]+}/password`
+	APIAdminUserQuota     = APIVersion + `/admin/users/{id:[0-9]+}/quota`
+	APIAdminUserRole      = APIVersion + `/admin/users/{id:[0-9]+}/role`
+	APIAdminUserLogout    = APIVersion + `/admin/users/{id:[0-9]+}/logout`
 
 	userDataFolder = `userdata`
+	uploadsFolder  = `uploads`
+	partsFolder    = `parts`
+	registryFolder = `registry`
+	thumbsFolder   = `thumbnails`
 )
 
-func init() {
-	err := os.Mkdir(userDataFolder, os.ModePerm)
-	if errors.Is(err, fs.ErrExist) {
-		return
+// Init creates the user data folders if they don't exist yet.
+func Init() error {
+	for _, dir := range []string{userDataFolder, Uploads(), Parts(), RegistryUploads(), Thumbnails()} {
+		err := os.Mkdir(dir, os.ModePerm)
+		if err != nil && !errors.Is(err, fs.ErrExist) {
+			return err
+		}
 	}
-	catcherr.HandleError(err)
+	return nil
 }
 
 func UserData() string { return CleanPath(userDataFolder) }
 
+// Uploads holds the data of unfinished resumable uploads.
+func Uploads() string { return CleanPath(userDataFolder, uploadsFolder) }
+
+// Parts holds the parts of unfinished S3 multipart uploads.
+func Parts() string { return CleanPath(userDataFolder, partsFolder) }
+
+// RegistryUploads holds the data of unfinished container blob uploads.
+func RegistryUploads() string { return CleanPath(userDataFolder, registryFolder) }
+
+// Thumbnails holds the thumbnails of images, named after their checksum.
+func Thumbnails() string { return CleanPath(userDataFolder, thumbsFolder) }
+
 func CleanPath(elem ...string) string {
 	return filepath.Clean(filepath.Join(elem...))
 }
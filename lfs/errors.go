@@ -0,0 +1,64 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lfs
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"server/catcherr"
+)
+
+var (
+	Unauthorized        = catcherr.New(http.StatusUnauthorized, `unauthorized`, `Credentials needed`)
+	InvalidCredentials  = catcherr.New(http.StatusUnauthorized, `invalid_credentials`, `Invalid login or token`)
+	Forbidden           = catcherr.New(http.StatusForbidden, `forbidden`, `You can't write to this repository`)
+	NotFound            = catcherr.New(http.StatusNotFound, `not_found`, `Not found`)
+	MethodNotAllowed    = catcherr.New(http.StatusMethodNotAllowed, `method_not_allowed`, `Method not allowed`)
+	HashAlgoUnsupported = catcherr.New(http.StatusConflict, `hash_algo_unsupported`, `Only sha256 object ids are supported`)
+	ValidationFailed    = catcherr.New(http.StatusUnprocessableEntity, `validation_failed`, `The request is not valid`)
+	RateLimited         = catcherr.New(http.StatusTooManyRequests, `rate_limited`, `Too many failed attempts`)
+	AccountLocked       = catcherr.New(http.StatusTooManyRequests, `account_locked`, `Account locked after failed attempts`)
+	InternalError       = catcherr.New(http.StatusInternalServerError, `internal_error`, `Internal server error`)
+	InsufficientStorage = catcherr.New(http.StatusInsufficientStorage, `insufficient_storage`, `Storage quota exceeded`)
+)
+
+// protocol sends errors as the JSON documents LFS clients show to their
+// users rather than the problem documents of the native API.
+var protocol = catcherr.Protocol{Internal: InternalError, Render: writeError}
+
+type errorResponse struct {
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, e *catcherr.Error, requestID string) {
+	if e.Status == http.StatusUnauthorized {
+		w.Header().Set(`LFS-Authenticate`, `Basic realm="dexcloud"`)
+	}
+	sendJSON(w, e.Status, errorResponse{Message: e.Message(), RequestID: requestID})
+}
+
+func sendJSON(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set(`Content-Type`, mediaType)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf(`[ lfs ]: can't send response to the client: %v`, err)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package lfs serves the Git LFS API at directory.LFS, so repositories
+// can keep their large files in dexcloud. Object ids are SHA-256
+// checksums, which is how blobs are stored already. Every user has their
+// own repositories, named by the path after the prefix, and sign in with
+// Basic auth and a personal token or an app password.
+package lfs
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"server/auth"
+	"server/catcherr"
+	"server/config"
+	"server/database"
+	"server/deadline"
+	"server/directory"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	mediaType = `application/vnd.git-lfs+json`
+
+	maxRepoLength = 255
+)
+
+// route splits a path into the repository and the endpoint. Clients
+// that derive the URL from a Git remote add /info/lfs, which is dropped.
+var route = regexp.MustCompile(`^(.+?)(?:/info/lfs)?/(objects/batch|objects/verify|objects/[0-9a-f]{64}|locks|locks/verify|locks/[0-9]+/unlock)$`)
+
+// request is an authenticated LFS request.
+type request struct {
+	*http.Request
+	u    database.User
+	repo string
+}
+
+// Handle mounts the LFS API at directory.LFS. It has to come before
+// routes with a prefix that would shadow it.
+func Handle(r *mux.Router) {
+	r.PathPrefix(directory.LFS + `/`).Handler(deadline.Extend(protocol.Handle(serveLFS)))
+}
+
+func serveLFS(w http.ResponseWriter, r *http.Request) error {
+	m := route.FindStringSubmatch(strings.TrimPrefix(r.URL.Path, directory.LFS))
+	if m == nil || !validRepo(m[1]) {
+		return NotFound
+	}
+
+	u, err := auth.AuthenticateBasicThrottled(w, r, failures)
+	if err != nil {
+		return err
+	}
+	catcherr.SetLogin(r.Context(), u.Login)
+
+	req := &request{Request: r, u: u, repo: strings.TrimPrefix(m[1], `/`)}
+	endpoint := m[2]
+	switch {
+	case endpoint == `objects/batch`:
+		return allow(w, req, http.MethodPost, batch)
+	case endpoint == `objects/verify`:
+		return allow(w, req, http.MethodPost, writable(verifyObject))
+	case strings.HasPrefix(endpoint, `objects/`):
+		oid := strings.TrimPrefix(endpoint, `objects/`)
+		if r.Method == http.MethodPut {
+			return writable(func(w http.ResponseWriter, r *request) error { return putObject(w, r, oid) })(w, req)
+		}
+		return allow(w, req, http.MethodGet, func(w http.ResponseWriter, r *request) error { return getObject(w, r, oid) })
+	case endpoint == `locks` && r.Method == http.MethodGet:
+		return listLocks(w, req)
+	case endpoint == `locks`:
+		return allow(w, req, http.MethodPost, writable(createLock))
+	case endpoint == `locks/verify`:
+		return allow(w, req, http.MethodPost, writable(verifyLocks))
+	}
+
+	id, _ := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(endpoint, `locks/`), `/unlock`), 10, 64)
+	return allow(w, req, http.MethodPost, writable(func(w http.ResponseWriter, r *request) error { return unlock(w, r, id) }))
+}
+
+type requestHandler func(w http.ResponseWriter, r *request) error
+
+// allow runs f for requests with the method.
+func allow(w http.ResponseWriter, r *request, method string, f requestHandler) error {
+	if r.Method != method {
+		w.Header().Set(`Allow`, method)
+		return MethodNotAllowed
+	}
+	return f(w, r)
+}
+
+// writable refuses read only users.
+func writable(f requestHandler) requestHandler {
+	return func(w http.ResponseWriter, r *request) error {
+		if r.u.Role == database.RoleReadOnly {
+			return Forbidden
+		}
+		return f(w, r)
+	}
+}
+
+// failures are answered in the format of the LFS API, which
+// sets LFS-Authenticate itself.
+var failures = auth.Failures{
+	Unauthorized:       Unauthorized,
+	InvalidCredentials: InvalidCredentials,
+	RateLimited:        RateLimited,
+	AccountLocked:      AccountLocked,
+	Internal:           InternalError,
+}
+
+// validRepo tells whether the repository name is a clean relative path.
+func validRepo(repo string) bool {
+	repo = strings.TrimPrefix(repo, `/`)
+	if repo == `` || len(repo) > maxRepoLength {
+		return false
+	}
+	for _, segment := range strings.Split(repo, `/`) {
+		if segment == `` || segment == `.` || segment == `..` {
+			return false
+		}
+	}
+	return true
+}
+
+// link returns the absolute URL of the endpoint of the repository.
+func (r *request) link(endpoint string) string {
+	segments := strings.Split(r.repo, `/`)
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.TrimSuffix(config.String(config.PublicURL), `/`) +
+		directory.LFS + `/` + strings.Join(segments, `/`) + `/` + endpoint
+}
+
+// decode reads the JSON body into v.
+func decode(r *request, v any) error {
+	body := io.LimitReader(r.Body, config.Int64(config.RequestMaxBody))
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		return ValidationFailed.WithDetail(`The body is not valid JSON`).Wrap(err)
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lfs
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"server/database"
+)
+
+const (
+	defaultLockLimit = 100
+	maxLockLimit     = 1000
+	maxPathLength    = 1024
+)
+
+type lockOwner struct {
+	Name string `json:"name"`
+}
+
+type lock struct {
+	ID       string    `json:"id"`
+	Path     string    `json:"path"`
+	LockedAt time.Time `json:"locked_at"`
+	Owner    lockOwner `json:"owner"`
+}
+
+type createLockRequest struct {
+	Path string `json:"path"`
+}
+
+type lockResponse struct {
+	Lock    lock   `json:"lock"`
+	Message string `json:"message,omitempty"`
+}
+
+type listLocksResponse struct {
+	Locks      []lock `json:"locks"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type verifyLocksRequest struct {
+	Cursor string `json:"cursor"`
+	Limit  int    `json:"limit"`
+}
+
+type verifyLocksResponse struct {
+	Ours       []lock `json:"ours"`
+	Theirs     []lock `json:"theirs"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type unlockRequest struct {
+	Force bool `json:"force"`
+}
+
+// createLock locks the path, or answers 409 with the lock already on it.
+func createLock(w http.ResponseWriter, r *request) error {
+	ctx := r.Context()
+
+	var req createLockRequest
+	if err := decode(r, &req); err != nil {
+		return err
+	}
+	if req.Path == `` || len(req.Path) > maxPathLength {
+		return ValidationFailed.WithDetail(`The path is empty or too long`)
+	}
+
+	l, err := database.CreateLFSLock(ctx, database.LFSLock{UserID: r.u.ID, Repo: r.repo, Path: req.Path})
+	if errors.Is(err, database.ErrDuplicate) {
+		l, err = database.GetLFSLockAt(ctx, r.u.ID, r.repo, req.Path)
+		if err != nil {
+			return InternalError.Wrap(err)
+		}
+		return sendJSON(w, http.StatusConflict, lockResponse{Lock: r.lock(l), Message: `already created lock`})
+	}
+	if err != nil {
+		return InternalError.Wrap(err)
+	}
+
+	return sendJSON(w, http.StatusCreated, lockResponse{Lock: r.lock(l)})
+}
+
+func listLocks(w http.ResponseWriter, r *request) error {
+	q := r.URL.Query()
+
+	var filter database.LFSLockFilter
+	filter.Path = q.Get(`path`)
+	if v := q.Get(`id`); v != `` {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return sendJSON(w, http.StatusOK, listLocksResponse{Locks: []lock{}})
+		}
+		filter.ID = id
+	}
+
+	limit, err := lockLimit(q.Get(`limit`))
+	if err != nil {
+		return err
+	}
+
+	locks, next, err := r.locks(filter, q.Get(`cursor`), limit)
+	if err != nil {
+		return err
+	}
+	return sendJSON(w, http.StatusOK, listLocksResponse{Locks: locks, NextCursor: next})
+}
+
+// verifyLocks lists the locks before a push. Repositories belong to one
+// user, so every lock is theirs to push over.
+func verifyLocks(w http.ResponseWriter, r *request) error {
+	var req verifyLocksRequest
+	if err := decode(r, &req); err != nil {
+		return err
+	}
+
+	limit := defaultLockLimit
+	if req.Limit > 0 {
+		limit = req.Limit
+	}
+	if limit > maxLockLimit {
+		limit = maxLockLimit
+	}
+
+	locks, next, err := r.locks(database.LFSLockFilter{}, req.Cursor, limit)
+	if err != nil {
+		return err
+	}
+	return sendJSON(w, http.StatusOK, verifyLocksResponse{Ours: locks, Theirs: []lock{}, NextCursor: next})
+}
+
+// unlock releases the lock. Force is accepted but changes nothing, since
+// the user owns every lock of their repositories.
+func unlock(w http.ResponseWriter, r *request, id int64) error {
+	var req unlockRequest
+	if err := decode(r, &req); err != nil {
+		return err
+	}
+
+	l, err := database.DeleteLFSLock(r.Context(), r.u.ID, r.repo, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return NotFound.WithDetail(`Lock does not exist`).Wrap(err)
+	}
+	if err != nil {
+		return InternalError.Wrap(err)
+	}
+
+	return sendJSON(w, http.StatusOK, lockResponse{Lock: r.lock(l)})
+}
+
+// locks returns a page of the locks of the repository after the cursor,
+// which is the id of the last lock of the previous page.
+func (r *request) locks(filter database.LFSLockFilter, cursor string, limit int) ([]lock, string, error) {
+	var after int64
+	if cursor != `` {
+		var err error
+		if after, err = strconv.ParseInt(cursor, 10, 64); err != nil {
+			return nil, ``, ValidationFailed.WithDetail(`The cursor is not valid`).Wrap(err)
+		}
+	}
+
+	stored, err := database.GetLFSLocks(r.Context(), r.u.ID, r.repo, filter, after, limit+1)
+	if err != nil {
+		return nil, ``, InternalError.Wrap(err)
+	}
+
+	next := ``
+	if len(stored) > limit {
+		stored = stored[:limit]
+		next = strconv.FormatInt(stored[limit-1].ID, 10)
+	}
+
+	locks := make([]lock, len(stored))
+	for i, l := range stored {
+		locks[i] = r.lock(l)
+	}
+	return locks, next, nil
+}
+
+func (r *request) lock(l database.LFSLock) lock {
+	return lock{
+		ID:       strconv.FormatInt(l.ID, 10),
+		Path:     l.Path,
+		LockedAt: l.LockedAt,
+		Owner:    lockOwner{Name: r.u.Login},
+	}
+}
+
+func lockLimit(v string) (int, error) {
+	if v == `` {
+		return defaultLockLimit, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, ValidationFailed.WithDetail(`The limit is not valid`).Wrap(err)
+	}
+	if n > maxLockLimit {
+		n = maxLockLimit
+	}
+	return n, nil
+}
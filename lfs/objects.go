@@ -0,0 +1,201 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lfs
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+
+	"server/database"
+	"server/user"
+)
+
+var oidPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+type batchRequest struct {
+	Operation string          `json:"operation"`
+	Transfers []string        `json:"transfers"`
+	HashAlgo  string          `json:"hash_algo"`
+	Objects   []objectPointer `json:"objects"`
+}
+
+type objectPointer struct {
+	OID  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+type action struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+type objectError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type batchObject struct {
+	objectPointer
+	Authenticated bool              `json:"authenticated,omitempty"`
+	Actions       map[string]action `json:"actions,omitempty"`
+	Error         *objectError      `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Transfer string        `json:"transfer"`
+	Objects  []batchObject `json:"objects"`
+	HashAlgo string        `json:"hash_algo"`
+}
+
+// batch tells the client where to download the objects from or upload
+// them to. Objects the repository has already need no upload.
+func batch(w http.ResponseWriter, r *request) error {
+	ctx := r.Context()
+
+	var req batchRequest
+	if err := decode(r, &req); err != nil {
+		return err
+	}
+
+	switch {
+	case req.HashAlgo != `` && req.HashAlgo != `sha256`:
+		return HashAlgoUnsupported
+	case req.Operation == `upload` && r.u.Role == database.RoleReadOnly:
+		return Forbidden
+	case req.Operation != `upload` && req.Operation != `download`:
+		return ValidationFailed.WithDetail(`The operation must be upload or download`)
+	}
+
+	oids := make([]string, 0, len(req.Objects))
+	for _, o := range req.Objects {
+		oids = append(oids, o.OID)
+	}
+	stored, err := database.GetLFSObjects(ctx, r.u.ID, r.repo, oids)
+	if err != nil {
+		return InternalError.Wrap(err)
+	}
+	sizes := make(map[string]int64, len(stored))
+	for _, o := range stored {
+		sizes[o.OID] = o.Size
+	}
+
+	// The same header that authenticated the batch authenticates the transfers.
+	header := map[string]string{`Authorization`: r.Header.Get(`Authorization`)}
+
+	res := batchResponse{Transfer: `basic`, HashAlgo: `sha256`, Objects: make([]batchObject, 0, len(req.Objects))}
+	var missing int64
+	for _, o := range req.Objects {
+		obj := batchObject{objectPointer: o, Authenticated: true}
+		size, exists := sizes[o.OID]
+
+		switch {
+		case !oidPattern.MatchString(o.OID) || o.Size < 0:
+			obj.Error = &objectError{Code: http.StatusUnprocessableEntity, Message: `Invalid object id or size`}
+		case req.Operation == `download` && !exists:
+			obj.Error = &objectError{Code: http.StatusNotFound, Message: `Object does not exist`}
+		case req.Operation == `download`:
+			obj.Size = size
+			obj.Actions = map[string]action{
+				`download`: {Href: r.link(`objects/` + o.OID), Header: header},
+			}
+		case !exists:
+			missing += o.Size
+			obj.Actions = map[string]action{
+				`upload`: {Href: r.link(`objects/` + o.OID), Header: header},
+				`verify`: {Href: r.link(`objects/verify`), Header: header},
+			}
+		}
+		res.Objects = append(res.Objects, obj)
+	}
+
+	if missing > 0 {
+		err = user.CheckQuota(ctx, r.u, missing)
+		if errors.Is(err, user.ErrQuotaExceeded) {
+			return InsufficientStorage.Wrap(err)
+		}
+		if err != nil {
+			return InternalError.Wrap(err)
+		}
+	}
+	return sendJSON(w, http.StatusOK, res)
+}
+
+func getObject(w http.ResponseWriter, r *request, oid string) error {
+	o, err := database.GetLFSObject(r.Context(), r.u.ID, r.repo, oid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return NotFound.WithDetail(`Object does not exist`).Wrap(err)
+	}
+	if err != nil {
+		return InternalError.Wrap(err)
+	}
+
+	blob, err := user.OpenFile(o.OID)
+	if err != nil {
+		return InternalError.Wrap(err)
+	}
+	defer blob.Close()
+
+	w.Header().Set(`Content-Type`, `application/octet-stream`)
+	w.Header().Set(`ETag`, `"`+o.OID+`"`)
+	http.ServeContent(w, r.Request, ``, o.CreatedAt, blob)
+	return nil
+}
+
+// putObject stores the object. Its size comes from Content-Length,
+// which the basic transfer always sends.
+func putObject(w http.ResponseWriter, r *request, oid string) error {
+	if r.ContentLength < 0 {
+		return ValidationFailed.WithDetail(`Content-Length is required`)
+	}
+
+	err := user.SaveLFSObject(r.Context(), r.u, r.repo, oid, r.ContentLength, r.Body)
+	switch {
+	case errors.Is(err, user.ErrLFSMismatch):
+		return ValidationFailed.WithDetail(`The content doesn't match the object id`).Wrap(err)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return ValidationFailed.WithDetail(`The body ended early`).Wrap(err)
+	case errors.Is(err, user.ErrQuotaExceeded):
+		return InsufficientStorage.Wrap(err)
+	case err != nil:
+		return InternalError.Wrap(err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// verifyObject confirms that an upload arrived whole.
+func verifyObject(w http.ResponseWriter, r *request) error {
+	var req objectPointer
+	if err := decode(r, &req); err != nil {
+		return err
+	}
+
+	o, err := database.GetLFSObject(r.Context(), r.u.ID, r.repo, req.OID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && o.Size != req.Size) {
+		return NotFound.WithDetail(`Object does not exist`)
+	}
+	if err != nil {
+		return InternalError.Wrap(err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SMTP delivers messages through an SMTP server. Authentication is
+// skipped when Username is empty, which is what local stand-ins expect.
+type SMTP struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (s SMTP) Send(ctx context.Context, m Message) error {
+	var auth smtp.Auth
+	if s.Username != `` {
+		host := s.Addr
+		if i := strings.LastIndex(host, `:`); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth(``, s.Username, s.Password, host)
+	}
+	return smtp.SendMail(s.Addr, auth, s.From, []string{m.To}, format(s.From, m))
+}
+
+// File writes every message as an .eml file into Dir.
+type File struct {
+	Dir  string
+	From string
+}
+
+func (f File) Send(ctx context.Context, m Message) error {
+	if err := os.MkdirAll(f.Dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf(`%d.eml`, time.Now().UnixNano())
+	return os.WriteFile(filepath.Join(f.Dir, name), format(f.From, m), 0600)
+}
+
+// Log only writes messages to the server log.
+type Log struct{}
+
+func (Log) Send(ctx context.Context, m Message) error {
+	const template = `[ Mail to: %s ]: %s\n%s`
+	log.Printf(template, m.To, m.Subject, m.Body)
+	return nil
+}
+
+func format(from string, m Message) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", m.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	return b.Bytes()
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"server/config"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(ctx context.Context, m Message) error
+}
+
+var mailer Mailer
+
+// Init selects the driver from config.yml.
+func Init() error {
+	from := config.String(config.MailFrom)
+
+	switch driver := config.String(config.MailDriver); driver {
+	case `smtp`:
+		mailer = SMTP{
+			Addr:     config.String(config.MailSMTPHost),
+			Username: config.String(config.MailSMTPUser),
+			Password: config.String(config.MailSMTPPass),
+			From:     from,
+		}
+	case `file`:
+		mailer = File{Dir: config.String(config.MailDir), From: from}
+	case `log`:
+		mailer = Log{}
+	default:
+		return fmt.Errorf(`unknown mail driver %q`, driver)
+	}
+	return nil
+}
+
+// SetMailer replaces the driver selected in config.yml.
+func SetMailer(m Mailer) { mailer = m }
+
+func Send(ctx context.Context, m Message) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return mailer.Send(ctx, m)
+}
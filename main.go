@@ -17,54 +17,128 @@ limitations under the License.
 package main
 
 import (
-	"errors"
+	"context"
+	"log"
 	"net/http"
 	"server/api"
 	"server/catcherr"
 	"server/config"
+	"server/database"
+	"server/dav"
+	"server/deadline"
 	"server/directory"
+	"server/lfs"
+	"server/mailer"
+	"server/openapi"
+	"server/pages"
+	"server/password"
+	"server/registry"
+	"server/restic"
+	"server/s3"
+	"server/sftp"
+	"server/throttle"
+	"server/user"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
+// idleTimeout is how long a kept alive connection may wait for its next
+// request.
+const idleTimeout = 2 * time.Minute
+
 func initHandlers(r *mux.Router) {
+	// API goes first so the file server prefix never shadows it.
+	api.Handle(r)
+	openapi.Handle(r)
+	pages.Handle(r)
+	dav.Handle(r)
+	s3.Handle(r)
+	lfs.Handle(r)
+	registry.Handle(r)
+	restic.Handle(r)
+
 	// FileServer
-	r.PathPrefix(directory.APIFileServer).HandlerFunc(fileServer).Methods(http.MethodGet)
+	r.PathPrefix(directory.APIFileServer).Handler(deadline.Extend(catcherr.Handle(fileServer))).Methods(http.MethodGet)
 
-	// API
-	api.Handle(r)
+	r.NotFoundHandler = catcherr.Respond(catcherr.NotFound)
+	r.MethodNotAllowedHandler = catcherr.Respond(catcherr.MethodNotAllowed)
 }
 
 func main() {
-	defer catcherr.Recover(`main.main()`)
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run() error {
+	ctx := context.Background()
+
+	if err := config.Load(`config.yml`); err != nil {
+		return err
+	}
+
+	if err := directory.Init(); err != nil {
+		return err
+	}
+
+	if err := database.Open(ctx); err != nil {
+		return err
+	}
+
+	if err := password.Load(); err != nil {
+		return err
+	}
+
+	if err := throttle.Init(); err != nil {
+		return err
+	}
+
+	if err := mailer.Init(); err != nil {
+		return err
+	}
+
+	if err := user.Init(ctx); err != nil {
+		return err
+	}
+
+	if err := sftp.Start(ctx); err != nil {
+		return err
+	}
+
+	if err := openapi.Load(); err != nil {
+		return err
+	}
+
 	r := mux.NewRouter()
 	initHandlers(r)
 
-	var (
-		host    = config.String(config.Host)
-		timeout = 15 * time.Second
-	)
+	// Refuse to start with routes the document doesn't describe.
+	if err := openapi.CheckRoutes(r); err != nil {
+		return err
+	}
 
+	// Routes of large bodies and streams push the read and write
+	// timeouts ahead while data moves, see deadline.Extend.
 	srv := http.Server{
-		Addr:         host,
-		Handler:      r,
-		WriteTimeout: timeout,
-		ReadTimeout:  timeout,
+		Addr:              config.String(config.Host),
+		Handler:           r,
+		ReadHeaderTimeout: deadline.Timeout,
+		ReadTimeout:       deadline.Timeout,
+		WriteTimeout:      deadline.Timeout,
+		IdleTimeout:       idleTimeout,
 	}
-	catcherr.HandleError(srv.ListenAndServe())
+	return srv.ListenAndServe()
 }
 
 // ToDo: Auth check
-func fileServer(w http.ResponseWriter, r *http.Request) {
-	defer catcherr.Recover(`main.fileServer()`)
-
+func fileServer(w http.ResponseWriter, r *http.Request) error {
 	if strings.HasSuffix(r.URL.Path, `/`) {
-		err := errors.New(catcherr.Forbidden.Description)
-		catcherr.HandleAndResponse(w, catcherr.Forbidden, err)
+		return catcherr.Forbidden
 	}
 
 	fs := http.FileServer(http.Dir(directory.APIFileServer))
 	fs.ServeHTTP(w, r)
+	return nil
 }
@@ -0,0 +1,39 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"server/openapi"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// TestRoutesDocumented fails on the same routes the server refuses to start
+// with, so an undocumented endpoint is caught before it is deployed.
+func TestRoutesDocumented(t *testing.T) {
+	if err := openapi.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := mux.NewRouter()
+	initHandlers(r)
+
+	if err := openapi.CheckRoutes(r); err != nil {
+		t.Fatal(err)
+	}
+}
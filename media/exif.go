@@ -0,0 +1,305 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// EXIF tags, of IFD0, the Exif IFD and the GPS IFD.
+const (
+	tagMake        = 0x010F
+	tagModel       = 0x0110
+	tagOrientation = 0x0112
+	tagDateTime    = 0x0132
+	tagExifIFD     = 0x8769
+	tagGPSIFD      = 0x8825
+
+	tagDateTimeOriginal = 0x9003
+
+	tagGPSLatitudeRef  = 1
+	tagGPSLatitude     = 2
+	tagGPSLongitudeRef = 3
+	tagGPSLongitude    = 4
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// readJPEG reads the EXIF data of the JPEG, if it has any.
+func readJPEG(r io.ReaderAt, size int64, m *Metadata) error {
+	return jpegSegments(r, size, func(marker byte, off int64, n int) (bool, error) {
+		if marker != 0xE1 || n < len(exifHeader) {
+			return true, nil
+		}
+		seg, err := readAt(r, off, n)
+		if err != nil || !bytes.HasPrefix(seg, exifHeader) {
+			return err == nil, err
+		}
+
+		readTIFF(seg[len(exifHeader):], m)
+		return false, nil
+	})
+}
+
+// jpegSegments calls f with the marker, offset and length of the content
+// of each segment before the image data, until f returns false.
+func jpegSegments(r io.ReaderAt, size int64, f func(marker byte, off int64, n int) (bool, error)) error {
+	head, err := readAt(r, 0, 2)
+	if err != nil || !bytes.Equal(head, []byte{0xFF, 0xD8}) {
+		return err
+	}
+
+	for off := int64(2); off+4 <= size; {
+		h, err := readAt(r, off, 4)
+		if err != nil || len(h) < 4 || h[0] != 0xFF {
+			return err
+		}
+
+		marker := h[1]
+		// Start of scan: the image data follows, no more metadata.
+		if marker == 0xDA || marker == 0xD9 {
+			return nil
+		}
+		n := int(binary.BigEndian.Uint16(h[2:])) - 2
+		if n < 0 {
+			return nil
+		}
+
+		more, err := f(marker, off+4, n)
+		if err != nil || !more {
+			return err
+		}
+		off += 4 + int64(n)
+	}
+	return nil
+}
+
+// tiff is the TIFF structure EXIF data is stored in.
+type tiff struct {
+	b     []byte
+	order binary.ByteOrder
+}
+
+// ifdEntry is a field of an IFD.
+type ifdEntry struct {
+	tag, typ uint16
+	count    uint32
+	pos      int // of the entry in the TIFF
+}
+
+func readTIFF(b []byte, m *Metadata) {
+	t, ifd0, ok := parseTIFF(b)
+	if !ok {
+		return
+	}
+
+	var exifIFD, gpsIFD uint32
+	var dateTime string
+	for _, e := range t.entries(ifd0) {
+		switch e.tag {
+		case tagMake:
+			m.CameraMake = t.ascii(e)
+		case tagModel:
+			m.CameraModel = t.ascii(e)
+		case tagOrientation:
+			if o := int(t.uint(e)); o >= 1 && o <= 8 {
+				m.Orientation = o
+			}
+		case tagDateTime:
+			dateTime = t.ascii(e)
+		case tagExifIFD:
+			exifIFD = t.uint(e)
+		case tagGPSIFD:
+			gpsIFD = t.uint(e)
+		}
+	}
+
+	var original string
+	if exifIFD != 0 {
+		for _, e := range t.entries(exifIFD) {
+			if e.tag == tagDateTimeOriginal {
+				original = t.ascii(e)
+			}
+		}
+	}
+	if original == `` {
+		original = dateTime
+	}
+	m.TakenAt = exifTime(original)
+
+	if gpsIFD != 0 {
+		readGPS(t, gpsIFD, m)
+	}
+}
+
+func parseTIFF(b []byte) (t tiff, ifd0 uint32, ok bool) {
+	if len(b) < 8 {
+		return t, 0, false
+	}
+	switch string(b[:2]) {
+	case `II`:
+		t.order = binary.LittleEndian
+	case `MM`:
+		t.order = binary.BigEndian
+	default:
+		return t, 0, false
+	}
+	t.b = b
+	return t, t.order.Uint32(b[4:]), true
+}
+
+// entries returns the entries of the IFD at off, none if it is broken.
+func (t tiff) entries(off uint32) []ifdEntry {
+	if int64(off)+2 > int64(len(t.b)) {
+		return nil
+	}
+	n := int(t.order.Uint16(t.b[off:]))
+	start := int(off) + 2
+	if start+12*n > len(t.b) {
+		return nil
+	}
+
+	entries := make([]ifdEntry, n)
+	for i := range entries {
+		pos := start + 12*i
+		entries[i] = ifdEntry{
+			tag:   t.order.Uint16(t.b[pos:]),
+			typ:   t.order.Uint16(t.b[pos+2:]),
+			count: t.order.Uint32(t.b[pos+4:]),
+			pos:   pos,
+		}
+	}
+	return entries
+}
+
+// typeSizes are the sizes in bytes of the TIFF field types.
+var typeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// value returns the bytes of the value of the entry, which are in the
+// entry itself if they fit into four bytes and elsewhere otherwise.
+func (t tiff) value(e ifdEntry) []byte {
+	n := int64(typeSizes[e.typ]) * int64(e.count)
+	if n == 0 {
+		return nil
+	}
+	if n <= 4 {
+		return t.b[e.pos+8 : e.pos+8+int(n)]
+	}
+
+	off := int64(t.order.Uint32(t.b[e.pos+8:]))
+	if off+n > int64(len(t.b)) {
+		return nil
+	}
+	return t.b[off : off+n]
+}
+
+func (t tiff) ascii(e ifdEntry) string {
+	if e.typ != 2 {
+		return ``
+	}
+	v := t.value(e)
+	if i := bytes.IndexByte(v, 0); i >= 0 {
+		v = v[:i]
+	}
+	return strings.TrimSpace(string(v))
+}
+
+// uint returns the first value of a SHORT or LONG entry.
+func (t tiff) uint(e ifdEntry) uint32 {
+	v := t.value(e)
+	switch {
+	case e.typ == 3 && len(v) >= 2:
+		return uint32(t.order.Uint16(v))
+	case e.typ == 4 && len(v) >= 4:
+		return t.order.Uint32(v)
+	}
+	return 0
+}
+
+// rationals returns the values of a RATIONAL entry.
+func (t tiff) rationals(e ifdEntry) []float64 {
+	if e.typ != 5 {
+		return nil
+	}
+	v := t.value(e)
+	out := make([]float64, 0, len(v)/8)
+	for i := 0; i+8 <= len(v); i += 8 {
+		num, den := t.order.Uint32(v[i:]), t.order.Uint32(v[i+4:])
+		if den == 0 {
+			return nil
+		}
+		out = append(out, float64(num)/float64(den))
+	}
+	return out
+}
+
+func readGPS(t tiff, off uint32, m *Metadata) {
+	var (
+		latRef, lonRef string
+		lat, lon       []float64
+	)
+	for _, e := range t.entries(off) {
+		switch e.tag {
+		case tagGPSLatitudeRef:
+			latRef = t.ascii(e)
+		case tagGPSLatitude:
+			lat = t.rationals(e)
+		case tagGPSLongitudeRef:
+			lonRef = t.ascii(e)
+		case tagGPSLongitude:
+			lon = t.rationals(e)
+		}
+	}
+
+	latitude, ok1 := degrees(lat, latRef == `S`)
+	longitude, ok2 := degrees(lon, lonRef == `W`)
+	if !ok1 || !ok2 || latitude > 90 || longitude > 180 || latitude < -90 || longitude < -180 {
+		return
+	}
+	m.Latitude, m.Longitude = &latitude, &longitude
+}
+
+// degrees turns degrees, minutes and seconds into decimal degrees.
+func degrees(dms []float64, negative bool) (float64, bool) {
+	if len(dms) != 3 {
+		return 0, false
+	}
+	d := dms[0] + dms[1]/60 + dms[2]/3600
+	if math.IsNaN(d) || math.IsInf(d, 0) {
+		return 0, false
+	}
+	if negative {
+		d = -d
+	}
+	return d, true
+}
+
+// exifTime parses an EXIF timestamp. The camera's wall clock is taken as
+// UTC, even if the offset to UTC is known, so the day a photo shows up on
+// is the day it was taken where it was taken.
+func exifTime(s string) time.Time {
+	t, err := time.Parse(`2006:01:02 15:04:05`, s)
+	if err != nil || t.Year() < 1900 {
+		return time.Time{}
+	}
+	return t
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// maxID3Size keeps huge tags, mostly cover art, from being read whole.
+const maxID3Size = 1 << 20
+
+// readID3 reads the ID3v2 tag at the start of an MP3, or the ID3v1 tag
+// at its end if there is none.
+func readID3(r io.ReaderAt, size int64, m *Metadata) error {
+	h, err := readAt(r, 0, 10)
+	if err != nil {
+		return err
+	}
+	if len(h) == 10 && string(h[:3]) == `ID3` {
+		tagSize := syncsafe(h[6:10])
+		if tagSize > maxID3Size {
+			tagSize = maxID3Size
+		}
+		tag, err := readAt(r, 10, tagSize)
+		if err != nil {
+			return err
+		}
+		readID3v2(tag, h[3], h[5], m)
+		if m.Title != `` || m.Artist != `` {
+			return nil
+		}
+	}
+
+	if size < 128 {
+		return nil
+	}
+	tag, err := readAt(r, size-128, 128)
+	if err != nil || len(tag) < 128 || string(tag[:3]) != `TAG` {
+		return err
+	}
+	m.Title = latin1(tag[3:33])
+	m.Artist = latin1(tag[33:63])
+	m.Album = latin1(tag[63:93])
+	m.Year, _ = strconv.Atoi(latin1(tag[93:97]))
+	return nil
+}
+
+func readID3v2(tag []byte, version, flags byte, m *Metadata) {
+	idLen, headLen := 4, 10
+	if version == 2 {
+		idLen, headLen = 3, 6
+	}
+
+	// An extended header only carries things that don't matter here.
+	if flags&0x40 != 0 && version >= 3 && len(tag) >= 4 {
+		n := int(binary.BigEndian.Uint32(tag))
+		if version == 4 {
+			n = syncsafe(tag[:4])
+		} else {
+			n += 4
+		}
+		if n > len(tag) {
+			return
+		}
+		tag = tag[n:]
+	}
+
+	for len(tag) >= headLen && tag[0] != 0 {
+		id := string(tag[:idLen])
+		var n int
+		switch version {
+		case 2:
+			n = int(tag[3])<<16 | int(tag[4])<<8 | int(tag[5])
+		case 4:
+			n = syncsafe(tag[4:8])
+		default:
+			n = int(binary.BigEndian.Uint32(tag[4:8]))
+		}
+		if n < 0 || headLen+n > len(tag) {
+			return
+		}
+		body := tag[headLen : headLen+n]
+		tag = tag[headLen+n:]
+
+		switch id {
+		case `TIT2`, `TT2`:
+			m.Title = id3Text(body)
+		case `TPE1`, `TP1`:
+			m.Artist = id3Text(body)
+		case `TALB`, `TAL`:
+			m.Album = id3Text(body)
+		case `TYER`, `TDRC`, `TYE`:
+			if s := id3Text(body); len(s) >= 4 {
+				m.Year, _ = strconv.Atoi(s[:4])
+			}
+		case `TLEN`, `TLE`:
+			if ms, err := strconv.Atoi(id3Text(body)); err == nil && ms > 0 {
+				m.Duration = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+}
+
+// id3Text decodes a text frame, of which only the first value is used.
+func id3Text(b []byte) string {
+	if len(b) == 0 {
+		return ``
+	}
+
+	var s string
+	switch enc, text := b[0], b[1:]; enc {
+	case 1, 2:
+		s = utf16Text(text, enc == 2)
+	case 3:
+		s = string(text)
+	default:
+		s = latin1(text)
+	}
+	if i := strings.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+// utf16Text decodes UTF-16, big endian without a byte order mark.
+func utf16Text(b []byte, bigEndian bool) string {
+	var order binary.ByteOrder = binary.LittleEndian
+	switch {
+	case bytes.HasPrefix(b, []byte{0xFE, 0xFF}):
+		order, b = binary.BigEndian, b[2:]
+	case bytes.HasPrefix(b, []byte{0xFF, 0xFE}):
+		b = b[2:]
+	case bigEndian:
+		order = binary.BigEndian
+	}
+
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		c := order.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}
+
+func latin1(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return strings.TrimSpace(string(r))
+}
+
+// syncsafe decodes the 28 bit integers of ID3v2, which
+// leave the top bit of each byte unset.
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7F)<<21 | int(b[1]&0x7F)<<14 | int(b[2]&0x7F)<<7 | int(b[3]&0x7F)
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package media reads metadata from the content of files: the EXIF data
+// of JPEG and PNG images, the ID3 tags of MP3s and the tags of MP4 and QuickTime
+// audio and video. Only what the rest of the server shows is read.
+package media
+
+import (
+	"errors"
+	"image"
+	_ "image/gif" // registers the formats whose size is read
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"time"
+)
+
+var ErrUnsupported = errors.New(`no metadata can be read from this type`)
+
+// Metadata is what was found in a file. Missing fields are left zero.
+type Metadata struct {
+	TakenAt     time.Time
+	CameraMake  string
+	CameraModel string
+	Orientation int // EXIF orientation, 1 to 8
+	Latitude    *float64
+	Longitude   *float64
+	Width       int
+	Height      int
+
+	Title    string
+	Artist   string
+	Album    string
+	Year     int
+	Duration time.Duration
+}
+
+// Types are the MIME types metadata is read from.
+var Types = []string{
+	`image/jpeg`, `image/png`, `image/gif`,
+	`audio/mpeg`,
+	`audio/mp4`, `audio/x-m4a`, `video/mp4`, `video/quicktime`,
+}
+
+// Supported tells whether metadata is read from files of the type.
+func Supported(mimeType string) bool {
+	for _, t := range Types {
+		if t == mimeType {
+			return true
+		}
+	}
+	return false
+}
+
+// Read reads the metadata of the content of size bytes with the MIME type.
+// Content that is broken or has no metadata yields what could be read,
+// errors are left for reading r itself.
+func Read(r io.ReaderAt, size int64, mimeType string) (Metadata, error) {
+	var m Metadata
+	switch mimeType {
+	case `image/jpeg`:
+		if err := readJPEG(r, size, &m); err != nil {
+			return m, err
+		}
+		readImageSize(r, size, &m)
+	case `image/png`:
+		if err := readPNG(r, size, &m); err != nil {
+			return m, err
+		}
+		readImageSize(r, size, &m)
+	case `image/gif`:
+		readImageSize(r, size, &m)
+	case `audio/mpeg`:
+		return m, readID3(r, size, &m)
+	case `audio/mp4`, `audio/x-m4a`, `video/mp4`, `video/quicktime`:
+		return m, readMP4(r, size, &m)
+	default:
+		return m, ErrUnsupported
+	}
+	return m, nil
+}
+
+func readImageSize(r io.ReaderAt, size int64, m *Metadata) {
+	cfg, _, err := image.DecodeConfig(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return
+	}
+	m.Width, m.Height = cfg.Width, cfg.Height
+	// Rotated photos are shown the other way round.
+	if m.Orientation >= 5 && m.Orientation <= 8 {
+		m.Width, m.Height = m.Height, m.Width
+	}
+}
+
+// readAt reads n bytes at off, or fewer at the end of the content.
+// Malformed content is never an error, it just has no metadata; only
+// errors reading r are returned.
+func readAt(r io.ReaderAt, off int64, n int) ([]byte, error) {
+	b := make([]byte, n)
+	read, err := r.ReadAt(b, off)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return b[:read], err
+}
@@ -0,0 +1,384 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package media
+
+import (
+	"encoding/binary"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxAtomSize keeps the atoms read whole small, the media data is never read.
+const maxAtomSize = 1 << 20
+
+// mp4Epoch is where the times of MP4 and QuickTime files count from.
+var mp4Epoch = time.Date(1904, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// locationKeys start the keys of QuickTime metadata naming a location.
+const locationKeys = `com.apple.quicktime.location.`
+
+// iso6709 is a location like +37.3861-122.0839+012.000/ in the ©xyz atom.
+var iso6709 = regexp.MustCompile(`^([+-]\d+(?:\.\d+)?)([+-]\d+(?:\.\d+)?)`)
+
+// atom is a box of an MP4 or QuickTime file.
+type atom struct {
+	typ       string
+	start     int64 // of the header
+	off, size int64 // of the content, without the header
+}
+
+// readMP4 reads the creation time and duration from moov/mvhd, the tags
+// from moov/udta/meta/ilst and the location from moov/udta/©xyz or, as
+// QuickTime keeps it, from moov/meta.
+func readMP4(r io.ReaderAt, size int64, m *Metadata) error {
+	top, err := atoms(r, 0, size)
+	if err != nil {
+		return err
+	}
+	moov, ok := find(top, `moov`)
+	if !ok {
+		return nil
+	}
+
+	children, err := atoms(r, moov.off, moov.size)
+	if err != nil {
+		return err
+	}
+	if mvhd, ok := find(children, `mvhd`); ok {
+		if err = readMVHD(r, mvhd, m); err != nil {
+			return err
+		}
+	}
+	if meta, ok := find(children, `meta`); ok {
+		items, err := locationItems(r, meta)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			value, err := itemValue(r, item)
+			if err != nil {
+				return err
+			}
+			parseISO6709(value, m)
+		}
+	}
+
+	udta, ok := find(children, `udta`)
+	if !ok {
+		return nil
+	}
+	children, err = atoms(r, udta.off, udta.size)
+	if err != nil {
+		return err
+	}
+	if xyz, ok := find(children, "\xa9xyz"); ok {
+		if err = readLocation(r, xyz, m); err != nil {
+			return err
+		}
+	}
+	if meta, ok := find(children, `meta`); ok {
+		return readMeta(r, meta, m)
+	}
+	return nil
+}
+
+// atoms lists the atoms in the n bytes at off.
+func atoms(r io.ReaderAt, off, n int64) ([]atom, error) {
+	var list []atom
+	for end := off + n; off+8 <= end; {
+		h, err := readAt(r, off, 16)
+		if err != nil || len(h) < 8 {
+			return list, err
+		}
+
+		size, headLen := int64(binary.BigEndian.Uint32(h)), int64(8)
+		switch {
+		case size == 1 && len(h) == 16:
+			size, headLen = int64(binary.BigEndian.Uint64(h[8:])), 16
+		case size == 0:
+			size = end - off
+		}
+		if size < headLen || off+size > end {
+			return list, nil
+		}
+
+		list = append(list, atom{typ: string(h[4:8]), start: off, off: off + headLen, size: size - headLen})
+		off += size
+	}
+	return list, nil
+}
+
+func find(list []atom, typ string) (atom, bool) {
+	for _, a := range list {
+		if a.typ == typ {
+			return a, true
+		}
+	}
+	return atom{}, false
+}
+
+func readWhole(r io.ReaderAt, a atom) ([]byte, error) {
+	if a.size > maxAtomSize {
+		return nil, nil
+	}
+	return readAt(r, a.off, int(a.size))
+}
+
+func readMVHD(r io.ReaderAt, a atom, m *Metadata) error {
+	b, err := readWhole(r, a)
+	if err != nil || len(b) < 4 {
+		return err
+	}
+
+	var created, scale, duration uint64
+	switch b[0] {
+	case 0:
+		if len(b) < 20 {
+			return nil
+		}
+		created = uint64(binary.BigEndian.Uint32(b[4:]))
+		scale = uint64(binary.BigEndian.Uint32(b[12:]))
+		duration = uint64(binary.BigEndian.Uint32(b[16:]))
+	case 1:
+		if len(b) < 32 {
+			return nil
+		}
+		created = binary.BigEndian.Uint64(b[4:])
+		scale = uint64(binary.BigEndian.Uint32(b[20:]))
+		duration = binary.BigEndian.Uint64(b[24:])
+	default:
+		return nil
+	}
+
+	// Some encoders leave the time zero, or count from 1970.
+	if t := mp4Epoch.Add(time.Duration(created) * time.Second); created != 0 && t.Year() >= 1980 {
+		m.TakenAt = t
+	}
+	if scale != 0 && duration/scale < uint64(100*365*24*time.Hour/time.Second) {
+		m.Duration = time.Duration(duration) * time.Second / time.Duration(scale)
+	}
+	return nil
+}
+
+func readLocation(r io.ReaderAt, a atom, m *Metadata) error {
+	b, err := readWhole(r, a)
+	if err != nil || len(b) < 4 {
+		return err
+	}
+
+	// A length and a language code come first.
+	parseISO6709(string(b[4:]), m)
+	return nil
+}
+
+func parseISO6709(s string, m *Metadata) {
+	match := iso6709.FindStringSubmatch(s)
+	if match == nil {
+		return
+	}
+	lat, err1 := strconv.ParseFloat(match[1], 64)
+	lon, err2 := strconv.ParseFloat(match[2], 64)
+	if err1 != nil || err2 != nil || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return
+	}
+	m.Latitude, m.Longitude = &lat, &lon
+}
+
+// metaChildren lists the atoms in meta. In MP4 meta has a version and
+// flags before its children, in QuickTime it doesn't.
+func metaChildren(r io.ReaderAt, meta atom) ([]atom, error) {
+	h, err := readAt(r, meta.off, 8)
+	if err != nil || len(h) < 8 {
+		return nil, err
+	}
+	if string(h[4:8]) != `hdlr` {
+		meta.off, meta.size = meta.off+4, meta.size-4
+	}
+	return atoms(r, meta.off, meta.size)
+}
+
+// locationItems returns the items of meta that hold a location: ©xyz
+// and, in QuickTime, the items whose key starts with locationKeys.
+func locationItems(r io.ReaderAt, meta atom) ([]atom, error) {
+	children, err := metaChildren(r, meta)
+	if err != nil {
+		return nil, err
+	}
+	ilst, ok := find(children, `ilst`)
+	if !ok {
+		return nil, nil
+	}
+	items, err := atoms(r, ilst.off, ilst.size)
+	if err != nil {
+		return nil, err
+	}
+
+	// Items are typed by the index of their key, counting from one.
+	located := make(map[string]bool)
+	if keys, ok := find(children, `keys`); ok {
+		b, err := readWhole(r, keys)
+		if err != nil {
+			return nil, err
+		}
+		// A version, flags and the count come first, then each key is
+		// its size, a namespace and the name.
+		index := uint32(1)
+		for pos := 8; pos+8 <= len(b); index++ {
+			n := int(binary.BigEndian.Uint32(b[pos:]))
+			if n < 8 || pos+n > len(b) {
+				break
+			}
+			if strings.HasPrefix(string(b[pos+8:pos+n]), locationKeys) {
+				typ := make([]byte, 4)
+				binary.BigEndian.PutUint32(typ, index)
+				located[string(typ)] = true
+			}
+			pos += n
+		}
+	}
+
+	var list []atom
+	for _, item := range items {
+		if item.typ == "\xa9xyz" || located[item.typ] {
+			list = append(list, item)
+		}
+	}
+	return list, nil
+}
+
+// readMeta reads the iTunes style tags.
+func readMeta(r io.ReaderAt, meta atom, m *Metadata) error {
+	children, err := metaChildren(r, meta)
+	if err != nil {
+		return err
+	}
+	ilst, ok := find(children, `ilst`)
+	if !ok {
+		return nil
+	}
+	items, err := atoms(r, ilst.off, ilst.size)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		var field *string
+		switch item.typ {
+		case "\xa9nam":
+			field = &m.Title
+		case "\xa9ART":
+			field = &m.Artist
+		case "\xa9alb":
+			field = &m.Album
+		case "\xa9day":
+		default:
+			continue
+		}
+
+		value, err := itemValue(r, item)
+		if err != nil {
+			return err
+		}
+		if field != nil {
+			*field = value
+		} else if len(value) >= 4 {
+			m.Year, _ = strconv.Atoi(value[:4])
+		}
+	}
+	return nil
+}
+
+// itemValue returns the text in the data atom of a tag.
+func itemValue(r io.ReaderAt, item atom) (string, error) {
+	children, err := atoms(r, item.off, item.size)
+	if err != nil {
+		return ``, err
+	}
+	data, ok := find(children, `data`)
+	if !ok {
+		return ``, nil
+	}
+
+	b, err := readWhole(r, data)
+	// A type and a locale come first; type 1 is UTF-8.
+	if err != nil || len(b) < 8 || binary.BigEndian.Uint32(b) != 1 {
+		return ``, err
+	}
+	return string(b[8:]), nil
+}
+
+// stripMP4 hides the location atoms of moov/udta and the location items of
+// moov/meta and moov/udta/meta. They become free atoms of zeros, which
+// players skip, and keep their size.
+func stripMP4(r io.ReaderAt, size int64) (*io.SectionReader, error) {
+	top, err := atoms(r, 0, size)
+	if err != nil {
+		return nil, err
+	}
+	moov, ok := find(top, `moov`)
+	if !ok {
+		return io.NewSectionReader(r, 0, size), nil
+	}
+	children, err := atoms(r, moov.off, moov.size)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		hide  []atom
+		metas []atom
+	)
+	if meta, ok := find(children, `meta`); ok {
+		metas = append(metas, meta)
+	}
+	if udta, ok := find(children, `udta`); ok {
+		list, err := atoms(r, udta.off, udta.size)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range list {
+			switch a.typ {
+			// loci is where 3GPP files keep the location.
+			case "\xa9xyz", `loci`:
+				hide = append(hide, a)
+			case `meta`:
+				metas = append(metas, a)
+			}
+		}
+	}
+	for _, meta := range metas {
+		items, err := locationItems(r, meta)
+		if err != nil {
+			return nil, err
+		}
+		hide = append(hide, items...)
+	}
+
+	sort.Slice(hide, func(i, j int) bool { return hide[i].start < hide[j].start })
+	edits := make([]edit, 0, 2*len(hide))
+	for _, a := range hide {
+		edits = append(edits,
+			edit{off: a.start + 4, n: 4, with: bytesPart([]byte(`free`))},
+			edit{off: a.off, n: a.size, with: part{r: zeros{}, n: a.size}},
+		)
+	}
+	return apply(r, size, edits), nil
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// maxEXIFSize keeps the EXIF data read whole small.
+const maxEXIFSize = 1 << 20
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// xmpKeyword starts the iTXt chunk with the XMP data of a PNG.
+var xmpKeyword = []byte("XML:com.adobe.xmp\x00")
+
+// readPNG reads the EXIF data of the PNG, if it has an eXIf chunk.
+func readPNG(r io.ReaderAt, size int64, m *Metadata) error {
+	return pngChunks(r, size, func(typ string, off, n int64) (bool, error) {
+		if typ != `eXIf` || n > maxEXIFSize {
+			return true, nil
+		}
+		b, err := readAt(r, off, int(n))
+		if err != nil {
+			return false, err
+		}
+
+		readTIFF(b, m)
+		return false, nil
+	})
+}
+
+// pngChunks calls f with the type, offset and length of the data of each
+// chunk, until f returns false.
+func pngChunks(r io.ReaderAt, size int64, f func(typ string, off, n int64) (bool, error)) error {
+	sig, err := readAt(r, 0, len(pngSignature))
+	if err != nil || !bytes.Equal(sig, pngSignature) {
+		return err
+	}
+
+	// Each chunk is its length, its type, the data and a CRC.
+	for off := int64(len(pngSignature)); off+12 <= size; {
+		h, err := readAt(r, off, 8)
+		if err != nil || len(h) < 8 {
+			return err
+		}
+		n := int64(binary.BigEndian.Uint32(h))
+		if off+12+n > size {
+			return nil
+		}
+
+		typ := string(h[4:])
+		more, err := f(typ, off+8, n)
+		if err != nil || !more || typ == `IEND` {
+			return err
+		}
+		off += 12 + n
+	}
+	return nil
+}
+
+// stripPNG empties the GPS IFD in the eXIf chunk of the PNG and leaves
+// out its XMP data. An eXIf chunk too large to read is left out whole.
+func stripPNG(r io.ReaderAt, size int64) (*io.SectionReader, error) {
+	var edits []edit
+	err := pngChunks(r, size, func(typ string, off, n int64) (bool, error) {
+		switch typ {
+		case `eXIf`:
+			if n > maxEXIFSize {
+				break
+			}
+			b, err := readAt(r, off-4, 4+int(n))
+			if err != nil {
+				return false, err
+			}
+			if clearGPS(b[4:]) {
+				// The data and the CRC, which covers the type as well.
+				b = binary.BigEndian.AppendUint32(b[4:], crc32.ChecksumIEEE(b))
+				edits = append(edits, edit{off: off, n: n + 4, with: bytesPart(b)})
+			}
+			return true, nil
+		case `iTXt`:
+			keyword, err := readAt(r, off, len(xmpKeyword))
+			if err != nil || !bytes.Equal(keyword, xmpKeyword) {
+				return err == nil, err
+			}
+		default:
+			return true, nil
+		}
+
+		// The whole chunk, with its length, type and CRC.
+		edits = append(edits, edit{off: off - 8, n: n + 12})
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return apply(r, size, edits), nil
+}
@@ -0,0 +1,234 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package media
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+)
+
+// xmpHeaders start the APP1 segments with XMP data, which can hold the
+// location of a photo as well.
+var xmpHeaders = [][]byte{
+	[]byte("http://ns.adobe.com/xap/1.0/\x00"),
+	[]byte("http://ns.adobe.com/xmp/extension/\x00"),
+}
+
+// StripTypes are the MIME types StripGPS takes the location out of.
+var StripTypes = []string{
+	`image/jpeg`, `image/png`,
+	`audio/mp4`, `audio/x-m4a`, `video/mp4`, `video/quicktime`,
+}
+
+// Strips tells whether StripGPS takes the location out of content of the type.
+func Strips(mimeType string) bool {
+	for _, t := range StripTypes {
+		if t == mimeType {
+			return true
+		}
+	}
+	return false
+}
+
+// KeepsLocation tells whether content of the type may carry a location
+// StripGPS can't take out: photos and videos of other types than
+// StripTypes, like HEIC or WebP.
+func KeepsLocation(mimeType string) bool {
+	if Strips(mimeType) || mimeType == `image/gif` {
+		return false
+	}
+	return strings.HasPrefix(mimeType, `image/`) || strings.HasPrefix(mimeType, `video/`)
+}
+
+// StripGPS returns the content of size bytes with the MIME type without
+// its location. Only the metadata is read here, the rest is read from r
+// as the result is read. Content of types StripGPS doesn't strip is
+// returned as it is.
+//
+// JPEG photos lose the GPS IFD of their EXIF data and their XMP data,
+// PNG images their eXIf chunk and XMP data. In MP4 and QuickTime files
+// the location atoms become free atoms of the same size, so none of the
+// offsets into the media data change.
+func StripGPS(r io.ReaderAt, size int64, mimeType string) (*io.SectionReader, error) {
+	switch mimeType {
+	case `image/jpeg`:
+		return stripJPEG(r, size)
+	case `image/png`:
+		return stripPNG(r, size)
+	case `audio/mp4`, `audio/x-m4a`, `video/mp4`, `video/quicktime`:
+		return stripMP4(r, size)
+	}
+	return io.NewSectionReader(r, 0, size), nil
+}
+
+func stripJPEG(r io.ReaderAt, size int64) (*io.SectionReader, error) {
+	var edits []edit
+	err := jpegSegments(r, size, func(marker byte, off int64, n int) (bool, error) {
+		if marker != 0xE1 {
+			return true, nil
+		}
+		seg, err := readAt(r, off, n)
+		if err != nil {
+			return false, err
+		}
+
+		switch {
+		case isXMP(seg):
+			// Leave out the whole segment, with its marker and length.
+			edits = append(edits, edit{off: off - 4, n: int64(n) + 4})
+		case bytes.HasPrefix(seg, exifHeader) && clearGPS(seg[len(exifHeader):]):
+			edits = append(edits, edit{off: off, n: int64(n), with: bytesPart(seg)})
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return apply(r, size, edits), nil
+}
+
+func isXMP(seg []byte) bool {
+	for _, h := range xmpHeaders {
+		if bytes.HasPrefix(seg, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// clearGPS empties the GPS IFD of the EXIF data in b, leaving the IFD
+// itself in place so no offsets change. It tells whether there was one.
+func clearGPS(b []byte) bool {
+	t, ifd0, ok := parseTIFF(b)
+	if !ok {
+		return false
+	}
+
+	var gpsIFD uint32
+	for _, e := range t.entries(ifd0) {
+		if e.tag == tagGPSIFD {
+			gpsIFD = t.uint(e)
+		}
+	}
+	entries := t.entries(gpsIFD)
+	if gpsIFD == 0 || len(entries) == 0 {
+		return false
+	}
+
+	for _, e := range entries {
+		zero(t.value(e))
+		zero(t.b[e.pos : e.pos+12])
+	}
+	// With a count of zero readers take the first, zeroed entry for
+	// the offset of the next IFD, so there is none.
+	t.order.PutUint16(t.b[gpsIFD:], 0)
+	return true
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// edit replaces the n bytes at off with the part with, or cuts them out
+// if with is empty.
+type edit struct {
+	off, n int64
+	with   part
+}
+
+// apply returns the content of size bytes of r with the edits, which
+// are ordered by their offset and don't overlap.
+func apply(r io.ReaderAt, size int64, edits []edit) *io.SectionReader {
+	var (
+		m   multiReaderAt
+		pos int64 // of what isn't in m yet
+	)
+	for _, e := range edits {
+		m.add(part{r: r, off: pos, n: e.off - pos})
+		m.add(e.with)
+		pos = e.off + e.n
+	}
+	m.add(part{r: r, off: pos, n: size - pos})
+	return io.NewSectionReader(&m, 0, m.size)
+}
+
+// part is n bytes at off of r.
+type part struct {
+	r      io.ReaderAt
+	off, n int64
+}
+
+func bytesPart(b []byte) part {
+	return part{r: bytes.NewReader(b), n: int64(len(b))}
+}
+
+// zeros reads as zero bytes.
+type zeros struct{}
+
+func (zeros) ReadAt(b []byte, _ int64) (int, error) {
+	zero(b)
+	return len(b), nil
+}
+
+// multiReaderAt reads its parts one after the other.
+type multiReaderAt struct {
+	parts  []part
+	starts []int64
+	size   int64
+}
+
+func (m *multiReaderAt) add(p part) {
+	if p.n > 0 {
+		m.starts = append(m.starts, m.size)
+		m.parts = append(m.parts, p)
+		m.size += p.n
+	}
+}
+
+func (m *multiReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	if off >= m.size {
+		return 0, io.EOF
+	}
+
+	i := sort.Search(len(m.starts), func(i int) bool { return m.starts[i] > off }) - 1
+	read := 0
+	for ; i < len(m.parts) && read < len(b); i++ {
+		p := m.parts[i]
+		rel := off + int64(read) - m.starts[i]
+		want := b[read:]
+		if int64(len(want)) > p.n-rel {
+			want = want[:p.n-rel]
+		}
+
+		n, err := p.r.ReadAt(want, p.off+rel)
+		read += n
+		if n < len(want) {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return read, err
+		}
+	}
+	if read < len(b) {
+		return read, io.EOF
+	}
+	return read, nil
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package media
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The fixtures are located at 52°31'12"N 13°24'36"E, JPEG and PNG in
+// EXIF and XMP, MP4 in udta/©xyz and QuickTime in the keys of moov/meta.
+func TestStripGPS(t *testing.T) {
+	tests := []struct {
+		file, mimeType string
+		image          bool
+	}{
+		{`gps.jpg`, `image/jpeg`, true},
+		{`gps.png`, `image/png`, true},
+		{`gps.mp4`, `video/mp4`, false},
+		{`gps.mov`, `video/quicktime`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			b, err := os.ReadFile(filepath.Join(`testdata`, tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m, err := Read(bytes.NewReader(b), int64(len(b)), tt.mimeType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Latitude == nil || m.Longitude == nil ||
+				math.Abs(*m.Latitude-52.52) > 1e-6 || math.Abs(*m.Longitude-13.41) > 1e-6 {
+				t.Fatalf(`location of the fixture = %v, %v, want 52.52, 13.41`, m.Latitude, m.Longitude)
+			}
+
+			r, err := StripGPS(bytes.NewReader(b), int64(len(b)), tt.mimeType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stripped, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m, err = Read(bytes.NewReader(stripped), int64(len(stripped)), tt.mimeType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Latitude != nil || m.Longitude != nil {
+				t.Errorf(`location after stripping = %v, %v, want none`, *m.Latitude, *m.Longitude)
+			}
+			for _, s := range []string{`GPSLatitude`, `+52.52`} {
+				if bytes.Contains(stripped, []byte(s)) {
+					t.Errorf(`stripped content still has %q`, s)
+				}
+			}
+
+			if !tt.image {
+				// Offsets into the media data must not move.
+				if len(stripped) != len(b) {
+					t.Errorf(`size after stripping = %d, want %d`, len(stripped), len(b))
+				}
+				return
+			}
+			if m.CameraMake != `Canon` {
+				t.Errorf(`camera make after stripping = %q, want the rest of EXIF kept`, m.CameraMake)
+			}
+			img, _, err := image.Decode(bytes.NewReader(stripped))
+			if err != nil {
+				t.Fatalf(`stripped image doesn't decode: %v`, err)
+			}
+			if size := img.Bounds().Size(); size != image.Pt(16, 8) {
+				t.Errorf(`image size after stripping = %v, want 16x8`, size)
+			}
+		})
+	}
+}
+
+func TestKeepsLocation(t *testing.T) {
+	tests := map[string]bool{
+		`image/jpeg`:       false,
+		`image/png`:        false,
+		`video/quicktime`:  false,
+		`image/gif`:        false,
+		`text/plain`:       false,
+		`image/heic`:       true,
+		`image/webp`:       true,
+		`video/x-matroska`: true,
+	}
+	for mimeType, want := range tests {
+		if got := KeepsLocation(mimeType); got != want {
+			t.Errorf(`KeepsLocation(%q) = %v, want %v`, mimeType, got, want)
+		}
+	}
+}
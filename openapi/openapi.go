@@ -0,0 +1,194 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package openapi serves the OpenAPI document of the API and a viewer for it.
+package openapi
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"server/catcherr"
+	"server/directory"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	//go:embed openapi.yaml
+	source []byte
+
+	//go:embed viewer.html
+	viewer []byte
+
+	// spec is the document converted to JSON by Load.
+	spec []byte
+)
+
+// Load converts the embedded YAML document to JSON, keeping the order of keys.
+func Load() error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(source, &doc); err != nil {
+		return fmt.Errorf(`openapi: %w`, err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, &doc); err != nil {
+		return fmt.Errorf(`openapi: %w`, err)
+	}
+	spec = buf.Bytes()
+	return nil
+}
+
+func writeJSON(buf *bytes.Buffer, n *yaml.Node) error {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		return writeJSON(buf, n.Content[0])
+	case yaml.AliasNode:
+		return writeJSON(buf, n.Alias)
+	case yaml.MappingNode:
+		buf.WriteByte('{')
+		for i := 0; i < len(n.Content); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(n.Content[i].Value)
+			buf.Write(key)
+			buf.WriteByte(':')
+			if err := writeJSON(buf, n.Content[i+1]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case yaml.SequenceNode:
+		buf.WriteByte('[')
+		for i, item := range n.Content {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeJSON(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	default:
+		var v any
+		if err := n.Decode(&v); err != nil {
+			return err
+		}
+		scalar, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf(`line %d: %w`, n.Line, err)
+		}
+		buf.Write(scalar)
+	}
+	return nil
+}
+
+func Handle(r *mux.Router) {
+	r.Handle(directory.APIOpenAPI, catcherr.Handle(specFunc)).Methods(http.MethodGet)
+	r.Handle(directory.APIDocs, catcherr.Handle(viewerFunc)).Methods(http.MethodGet)
+}
+
+func specFunc(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set(`Content-Type`, `application/json`)
+	_, err := w.Write(spec)
+	return err
+}
+
+func viewerFunc(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set(`Content-Type`, `text/html; charset=utf-8`)
+	_, err := w.Write(viewer)
+	return err
+}
+
+// muxVariable matches route variables with a pattern, like {id:[0-9]+}.
+var muxVariable = regexp.MustCompile(`\{(\w+):[^}]+\}`)
+
+// CheckRoutes compares the routes of r with the document and returns an
+// error listing every route it lacks and every operation without a route.
+// Path prefixes, like the file server, can't be described and are skipped.
+func CheckRoutes(r *mux.Router) error {
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return fmt.Errorf(`openapi: %w`, err)
+	}
+
+	documented := make(map[string]bool)
+	for path, item := range doc.Paths {
+		for method := range item {
+			if method != `parameters` {
+				documented[strings.ToUpper(method)+` `+path] = true
+			}
+		}
+	}
+
+	var undocumented []string
+	err := r.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		if re, err := route.GetPathRegexp(); err != nil || !strings.HasSuffix(re, `$`) {
+			return nil
+		}
+
+		path := muxVariable.ReplaceAllString(template, `{$1}`)
+		methods, err := route.GetMethods()
+		if err != nil {
+			undocumented = append(undocumented, `* `+path)
+			return nil
+		}
+
+		for _, method := range methods {
+			operation := method + ` ` + path
+			if documented[operation] {
+				delete(documented, operation)
+			} else {
+				undocumented = append(undocumented, operation)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var msgs []string
+	if len(undocumented) > 0 {
+		msgs = append(msgs, `routes missing from the document: `+strings.Join(undocumented, `, `))
+	}
+	if len(documented) > 0 {
+		unrouted := make([]string, 0, len(documented))
+		for operation := range documented {
+			unrouted = append(unrouted, operation)
+		}
+		sort.Strings(unrouted)
+		msgs = append(msgs, `documented operations without a route: `+strings.Join(unrouted, `, `))
+	}
+	if len(msgs) > 0 {
+		return fmt.Errorf(`openapi: %s`, strings.Join(msgs, `; `))
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package pages serves the pages the links sent by email open. They
+// take the token from the link and send it on to the API, so the links
+// work without a separate frontend.
+package pages
+
+import (
+	_ "embed"
+	"net/http"
+
+	"server/catcherr"
+	"server/directory"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	//go:embed verify.html
+	verify []byte
+
+	//go:embed reset.html
+	reset []byte
+)
+
+func Handle(r *mux.Router) {
+	r.Handle(directory.VerifyPage, catcherr.Handle(serve(verify))).Methods(http.MethodGet)
+	r.Handle(directory.ResetPage, catcherr.Handle(serve(reset))).Methods(http.MethodGet)
+}
+
+func serve(page []byte) catcherr.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set(`Content-Type`, `text/html; charset=utf-8`)
+		// The token is in the address, keep it out of the Referer
+		// of anything the page loads.
+		w.Header().Set(`Referrer-Policy`, `no-referrer`)
+		_, err := w.Write(page)
+		return err
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package password
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"server/config"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	ErrTooShort = errors.New(`password is too short`)
+	ErrTooLong  = errors.New(`password is too long`)
+	ErrBreached = errors.New(`password appears in a list of breached passwords`)
+	ErrSimilar  = errors.New(`password is too similar to the login`)
+)
+
+// IsPolicyError reports whether err was returned because the password
+// does not satisfy the policy.
+func IsPolicyError(err error) bool {
+	for _, target := range []error{ErrTooShort, ErrTooLong, ErrBreached, ErrSimilar} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+var breached = map[string]struct{}{}
+
+// Load reads the breached password list, if one is configured.
+func Load() error {
+	path := config.String(config.PasswordBreachedList)
+	if path == `` {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == `` {
+			continue
+		}
+		breached[strings.ToLower(line)] = struct{}{}
+	}
+	return s.Err()
+}
+
+// Validate checks the password against the policy from config.yml.
+func Validate(login, password string) error {
+	length := utf8.RuneCountInString(password)
+	switch {
+	case length < config.Int(config.PasswordMinLength):
+		return ErrTooShort
+	case len(password) > config.Int(config.PasswordMaxLength):
+		return ErrTooLong
+	}
+
+	lower := strings.ToLower(password)
+	if _, ok := breached[lower]; ok {
+		return ErrBreached
+	}
+
+	if similarity(strings.ToLower(login), lower) > config.Float64(config.PasswordMaxSimilarity) {
+		return ErrSimilar
+	}
+	return nil
+}
+
+// similarity returns 1 for equal strings and 0 for completely different ones.
+// A password containing the login is always treated as equal to it.
+func similarity(login, password string) float64 {
+	if login == `` {
+		return 0
+	}
+	if strings.Contains(password, login) || strings.Contains(password, reverse(login)) {
+		return 1
+	}
+
+	a, b := []rune(login), []rune(password)
+	longest := len(a)
+	if len(b) > longest {
+		longest = len(b)
+	}
+	return 1 - float64(distance(a, b))/float64(longest)
+}
+
+// distance is the Levenshtein distance between a and b.
+func distance(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = minOf(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func minOf(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+func reverse(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return string(r)
+}
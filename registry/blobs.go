@@ -0,0 +1,233 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/database"
+	"server/directory"
+	"server/user"
+)
+
+func serveBlob(w http.ResponseWriter, r *request, digest string) error {
+	checksum, err := parseDigest(digest)
+	if err != nil {
+		return err
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return getBlob(w, r, checksum)
+	case http.MethodDelete:
+		err = user.DeleteRegistryBlob(r.Context(), r.u, r.repo, checksum)
+		if errors.Is(err, sql.ErrNoRows) {
+			return BlobUnknown.Wrap(err)
+		}
+		if err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return nil
+	}
+	w.Header().Set(`Allow`, `GET, HEAD, DELETE`)
+	return Unsupported
+}
+
+func getBlob(w http.ResponseWriter, r *request, checksum string) error {
+	if _, err := database.GetRegistryBlob(r.Context(), r.u.ID, r.repo, checksum); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return BlobUnknown.Wrap(err)
+		}
+		return err
+	}
+
+	f, err := user.OpenFile(checksum)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w.Header().Set(`Content-Type`, `application/octet-stream`)
+	w.Header().Set(`Docker-Content-Digest`, digestOf(checksum))
+	w.Header().Set(`ETag`, `"`+digestOf(checksum)+`"`)
+	http.ServeContent(w, r.Request, ``, time.Time{}, f)
+	return nil
+}
+
+// serveUpload runs the blob upload endpoints. An empty id starts an
+// upload, which is either sent in one piece with the digest, mounted
+// from another repository of the user or sent in chunks.
+func serveUpload(w http.ResponseWriter, r *request, id string) error {
+	if id == `` {
+		return allow(w, r.Method, http.MethodPost, func() error { return startUpload(w, r) })
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		upload, err := user.GetRegistryUpload(r.Context(), r.u, r.repo, id)
+		if err != nil {
+			return uploadError(err)
+		}
+		uploadStatus(w, r, upload, http.StatusNoContent)
+		return nil
+	case http.MethodPatch:
+		return patchUpload(w, r, id)
+	case http.MethodPut:
+		checksum, err := parseDigest(r.URL.Query().Get(`digest`))
+		if err != nil {
+			return err
+		}
+		return completeUpload(w, r, id, checksum)
+	case http.MethodDelete:
+		if err := user.CancelRegistryUpload(r.Context(), r.u, r.repo, id); err != nil {
+			return uploadError(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	w.Header().Set(`Allow`, `GET, PATCH, PUT, DELETE`)
+	return Unsupported
+}
+
+func startUpload(w http.ResponseWriter, r *request) error {
+	ctx := r.Context()
+	query := r.URL.Query()
+
+	// Mounting falls back to an upload when the blob can't be found.
+	if mount, from := query.Get(`mount`), query.Get(`from`); mount != `` && from != `` {
+		checksum, err := parseDigest(mount)
+		if err != nil {
+			return err
+		}
+		if fromRepo, ok := ownRepo(r.u, from); ok {
+			_, err = user.MountRegistryBlob(ctx, r.u, r.repo, fromRepo, checksum)
+			if err == nil {
+				blobCreated(w, r, checksum)
+				return nil
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				return uploadError(err)
+			}
+		}
+	}
+
+	upload, err := user.CreateRegistryUpload(ctx, r.u, r.repo)
+	if err != nil {
+		return err
+	}
+
+	if digest := query.Get(`digest`); digest != `` {
+		checksum, err := parseDigest(digest)
+		if err != nil {
+			return err
+		}
+		return completeUpload(w, r, upload.ID, checksum)
+	}
+
+	uploadStatus(w, r, upload, http.StatusAccepted)
+	return nil
+}
+
+// patchUpload appends a chunk. Its Content-Range, if sent, has to start
+// where the upload ends.
+func patchUpload(w http.ResponseWriter, r *request, id string) error {
+	ctx := r.Context()
+
+	upload, err := user.GetRegistryUpload(ctx, r.u, r.repo, id)
+	if err != nil {
+		return uploadError(err)
+	}
+
+	offset := upload.Offset
+	if contentRange := r.Header.Get(`Content-Range`); contentRange != `` {
+		start, _, _ := strings.Cut(strings.TrimPrefix(contentRange, `bytes=`), `-`)
+		if offset, err = strconv.ParseInt(start, 10, 64); err != nil {
+			return BlobUploadInvalid.WithDetail(`Content-Range is not valid`)
+		}
+	}
+
+	upload, err = user.AppendRegistryUpload(ctx, r.u, r.repo, id, offset, r.Body)
+	if errors.Is(err, user.ErrUploadOffset) {
+		uploadStatus(w, r, upload, 0)
+		return RangeInvalid
+	}
+	if err != nil {
+		return uploadError(err)
+	}
+
+	uploadStatus(w, r, upload, http.StatusAccepted)
+	return nil
+}
+
+func completeUpload(w http.ResponseWriter, r *request, id, checksum string) error {
+	_, err := user.CompleteRegistryUpload(r.Context(), r.u, r.repo, id, checksum, r.Body)
+	if err != nil {
+		return uploadError(err)
+	}
+
+	blobCreated(w, r, checksum)
+	return nil
+}
+
+// uploadStatus sends the location and the received range of the upload,
+// and the status unless it is zero.
+func uploadStatus(w http.ResponseWriter, r *request, upload database.RegistryUpload, status int) {
+	end := upload.Offset - 1
+	if end < 0 {
+		end = 0
+	}
+
+	w.Header().Set(`Location`, r.location(`blobs/uploads/`+upload.ID))
+	w.Header().Set(`Range`, `0-`+strconv.FormatInt(end, 10))
+	w.Header().Set(`Docker-Upload-UUID`, upload.ID)
+	if status != 0 {
+		w.Header().Set(`Content-Length`, `0`)
+		w.WriteHeader(status)
+	}
+}
+
+func blobCreated(w http.ResponseWriter, r *request, checksum string) {
+	w.Header().Set(`Location`, r.location(`blobs/`+digestOf(checksum)))
+	w.Header().Set(`Docker-Content-Digest`, digestOf(checksum))
+	w.Header().Set(`Content-Length`, `0`)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// location returns the path of the endpoint of the repository.
+func (r *request) location(endpoint string) string {
+	return directory.Registry + `/` + r.name + `/` + endpoint
+}
+
+func uploadError(err error) error {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return BlobUploadUnknown.Wrap(err)
+	case errors.Is(err, user.ErrUploadOffset):
+		return RangeInvalid.Wrap(err)
+	case errors.Is(err, user.ErrDigestMismatch):
+		return DigestInvalid.Wrap(err)
+	case errors.Is(err, user.ErrQuotaExceeded):
+		return QuotaExceeded.Wrap(err)
+	}
+	return err
+}
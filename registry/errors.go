@@ -0,0 +1,82 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"server/catcherr"
+)
+
+var (
+	BlobUnknown         = catcherr.New(http.StatusNotFound, `BLOB_UNKNOWN`, `blob unknown to registry`)
+	BlobUploadInvalid   = catcherr.New(http.StatusBadRequest, `BLOB_UPLOAD_INVALID`, `blob upload invalid`)
+	BlobUploadUnknown   = catcherr.New(http.StatusNotFound, `BLOB_UPLOAD_UNKNOWN`, `blob upload unknown to registry`)
+	RangeInvalid        = catcherr.New(http.StatusRequestedRangeNotSatisfiable, `BLOB_UPLOAD_INVALID`, `chunk doesn't start at the end of the upload`)
+	DigestInvalid       = catcherr.New(http.StatusBadRequest, `DIGEST_INVALID`, `provided digest did not match uploaded content`)
+	ManifestBlobUnknown = catcherr.New(http.StatusBadRequest, `MANIFEST_BLOB_UNKNOWN`, `manifest references a blob or manifest unknown to the repository`)
+	ManifestInvalid     = catcherr.New(http.StatusBadRequest, `MANIFEST_INVALID`, `manifest invalid`)
+	ManifestUnknown     = catcherr.New(http.StatusNotFound, `MANIFEST_UNKNOWN`, `manifest unknown to registry`)
+	NameInvalid         = catcherr.New(http.StatusBadRequest, `NAME_INVALID`, `invalid repository name`)
+	NameUnknown         = catcherr.New(http.StatusNotFound, `NAME_UNKNOWN`, `repository name not known to registry`)
+	PaginationInvalid   = catcherr.New(http.StatusBadRequest, `PAGINATION_NUMBER_INVALID`, `invalid number of results requested`)
+	SizeInvalid         = catcherr.New(http.StatusRequestEntityTooLarge, `SIZE_INVALID`, `manifest is too large`)
+	TagInvalid          = catcherr.New(http.StatusBadRequest, `TAG_INVALID`, `manifest tag did not match URI`)
+	Unauthorized        = catcherr.New(http.StatusUnauthorized, `UNAUTHORIZED`, `authentication required`)
+	InvalidCredentials  = catcherr.New(http.StatusUnauthorized, `UNAUTHORIZED`, `invalid login or token`)
+	Denied              = catcherr.New(http.StatusForbidden, `DENIED`, `requested access to the resource is denied`)
+	QuotaExceeded       = catcherr.New(http.StatusInsufficientStorage, `DENIED`, `storage quota exceeded`)
+	NotFound            = catcherr.New(http.StatusNotFound, `NOT_FOUND`, `not found`)
+	Unsupported         = catcherr.New(http.StatusMethodNotAllowed, `UNSUPPORTED`, `the operation is unsupported`)
+	TooManyRequests     = catcherr.New(http.StatusTooManyRequests, `TOOMANYREQUESTS`, `too many failed attempts`)
+	AccountLocked       = catcherr.New(http.StatusTooManyRequests, `TOOMANYREQUESTS`, `account is locked after failed attempts`)
+	InternalError       = catcherr.New(http.StatusInternalServerError, `UNKNOWN`, `internal server error`)
+)
+
+// protocol sends errors in the JSON document of the distribution API,
+// which container clients show to their users.
+var protocol = catcherr.Protocol{Internal: InternalError, Render: writeError}
+
+type (
+	errorDetail struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+
+	errorResponse struct {
+		Errors []errorDetail `json:"errors"`
+	}
+)
+
+func writeError(w http.ResponseWriter, r *http.Request, e *catcherr.Error, _ string) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(e.Status)
+		return
+	}
+	sendJSON(w, e.Status, errorResponse{Errors: []errorDetail{{Code: e.Code, Message: e.Message()}}})
+}
+
+func sendJSON(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set(`Content-Type`, `application/json`)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf(`[ registry ]: can't send response to the client: %v`, err)
+	}
+	return nil
+}
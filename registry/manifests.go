@@ -0,0 +1,328 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/database"
+	"server/directory"
+	"server/user"
+)
+
+const (
+	maxManifestSize = 4 << 20
+
+	mediaTypeManifest = `application/vnd.oci.image.manifest.v1+json`
+	mediaTypeIndex    = `application/vnd.oci.image.index.v1+json`
+)
+
+type (
+	descriptor struct {
+		Digest string   `json:"digest"`
+		URLs   []string `json:"urls"`
+	}
+
+	// manifest holds what the registry needs of image manifests and
+	// indexes, in the OCI and the Docker schema 2 formats alike.
+	manifest struct {
+		SchemaVersion int          `json:"schemaVersion"`
+		MediaType     string       `json:"mediaType"`
+		Config        *descriptor  `json:"config"`
+		Layers        []descriptor `json:"layers"`
+		Manifests     []descriptor `json:"manifests"`
+	}
+
+	tagList struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}
+
+	catalogList struct {
+		Repositories []string `json:"repositories"`
+	}
+)
+
+// serveManifest runs the manifest endpoints. The reference is a tag
+// or the digest of the manifest.
+func serveManifest(w http.ResponseWriter, r *request, reference string) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return getManifest(w, r, reference)
+	case http.MethodPut:
+		return putManifest(w, r, reference)
+	case http.MethodDelete:
+		return deleteManifest(w, r, reference)
+	}
+	w.Header().Set(`Allow`, `GET, HEAD, PUT, DELETE`)
+	return Unsupported
+}
+
+func getManifest(w http.ResponseWriter, r *request, reference string) error {
+	ctx := r.Context()
+
+	var (
+		m   database.RegistryManifest
+		err error
+	)
+	if strings.Contains(reference, `:`) {
+		checksum, digestErr := parseDigest(reference)
+		if digestErr != nil {
+			return digestErr
+		}
+		m, err = database.GetRegistryManifest(ctx, r.u.ID, r.repo, checksum)
+	} else {
+		m, err = database.GetTaggedRegistryManifest(ctx, r.u.ID, r.repo, reference)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return ManifestUnknown.Wrap(err)
+	}
+	if err != nil {
+		return err
+	}
+
+	f, err := user.OpenFile(m.Checksum)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w.Header().Set(`Content-Type`, m.MediaType)
+	w.Header().Set(`Docker-Content-Digest`, digestOf(m.Checksum))
+	w.Header().Set(`ETag`, `"`+digestOf(m.Checksum)+`"`)
+	http.ServeContent(w, r.Request, ``, time.Time{}, f)
+	return nil
+}
+
+// putManifest stores the manifest once every blob and manifest it refers
+// to is in the repository, and points the tag at it if the reference is one.
+func putManifest(w http.ResponseWriter, r *request, reference string) error {
+	var tag, want string
+	if strings.Contains(reference, `:`) {
+		checksum, err := parseDigest(reference)
+		if err != nil {
+			return err
+		}
+		want = checksum
+	} else if tagFormat.MatchString(reference) {
+		tag = reference
+	} else {
+		return TagInvalid.WithDetail(`invalid tag`)
+	}
+
+	content, err := io.ReadAll(io.LimitReader(r.Body, maxManifestSize+1))
+	if err != nil {
+		return err
+	}
+	if len(content) > maxManifestSize {
+		return SizeInvalid
+	}
+
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+	if want != `` && want != checksum {
+		return DigestInvalid
+	}
+
+	var man manifest
+	if err = json.Unmarshal(content, &man); err != nil {
+		return ManifestInvalid.Wrap(err)
+	}
+	if man.SchemaVersion != 2 {
+		return ManifestInvalid.WithDetail(`only schema version 2 manifests are supported`)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get(`Content-Type`))
+	switch {
+	case mediaType != ``:
+	case man.MediaType != ``:
+		mediaType = man.MediaType
+	case man.Config != nil:
+		mediaType = mediaTypeManifest
+	default:
+		mediaType = mediaTypeIndex
+	}
+
+	descriptors := man.Layers
+	if man.Config != nil {
+		descriptors = append([]descriptor{*man.Config}, descriptors...)
+	}
+	blobs, err := checksums(descriptors)
+	if err != nil {
+		return err
+	}
+	manifests, err := checksums(man.Manifests)
+	if err != nil {
+		return err
+	}
+
+	m := database.RegistryManifest{Repo: r.repo, Checksum: checksum, MediaType: mediaType}
+	err = user.SaveRegistryManifest(r.Context(), r.u, m, content, tag, blobs, manifests)
+	switch {
+	case errors.Is(err, user.ErrManifestBlobUnknown):
+		return ManifestBlobUnknown.Wrap(err)
+	case errors.Is(err, user.ErrQuotaExceeded):
+		return QuotaExceeded.Wrap(err)
+	case err != nil:
+		return err
+	}
+
+	w.Header().Set(`Location`, r.location(`manifests/`+digestOf(checksum)))
+	w.Header().Set(`Docker-Content-Digest`, digestOf(checksum))
+	w.Header().Set(`Content-Length`, `0`)
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// checksums returns the checksums of the descriptors. Foreign layers,
+// which are fetched from their URLs, are never pushed and left out.
+func checksums(descriptors []descriptor) ([]string, error) {
+	var sums []string
+	for _, d := range descriptors {
+		if len(d.URLs) > 0 {
+			continue
+		}
+		checksum, err := parseDigest(d.Digest)
+		if err != nil {
+			return nil, ManifestInvalid.WithDetail(`manifest refers to ` + strconv.Quote(d.Digest) + `, only sha256 digests are supported`)
+		}
+		sums = append(sums, checksum)
+	}
+	return sums, nil
+}
+
+// deleteManifest deletes the manifest with the digest and its tags,
+// or just the tag if the reference is one.
+func deleteManifest(w http.ResponseWriter, r *request, reference string) error {
+	ctx := r.Context()
+
+	var err error
+	if strings.Contains(reference, `:`) {
+		checksum, digestErr := parseDigest(reference)
+		if digestErr != nil {
+			return digestErr
+		}
+		err = user.DeleteRegistryManifest(ctx, r.u, r.repo, checksum)
+	} else {
+		err = database.DeleteRegistryTag(ctx, r.u.ID, r.repo, reference)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return ManifestUnknown.Wrap(err)
+	}
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+func listTags(w http.ResponseWriter, r *request) error {
+	ctx := r.Context()
+
+	n, last, err := pagination(r.Request)
+	if err != nil {
+		return err
+	}
+
+	tags, err := database.GetRegistryTags(ctx, r.u.ID, r.repo, last, n+1)
+	if err != nil {
+		return err
+	}
+
+	if len(tags) == 0 && last == `` {
+		exists, err := database.RegistryRepoExists(ctx, r.u.ID, r.repo)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return NameUnknown
+		}
+	}
+
+	if n >= 0 && len(tags) > n {
+		tags = tags[:n]
+		next(w, r.location(`tags/list`), n, tags)
+	}
+	if tags == nil {
+		tags = []string{}
+	}
+	return sendJSON(w, http.StatusOK, tagList{Name: r.name, Tags: tags})
+}
+
+// catalog lists the repositories of the user, the only ones they can see.
+func catalog(w http.ResponseWriter, r *http.Request, u database.User) error {
+	n, last, err := pagination(r)
+	if err != nil {
+		return err
+	}
+	if last != `` {
+		last, _ = ownRepo(u, last)
+	}
+
+	repos, err := database.GetRegistryRepos(r.Context(), u.ID, last, n+1)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(repos))
+	for _, repo := range repos {
+		names = append(names, repoName(u, repo))
+	}
+
+	if n >= 0 && len(names) > n {
+		names = names[:n]
+		next(w, directory.Registry+`/_catalog`, n, names)
+	}
+	return sendJSON(w, http.StatusOK, catalogList{Repositories: names})
+}
+
+// pagination returns the n and last parameters of a listing. Without n
+// everything is listed, which is told by a negative n.
+func pagination(r *http.Request) (n int, last string, err error) {
+	query := r.URL.Query()
+
+	n = -1
+	if s := query.Get(`n`); s != `` {
+		n, err = strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return 0, ``, PaginationInvalid
+		}
+	}
+	return n, query.Get(`last`), nil
+}
+
+// next links the page after the items, which the client follows to get
+// the rest of the listing. An empty page links nowhere.
+func next(w http.ResponseWriter, path string, n int, items []string) {
+	if len(items) == 0 {
+		return
+	}
+	query := url.Values{`n`: {strconv.Itoa(n)}, `last`: {items[len(items)-1]}}
+	w.Header().Set(`Link`, `<`+path+`?`+query.Encode()+`>; rel="next"`)
+}
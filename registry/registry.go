@@ -0,0 +1,161 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package registry serves the OCI distribution API at directory.Registry,
+// so container images can be pushed to and pulled from dexcloud. Blobs
+// and manifests are stored under their SHA-256 like files. Every user has
+// their own namespace, the repositories whose name starts with the login,
+// and signs in with a bearer token issued by the token endpoint.
+package registry
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"server/auth"
+	"server/database"
+	"server/deadline"
+	"server/directory"
+
+	"github.com/gorilla/mux"
+)
+
+const maxNameLength = 255
+
+var (
+	// route splits a path into the repository name and the endpoint.
+	route = regexp.MustCompile(`^/(.+)/(tags/list|manifests/[^/]+|blobs/uploads/[^/]*|blobs/[^/]+)$`)
+
+	nameFormat   = regexp.MustCompile(`^[a-z0-9]+(?:(?:\.|_|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:\.|_|__|-+)[a-z0-9]+)*)*$`)
+	tagFormat    = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+	digestFormat = regexp.MustCompile(`^sha256:([0-9a-f]{64})$`)
+)
+
+// request is an authenticated request to a repository. name is the
+// repository as clients know it, repo the part after the namespace.
+type request struct {
+	*http.Request
+	u    database.User
+	name string
+	repo string
+}
+
+// Handle mounts the distribution API at directory.Registry. It has to
+// come before routes with a prefix that would shadow it.
+func Handle(r *mux.Router) {
+	r.PathPrefix(directory.Registry + `/`).Handler(deadline.Extend(protocol.Handle(serveRegistry)))
+}
+
+func serveRegistry(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set(`Docker-Distribution-API-Version`, `registry/2.0`)
+
+	p := strings.TrimPrefix(r.URL.Path, directory.Registry)
+	switch p {
+	case `/token`:
+		return serveToken(w, r)
+	case `/`:
+		if _, err := authenticate(w, r, auth.RegistryAccess{}); err != nil {
+			return err
+		}
+		return sendJSON(w, http.StatusOK, struct{}{})
+	case `/_catalog`:
+		u, err := authenticate(w, r, auth.RegistryAccess{Type: `registry`, Name: `catalog`, Actions: []string{`*`}})
+		if err != nil {
+			return err
+		}
+		return allow(w, r.Method, http.MethodGet, func() error { return catalog(w, r, u) })
+	}
+
+	m := route.FindStringSubmatch(p)
+	if m == nil {
+		return NotFound
+	}
+	name, endpoint := m[1], m[2]
+	if len(name) > maxNameLength || !nameFormat.MatchString(name) {
+		return NameInvalid
+	}
+
+	access := auth.RegistryAccess{Type: `repository`, Name: name, Actions: []string{action(r.Method)}}
+	u, err := authenticate(w, r, access)
+	if err != nil {
+		return err
+	}
+
+	repo, ok := ownRepo(u, name)
+	if !ok {
+		return Denied
+	}
+	req := &request{Request: r, u: u, name: name, repo: repo}
+
+	switch {
+	case endpoint == `tags/list`:
+		return allow(w, r.Method, http.MethodGet, func() error { return listTags(w, req) })
+	case strings.HasPrefix(endpoint, `manifests/`):
+		return serveManifest(w, req, strings.TrimPrefix(endpoint, `manifests/`))
+	case strings.HasPrefix(endpoint, `blobs/uploads/`):
+		return serveUpload(w, req, strings.TrimPrefix(endpoint, `blobs/uploads/`))
+	}
+	return serveBlob(w, req, strings.TrimPrefix(endpoint, `blobs/`))
+}
+
+// allow runs f for requests with one of the methods.
+func allow(w http.ResponseWriter, method, methods string, f func() error) error {
+	for _, m := range strings.Split(methods, `, `) {
+		if m == method {
+			return f()
+		}
+	}
+	w.Header().Set(`Allow`, methods)
+	return Unsupported
+}
+
+// action returns the action a request with the method needs.
+func action(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return `pull`
+	case http.MethodDelete:
+		return `delete`
+	}
+	return `push`
+}
+
+// ownRepo returns the part of the repository name after the namespace
+// of the user, and whether the name is in that namespace at all.
+func ownRepo(u database.User, name string) (string, bool) {
+	namespace, repo, ok := strings.Cut(name, `/`)
+	if !ok || !strings.EqualFold(namespace, u.Login) {
+		return ``, false
+	}
+	return repo, true
+}
+
+// repoName returns the name clients know the repository of the user by.
+func repoName(u database.User, repo string) string {
+	return strings.ToLower(u.Login) + `/` + repo
+}
+
+// parseDigest returns the checksum of a digest, or DigestInvalid.
+func parseDigest(digest string) (string, error) {
+	m := digestFormat.FindStringSubmatch(digest)
+	if m == nil {
+		return ``, DigestInvalid.WithDetail(`only sha256 digests are supported`)
+	}
+	return m[1], nil
+}
+
+func digestOf(checksum string) string { return `sha256:` + checksum }
@@ -0,0 +1,191 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"server/auth"
+	"server/catcherr"
+	"server/config"
+	"server/database"
+	"server/directory"
+)
+
+// service names the registry in challenges and tokens.
+const service = `dexcloud`
+
+type tokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+	IssuedAt    string `json:"issued_at"`
+}
+
+// serveToken issues registry tokens to users signed in with Basic
+// credentials, like docker login sends them, or with an API token.
+// The token grants the requested scopes as far as the user may use them.
+func serveToken(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		w.Header().Set(`Allow`, http.MethodGet)
+		return Unsupported
+	}
+
+	u, err := tokenUser(w, r)
+	if err != nil {
+		w.Header().Set(`WWW-Authenticate`, fmt.Sprintf(`Basic realm=%q`, service))
+		return err
+	}
+	catcherr.SetLogin(r.Context(), u.Login)
+
+	var access []auth.RegistryAccess
+	for _, scope := range r.URL.Query()[`scope`] {
+		for _, s := range strings.Fields(scope) {
+			if a, ok := grant(u, s); ok {
+				access = append(access, a)
+			}
+		}
+	}
+
+	token, expires, err := auth.CreateRegistryToken(u, access)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	return sendJSON(w, http.StatusOK, tokenResponse{
+		Token:       token,
+		AccessToken: token,
+		ExpiresIn:   int64(expires.Sub(now).Seconds()),
+		IssuedAt:    now.UTC().Format(time.RFC3339),
+	})
+}
+
+// tokenUser returns the user of a token request. Basic credentials take
+// an app password or a personal token and are throttled like logins.
+func tokenUser(w http.ResponseWriter, r *http.Request) (database.User, error) {
+	if _, _, ok := r.BasicAuth(); ok {
+		return auth.AuthenticateBasicThrottled(w, r, failures)
+	}
+
+	u, err := auth.Authenticate(r)
+	if err != nil {
+		return database.User{}, Unauthorized.Wrap(err)
+	}
+	return u, nil
+}
+
+// failures of Basic credentials are answered in the format of the
+// registry, which has a single code for failed and missing sign ins.
+var failures = auth.Failures{
+	Unauthorized:       Unauthorized,
+	InvalidCredentials: InvalidCredentials,
+	RateLimited:        TooManyRequests,
+	AccountLocked:      AccountLocked,
+	Internal:           InternalError,
+}
+
+// grant returns the access of the scope the user may have. Users can
+// pull from their own repositories, push and delete unless read only,
+// and list them in the catalog.
+func grant(u database.User, scope string) (auth.RegistryAccess, bool) {
+	parts := strings.Split(scope, `:`)
+	if len(parts) != 3 {
+		return auth.RegistryAccess{}, false
+	}
+	a := auth.RegistryAccess{Type: parts[0], Name: parts[1]}
+
+	switch {
+	case a.Type == `registry` && a.Name == `catalog`:
+		a.Actions = []string{`*`}
+		return a, true
+	case a.Type != `repository`:
+		return auth.RegistryAccess{}, false
+	}
+	if _, ok := ownRepo(u, a.Name); !ok {
+		return auth.RegistryAccess{}, false
+	}
+
+	for _, action := range strings.Split(parts[2], `,`) {
+		switch action {
+		case `pull`:
+		case `push`, `delete`, `*`:
+			if u.Role == database.RoleReadOnly {
+				continue
+			}
+		default:
+			continue
+		}
+		a.Actions = append(a.Actions, action)
+	}
+	return a, len(a.Actions) > 0
+}
+
+// authenticate returns the user of a request with a registry token that
+// grants the access. Requests without such a token get a challenge that
+// tells the client where to get one. An empty access only needs a token.
+func authenticate(w http.ResponseWriter, r *http.Request, access auth.RegistryAccess) (database.User, error) {
+	u, granted, err := auth.AuthenticateRegistry(r)
+	if err == nil {
+		catcherr.SetLogin(r.Context(), u.Login)
+	}
+	if err == nil && (access.Type == `` || allowed(granted, access)) {
+		return u, nil
+	}
+
+	// Read only users are never granted writes, asking for
+	// another token won't help.
+	if err == nil && u.Role == database.RoleReadOnly && access.Actions[0] != `pull` {
+		return database.User{}, Denied
+	}
+
+	challenge := fmt.Sprintf(`Bearer realm=%q,service=%q`,
+		strings.TrimSuffix(config.String(config.PublicURL), `/`)+directory.Registry+`/token`, service)
+	if access.Type != `` {
+		challenge += fmt.Sprintf(`,scope="%s:%s:%s"`, access.Type, access.Name, strings.Join(access.Actions, `,`))
+	}
+	w.Header().Set(`WWW-Authenticate`, challenge)
+
+	if err != nil {
+		return database.User{}, Unauthorized.Wrap(err)
+	}
+	return database.User{}, Unauthorized.WithDetail(`token doesn't grant the access`)
+}
+
+// allowed tells whether the granted access covers every action of a.
+func allowed(granted []auth.RegistryAccess, a auth.RegistryAccess) bool {
+	for _, action := range a.Actions {
+		ok := false
+		for _, g := range granted {
+			if g.Type != a.Type || g.Name != a.Name {
+				continue
+			}
+			for _, ga := range g.Actions {
+				if ga == action || ga == `*` {
+					ok = true
+				}
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
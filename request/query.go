@@ -0,0 +1,121 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package request
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"time"
+
+	"server/catcherr"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// DecodeQuery fills the fields of the struct v points to from the query
+// string and validates it. Parameters are named by the json tags of the
+// fields; missing parameters leave the fields untouched, so v can hold
+// defaults. Strings, booleans, integers, RFC 3339 timestamps and pointers
+// to them are supported, embedded structs are filled as well. Slices of
+// them take every value of a repeated parameter.
+func DecodeQuery(r *http.Request, v any) error {
+	fields := decodeQuery(r.URL.Query(), reflect.ValueOf(v).Elem())
+	if len(fields) > 0 {
+		return catcherr.ValidationFailed.WithFields(fields...)
+	}
+	return Validate(v)
+}
+
+func decodeQuery(query url.Values, value reflect.Value) (fields []catcherr.FieldError) {
+	valueType := value.Type()
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			fields = append(fields, decodeQuery(query, value.Field(i))...)
+			continue
+		}
+
+		name := jsonName(field)
+		if !query.Has(name) || !field.IsExported() {
+			continue
+		}
+
+		if msg := setParams(value.Field(i), query[name]); msg != `` {
+			fields = append(fields, catcherr.FieldError{Field: name, Code: `type`, Message: msg})
+		}
+	}
+	return fields
+}
+
+// setParams parses the values of a parameter into the field, all of them
+// for slices and the first one otherwise.
+func setParams(field reflect.Value, params []string) string {
+	if field.Kind() != reflect.Slice {
+		return setParam(field, params[0])
+	}
+
+	values := reflect.MakeSlice(field.Type(), len(params), len(params))
+	for i, param := range params {
+		if msg := setParam(values.Index(i), param); msg != `` {
+			return msg
+		}
+	}
+	field.Set(values)
+	return ``
+}
+
+// setParam parses param into the field and returns what is wrong with it.
+func setParam(field reflect.Value, param string) string {
+	if field.Kind() == reflect.Pointer {
+		elem := reflect.New(field.Type().Elem())
+		if msg := setParam(elem.Elem(), param); msg != `` {
+			return msg
+		}
+		field.Set(elem)
+		return ``
+	}
+
+	if field.Type() == timeType {
+		t, err := time.Parse(time.RFC3339, param)
+		if err != nil {
+			return `must be an RFC 3339 timestamp`
+		}
+		field.Set(reflect.ValueOf(t))
+		return ``
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(param)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(param)
+		if err != nil {
+			return `must be true or false`
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(param, 10, field.Type().Bits())
+		if err != nil {
+			return `must be an integer`
+		}
+		field.SetInt(n)
+	default:
+		panic(`request: unsupported query parameter type ` + field.Type().String())
+	}
+	return ``
+}
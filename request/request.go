@@ -0,0 +1,117 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package request decodes and validates JSON request bodies.
+package request
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"server/catcherr"
+	"server/config"
+)
+
+// Decode reads exactly one JSON value from the body into v and validates it.
+// Bodies over request_max_body, unknown fields and values of the wrong type
+// are rejected.
+func Decode(w http.ResponseWriter, r *http.Request, v any) error {
+	if contentType := r.Header.Get(`Content-Type`); contentType != `` {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || !isJSON(mediaType) {
+			return catcherr.UnsupportedMediaType.WithDetail(`expected application/json`)
+		}
+	}
+
+	body := http.MaxBytesReader(w, r.Body, config.Int64(config.RequestMaxBody))
+	decoder := json.NewDecoder(body)
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(v)
+	if err != nil {
+		return decodeError(err)
+	}
+
+	_, err = decoder.Token()
+	if !errors.Is(err, io.EOF) {
+		return catcherr.InvalidJSON.WithDetail(`body must contain a single JSON value`)
+	}
+
+	return Validate(v)
+}
+
+func isJSON(mediaType string) bool {
+	return mediaType == `application/json` || strings.HasSuffix(mediaType, `+json`)
+}
+
+func decodeError(err error) error {
+	var (
+		syntaxErr   *json.SyntaxError
+		typeErr     *json.UnmarshalTypeError
+		tooLargeErr *http.MaxBytesError
+	)
+
+	switch {
+	case errors.Is(err, io.EOF):
+		return catcherr.InvalidJSON.WithDetail(`body is empty`).Wrap(err)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return catcherr.InvalidJSON.WithDetail(`body ends unexpectedly`).Wrap(err)
+	case errors.As(err, &syntaxErr):
+		detail := fmt.Sprintf(`syntax error at offset %d`, syntaxErr.Offset)
+		return catcherr.InvalidJSON.WithDetail(detail).Wrap(err)
+	case errors.As(err, &tooLargeErr):
+		detail := fmt.Sprintf(`body is larger than %d bytes`, tooLargeErr.Limit)
+		return catcherr.PayloadTooLarge.WithDetail(detail).Wrap(err)
+	case errors.As(err, &typeErr):
+		return catcherr.ValidationFailed.WithFields(catcherr.FieldError{
+			Field:   typeErr.Field,
+			Code:    `type`,
+			Message: `must be ` + typeName(typeErr.Type.Kind().String()),
+		}).Wrap(err)
+	}
+
+	// encoding/json has no error type for unknown fields.
+	const unknownField = `json: unknown field `
+	if msg := err.Error(); strings.HasPrefix(msg, unknownField) {
+		return catcherr.ValidationFailed.WithFields(catcherr.FieldError{
+			Field:   strings.Trim(strings.TrimPrefix(msg, unknownField), `"`),
+			Code:    `unknown`,
+			Message: `unknown field`,
+		}).Wrap(err)
+	}
+	return catcherr.InvalidJSON.Wrap(err)
+}
+
+// typeName names Go kinds the way JSON does.
+func typeName(kind string) string {
+	switch {
+	case kind == `string`:
+		return `a string`
+	case kind == `bool`:
+		return `a boolean`
+	case strings.HasPrefix(kind, `int`), strings.HasPrefix(kind, `uint`):
+		return `an integer`
+	case strings.HasPrefix(kind, `float`):
+		return `a number`
+	case kind == `slice`, kind == `array`:
+		return `an array`
+	}
+	return `an object`
+}
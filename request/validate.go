@@ -0,0 +1,218 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package request
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"server/catcherr"
+)
+
+// Validator is implemented by requests with rules spanning several fields.
+// It runs after the tag rules and only when they passed.
+type Validator interface {
+	Validate() []catcherr.FieldError
+}
+
+// Validate checks the `validate` tags of the struct fields of v,
+// which may be a struct or a pointer to one. Rules are separated by commas:
+//
+//	required    the value is not empty (blank strings count as empty)
+//	min=N       strings and slices have at least N elements, numbers are >= N
+//	max=N       strings and slices have at most N elements, numbers are <= N
+//	len=N       strings and slices have exactly N elements
+//	oneof=a b   the value is one of the space separated words
+//	email       an email address without a display name
+//	hex         a hex encoded string
+//	duration    a Go duration like 72h
+//	ip          an IPv4 or IPv6 address
+//
+// Empty values only fail required, so optional fields need no extra rule.
+// Field errors are reported under the json name of the field.
+func Validate(v any) error {
+	value := reflect.Indirect(reflect.ValueOf(v))
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
+
+	fields := validateStruct(value)
+	if v, ok := v.(Validator); ok && len(fields) == 0 {
+		fields = v.Validate()
+	}
+
+	if len(fields) > 0 {
+		return catcherr.ValidationFailed.WithFields(fields...)
+	}
+	return nil
+}
+
+// validateStruct checks the fields of the struct and of embedded structs.
+func validateStruct(value reflect.Value) (fields []catcherr.FieldError) {
+	valueType := value.Type()
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			fields = append(fields, validateStruct(value.Field(i))...)
+			continue
+		}
+
+		tag := field.Tag.Get(`validate`)
+		if tag == `` {
+			continue
+		}
+
+		if fieldErr, ok := check(value.Field(i), tag); !ok {
+			fieldErr.Field = jsonName(field)
+			fields = append(fields, fieldErr)
+		}
+	}
+	return fields
+}
+
+// check returns the error of the first rule the value breaks.
+func check(value reflect.Value, tag string) (catcherr.FieldError, bool) {
+	for value.Kind() == reflect.Pointer && !value.IsNil() {
+		value = value.Elem()
+	}
+
+	empty := isEmpty(value)
+	for _, rule := range strings.Split(tag, `,`) {
+		name, arg, _ := strings.Cut(rule, `=`)
+		if name == `required` {
+			if empty {
+				return invalid(`required`, `is required`), false
+			}
+			continue
+		}
+		if empty {
+			continue
+		}
+
+		if msg := apply(name, arg, value); msg != `` {
+			code := `invalid`
+			if name == `min` || name == `max` {
+				code = `out_of_range`
+			}
+			return invalid(code, msg), false
+		}
+	}
+	return catcherr.FieldError{}, true
+}
+
+// apply returns what is wrong with the value, or an empty string.
+func apply(name, arg string, value reflect.Value) string {
+	switch name {
+	case `min`, `max`, `len`:
+		return checkSize(name, arg, value)
+	case `oneof`:
+		words := strings.Fields(arg)
+		for _, word := range words {
+			if fmt.Sprint(value.Interface()) == word {
+				return ``
+			}
+		}
+		return `must be one of: ` + strings.Join(words, `, `)
+	case `email`:
+		addr, err := mail.ParseAddress(value.String())
+		if err != nil || addr.Name != `` || addr.Address != value.String() {
+			return `must be an email address`
+		}
+	case `hex`:
+		if _, err := hex.DecodeString(value.String()); err != nil {
+			return `must be hex encoded`
+		}
+	case `duration`:
+		if _, err := time.ParseDuration(value.String()); err != nil {
+			return `must be a duration like 72h`
+		}
+	case `ip`:
+		if net.ParseIP(value.String()) == nil {
+			return `must be an IP address`
+		}
+	default:
+		panic(fmt.Sprintf(`request: unknown validation rule %q`, name))
+	}
+	return ``
+}
+
+func checkSize(name, arg string, value reflect.Value) string {
+	limit, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		panic(fmt.Sprintf(`request: bad argument of %s: %q`, name, arg))
+	}
+
+	var (
+		size float64
+		unit string
+	)
+	switch value.Kind() {
+	case reflect.String:
+		size, unit = float64(utf8.RuneCountInString(value.String())), ` characters`
+	case reflect.Slice, reflect.Array, reflect.Map:
+		size, unit = float64(value.Len()), ` items`
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		size = float64(value.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		size = float64(value.Uint())
+	case reflect.Float32, reflect.Float64:
+		size = value.Float()
+	default:
+		panic(fmt.Sprintf(`request: %s doesn't apply to %s`, name, value.Kind()))
+	}
+
+	switch {
+	case name == `min` && size < limit:
+		return fmt.Sprintf(`must be at least %s%s`, arg, unit)
+	case name == `max` && size > limit:
+		return fmt.Sprintf(`must be at most %s%s`, arg, unit)
+	case name == `len` && size != limit:
+		return fmt.Sprintf(`must be exactly %s%s`, arg, unit)
+	}
+	return ``
+}
+
+func isEmpty(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.String:
+		return strings.TrimSpace(value.String()) == ``
+	case reflect.Pointer, reflect.Interface:
+		return value.IsNil()
+	case reflect.Slice, reflect.Map:
+		return value.Len() == 0
+	}
+	// Numbers and booleans are never empty, zero is a valid value.
+	return false
+}
+
+func invalid(code, msg string) catcherr.FieldError {
+	return catcherr.FieldError{Code: code, Message: msg}
+}
+
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get(`json`), `,`)
+	if name == `` {
+		return field.Name
+	}
+	return name
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package response
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"server/catcherr"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type codec struct {
+	contentType string
+	aliases     []string
+	marshal     func(v any) ([]byte, error)
+}
+
+// codecs are in the order of preference, the first one is the default.
+// Struct fields are named by their json tags in every format.
+var codecs = []codec{
+	{contentType: `application/json`, marshal: json.Marshal},
+	{
+		contentType: `application/msgpack`,
+		aliases:     []string{`application/x-msgpack`, `application/vnd.msgpack`},
+		marshal:     marshalMsgpack,
+	},
+	{contentType: `application/cbor`, marshal: marshalCBOR},
+}
+
+var cborMode, _ = cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+
+func marshalMsgpack(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := msgpack.NewEncoder(&buf)
+	encoder.SetCustomStructTag(`json`)
+	encoder.UseCompactInts(true)
+
+	err := encoder.Encode(v)
+	return buf.Bytes(), err
+}
+
+func marshalCBOR(v any) ([]byte, error) { return cborMode.Marshal(v) }
+
+type codecKey struct{}
+
+func fromContext(ctx context.Context) *codec {
+	c, _ := ctx.Value(codecKey{}).(*codec)
+	return c
+}
+
+// Negotiate picks the response format from the Accept header before the
+// handler runs, so a client asking for something else gets 406 without
+// any side effects.
+func Negotiate(next catcherr.HandlerFunc) catcherr.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		c := negotiate(r.Header.Get(`Accept`))
+		if c == nil {
+			return catcherr.NotAcceptable.WithDetail(`supported formats: ` + supported())
+		}
+
+		ctx := context.WithValue(r.Context(), codecKey{}, c)
+		return next(w, r.WithContext(ctx))
+	}
+}
+
+// negotiate returns the codec with the highest quality in accept.
+// Explicit media types win over wildcards of the same quality.
+func negotiate(accept string) *codec {
+	if strings.TrimSpace(accept) == `` {
+		return &codecs[0]
+	}
+
+	var (
+		best         *codec
+		bestQ        float64
+		bestExplicit bool
+	)
+	for _, part := range strings.Split(accept, `,`) {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if value, ok := params[`q`]; ok {
+			q, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+
+		for i := range codecs {
+			explicit, ok := codecs[i].accepts(mediaType)
+			if !ok {
+				continue
+			}
+			if best == nil || q > bestQ || (q == bestQ && explicit && !bestExplicit) {
+				best, bestQ, bestExplicit = &codecs[i], q, explicit
+			}
+			break
+		}
+	}
+	return best
+}
+
+// accepts reports if the media range includes the codec and if it names it.
+func (c *codec) accepts(mediaRange string) (explicit, ok bool) {
+	switch mediaRange {
+	case `*/*`, `application/*`:
+		return false, true
+	case c.contentType:
+		return true, true
+	}
+	for _, alias := range c.aliases {
+		if mediaRange == alias {
+			return true, true
+		}
+	}
+	return false, false
+}
+
+func supported() string {
+	types := make([]string, 0, len(codecs))
+	for _, c := range codecs {
+		types = append(types, c.contentType)
+	}
+	return strings.Join(types, `, `)
+}
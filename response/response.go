@@ -14,35 +14,41 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
+// Package response writes successful API responses. Every body is the same
+// envelope, encoded in the format the client asked for with Accept.
 package response
 
 import (
-	"encoding/json"
 	"net/http"
 )
 
-type Data struct {
-	StatusCode int `json:"status"`
-	Data       any `json:"data"`
+// Envelope wraps every successful response body.
+type Envelope struct {
+	Data any `json:"data"`
 }
 
-const (
-	defaultType  = "Content-Type"
-	defaultValue = "application/json"
-)
-
-func Send(w http.ResponseWriter, resp Data) error {
-	w.Header().Set(defaultType, defaultValue)
-	w.WriteHeader(resp.StatusCode)
-
-	jsonData, err := json.Marshal(resp)
-	if err != nil {
-		return err
+// Send writes data with the status in the format negotiated for r.
+func Send(w http.ResponseWriter, r *http.Request, status int, data any) error {
+	c := fromContext(r.Context())
+	if c == nil {
+		c = &codecs[0]
 	}
 
-	_, err = w.Write(jsonData)
+	body, err := c.marshal(Envelope{Data: data})
 	if err != nil {
 		return err
 	}
+
+	w.Header().Set(`Content-Type`, c.contentType)
+	w.Header().Add(`Vary`, `Accept`)
+	w.WriteHeader(status)
+
+	_, err = w.Write(body)
+	return err
+}
+
+// NoContent answers requests that succeeded without anything to return.
+func NoContent(w http.ResponseWriter) error {
+	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
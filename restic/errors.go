@@ -0,0 +1,49 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package restic
+
+import (
+	"net/http"
+
+	"server/catcherr"
+)
+
+var (
+	Unauthorized        = catcherr.New(http.StatusUnauthorized, `unauthorized`, `Credentials needed`)
+	InvalidCredentials  = catcherr.New(http.StatusUnauthorized, `invalid_credentials`, `Invalid login or token`)
+	Forbidden           = catcherr.New(http.StatusForbidden, `forbidden`, `You can't write to this repository`)
+	AppendOnly          = catcherr.New(http.StatusForbidden, `append_only`, `The repository is append only`)
+	Exists              = catcherr.New(http.StatusForbidden, `exists`, `File already exists`)
+	NotFound            = catcherr.New(http.StatusNotFound, `not_found`, `Not found`)
+	MethodNotAllowed    = catcherr.New(http.StatusMethodNotAllowed, `method_not_allowed`, `Method not allowed`)
+	Mismatch            = catcherr.New(http.StatusBadRequest, `mismatch`, `File content doesn't match its name`)
+	RateLimited         = catcherr.New(http.StatusTooManyRequests, `rate_limited`, `Too many failed attempts`)
+	AccountLocked       = catcherr.New(http.StatusTooManyRequests, `account_locked`, `Account locked after failed attempts`)
+	InternalError       = catcherr.New(http.StatusInternalServerError, `internal_error`, `Internal server error`)
+	InsufficientStorage = catcherr.New(http.StatusInsufficientStorage, `insufficient_storage`, `Storage quota exceeded`)
+)
+
+// protocol sends errors as plain text. Restic only looks at the status,
+// the message is for people reading logs.
+var protocol = catcherr.Protocol{Internal: InternalError, Render: writeError}
+
+func writeError(w http.ResponseWriter, r *http.Request, e *catcherr.Error, _ string) {
+	if e.Status == http.StatusUnauthorized {
+		w.Header().Set(`WWW-Authenticate`, `Basic realm="dexcloud"`)
+	}
+	http.Error(w, e.Message(), e.Status)
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package restic
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"server/database"
+	"server/user"
+)
+
+const (
+	mediaTypeV1 = `application/vnd.x.restic.rest.v1`
+	mediaTypeV2 = `application/vnd.x.restic.rest.v2`
+)
+
+// entry is a file in a listing of the second protocol version.
+type entry struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// serveRepo creates or deletes the repository. Repositories exist once
+// their config is stored, so creating one only checks that it may be.
+func serveRepo(w http.ResponseWriter, r *request) error {
+	switch r.Method {
+	case http.MethodPost:
+		return writable(func(w http.ResponseWriter, r *request) error {
+			if r.URL.Query().Get(`create`) != `true` {
+				return MethodNotAllowed
+			}
+			return nil
+		})(w, r)
+	case http.MethodDelete:
+		return deletable(``, func(w http.ResponseWriter, r *request) error {
+			return user.DeleteResticRepo(r.Context(), r.u, r.repo)
+		})(w, r)
+	}
+	w.Header().Set(`Allow`, `POST, DELETE`)
+	return MethodNotAllowed
+}
+
+func serveObject(w http.ResponseWriter, r *request, typ, name string) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return getObject(w, r, typ, name)
+	case http.MethodPost:
+		return writable(func(w http.ResponseWriter, r *request) error { return saveObject(r, typ, name) })(w, r)
+	case http.MethodDelete:
+		return deletable(typ, func(w http.ResponseWriter, r *request) error { return deleteObject(r, typ, name) })(w, r)
+	}
+	w.Header().Set(`Allow`, `GET, HEAD, POST, DELETE`)
+	return MethodNotAllowed
+}
+
+func getObject(w http.ResponseWriter, r *request, typ, name string) error {
+	o, err := database.GetResticObject(r.Context(), r.u.ID, r.repo, typ, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return NotFound.Wrap(err)
+	}
+	if err != nil {
+		return err
+	}
+
+	f, err := user.OpenFile(o.Checksum)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w.Header().Set(`Content-Type`, `application/octet-stream`)
+	http.ServeContent(w, r.Request, ``, time.Time{}, f)
+	return nil
+}
+
+// saveObject stores the body. Uploads larger than the remaining quota
+// are refused before they are read when the client sends the length.
+func saveObject(r *request, typ, name string) error {
+	ctx := r.Context()
+
+	if r.ContentLength > 0 {
+		if err := user.CheckQuota(ctx, r.u, r.ContentLength); err != nil {
+			return objectError(err)
+		}
+	}
+	return objectError(user.SaveResticObject(ctx, r.u, r.repo, typ, name, r.Body))
+}
+
+func deleteObject(r *request, typ, name string) error {
+	return objectError(user.DeleteResticObject(r.Context(), r.u, r.repo, typ, name))
+}
+
+// list sends the names of the files of the type, in the second protocol
+// version with their sizes if the client asks for it.
+func list(w http.ResponseWriter, r *request, typ string) error {
+	objects, err := database.GetResticObjects(r.Context(), r.u.ID, r.repo, typ)
+	if err != nil {
+		return err
+	}
+
+	var v any
+	mediaType := mediaTypeV1
+	if strings.Contains(r.Header.Get(`Accept`), mediaTypeV2) {
+		entries := make([]entry, 0, len(objects))
+		for _, o := range objects {
+			entries = append(entries, entry{Name: o.Name, Size: o.Size})
+		}
+		v, mediaType = entries, mediaTypeV2
+	} else {
+		names := make([]string, 0, len(objects))
+		for _, o := range objects {
+			names = append(names, o.Name)
+		}
+		v = names
+	}
+
+	w.Header().Set(`Content-Type`, mediaType)
+	if err = json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf(`[ restic ]: can't send response to the client: %v`, err)
+	}
+	return nil
+}
+
+func objectError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, sql.ErrNoRows):
+		return NotFound.Wrap(err)
+	case errors.Is(err, user.ErrResticExists):
+		return Exists.Wrap(err)
+	case errors.Is(err, user.ErrResticMismatch):
+		return Mismatch.Wrap(err)
+	case errors.Is(err, user.ErrQuotaExceeded):
+		return InsufficientStorage.Wrap(err)
+	}
+	return err
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package restic serves restic repositories over the REST backend
+// protocol at directory.Restic, so restic can back up to dexcloud.
+// Every user has their own repositories, named by the path after the
+// prefix, and signs in with Basic auth and a personal token or an app
+// password. The files of a repository are stored as blobs like files.
+package restic
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"server/auth"
+	"server/catcherr"
+	"server/config"
+	"server/database"
+	"server/deadline"
+	"server/directory"
+	"server/user"
+
+	"github.com/gorilla/mux"
+)
+
+const maxRepoLength = 255
+
+// route splits a path into the repository, the config and the type and
+// name of other files. Without a type the path is the repository itself,
+// without a name it lists the files of the type.
+var route = regexp.MustCompile(`^/(.+?)/(?:(config)|(data|keys|locks|snapshots|index)/([0-9a-f]{64})?)?$`)
+
+// request is an authenticated request to a repository.
+type request struct {
+	*http.Request
+	u    database.User
+	repo string
+}
+
+// Handle mounts the restic REST backend at directory.Restic. It has to
+// come before routes with a prefix that would shadow it.
+func Handle(r *mux.Router) {
+	r.PathPrefix(directory.Restic + `/`).Handler(deadline.Extend(protocol.Handle(serveRestic)))
+}
+
+func serveRestic(w http.ResponseWriter, r *http.Request) error {
+	m := route.FindStringSubmatch(strings.TrimPrefix(r.URL.Path, directory.Restic))
+	if m == nil || !validRepo(m[1]) {
+		return NotFound
+	}
+
+	u, err := auth.AuthenticateBasicThrottled(w, r, failures)
+	if err != nil {
+		return err
+	}
+	catcherr.SetLogin(r.Context(), u.Login)
+
+	req := &request{Request: r, u: u, repo: m[1]}
+	switch typ, name := m[2]+m[3], m[4]; {
+	case typ == ``:
+		return serveRepo(w, req)
+	case typ == user.ResticConfig:
+		return serveObject(w, req, typ, typ)
+	case name == ``:
+		return allow(w, req, http.MethodGet, func(w http.ResponseWriter, r *request) error { return list(w, r, typ) })
+	default:
+		return serveObject(w, req, typ, name)
+	}
+}
+
+type requestHandler func(w http.ResponseWriter, r *request) error
+
+// allow runs f for requests with the method.
+func allow(w http.ResponseWriter, r *request, method string, f requestHandler) error {
+	if r.Method != method {
+		w.Header().Set(`Allow`, method)
+		return MethodNotAllowed
+	}
+	return f(w, r)
+}
+
+// writable refuses read only users.
+func writable(f requestHandler) requestHandler {
+	return func(w http.ResponseWriter, r *request) error {
+		if r.u.Role == database.RoleReadOnly {
+			return Forbidden
+		}
+		return f(w, r)
+	}
+}
+
+// deletable refuses deletions in append only mode, which only lets
+// restic remove its locks.
+func deletable(typ string, f requestHandler) requestHandler {
+	return writable(func(w http.ResponseWriter, r *request) error {
+		if config.Bool(config.ResticAppendOnly) && typ != `locks` {
+			return AppendOnly
+		}
+		return f(w, r)
+	})
+}
+
+// failures are answered as plain text, whose renderer asks for
+// credentials again itself.
+var failures = auth.Failures{
+	Unauthorized:       Unauthorized,
+	InvalidCredentials: InvalidCredentials,
+	RateLimited:        RateLimited,
+	AccountLocked:      AccountLocked,
+	Internal:           InternalError,
+}
+
+// validRepo tells whether the repository name is a clean relative path.
+func validRepo(repo string) bool {
+	if len(repo) > maxRepoLength {
+		return false
+	}
+	for _, segment := range strings.Split(repo, `/`) {
+		if segment == `` || segment == `.` || segment == `..` {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,380 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"server/database"
+)
+
+const (
+	defaultMaxKeys = 1000
+	listBatch      = 1000
+)
+
+type owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type listBucketsResponse struct {
+	XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Owner   owner    `xml:"Owner"`
+	Buckets []bucket `xml:"Buckets>Bucket"`
+}
+
+type locationResponse struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+}
+
+type object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type listObjectsResponse struct {
+	XMLName        xml.Name       `xml:"ListBucketResult"`
+	Xmlns          string         `xml:"xmlns,attr"`
+	Name           string         `xml:"Name"`
+	Prefix         string         `xml:"Prefix"`
+	Delimiter      string         `xml:"Delimiter,omitempty"`
+	MaxKeys        int            `xml:"MaxKeys"`
+	EncodingType   string         `xml:"EncodingType,omitempty"`
+	IsTruncated    bool           `xml:"IsTruncated"`
+	Contents       []object       `xml:"Contents"`
+	CommonPrefixes []commonPrefix `xml:"CommonPrefixes"`
+
+	// Version 1
+	Marker     *string `xml:"Marker"`
+	NextMarker string  `xml:"NextMarker,omitempty"`
+
+	// Version 2
+	KeyCount              *int   `xml:"KeyCount"`
+	StartAfter            string `xml:"StartAfter,omitempty"`
+	ContinuationToken     string `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string `xml:"NextContinuationToken,omitempty"`
+}
+
+// listing is a page of the keys in a bucket.
+type listing struct {
+	objects   []database.File
+	prefixes  []string
+	last      string
+	truncated bool
+}
+
+func listBuckets(w http.ResponseWriter, r *request) error {
+	folders, err := database.GetFolders(r.Context(), r.u.ID, `/`)
+	if err != nil {
+		return InternalError.Wrap(err)
+	}
+
+	res := listBucketsResponse{
+		Xmlns: xmlns,
+		Owner: owner{ID: strconv.FormatInt(r.u.ID, 10), DisplayName: r.u.Login},
+	}
+	for _, f := range folders {
+		res.Buckets = append(res.Buckets, bucket{Name: f.Name, CreationDate: formatTime(f.CreatedAt)})
+	}
+	return sendXML(w, http.StatusOK, res)
+}
+
+func headBucket(w http.ResponseWriter, r *request) error {
+	if err := checkBucket(r); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// createBucket creates the folder. S3 outside us-east-1 refuses
+// buckets the caller already owns, so does this.
+func createBucket(w http.ResponseWriter, r *request) error {
+	ctx := r.Context()
+
+	_, err := database.GetFolder(ctx, r.u.ID, r.folder())
+	if err == nil {
+		return BucketAlreadyOwnedByYou
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return InternalError.Wrap(err)
+	}
+
+	if err = database.EnsureFolder(ctx, r.u.ID, r.folder()); err != nil {
+		return InternalError.Wrap(err)
+	}
+	w.Header().Set(`Location`, r.folder())
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func deleteBucket(w http.ResponseWriter, r *request) error {
+	ctx := r.Context()
+
+	f, err := database.GetFolder(ctx, r.u.ID, r.folder())
+	if errors.Is(err, sql.ErrNoRows) {
+		return NoSuchBucket.Wrap(err)
+	}
+	if err != nil {
+		return InternalError.Wrap(err)
+	}
+
+	err = database.DeleteFolder(ctx, r.u.ID, f.ID)
+	if errors.Is(err, database.ErrNotEmpty) {
+		return BucketNotEmpty.Wrap(err)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return NoSuchBucket.Wrap(err)
+	}
+	if err != nil {
+		return InternalError.Wrap(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func listObjectsV1(w http.ResponseWriter, r *request) error {
+	q := r.URL.Query()
+
+	res, l, err := listObjects(r, q.Get(`marker`))
+	if err != nil {
+		return err
+	}
+
+	marker := encodeKey(q.Get(`marker`), res.EncodingType)
+	res.Marker = &marker
+	if l.truncated {
+		res.NextMarker = encodeKey(l.last, res.EncodingType)
+	}
+	return sendXML(w, http.StatusOK, res)
+}
+
+func listObjectsV2(w http.ResponseWriter, r *request) error {
+	q := r.URL.Query()
+
+	start := q.Get(`start-after`)
+	token := q.Get(`continuation-token`)
+	if token != `` {
+		b, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			return InvalidArgument.Wrap(err)
+		}
+		start = string(b)
+	}
+
+	res, l, err := listObjects(r, start)
+	if err != nil {
+		return err
+	}
+
+	count := len(res.Contents) + len(res.CommonPrefixes)
+	res.KeyCount = &count
+	res.StartAfter = encodeKey(q.Get(`start-after`), res.EncodingType)
+	res.ContinuationToken = token
+	if l.truncated {
+		res.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(l.last))
+	}
+	return sendXML(w, http.StatusOK, res)
+}
+
+// listObjects answers the parameters both versions of ListObjects share,
+// listing the keys after start.
+func listObjects(r *request, start string) (listObjectsResponse, listing, error) {
+	q := r.URL.Query()
+
+	maxKeys := defaultMaxKeys
+	if v := q.Get(`max-keys`); v != `` {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return listObjectsResponse{}, listing{}, InvalidArgument.Wrap(err)
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	encoding := q.Get(`encoding-type`)
+	if encoding != `` && encoding != `url` {
+		return listObjectsResponse{}, listing{}, InvalidArgument
+	}
+
+	if err := checkBucket(r); err != nil {
+		return listObjectsResponse{}, listing{}, err
+	}
+
+	prefix, delimiter := q.Get(`prefix`), q.Get(`delimiter`)
+	l, err := list(r, prefix, delimiter, start, maxKeys)
+	if err != nil {
+		return listObjectsResponse{}, listing{}, InternalError.Wrap(err)
+	}
+
+	res := listObjectsResponse{
+		Xmlns:        xmlns,
+		Name:         r.bucket,
+		Prefix:       encodeKey(prefix, encoding),
+		Delimiter:    encodeKey(delimiter, encoding),
+		MaxKeys:      maxKeys,
+		EncodingType: encoding,
+		IsTruncated:  l.truncated,
+	}
+	base := r.folder() + `/`
+	for _, f := range l.objects {
+		res.Contents = append(res.Contents, object{
+			Key:          encodeKey(strings.TrimPrefix(filePath(f), base), encoding),
+			LastModified: formatTime(f.ModifiedAt),
+			ETag:         `"` + f.Checksum + `"`,
+			Size:         f.Size,
+			StorageClass: `STANDARD`,
+		})
+	}
+	for _, p := range l.prefixes {
+		res.CommonPrefixes = append(res.CommonPrefixes, commonPrefix{Prefix: encodeKey(p, encoding)})
+	}
+	return res, l, nil
+}
+
+// list returns up to max keys of the bucket that start with prefix and
+// sort after start. Keys with the delimiter after the prefix are rolled
+// up into common prefixes, and of files with one path only the newest
+// counts. A start that is a common prefix skips the keys below it.
+func list(r *request, prefix, delimiter, start string, max int) (l listing, err error) {
+	base := r.folder() + `/`
+
+	var (
+		after     string
+		inclusive bool
+		lastKey   string
+		lastCP    string
+	)
+	if start != `` {
+		after = base + start
+	}
+	if delimiter != `` && strings.HasPrefix(start, prefix) && strings.HasSuffix(start, delimiter) &&
+		strings.Contains(start[len(prefix):], delimiter) {
+		lastCP = start
+		after, inclusive = skip(base, start)
+	}
+
+	for max > 0 {
+		files, err := database.ListObjects(r.Context(), r.u.ID, base+prefix, after, inclusive, listBatch)
+		if err != nil {
+			return listing{}, err
+		}
+
+		skipped := false
+		for _, f := range files {
+			key := strings.TrimPrefix(filePath(f), base)
+			if key == lastKey {
+				continue
+			}
+			lastKey = key
+
+			cp := ``
+			if delimiter != `` {
+				if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+					cp = key[:len(prefix)+i+len(delimiter)]
+				}
+			}
+			if cp != `` && cp == lastCP {
+				continue
+			}
+
+			if len(l.objects)+len(l.prefixes) == max {
+				l.truncated = true
+				return l, nil
+			}
+
+			if cp == `` {
+				l.objects = append(l.objects, f)
+				l.last = key
+				continue
+			}
+
+			l.prefixes = append(l.prefixes, cp)
+			l.last, lastCP = cp, cp
+			if next, ok := skip(base, cp); ok {
+				after, inclusive = next, true
+				skipped = true
+				break
+			}
+		}
+
+		if skipped {
+			continue
+		}
+		if len(files) < listBatch {
+			break
+		}
+		after, inclusive = filePath(files[len(files)-1]), false
+	}
+	return l, nil
+}
+
+// skip returns the first path after every key starting with the common
+// prefix: the prefix with its last byte incremented. It gives up on
+// delimiters that don't end in ASCII, where that wouldn't be UTF-8.
+func skip(base, cp string) (string, bool) {
+	last := cp[len(cp)-1]
+	if last >= 0x7f {
+		return base + cp, false
+	}
+	return base + cp[:len(cp)-1] + string(last+1), true
+}
+
+// checkBucket fails with NoSuchBucket unless the bucket exists.
+func checkBucket(r *request) error {
+	_, err := database.GetFolder(r.Context(), r.u.ID, r.folder())
+	if errors.Is(err, sql.ErrNoRows) {
+		return NoSuchBucket.Wrap(err)
+	}
+	if err != nil {
+		return InternalError.Wrap(err)
+	}
+	return nil
+}
+
+func filePath(f database.File) string {
+	return f.Folder + `/` + f.Name
+}
+
+func encodeKey(key, encoding string) string {
+	if encoding == `url` {
+		return uriEncode(key, false)
+	}
+	return key
+}
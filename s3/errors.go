@@ -0,0 +1,88 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+
+	"server/catcherr"
+)
+
+var (
+	AccessDenied            = catcherr.New(http.StatusForbidden, `AccessDenied`, `Access denied`)
+	InvalidAccessKeyID      = catcherr.New(http.StatusForbidden, `InvalidAccessKeyId`, `The access key id doesn't exist`)
+	SignatureDoesNotMatch   = catcherr.New(http.StatusForbidden, `SignatureDoesNotMatch`, `The request signature doesn't match`)
+	RequestTimeTooSkewed    = catcherr.New(http.StatusForbidden, `RequestTimeTooSkewed`, `The request time is too far from the server time`)
+	ExpiredRequest          = catcherr.New(http.StatusForbidden, `AccessDenied`, `Request has expired`)
+	AuthorizationMalformed  = catcherr.New(http.StatusBadRequest, `AuthorizationHeaderMalformed`, `The authorization is malformed`)
+	InvalidArgument         = catcherr.New(http.StatusBadRequest, `InvalidArgument`, `Invalid argument`)
+	InvalidBucketName       = catcherr.New(http.StatusBadRequest, `InvalidBucketName`, `The bucket name is not valid`)
+	InvalidKey              = catcherr.New(http.StatusBadRequest, `InvalidArgument`, `The key can't be stored as a file path`)
+	MalformedXML            = catcherr.New(http.StatusBadRequest, `MalformedXML`, `The XML is not well-formed`)
+	InvalidDigest           = catcherr.New(http.StatusBadRequest, `InvalidDigest`, `The Content-MD5 is not valid`)
+	BadDigest               = catcherr.New(http.StatusBadRequest, `BadDigest`, `The Content-MD5 doesn't match the content`)
+	ContentSHA256Mismatch   = catcherr.New(http.StatusBadRequest, `XAmzContentSHA256Mismatch`, `The x-amz-content-sha256 doesn't match the content`)
+	IncompleteBody          = catcherr.New(http.StatusBadRequest, `IncompleteBody`, `The body is shorter than the Content-Length`)
+	InvalidChunk            = catcherr.New(http.StatusBadRequest, `InvalidRequest`, `The chunked body is malformed`)
+	InvalidPart             = catcherr.New(http.StatusBadRequest, `InvalidPart`, `A part wasn't uploaded or its ETag doesn't match`)
+	InvalidPartOrder        = catcherr.New(http.StatusBadRequest, `InvalidPartOrder`, `The parts aren't in ascending order`)
+	EntityTooSmall          = catcherr.New(http.StatusBadRequest, `EntityTooSmall`, `A part but the last is smaller than 5 MiB`)
+	NoSuchBucket            = catcherr.New(http.StatusNotFound, `NoSuchBucket`, `The bucket doesn't exist`)
+	NoSuchKey               = catcherr.New(http.StatusNotFound, `NoSuchKey`, `The key doesn't exist`)
+	NoSuchUpload            = catcherr.New(http.StatusNotFound, `NoSuchUpload`, `The upload doesn't exist or has expired`)
+	MethodNotAllowed        = catcherr.New(http.StatusMethodNotAllowed, `MethodNotAllowed`, `The method is not allowed on this resource`)
+	BucketAlreadyOwnedByYou = catcherr.New(http.StatusConflict, `BucketAlreadyOwnedByYou`, `The bucket already exists`)
+	BucketNotEmpty          = catcherr.New(http.StatusConflict, `BucketNotEmpty`, `The bucket is not empty`)
+	InternalError           = catcherr.New(http.StatusInternalServerError, `InternalError`, `Internal server error`)
+	NotImplemented          = catcherr.New(http.StatusNotImplemented, `NotImplemented`, `The operation is not supported`)
+	SlowDown                = catcherr.New(http.StatusServiceUnavailable, `SlowDown`, `Too many failed attempts`)
+	AccountLocked           = catcherr.New(http.StatusTooManyRequests, `AccountLocked`, `The access key is locked after failed attempts`)
+	QuotaExceeded           = catcherr.New(http.StatusInsufficientStorage, `QuotaExceeded`, `Storage quota exceeded`)
+)
+
+// protocol sends errors as the XML documents S3 clients expect rather
+// than the problem documents of the native API.
+var protocol = catcherr.Protocol{Internal: InternalError, Render: writeError, IDHeader: `x-amz-request-id`}
+
+type errorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource"`
+	RequestID string   `xml:"RequestId"`
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, e *catcherr.Error, requestID string) {
+	w.Header().Set(`Content-Type`, `application/xml`)
+	w.WriteHeader(e.Status)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	w.Write([]byte(xml.Header))
+	err := xml.NewEncoder(w).Encode(errorResponse{
+		Code:      e.Code,
+		Message:   e.Message(),
+		Resource:  r.URL.Path,
+		RequestID: requestID,
+	})
+	if err != nil {
+		log.Printf(`[ s3 ]: can't send error to the client: %v`, err)
+	}
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"server/catcherr"
+	"server/database"
+	"server/user"
+)
+
+// maxPartNumber is the highest part number, as on S3.
+const maxPartNumber = 10000
+
+type createMultipartUploadResponse struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type completeMultipartUploadRequest struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResponse struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+func createMultipartUpload(w http.ResponseWriter, r *request) error {
+	if strings.HasSuffix(r.key, `/`) {
+		return InvalidKey
+	}
+
+	upload, err := user.CreateMultipartUpload(r.Context(), r.u, r.path(), contentType(r.Header.Get(`Content-Type`)))
+	if err != nil {
+		return InternalError.Wrap(err)
+	}
+
+	return sendXML(w, http.StatusOK, createMultipartUploadResponse{
+		Xmlns:    xmlns,
+		Bucket:   r.bucket,
+		Key:      r.key,
+		UploadID: upload.ID,
+	})
+}
+
+// uploadPart stores a part. Its ETag is the MD5 of its content, as on S3,
+// which clients send back to complete the upload.
+func uploadPart(w http.ResponseWriter, r *request) error {
+	ctx := r.Context()
+
+	number, err := strconv.Atoi(r.URL.Query().Get(`partNumber`))
+	if err != nil || number < 1 || number > maxPartNumber {
+		return InvalidArgument.Wrap(err)
+	}
+
+	if _, err = getUpload(r); err != nil {
+		return err
+	}
+
+	body, err := contentMD5(r)
+	if err != nil {
+		return err
+	}
+
+	// Parts don't count before the upload completes, but one that
+	// couldn't fit anyway isn't worth keeping.
+	size := contentLength(r)
+	if size >= 0 {
+		if err = user.CheckQuota(ctx, r.u, size); err != nil {
+			return storeError(err)
+		}
+		body = &sizeReader{r: body, want: size}
+	}
+
+	part, err := user.UploadPart(ctx, r.u, r.URL.Query().Get(`uploadId`), number, body)
+	if err != nil {
+		return uploadError(err)
+	}
+
+	w.Header().Set(`ETag`, `"`+part.ETag+`"`)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func completeMultipartUpload(w http.ResponseWriter, r *request) error {
+	upload, err := getUpload(r)
+	if err != nil {
+		return err
+	}
+
+	var req completeMultipartUploadRequest
+	if err = decodeXML(r, &req); err != nil {
+		return err
+	}
+
+	parts := make([]user.CompletedPart, len(req.Parts))
+	for i, p := range req.Parts {
+		parts[i] = user.CompletedPart{Number: p.PartNumber, ETag: p.ETag}
+	}
+
+	f, err := user.CompleteMultipartUpload(r.Context(), r.u, upload.ID, parts)
+	if err != nil {
+		return uploadError(err)
+	}
+
+	return sendXML(w, http.StatusOK, completeMultipartUploadResponse{
+		Xmlns:    xmlns,
+		Location: r.URL.Path,
+		Bucket:   r.bucket,
+		Key:      r.key,
+		ETag:     `"` + f.Checksum + `"`,
+	})
+}
+
+func abortMultipartUpload(w http.ResponseWriter, r *request) error {
+	upload, err := getUpload(r)
+	if err != nil {
+		return err
+	}
+
+	if err = user.AbortMultipartUpload(r.Context(), r.u, upload.ID); err != nil {
+		return uploadError(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// getUpload returns the upload named by the uploadId parameter, which
+// has to be one of the key.
+func getUpload(r *request) (database.MultipartUpload, error) {
+	upload, err := database.GetMultipartUpload(r.Context(), r.u.ID, r.URL.Query().Get(`uploadId`))
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.MultipartUpload{}, NoSuchUpload.Wrap(err)
+	}
+	if err != nil {
+		return database.MultipartUpload{}, InternalError.Wrap(err)
+	}
+
+	if path.Join(upload.Folder, upload.Name) != r.path() {
+		return database.MultipartUpload{}, NoSuchUpload
+	}
+	return upload, nil
+}
+
+// uploadError turns an error of a multipart upload into the error to send.
+func uploadError(err error) error {
+	var e *catcherr.Error
+	switch {
+	case errors.As(err, &e):
+		return err
+	case errors.Is(err, sql.ErrNoRows):
+		return NoSuchUpload.Wrap(err)
+	case errors.Is(err, user.ErrInvalidPart):
+		return InvalidPart.Wrap(err)
+	case errors.Is(err, user.ErrInvalidPartOrder):
+		return InvalidPartOrder.Wrap(err)
+	case errors.Is(err, user.ErrPartTooSmall):
+		return EntityTooSmall.Wrap(err)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return IncompleteBody.Wrap(err)
+	}
+	return storeError(err)
+}
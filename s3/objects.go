@@ -0,0 +1,363 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3
+
+import (
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"server/database"
+	"server/user"
+)
+
+// maxDeleteObjects is how many keys DeleteObjects takes at once, as on S3.
+const maxDeleteObjects = 1000
+
+type copyObjectResponse struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	Xmlns        string   `xml:"xmlns,attr"`
+	LastModified string   `xml:"LastModified"`
+	ETag         string   `xml:"ETag"`
+}
+
+type deleteRequest struct {
+	Quiet   bool `xml:"Quiet"`
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type deletedObject struct {
+	Key string `xml:"Key"`
+}
+
+type deleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type deleteResponse struct {
+	XMLName xml.Name        `xml:"DeleteResult"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Deleted []deletedObject `xml:"Deleted"`
+	Errors  []deleteError   `xml:"Error"`
+}
+
+// putObject stores the body at the key, replacing the files that were
+// there. A key ending with a slash creates the folder instead.
+func putObject(w http.ResponseWriter, r *request) error {
+	ctx := r.Context()
+
+	body, err := contentMD5(r)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(r.key, `/`) {
+		if _, err = io.Copy(io.Discard, body); err != nil {
+			return bodyError(err)
+		}
+		if err = database.EnsureFolder(ctx, r.u.ID, user.CleanFolder(r.path())); err != nil {
+			return InternalError.Wrap(err)
+		}
+		w.Header().Set(`ETag`, `"`+emptySHA256+`"`)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	size := contentLength(r)
+	if size >= 0 {
+		if err = user.CheckQuota(ctx, r.u, size); err != nil {
+			return storeError(err)
+		}
+		body = &sizeReader{r: body, want: size}
+	}
+
+	fw, err := user.CreateFile(r.u, r.path())
+	if errors.Is(err, user.ErrInvalidName) {
+		return InvalidKey.Wrap(err)
+	}
+	if err != nil {
+		return InternalError.Wrap(err)
+	}
+	defer fw.Abort()
+	fw.SetMimeType(contentType(r.Header.Get(`Content-Type`)))
+
+	if _, err = io.Copy(fw, body); err != nil {
+		return bodyError(err)
+	}
+
+	f, err := fw.Commit(ctx)
+	if err != nil {
+		return storeError(err)
+	}
+	if err = user.ReplaceFiles(ctx, f); err != nil {
+		return InternalError.Wrap(err)
+	}
+
+	w.Header().Set(`ETag`, `"`+f.Checksum+`"`)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// copyObject records the content of the source key at the key, which
+// takes no space in the blob store but counts against the quota.
+func copyObject(w http.ResponseWriter, r *request) error {
+	ctx := r.Context()
+
+	source, _, _ := strings.Cut(r.Header.Get(`x-amz-copy-source`), `?`)
+	source, err := url.PathUnescape(strings.TrimPrefix(source, `/`))
+	if err != nil {
+		return InvalidArgument.Wrap(err)
+	}
+	bucket, key, _ := strings.Cut(source, `/`)
+	if !validSegment(bucket) || !validKey(key) || strings.HasSuffix(key, `/`) || strings.HasSuffix(r.key, `/`) {
+		return InvalidArgument
+	}
+
+	src, err := newestFile(ctx, r.u.ID, `/`+bucket+`/`+key)
+	if err != nil {
+		return err
+	}
+
+	if err = user.CheckQuota(ctx, r.u, src.Size); err != nil {
+		return storeError(err)
+	}
+
+	mimeType := src.MimeType
+	if r.Header.Get(`x-amz-metadata-directive`) == `REPLACE` {
+		if t := contentType(r.Header.Get(`Content-Type`)); t != `` {
+			mimeType = t
+		}
+	}
+
+	p := r.path()
+	if err = database.EnsureFolder(ctx, r.u.ID, path.Dir(p)); err != nil {
+		return InternalError.Wrap(err)
+	}
+
+	f, err := user.CopyFile(ctx, r.u.Login, src, path.Dir(p), path.Base(p), mimeType)
+	if errors.Is(err, fs.ErrNotExist) {
+		return NoSuchKey
+	}
+	if errors.Is(err, user.ErrInvalidName) {
+		return InvalidKey.Wrap(err)
+	}
+	if err != nil {
+		return InternalError.Wrap(err)
+	}
+	if err = user.ReplaceFiles(ctx, f); err != nil {
+		return InternalError.Wrap(err)
+	}
+
+	return sendXML(w, http.StatusOK, copyObjectResponse{
+		Xmlns:        xmlns,
+		LastModified: formatTime(f.ModifiedAt),
+		ETag:         `"` + f.Checksum + `"`,
+	})
+}
+
+// getObject sends the newest file at the key. It answers Range and
+// conditional requests; the ETag is the quoted checksum.
+func getObject(w http.ResponseWriter, r *request) error {
+	ctx := r.Context()
+
+	if strings.HasSuffix(r.key, `/`) {
+		folder, err := database.GetFolder(ctx, r.u.ID, user.CleanFolder(r.path()))
+		if errors.Is(err, sql.ErrNoRows) {
+			return NoSuchKey.Wrap(err)
+		}
+		if err != nil {
+			return InternalError.Wrap(err)
+		}
+
+		w.Header().Set(`ETag`, `"`+emptySHA256+`"`)
+		http.ServeContent(w, r.Request, ``, folder.CreatedAt, strings.NewReader(``))
+		return nil
+	}
+
+	f, err := newestFile(ctx, r.u.ID, r.path())
+	if err != nil {
+		return err
+	}
+
+	blob, err := user.OpenFile(f.Checksum)
+	if err != nil {
+		return InternalError.Wrap(err)
+	}
+	defer blob.Close()
+
+	w.Header().Set(`Content-Type`, f.MimeType)
+	w.Header().Set(`ETag`, `"`+f.Checksum+`"`)
+	http.ServeContent(w, r.Request, f.Name, f.ModifiedAt, blob)
+	return nil
+}
+
+// deleteObject succeeds whether or not the key existed, like on S3.
+func deleteObject(w http.ResponseWriter, r *request) error {
+	if err := deleteKey(r.Context(), r.u.ID, r.path()); err != nil {
+		return InternalError.Wrap(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func deleteObjects(w http.ResponseWriter, r *request) error {
+	ctx := r.Context()
+
+	if err := checkBucket(r); err != nil {
+		return err
+	}
+
+	body, err := contentMD5(r)
+	if err != nil {
+		return err
+	}
+	r.body = body
+
+	var req deleteRequest
+	if err = decodeXML(r, &req); err != nil {
+		return err
+	}
+	if len(req.Objects) > maxDeleteObjects {
+		return MalformedXML
+	}
+
+	res := deleteResponse{Xmlns: xmlns}
+	for _, o := range req.Objects {
+		if !validKey(o.Key) {
+			res.Errors = append(res.Errors, deleteError{Key: o.Key, Code: InvalidKey.Code, Message: InvalidKey.Title})
+			continue
+		}
+
+		if err = deleteKey(ctx, r.u.ID, r.folder()+`/`+o.Key); err != nil {
+			return InternalError.Wrap(err)
+		}
+		if !req.Quiet {
+			res.Deleted = append(res.Deleted, deletedObject{Key: o.Key})
+		}
+	}
+	return sendXML(w, http.StatusOK, res)
+}
+
+// deleteKey deletes the files at the path, or the folder if the path
+// ends with a slash and nothing is inside.
+func deleteKey(ctx context.Context, uid int64, p string) error {
+	if strings.HasSuffix(p, `/`) {
+		folder, err := database.GetFolder(ctx, uid, user.CleanFolder(p))
+		if err == nil {
+			err = database.DeleteFolder(ctx, uid, folder.ID)
+		}
+		if errors.Is(err, sql.ErrNoRows) || errors.Is(err, database.ErrNotEmpty) {
+			return nil
+		}
+		return err
+	}
+
+	files, err := database.DeleteFilesAt(ctx, uid, path.Dir(p), path.Base(p), 0)
+	if err != nil {
+		return err
+	}
+	return user.RemoveUnusedFiles(ctx, files)
+}
+
+// newestFile returns the file the key stands for, the newest of the
+// files uploaded side by side with the path.
+func newestFile(ctx context.Context, uid int64, p string) (database.File, error) {
+	files, err := database.GetFilesAt(ctx, uid, path.Dir(p), path.Base(p))
+	if err != nil {
+		return database.File{}, InternalError.Wrap(err)
+	}
+	if len(files) == 0 {
+		return database.File{}, NoSuchKey
+	}
+	return files[0], nil
+}
+
+// contentMD5 returns the body, checked against Content-MD5 if sent.
+func contentMD5(r *request) (io.Reader, error) {
+	v := r.Header.Get(`Content-MD5`)
+	if v == `` {
+		return r.body, nil
+	}
+
+	want, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || len(want) != md5.Size {
+		return nil, InvalidDigest.Wrap(err)
+	}
+	return &digestReader{r: r.body, hash: md5.New(), want: want, mismatch: BadDigest}, nil
+}
+
+// sizeReader fails at the end of the content unless it had the size.
+type sizeReader struct {
+	r    io.Reader
+	n    int64
+	want int64
+}
+
+func (s *sizeReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.n += int64(n)
+	if s.n > s.want || (err == io.EOF && s.n != s.want) {
+		return n, IncompleteBody
+	}
+	return n, err
+}
+
+// contentLength returns the size of the content, or -1 if unknown.
+// Streaming uploads declare it separately from the chunked body.
+func contentLength(r *request) int64 {
+	if v := r.Header.Get(`x-amz-decoded-content-length`); v != `` {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return -1
+		}
+		return n
+	}
+	return r.ContentLength
+}
+
+// contentType returns the media type the client sent, or nothing if it
+// sent none or the generic one, so the type comes from the name.
+func contentType(v string) string {
+	mediaType, params, err := mime.ParseMediaType(v)
+	if err != nil || mediaType == `application/octet-stream` || mediaType == `binary/octet-stream` {
+		return ``
+	}
+	return mime.FormatMediaType(mediaType, params)
+}
+
+// storeError turns a failure to store a file into the error to send.
+func storeError(err error) error {
+	if errors.Is(err, user.ErrQuotaExceeded) {
+		return QuotaExceeded.Wrap(err)
+	}
+	return InternalError.Wrap(err)
+}
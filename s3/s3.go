@@ -0,0 +1,269 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package s3 serves the storage of the users over a subset of the Amazon
+// S3 API at directory.S3, so S3 tools and SDKs can use it. The top level
+// folders of a user are the buckets and the keys are paths below them,
+// kept in the same tables as files uploaded through the native API.
+// Requests are path-style and signed with SigV4 and an access key.
+package s3
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"server/auth"
+	"server/catcherr"
+	"server/database"
+	"server/deadline"
+	"server/directory"
+	"server/throttle"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	xmlns        = `http://s3.amazonaws.com/doc/2006-03-01/`
+	timeFormat   = `2006-01-02T15:04:05.000Z`
+	maxKeyLength = 1024
+
+	// maxXMLSize bounds request documents, enough for 1000 long keys.
+	maxXMLSize = 2 << 20
+)
+
+// request is an authenticated S3 request.
+type request struct {
+	*http.Request
+	u      database.User
+	body   io.Reader
+	bucket string
+	key    string
+}
+
+// folder returns the path of the bucket.
+func (r *request) folder() string { return `/` + r.bucket }
+
+// path returns the file path of the key.
+func (r *request) path() string { return `/` + r.bucket + `/` + r.key }
+
+// Handle mounts the S3 API at directory.S3. It has to come before
+// routes with a prefix that would shadow it.
+func Handle(r *mux.Router) {
+	r.PathPrefix(directory.S3).Handler(deadline.Extend(protocol.Handle(serveS3)))
+}
+
+func serveS3(w http.ResponseWriter, r *http.Request) error {
+	// The prefix alone would match /s3foo as well.
+	if r.URL.Path != directory.S3 && !strings.HasPrefix(r.URL.Path, directory.S3+`/`) {
+		return NoSuchBucket
+	}
+
+	u, body, err := authenticate(w, r)
+	if err != nil {
+		return err
+	}
+	catcherr.SetLogin(r.Context(), u.Login)
+
+	if u.Role == database.RoleReadOnly && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return AccessDenied
+	}
+
+	req := &request{Request: r, u: u, body: body}
+	req.bucket, req.key, _ = strings.Cut(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, directory.S3), `/`), `/`)
+
+	if req.bucket == `` {
+		if r.Method != http.MethodGet {
+			return MethodNotAllowed
+		}
+		return listBuckets(w, req)
+	}
+	if !validSegment(req.bucket) {
+		return InvalidBucketName
+	}
+
+	if req.key == `` {
+		return serveBucket(w, req)
+	}
+	if !validKey(req.key) {
+		return InvalidKey
+	}
+	if err = checkBucket(req); err != nil {
+		return err
+	}
+	return serveObject(w, req)
+}
+
+func serveBucket(w http.ResponseWriter, r *request) error {
+	q := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && q.Has(`location`):
+		return sendXML(w, http.StatusOK, locationResponse{Xmlns: xmlns})
+	case r.Method == http.MethodGet && q.Has(`uploads`):
+		return NotImplemented
+	case r.Method == http.MethodGet && q.Get(`list-type`) == `2`:
+		return listObjectsV2(w, r)
+	case r.Method == http.MethodGet:
+		return listObjectsV1(w, r)
+	case r.Method == http.MethodHead:
+		return headBucket(w, r)
+	case r.Method == http.MethodPut:
+		return createBucket(w, r)
+	case r.Method == http.MethodDelete:
+		return deleteBucket(w, r)
+	case r.Method == http.MethodPost && q.Has(`delete`):
+		return deleteObjects(w, r)
+	}
+	return MethodNotAllowed
+}
+
+func serveObject(w http.ResponseWriter, r *request) error {
+	q := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPut && q.Has(`uploadId`):
+		return uploadPart(w, r)
+	case r.Method == http.MethodPut && r.Header.Get(`x-amz-copy-source`) != ``:
+		return copyObject(w, r)
+	case r.Method == http.MethodPut:
+		return putObject(w, r)
+	case r.Method == http.MethodPost && q.Has(`uploads`):
+		return createMultipartUpload(w, r)
+	case r.Method == http.MethodPost && q.Has(`uploadId`):
+		return completeMultipartUpload(w, r)
+	case r.Method == http.MethodDelete && q.Has(`uploadId`):
+		return abortMultipartUpload(w, r)
+	case r.Method == http.MethodDelete:
+		return deleteObject(w, r)
+	case (r.Method == http.MethodGet || r.Method == http.MethodHead) && q.Has(`uploadId`):
+		return NotImplemented
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return getObject(w, r)
+	}
+	return MethodNotAllowed
+}
+
+// authenticate checks the signature of the request, throttled like logins
+// with the access key id in place of the login, and returns the user and
+// the body, which is checked against the signed payload as it is read.
+func authenticate(w http.ResponseWriter, r *http.Request) (database.User, io.Reader, error) {
+	ctx := r.Context()
+
+	s, err := parseSignature(r, time.Now().UTC())
+	if err != nil {
+		return database.User{}, nil, err
+	}
+
+	ip := auth.ClientIP(r.RemoteAddr)
+	if err = throttle.Check(ctx, s.keyID, ip); err != nil {
+		return database.User{}, nil, auth.ThrottleError(w, err, failures)
+	}
+
+	fail := func(e *catcherr.Error) error {
+		if err := throttle.Failure(ctx, s.keyID, ip); err != nil {
+			return InternalError.Wrap(err)
+		}
+		return e
+	}
+
+	k, u, err := database.UseAccessKey(ctx, s.keyID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.User{}, nil, fail(InvalidAccessKeyID.Wrap(err))
+	}
+	if err != nil {
+		return database.User{}, nil, InternalError.Wrap(err)
+	}
+
+	secret, err := auth.AccessKeySecret(k)
+	if err != nil {
+		return database.User{}, nil, InternalError.Wrap(err)
+	}
+
+	if !s.verify(r, secret) {
+		return database.User{}, nil, fail(SignatureDoesNotMatch)
+	}
+
+	body, err := s.payload(r, secret)
+	if err != nil {
+		return database.User{}, nil, err
+	}
+	return u, body, nil
+}
+
+// failures of signatures are answered in the format of S3.
+var failures = auth.Failures{
+	RateLimited:   SlowDown,
+	AccountLocked: AccountLocked,
+	Internal:      InternalError,
+}
+
+// validSegment tells whether the name can be a folder or file name.
+func validSegment(name string) bool {
+	return name != `` && name != `.` && name != `..` && !strings.Contains(name, `/`)
+}
+
+// validKey tells whether the key maps to a file path and back. A key
+// ending with a slash stands for the folder, as S3 consoles create them.
+func validKey(key string) bool {
+	if len(key) > maxKeyLength {
+		return false
+	}
+	for _, segment := range strings.Split(strings.TrimSuffix(key, `/`), `/`) {
+		if !validSegment(segment) {
+			return false
+		}
+	}
+	return true
+}
+
+func sendXML(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set(`Content-Type`, `application/xml`)
+	w.WriteHeader(status)
+
+	w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		log.Printf(`[ s3 ]: can't send response to the client: %v`, err)
+	}
+	return nil
+}
+
+// decodeXML reads the XML document of the body, which is read whole so
+// the payload is checked before anything is done.
+func decodeXML(r *request, v any) error {
+	b, err := io.ReadAll(io.LimitReader(r.body, maxXMLSize))
+	if err != nil {
+		return bodyError(err)
+	}
+	if err = xml.Unmarshal(b, v); err != nil {
+		return MalformedXML.Wrap(err)
+	}
+	return nil
+}
+
+// bodyError turns a failure to read the body into the error to send.
+func bodyError(err error) error {
+	var e *catcherr.Error
+	if errors.As(err, &e) {
+		return err
+	}
+	return IncompleteBody.Wrap(err)
+}
+
+func formatTime(t time.Time) string { return t.UTC().Format(timeFormat) }
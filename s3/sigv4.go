@@ -0,0 +1,457 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/catcherr"
+)
+
+const (
+	algorithm        = `AWS4-HMAC-SHA256`
+	amzDateFormat    = `20060102T150405Z`
+	scopeDateFormat  = `20060102`
+	scopeTerminator  = `aws4_request`
+	maxClockSkew     = 15 * time.Minute
+	maxPresignExpiry = 7 * 24 * time.Hour
+
+	unsignedPayload          = `UNSIGNED-PAYLOAD`
+	streamingPayload         = `STREAMING-AWS4-HMAC-SHA256-PAYLOAD`
+	streamingUnsignedTrailer = `STREAMING-UNSIGNED-PAYLOAD-TRAILER`
+
+	// maxChunkSize bounds the chunks of streaming uploads, which are
+	// buffered until their signature is checked.
+	maxChunkSize = 16 << 20
+)
+
+// emptySHA256 is the payload hash of requests without a body.
+var emptySHA256 = hex.EncodeToString(sha256.New().Sum(nil))
+
+// signature holds what a request says about how it was signed, from the
+// Authorization header or, for presigned URLs, from the query.
+type signature struct {
+	keyID         string
+	date          string
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	time          time.Time
+	presigned     bool
+	payloadHash   string
+}
+
+func (s signature) scope() string {
+	return strings.Join([]string{s.date, s.region, s.service, scopeTerminator}, `/`)
+}
+
+// parseSignature reads the signature of the request. It returns
+// AccessDenied for anonymous requests, which aren't supported.
+func parseSignature(r *http.Request, now time.Time) (signature, error) {
+	var (
+		s   signature
+		err error
+	)
+	switch {
+	case strings.HasPrefix(r.Header.Get(`Authorization`), algorithm+` `):
+		s, err = parseAuthorization(r)
+	case r.URL.Query().Get(`X-Amz-Algorithm`) != ``:
+		s, err = parsePresigned(r, now)
+	default:
+		return signature{}, AccessDenied
+	}
+	if err != nil {
+		return signature{}, err
+	}
+
+	if s.time.Sub(now) > maxClockSkew || (!s.presigned && now.Sub(s.time) > maxClockSkew) {
+		return signature{}, RequestTimeTooSkewed
+	}
+	if s.date != s.time.Format(scopeDateFormat) || s.service != `s3` {
+		return signature{}, AuthorizationMalformed
+	}
+	// Without host in the signature, it could be replayed against
+	// another server sharing the key.
+	if !containsHeader(s.signedHeaders, `host`) {
+		return signature{}, AuthorizationMalformed.Wrap(errors.New(`host isn't signed`))
+	}
+	return s, nil
+}
+
+func containsHeader(headers []string, name string) bool {
+	for _, h := range headers {
+		if strings.EqualFold(h, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAuthorization reads a header like
+//
+//	AWS4-HMAC-SHA256 Credential=KEY/20230102/us-east-1/s3/aws4_request,
+//	SignedHeaders=host;x-amz-date, Signature=hex
+func parseAuthorization(r *http.Request) (signature, error) {
+	s := signature{payloadHash: r.Header.Get(`X-Amz-Content-Sha256`)}
+	if s.payloadHash == `` {
+		return signature{}, AuthorizationMalformed.Wrap(errors.New(`no x-amz-content-sha256 header`))
+	}
+
+	fields := strings.TrimPrefix(r.Header.Get(`Authorization`), algorithm+` `)
+	for _, field := range strings.Split(fields, `,`) {
+		name, value, _ := strings.Cut(strings.TrimSpace(field), `=`)
+		switch name {
+		case `Credential`:
+			if !s.parseCredential(value) {
+				return signature{}, AuthorizationMalformed
+			}
+		case `SignedHeaders`:
+			s.signedHeaders = strings.Split(value, `;`)
+		case `Signature`:
+			s.signature = value
+		}
+	}
+
+	date := r.Header.Get(`X-Amz-Date`)
+	if date == `` {
+		date = r.Header.Get(`Date`)
+	}
+	t, err := parseTime(date)
+	if err != nil || s.signature == `` || len(s.signedHeaders) == 0 {
+		return signature{}, AuthorizationMalformed
+	}
+	s.time = t
+	return s, nil
+}
+
+// parsePresigned reads the X-Amz-* parameters of a presigned URL and
+// fails with ExpiredRequest once X-Amz-Expires passed.
+func parsePresigned(r *http.Request, now time.Time) (signature, error) {
+	q := r.URL.Query()
+	s := signature{
+		signedHeaders: strings.Split(q.Get(`X-Amz-SignedHeaders`), `;`),
+		signature:     q.Get(`X-Amz-Signature`),
+		presigned:     true,
+		payloadHash:   unsignedPayload,
+	}
+	if h := q.Get(`X-Amz-Content-Sha256`); h != `` {
+		s.payloadHash = h
+	}
+
+	t, err := time.Parse(amzDateFormat, q.Get(`X-Amz-Date`))
+	if err != nil || q.Get(`X-Amz-Algorithm`) != algorithm || !s.parseCredential(q.Get(`X-Amz-Credential`)) || s.signature == `` {
+		return signature{}, AuthorizationMalformed
+	}
+	s.time = t
+
+	seconds, err := strconv.Atoi(q.Get(`X-Amz-Expires`))
+	expires := time.Duration(seconds) * time.Second
+	if err != nil || seconds < 0 || expires > maxPresignExpiry {
+		return signature{}, AuthorizationMalformed
+	}
+	if now.After(t.Add(expires)) {
+		return signature{}, ExpiredRequest
+	}
+	return s, nil
+}
+
+// parseCredential reads KEY/20230102/us-east-1/s3/aws4_request.
+func (s *signature) parseCredential(credential string) bool {
+	parts := strings.Split(credential, `/`)
+	if len(parts) != 5 || parts[4] != scopeTerminator {
+		return false
+	}
+	s.keyID, s.date, s.region, s.service = parts[0], parts[1], parts[2], parts[3]
+	return true
+}
+
+func parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(amzDateFormat, value); err == nil {
+		return t, nil
+	}
+	return http.ParseTime(value)
+}
+
+// verify tells whether the request was signed with the secret.
+func (s signature) verify(r *http.Request, secret string) bool {
+	key := signingKey(secret, s.date, s.region, s.service)
+	want := hmacSHA256(key, s.stringToSign(canonicalRequest(r, s)))
+	return hmac.Equal([]byte(hex.EncodeToString(want)), []byte(s.signature))
+}
+
+func (s signature) stringToSign(canonical string) string {
+	sum := sha256.Sum256([]byte(canonical))
+	return strings.Join([]string{
+		algorithm,
+		s.time.Format(amzDateFormat),
+		s.scope(),
+		hex.EncodeToString(sum[:]),
+	}, "\n")
+}
+
+func canonicalRequest(r *http.Request, s signature) string {
+	headers := make([]string, len(s.signedHeaders))
+	for i, name := range s.signedHeaders {
+		headers[i] = name + `:` + canonicalHeader(r, name)
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		uriEncode(r.URL.Path, false),
+		canonicalQuery(r.URL.RawQuery, s.presigned),
+		strings.Join(headers, "\n") + "\n",
+		strings.Join(s.signedHeaders, `;`),
+		s.payloadHash,
+	}, "\n")
+}
+
+func canonicalHeader(r *http.Request, name string) string {
+	var values []string
+	switch name {
+	case `host`:
+		values = []string{r.Host}
+	case `content-length`:
+		values = []string{strconv.FormatInt(r.ContentLength, 10)}
+	default:
+		values = r.Header.Values(name)
+	}
+
+	for i, v := range values {
+		values[i] = strings.Join(strings.Fields(v), ` `)
+	}
+	return strings.Join(values, `,`)
+}
+
+// canonicalQuery sorts the parameters and encodes them the AWS way.
+// Presigned URLs carry the signature itself, which isn't signed.
+func canonicalQuery(rawQuery string, presigned bool) string {
+	query, _ := url.ParseQuery(rawQuery)
+
+	params := make([]string, 0, len(query))
+	for name, values := range query {
+		if presigned && name == `X-Amz-Signature` {
+			continue
+		}
+		for _, v := range values {
+			params = append(params, uriEncode(name, true)+`=`+uriEncode(v, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, `&`)
+}
+
+// uriEncode percent-encodes everything but unreserved characters and,
+// unless encodeSlash, the slash, as SigV4 does.
+func uriEncode(s string, encodeSlash bool) string {
+	const hexDigits = `0123456789ABCDEF`
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&15])
+		}
+	}
+	return b.String()
+}
+
+func signingKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte(`AWS4`+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, scopeTerminator)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// payload returns the body of the signed request, checked against the
+// payload hash or decoded from the chunks of a streaming upload.
+func (s signature) payload(r *http.Request, secret string) (io.Reader, error) {
+	switch s.payloadHash {
+	case unsignedPayload:
+		return r.Body, nil
+	case streamingPayload:
+		return &chunkReader{
+			r:       bufio.NewReader(r.Body),
+			key:     signingKey(secret, s.date, s.region, s.service),
+			amzDate: s.time.Format(amzDateFormat),
+			scope:   s.scope(),
+			prev:    s.signature,
+		}, nil
+	case streamingUnsignedTrailer:
+		return &chunkReader{r: bufio.NewReader(r.Body), trailer: true}, nil
+	}
+
+	want, err := hex.DecodeString(s.payloadHash)
+	if err != nil || len(want) != sha256.Size {
+		return nil, NotImplemented.Wrap(errors.New(`payload hash ` + s.payloadHash))
+	}
+	return &digestReader{r: r.Body, hash: sha256.New(), want: want, mismatch: ContentSHA256Mismatch}, nil
+}
+
+// digestReader fails at the end of the content if its digest isn't want.
+type digestReader struct {
+	r        io.Reader
+	hash     hash.Hash
+	want     []byte
+	mismatch *catcherr.Error
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(d.hash.Sum(nil), d.want) {
+		return n, d.mismatch
+	}
+	return n, err
+}
+
+// chunkReader decodes an aws-chunked body. Signed chunks carry a
+// signature chained from the one of the request, checked before any of
+// their bytes are returned; unsigned ones end with trailing headers.
+type chunkReader struct {
+	r       *bufio.Reader
+	chunk   []byte
+	rest    []byte
+	done    bool
+	trailer bool
+
+	key     []byte
+	amzDate string
+	scope   string
+	prev    string
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.rest) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, c.rest)
+	c.rest = c.rest[n:]
+	return n, nil
+}
+
+// next reads a chunk: its hex size, the signature if signed, the data
+// and a CRLF. The last chunk is empty.
+func (c *chunkReader) next() error {
+	header, err := c.line()
+	if err != nil {
+		return err
+	}
+
+	sizeHex, ext, _ := strings.Cut(header, `;`)
+	size, err := strconv.ParseInt(strings.TrimSpace(sizeHex), 16, 64)
+	if err != nil || size < 0 || size > maxChunkSize {
+		return InvalidChunk
+	}
+
+	if int64(cap(c.chunk)) < size {
+		c.chunk = make([]byte, size)
+	}
+	c.chunk = c.chunk[:size]
+	if _, err = io.ReadFull(c.r, c.chunk); err != nil {
+		return IncompleteBody.Wrap(err)
+	}
+
+	if c.key != nil {
+		if err = c.verify(strings.TrimPrefix(ext, `chunk-signature=`)); err != nil {
+			return err
+		}
+	}
+
+	if size == 0 {
+		c.done = true
+		return c.end()
+	}
+
+	if crlf, err := c.line(); err != nil || crlf != `` {
+		return InvalidChunk
+	}
+	c.rest = c.chunk
+	return nil
+}
+
+// end reads what follows the last chunk: trailing headers, whose
+// checksums aren't checked, and an empty line.
+func (c *chunkReader) end() error {
+	for {
+		line, err := c.line()
+		if err != nil || line == `` {
+			return err
+		}
+		if !c.trailer {
+			return InvalidChunk
+		}
+	}
+}
+
+func (c *chunkReader) verify(sig string) error {
+	sum := sha256.Sum256(c.chunk)
+	toSign := strings.Join([]string{
+		algorithm + `-PAYLOAD`,
+		c.amzDate,
+		c.scope,
+		c.prev,
+		emptySHA256,
+		hex.EncodeToString(sum[:]),
+	}, "\n")
+
+	want := hex.EncodeToString(hmacSHA256(c.key, toSign))
+	if !hmac.Equal([]byte(want), []byte(sig)) {
+		return SignatureDoesNotMatch
+	}
+	c.prev = sig
+	return nil
+}
+
+func (c *chunkReader) line() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return ``, IncompleteBody.Wrap(err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
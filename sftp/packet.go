@@ -0,0 +1,241 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// Packet types of version 3 of the protocol.
+const (
+	typeInit     = 1
+	typeVersion  = 2
+	typeOpen     = 3
+	typeClose    = 4
+	typeRead     = 5
+	typeWrite    = 6
+	typeLstat    = 7
+	typeFstat    = 8
+	typeSetstat  = 9
+	typeFsetstat = 10
+	typeOpendir  = 11
+	typeReaddir  = 12
+	typeRemove   = 13
+	typeMkdir    = 14
+	typeRmdir    = 15
+	typeRealpath = 16
+	typeStat     = 17
+	typeRename   = 18
+	typeReadlink = 19
+	typeSymlink  = 20
+	typeStatus   = 101
+	typeHandle   = 102
+	typeData     = 103
+	typeName     = 104
+	typeAttrs    = 105
+	typeExtended = 200
+)
+
+// Status codes.
+const (
+	statusOK               = 0
+	statusEOF              = 1
+	statusNoSuchFile       = 2
+	statusPermissionDenied = 3
+	statusFailure          = 4
+	statusBadMessage       = 5
+	statusOpUnsupported    = 8
+)
+
+// Flags of SSH_FXP_OPEN.
+const (
+	flagRead   = 0x01
+	flagWrite  = 0x02
+	flagAppend = 0x04
+	flagCreate = 0x08
+	flagTrunc  = 0x10
+	flagExcl   = 0x20
+)
+
+// Flags of the attributes, which tell the fields that follow.
+const (
+	attrSize        = 0x00000001
+	attrUIDGID      = 0x00000002
+	attrPermissions = 0x00000004
+	attrTimes       = 0x00000008
+	attrExtended    = 0x80000000
+)
+
+const (
+	modeFile   = 0o100000
+	modeFolder = 0o040000
+
+	// maxPacket bounds the packets clients send. Writes of OpenSSH and
+	// most other clients are 32 KiB, a few send up to 256 KiB.
+	maxPacket = 1 << 20
+)
+
+var errShortPacket = errors.New(`packet is shorter than its fields`)
+
+// attrs are the attributes of a file. Clients send them with some
+// requests; they are parsed so the fields after them can be read, but
+// nothing but the size is stored.
+type attrs struct {
+	flags uint32
+	size  uint64
+	mode  uint32
+	mtime time.Time
+}
+
+// decoder reads the fields of a packet. Reading past the end of the
+// packet sets err, so the fields can be read before checking it once.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) byte() byte {
+	if len(d.b) < 1 {
+		d.err = errShortPacket
+		return 0
+	}
+	v := d.b[0]
+	d.b = d.b[1:]
+	return v
+}
+
+func (d *decoder) uint32() uint32 {
+	if len(d.b) < 4 {
+		d.err = errShortPacket
+		d.b = nil
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.b)
+	d.b = d.b[4:]
+	return v
+}
+
+func (d *decoder) uint64() uint64 {
+	if len(d.b) < 8 {
+		d.err = errShortPacket
+		d.b = nil
+		return 0
+	}
+	v := binary.BigEndian.Uint64(d.b)
+	d.b = d.b[8:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uint32()
+	if uint32(len(d.b)) < n {
+		d.err = errShortPacket
+		d.b = nil
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) string() string { return string(d.bytes()) }
+
+func (d *decoder) attrs() attrs {
+	a := attrs{flags: d.uint32()}
+	if a.flags&attrSize != 0 {
+		a.size = d.uint64()
+	}
+	if a.flags&attrUIDGID != 0 {
+		d.uint32()
+		d.uint32()
+	}
+	if a.flags&attrPermissions != 0 {
+		a.mode = d.uint32()
+	}
+	if a.flags&attrTimes != 0 {
+		d.uint32()
+		a.mtime = time.Unix(int64(d.uint32()), 0)
+	}
+	if a.flags&attrExtended != 0 {
+		for n := d.uint32(); n > 0 && d.err == nil; n-- {
+			d.string()
+			d.string()
+		}
+	}
+	return a
+}
+
+// packet is a reply being encoded, starting with its length,
+// which send fills in.
+type packet []byte
+
+func newPacket(typ byte, id uint32) packet {
+	p := packet{0, 0, 0, 0, typ}
+	return p.uint32(id)
+}
+
+func (p packet) uint32(v uint32) packet { return binary.BigEndian.AppendUint32(p, v) }
+func (p packet) uint64(v uint64) packet { return binary.BigEndian.AppendUint64(p, v) }
+
+func (p packet) bytes(v []byte) packet  { return append(p.uint32(uint32(len(v))), v...) }
+func (p packet) string(v string) packet { return append(p.uint32(uint32(len(v))), v...) }
+
+func (p packet) attrs(e entry) packet {
+	mode := uint32(modeFile | 0o644)
+	if e.folder {
+		mode = modeFolder | 0o755
+	}
+	mtime := uint32(e.modTime.Unix())
+	return p.uint32(attrSize | attrPermissions | attrTimes).
+		uint64(uint64(e.size)).
+		uint32(mode).
+		uint32(mtime).
+		uint32(mtime)
+}
+
+func (p packet) send(w io.Writer) error {
+	binary.BigEndian.PutUint32(p, uint32(len(p)-4))
+	_, err := w.Write(p)
+	return err
+}
+
+func statusPacket(id, code uint32, message string) packet {
+	return newPacket(typeStatus, id).uint32(code).string(message).string(`en`)
+}
+
+// readPacket reads the next packet of the client and returns its type
+// and the rest of it.
+func readPacket(r io.Reader) (byte, []byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return 0, nil, err
+	}
+
+	n := binary.BigEndian.Uint32(length[:])
+	if n == 0 || n > maxPacket {
+		return 0, nil, errors.New(`packet is empty or too long`)
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, err
+	}
+	return b[0], b[1:], nil
+}
@@ -0,0 +1,680 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sftp
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/database"
+	"server/user"
+)
+
+const (
+	// maxRead bounds the data of a read reply.
+	maxRead = 256 << 10
+	// readdirBatch is how many entries a READDIR returns at most.
+	readdirBatch = 100
+)
+
+var (
+	errUnsupported = errors.New(`operation is not supported`)
+	errSequential  = errors.New(`files can only be written from start to end`)
+	errIsFolder    = errors.New(`path is a folder`)
+	errNotFolder   = errors.New(`path is not a folder`)
+	errBadHandle   = errors.New(`handle is not valid`)
+	errMoveIntoOwn = errors.New(`folder can't move into itself`)
+)
+
+// entry describes a file or a folder. Folders have no modification
+// time of their own, the creation time stands in for it.
+type entry struct {
+	name    string
+	folder  bool
+	size    int64
+	modTime time.Time
+	file    database.File
+}
+
+// reader is a file opened for reading.
+type reader struct {
+	*os.File
+	entry entry
+}
+
+// writer is a file opened for writing. Its content replaces
+// the files at its path once it is closed.
+type writer struct {
+	*user.FileWriter
+	name string
+}
+
+// lister is a folder opened for listing.
+type lister struct {
+	name    string
+	entries []entry
+	listed  bool
+}
+
+// server answers the requests of one session. The REST API keeps files
+// with the same name side by side, here only the newest is seen and
+// writing a path replaces all of them. Paths are absolute in the tree of
+// the user, relative ones start at the root.
+type server struct {
+	ctx     context.Context
+	u       database.User
+	handles map[string]any
+	next    uint64
+}
+
+// serveSFTP runs the protocol over the channel until the client closes it.
+func serveSFTP(ctx context.Context, u database.User, rw io.ReadWriter) error {
+	s := &server{ctx: ctx, u: u, handles: make(map[string]any)}
+	defer s.closeAll()
+
+	typ, b, err := readPacket(rw)
+	if err != nil {
+		return err
+	}
+	if typ != typeInit {
+		return fmt.Errorf(`packet %d before init`, typ)
+	}
+	d := decoder{b: b}
+	if d.uint32(); d.err != nil {
+		return d.err
+	}
+	if err = newVersionPacket().send(rw); err != nil {
+		return err
+	}
+
+	for {
+		typ, b, err := readPacket(rw)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		d := decoder{b: b}
+		id := d.uint32()
+		if d.err != nil {
+			return d.err
+		}
+
+		reply, err := s.handle(typ, id, &d)
+		if err != nil {
+			reply = s.status(id, err)
+		}
+		if err = reply.send(rw); err != nil {
+			return err
+		}
+	}
+}
+
+func newVersionPacket() packet {
+	return packet{0, 0, 0, 0, typeVersion}.uint32(3)
+}
+
+func (s *server) handle(typ byte, id uint32, d *decoder) (packet, error) {
+	switch typ {
+	case typeOpen:
+		name, flags, _ := d.string(), d.uint32(), d.attrs()
+		return s.check(d, func() (packet, error) { return s.open(id, name, flags) })
+	case typeClose:
+		handle := d.string()
+		return s.check(d, func() (packet, error) { return s.close(id, handle) })
+	case typeRead:
+		handle, offset, length := d.string(), d.uint64(), d.uint32()
+		return s.check(d, func() (packet, error) { return s.read(id, handle, offset, length) })
+	case typeWrite:
+		handle, offset, data := d.string(), d.uint64(), d.bytes()
+		return s.check(d, func() (packet, error) { return s.write(id, handle, offset, data) })
+	case typeLstat, typeStat:
+		name := d.string()
+		return s.check(d, func() (packet, error) { return s.stat(id, name) })
+	case typeFstat:
+		handle := d.string()
+		return s.check(d, func() (packet, error) { return s.fstat(id, handle) })
+	case typeSetstat:
+		name, a := d.string(), d.attrs()
+		return s.check(d, func() (packet, error) { return s.setstat(id, name, a) })
+	case typeFsetstat:
+		handle, a := d.string(), d.attrs()
+		return s.check(d, func() (packet, error) { return s.fsetstat(id, handle, a) })
+	case typeOpendir:
+		name := d.string()
+		return s.check(d, func() (packet, error) { return s.opendir(id, name) })
+	case typeReaddir:
+		handle := d.string()
+		return s.check(d, func() (packet, error) { return s.readdir(id, handle) })
+	case typeRemove:
+		name := d.string()
+		return s.check(d, func() (packet, error) { return s.remove(id, name) })
+	case typeMkdir:
+		name, _ := d.string(), d.attrs()
+		return s.check(d, func() (packet, error) { return s.mkdir(id, name) })
+	case typeRmdir:
+		name := d.string()
+		return s.check(d, func() (packet, error) { return s.rmdir(id, name) })
+	case typeRealpath:
+		name := d.string()
+		return s.check(d, func() (packet, error) { return s.realpath(id, name) })
+	case typeRename:
+		oldName, newName := d.string(), d.string()
+		return s.check(d, func() (packet, error) { return s.rename(id, oldName, newName) })
+	}
+
+	// Links don't exist in the tree and no extensions are offered.
+	return nil, errUnsupported
+}
+
+// check runs f once the fields of the request were read in full.
+func (s *server) check(d *decoder, f func() (packet, error)) (packet, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	return f()
+}
+
+// status turns the error of a request into a status reply.
+func (s *server) status(id uint32, err error) packet {
+	switch {
+	case err == io.EOF:
+		return statusPacket(id, statusEOF, `end of file`)
+	case errors.Is(err, errShortPacket):
+		return statusPacket(id, statusBadMessage, err.Error())
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, sql.ErrNoRows):
+		return statusPacket(id, statusNoSuchFile, `no such file or folder`)
+	case errors.Is(err, os.ErrPermission):
+		return statusPacket(id, statusPermissionDenied, `permission denied`)
+	case errors.Is(err, errUnsupported), errors.Is(err, errSequential):
+		return statusPacket(id, statusOpUnsupported, err.Error())
+	case errors.Is(err, os.ErrExist):
+		return statusPacket(id, statusFailure, `path exists`)
+	case errors.Is(err, errIsFolder), errors.Is(err, errNotFolder), errors.Is(err, errBadHandle),
+		errors.Is(err, errMoveIntoOwn), errors.Is(err, database.ErrNotEmpty), errors.Is(err, user.ErrQuotaExceeded),
+		errors.Is(err, user.ErrInvalidName):
+		return statusPacket(id, statusFailure, err.Error())
+	}
+
+	log.Printf(`[ Sender: sftp.serveSFTP() ]: %s: %v`, s.u.Login, err)
+	return statusPacket(id, statusFailure, `internal error`)
+}
+
+func (s *server) ok(id uint32) (packet, error) {
+	return statusPacket(id, statusOK, `ok`), nil
+}
+
+// writable fails for read only users.
+func (s *server) writable() error {
+	if s.u.Role == database.RoleReadOnly {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+func (s *server) open(id uint32, name string, flags uint32) (packet, error) {
+	name = user.CleanFolder(name)
+	if flags&flagWrite != 0 {
+		return s.create(id, name, flags)
+	}
+
+	e, err := s.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if e.folder {
+		return nil, errIsFolder
+	}
+
+	blob, err := user.OpenFile(e.file.Checksum)
+	if err != nil {
+		return nil, err
+	}
+	return s.newHandle(id, &reader{File: blob, entry: e}), nil
+}
+
+// create opens a file for writing. Files are stored whole, so writing
+// has to start at the beginning and go on from where it stopped.
+func (s *server) create(id uint32, name string, flags uint32) (packet, error) {
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+	if flags&(flagRead|flagAppend) != 0 {
+		return nil, errUnsupported
+	}
+
+	e, err := s.lookup(name)
+	exists := err == nil
+	switch {
+	case err != nil && !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	case exists && e.folder:
+		return nil, errIsFolder
+	case exists && flags&flagExcl != 0:
+		return nil, os.ErrExist
+	case exists && flags&flagTrunc == 0:
+		return nil, errSequential
+	case !exists && flags&flagCreate == 0:
+		return nil, os.ErrNotExist
+	}
+
+	if err = s.requireFolder(path.Dir(name)); err != nil {
+		return nil, err
+	}
+
+	fw, err := user.CreateFile(s.u, name)
+	if err != nil {
+		return nil, err
+	}
+	return s.newHandle(id, &writer{FileWriter: fw, name: name}), nil
+}
+
+func (s *server) close(id uint32, handle string) (packet, error) {
+	h, ok := s.handles[handle]
+	if !ok {
+		return nil, errBadHandle
+	}
+	delete(s.handles, handle)
+
+	switch h := h.(type) {
+	case *reader:
+		h.Close()
+	case *writer:
+		f, err := h.Commit(s.ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err = user.ReplaceFiles(s.ctx, f); err != nil {
+			return nil, err
+		}
+	}
+	return s.ok(id)
+}
+
+func (s *server) read(id uint32, handle string, offset uint64, length uint32) (packet, error) {
+	r, ok := s.handles[handle].(*reader)
+	if !ok {
+		return nil, errBadHandle
+	}
+
+	if length > maxRead {
+		length = maxRead
+	}
+	b := make([]byte, length)
+	n, err := r.ReadAt(b, int64(offset))
+	if n == 0 && err != nil {
+		return nil, err
+	}
+	return newPacket(typeData, id).bytes(b[:n]), nil
+}
+
+func (s *server) write(id uint32, handle string, offset uint64, data []byte) (packet, error) {
+	w, ok := s.handles[handle].(*writer)
+	if !ok {
+		return nil, errBadHandle
+	}
+	if int64(offset) != w.Size() {
+		return nil, errSequential
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	return s.ok(id)
+}
+
+func (s *server) stat(id uint32, name string) (packet, error) {
+	e, err := s.lookup(user.CleanFolder(name))
+	if err != nil {
+		return nil, err
+	}
+	return newPacket(typeAttrs, id).attrs(e), nil
+}
+
+func (s *server) fstat(id uint32, handle string) (packet, error) {
+	var e entry
+	switch h := s.handles[handle].(type) {
+	case *reader:
+		e = h.entry
+	case *writer:
+		e = entry{name: path.Base(h.name), size: h.Size(), modTime: time.Now()}
+	case *lister:
+		return s.stat(id, h.name)
+	default:
+		return nil, errBadHandle
+	}
+	return newPacket(typeAttrs, id).attrs(e), nil
+}
+
+// setstat accepts the permissions and times clients set after uploads,
+// but keeps neither. Only the size of a file can't be changed.
+func (s *server) setstat(id uint32, name string, a attrs) (packet, error) {
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+
+	e, err := s.lookup(user.CleanFolder(name))
+	if err != nil {
+		return nil, err
+	}
+	if a.flags&attrSize != 0 && (e.folder || int64(a.size) != e.size) {
+		return nil, errUnsupported
+	}
+	return s.ok(id)
+}
+
+func (s *server) fsetstat(id uint32, handle string, a attrs) (packet, error) {
+	var size int64
+	switch h := s.handles[handle].(type) {
+	case *reader:
+		size = h.entry.size
+	case *writer:
+		size = h.Size()
+	case *lister:
+		return s.setstat(id, h.name, a)
+	default:
+		return nil, errBadHandle
+	}
+
+	if a.flags&attrSize != 0 && int64(a.size) != size {
+		return nil, errUnsupported
+	}
+	return s.ok(id)
+}
+
+func (s *server) opendir(id uint32, name string) (packet, error) {
+	name = user.CleanFolder(name)
+	if err := s.requireFolder(name); err != nil {
+		return nil, err
+	}
+	return s.newHandle(id, &lister{name: name}), nil
+}
+
+func (s *server) readdir(id uint32, handle string) (packet, error) {
+	l, ok := s.handles[handle].(*lister)
+	if !ok {
+		return nil, errBadHandle
+	}
+
+	if !l.listed {
+		if err := s.list(l); err != nil {
+			return nil, err
+		}
+		l.listed = true
+	}
+	if len(l.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	n := len(l.entries)
+	if n > readdirBatch {
+		n = readdirBatch
+	}
+	p := newPacket(typeName, id).uint32(uint32(n))
+	for _, e := range l.entries[:n] {
+		p = p.string(e.name).string(longName(e, s.u.Login)).attrs(e)
+	}
+	l.entries = l.entries[n:]
+	return p, nil
+}
+
+// list reads the entries of the folder. A file can't be seen under the
+// name of a folder, and of several files with one name only the newest.
+func (s *server) list(l *lister) error {
+	folders, err := database.GetFolders(s.ctx, s.u.ID, l.name)
+	if err != nil {
+		return err
+	}
+
+	files, err := database.GetFilesIn(s.ctx, s.u.ID, l.name)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool, len(folders)+len(files))
+	for _, f := range folders {
+		seen[f.Name] = true
+		l.entries = append(l.entries, entry{name: f.Name, folder: true, modTime: f.CreatedAt})
+	}
+	for _, f := range files {
+		if !seen[f.Name] {
+			seen[f.Name] = true
+			l.entries = append(l.entries, fileEntry(f))
+		}
+	}
+	return nil
+}
+
+func (s *server) remove(id uint32, name string) (packet, error) {
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+
+	name = user.CleanFolder(name)
+	e, err := s.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if e.folder {
+		return nil, errIsFolder
+	}
+
+	files, err := database.DeleteFilesAt(s.ctx, s.u.ID, path.Dir(name), path.Base(name), 0)
+	if err != nil {
+		return nil, err
+	}
+	if err = user.RemoveUnusedFiles(s.ctx, files); err != nil {
+		return nil, err
+	}
+	return s.ok(id)
+}
+
+func (s *server) mkdir(id uint32, name string) (packet, error) {
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+
+	name = user.CleanFolder(name)
+	if err := s.mustNotExist(name); err != nil {
+		return nil, err
+	}
+	if err := s.requireFolder(path.Dir(name)); err != nil {
+		return nil, err
+	}
+
+	if err := database.EnsureFolder(s.ctx, s.u.ID, name); err != nil {
+		return nil, err
+	}
+	return s.ok(id)
+}
+
+func (s *server) rmdir(id uint32, name string) (packet, error) {
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+
+	name = user.CleanFolder(name)
+	if name == `/` {
+		return nil, os.ErrPermission
+	}
+
+	f, err := database.GetFolder(s.ctx, s.u.ID, name)
+	if err != nil {
+		return nil, err
+	}
+	if err = database.DeleteFolder(s.ctx, s.u.ID, f.ID); err != nil {
+		return nil, err
+	}
+	return s.ok(id)
+}
+
+// realpath resolves the path without checking that it exists,
+// which clients rely on to build paths of new files.
+func (s *server) realpath(id uint32, name string) (packet, error) {
+	name = user.CleanFolder(name)
+	return newPacket(typeName, id).uint32(1).string(name).string(name).uint32(0), nil
+}
+
+// rename moves a file or a folder with everything inside. Like rename
+// of version 3 it fails if something is at the new path.
+func (s *server) rename(id uint32, oldName, newName string) (packet, error) {
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+
+	oldName, newName = user.CleanFolder(oldName), user.CleanFolder(newName)
+	if oldName == `/` || newName == `/` {
+		return nil, os.ErrPermission
+	}
+	if strings.HasPrefix(newName, oldName+`/`) {
+		return nil, errMoveIntoOwn
+	}
+
+	e, err := s.lookup(oldName)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.mustNotExist(newName); err != nil {
+		return nil, err
+	}
+	if err = s.requireFolder(path.Dir(newName)); err != nil {
+		return nil, err
+	}
+
+	if e.folder {
+		err = database.MoveTree(s.ctx, s.u.ID, oldName, newName)
+	} else {
+		err = s.moveFiles(oldName, newName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.ok(id)
+}
+
+func (s *server) moveFiles(oldName, newName string) error {
+	files, err := database.GetFilesAt(s.ctx, s.u.ID, path.Dir(oldName), path.Base(oldName))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		_, err = user.MoveFile(s.ctx, s.u.ID, f.ID, path.Dir(newName), path.Base(newName))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookup describes what is at the path, a folder or the newest
+// file, or fails with os.ErrNotExist.
+func (s *server) lookup(name string) (entry, error) {
+	if name == `/` {
+		return entry{name: `/`, folder: true}, nil
+	}
+
+	folder, err := database.GetFolder(s.ctx, s.u.ID, name)
+	if err == nil {
+		return entry{name: folder.Name, folder: true, modTime: folder.CreatedAt}, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return entry{}, err
+	}
+
+	files, err := database.GetFilesAt(s.ctx, s.u.ID, path.Dir(name), path.Base(name))
+	if err != nil {
+		return entry{}, err
+	}
+	if len(files) == 0 {
+		return entry{}, os.ErrNotExist
+	}
+	return fileEntry(files[0]), nil
+}
+
+// requireFolder fails with os.ErrNotExist unless a folder is at the path.
+func (s *server) requireFolder(name string) error {
+	e, err := s.lookup(name)
+	if err != nil {
+		return err
+	}
+	if !e.folder {
+		return errNotFolder
+	}
+	return nil
+}
+
+// mustNotExist fails with os.ErrExist if anything is at the path.
+func (s *server) mustNotExist(name string) error {
+	_, err := s.lookup(name)
+	switch {
+	case err == nil:
+		return os.ErrExist
+	case errors.Is(err, os.ErrNotExist):
+		return nil
+	}
+	return err
+}
+
+func (s *server) newHandle(id uint32, h any) packet {
+	s.next++
+	handle := strconv.FormatUint(s.next, 10)
+	s.handles[handle] = h
+	return newPacket(typeHandle, id).string(handle)
+}
+
+// closeAll releases what the client left open. Unfinished
+// writes are dropped rather than stored.
+func (s *server) closeAll() {
+	for _, h := range s.handles {
+		switch h := h.(type) {
+		case *reader:
+			h.Close()
+		case *writer:
+			h.Abort()
+		}
+	}
+}
+
+func fileEntry(f database.File) entry {
+	return entry{name: f.Name, size: f.Size, modTime: f.ModifiedAt, file: f}
+}
+
+// longName formats the entry like ls -l, which clients show as is.
+func longName(e entry, owner string) string {
+	mode := `-rw-r--r--`
+	if e.folder {
+		mode = `drwxr-xr-x`
+	}
+
+	date := e.modTime.Format(`Jan _2 15:04`)
+	if time.Since(e.modTime) > 182*24*time.Hour || e.modTime.After(time.Now()) {
+		date = e.modTime.Format(`Jan _2  2006`)
+	}
+	return fmt.Sprintf(`%s %3d %-8s %-8s %8d %s %s`, mode, 1, owner, owner, e.size, date, e.name)
+}
@@ -0,0 +1,260 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package sftp serves the files and folders of the users over SFTP, for
+// scripts and partners that only speak it. Users sign in with their
+// password or an SSH key they registered and only see their own tree.
+// The listener runs next to the HTTP server when sftp_host is set.
+package sftp
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"server/auth"
+	"server/config"
+	"server/database"
+	"server/throttle"
+	"server/user"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+// handshakeTimeout bounds the time a client takes to sign in.
+const handshakeTimeout = 30 * time.Second
+
+var errDenied = errors.New(`access denied`)
+
+// Start listens on sftp_host and serves SFTP until ctx is done.
+// It does nothing if sftp_host is empty.
+func Start(ctx context.Context) error {
+	addr := config.String(config.SFTPHost)
+	if addr == `` {
+		return nil
+	}
+
+	signer, err := hostKey(config.String(config.SFTPHostKey))
+	if err != nil {
+		return err
+	}
+
+	cfg := &ssh.ServerConfig{
+		PasswordCallback:  passwordCallback(ctx),
+		PublicKeyCallback: publicKeyCallback(ctx),
+		ServerVersion:     `SSH-2.0-dexcloud`,
+	}
+	cfg.AddHostKey(signer)
+
+	ln, err := net.Listen(`tcp`, addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	go serve(ctx, ln, cfg)
+	return nil
+}
+
+// hostKey reads the host key from the file, generating
+// an Ed25519 key there if the file doesn't exist yet.
+func hostKey(name string) (ssh.Signer, error) {
+	b, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		b, err = generateHostKey(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(b)
+}
+
+func generateHostKey(name string) ([]byte, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	b := pem.EncodeToMemory(&pem.Block{Type: `PRIVATE KEY`, Bytes: der})
+	return b, os.WriteFile(name, b, 0o600)
+}
+
+// passwordCallback checks the account password, throttled like logins.
+func passwordCallback(ctx context.Context) func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+	return func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		login, ip := conn.User(), auth.ClientIP(conn.RemoteAddr().String())
+		if err := throttle.Check(ctx, login, ip); err != nil {
+			return nil, err
+		}
+
+		u, err := user.CheckPassword(ctx, login, string(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) || errors.Is(err, sql.ErrNoRows) {
+			if failureErr := throttle.Failure(ctx, login, ip); failureErr != nil {
+				return nil, failureErr
+			}
+			return nil, errDenied
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if err = throttle.Success(ctx, login); err != nil {
+			return nil, err
+		}
+		return permissions(u), nil
+	}
+}
+
+// publicKeyCallback looks up the key among the SSH keys of the user.
+// Clients offer every key they have, so unknown ones aren't failures.
+func publicKeyCallback(ctx context.Context) func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+	return func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		login, ip := conn.User(), auth.ClientIP(conn.RemoteAddr().String())
+		if err := throttle.Check(ctx, login, ip); err != nil {
+			return nil, err
+		}
+
+		u, err := database.UseSSHKey(ctx, login, ssh.FingerprintSHA256(key))
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errDenied
+		}
+		if err != nil {
+			return nil, err
+		}
+		return permissions(u), nil
+	}
+}
+
+// permissions carry the id of the user to the connection,
+// since the login may change while it is open.
+func permissions(u database.User) *ssh.Permissions {
+	return &ssh.Permissions{Extensions: map[string]string{`uid`: strconv.FormatInt(u.ID, 10)}}
+}
+
+func serve(ctx context.Context, ln net.Listener, cfg *ssh.ServerConfig) {
+	for {
+		c, err := ln.Accept()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf(`[ Sender: sftp.serve() ]: %v`, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go serveConn(ctx, c, cfg)
+	}
+}
+
+func serveConn(ctx context.Context, c net.Conn, cfg *ssh.ServerConfig) {
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	conn, chans, reqs, err := ssh.NewServerConn(c, cfg)
+	if err != nil {
+		// Failed sign ins are the throttle's business.
+		return
+	}
+	defer conn.Close()
+	c.SetDeadline(time.Time{})
+
+	go ssh.DiscardRequests(reqs)
+
+	uid, err := strconv.ParseInt(conn.Permissions.Extensions[`uid`], 10, 64)
+	if err != nil {
+		return
+	}
+
+	for newChan := range chans {
+		if newChan.ChannelType() != `session` {
+			newChan.Reject(ssh.UnknownChannelType, `only sessions are supported`)
+			continue
+		}
+
+		ch, chReqs, err := newChan.Accept()
+		if err != nil {
+			log.Printf(`[ Sender: sftp.serveConn() ]: %v`, err)
+			return
+		}
+		go serveSession(ctx, uid, ch, chReqs)
+	}
+}
+
+// serveSession starts SFTP when the client asks for the subsystem.
+// Shells and commands are refused.
+func serveSession(ctx context.Context, uid int64, ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+
+	started := false
+	for req := range reqs {
+		ok := req.Type == `subsystem` && !started && subsystem(req.Payload) == `sftp`
+		req.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+		started = true
+
+		go func() {
+			defer ch.Close()
+
+			status := uint32(0)
+			if err := runSFTP(ctx, uid, ch); err != nil {
+				log.Printf(`[ Sender: sftp.serveSession() ]: %v`, err)
+				status = 1
+			}
+			ch.SendRequest(`exit-status`, false, ssh.Marshal(struct{ Status uint32 }{status}))
+		}()
+	}
+}
+
+// runSFTP serves the user, who may have been disabled since signing in.
+func runSFTP(ctx context.Context, uid int64, ch ssh.Channel) error {
+	u, err := database.GetUserByID(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if u.Disabled || u.Status != database.StatusActive {
+		return errDenied
+	}
+	return serveSFTP(ctx, u, ch)
+}
+
+// subsystem reads the name of the subsystem request.
+func subsystem(payload []byte) string {
+	var req struct{ Name string }
+	if err := ssh.Unmarshal(payload, &req); err != nil {
+		return ``
+	}
+	return req.Name
+}
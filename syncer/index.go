@@ -0,0 +1,111 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// indexName is the file in the synced directory that remembers
+// the state both sides had after the last pass.
+const indexName = `.dexcloud-sync.json`
+
+// ignored tells whether a local file belongs to the syncer itself,
+// like the index and downloads in progress.
+func ignored(name string) bool {
+	return strings.HasPrefix(name, `.dexcloud`)
+}
+
+// entry is a file as it was on both sides after it was last synced.
+// The size and modification time spare hashing unchanged local files.
+type entry struct {
+	Checksum string    `json:"checksum"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	RemoteID int64     `json:"remote_id"`
+}
+
+// pending is an upload that may be resumed after a restart,
+// as long as the local file still has the checksum.
+type pending struct {
+	UploadID string `json:"upload_id"`
+	Checksum string `json:"checksum"`
+}
+
+type index struct {
+	Remote  string             `json:"remote"`
+	Files   map[string]entry   `json:"files"`
+	Uploads map[string]pending `json:"uploads,omitempty"`
+
+	path string
+}
+
+// loadIndex reads the index of the local directory, or starts an empty one.
+func loadIndex(local, remote string) (*index, error) {
+	idx := &index{Remote: remote, path: filepath.Join(local, indexName)}
+
+	data, err := os.ReadFile(idx.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err = json.Unmarshal(data, idx); err != nil {
+			return nil, fmt.Errorf(`%s: %w`, idx.path, err)
+		}
+	}
+
+	if idx.Remote != remote {
+		return nil, fmt.Errorf(`%w: %s`, ErrOtherRemote, idx.Remote)
+	}
+	if idx.Files == nil {
+		idx.Files = map[string]entry{}
+	}
+	if idx.Uploads == nil {
+		idx.Uploads = map[string]pending{}
+	}
+	return idx, nil
+}
+
+// save replaces the index at once, so a crash leaves the old or the new one.
+func (idx *index) save() error {
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(idx.path), indexName+`-*`)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), idx.path)
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"server/client"
+)
+
+// localFile is a file found in the local directory.
+type localFile struct {
+	checksum string
+	size     int64
+	modTime  time.Time
+}
+
+// scanLocal returns the files of the local directory by their path
+// relative to it. Files that look unchanged since the last pass are not
+// hashed again.
+func (s *Syncer) scanLocal() (map[string]localFile, error) {
+	files := map[string]localFile{}
+	err := filepath.WalkDir(s.local, func(name string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if name != s.local && ignored(d.Name()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(s.local, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		f := localFile{size: info.Size(), modTime: info.ModTime()}
+		if e, ok := s.index.Files[rel]; ok && e.Size == f.size && e.ModTime.Equal(f.modTime) {
+			f.checksum = e.Checksum
+		} else if f.checksum, err = hashFile(name); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		files[rel] = f
+		return nil
+	})
+	return files, err
+}
+
+// hashFile returns the checksum the server gives the content of the file.
+func hashFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return ``, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return ``, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// scanRemote returns the files in and below the remote folder
+// by their path relative to it.
+func (s *Syncer) scanRemote(ctx context.Context) (map[string]client.File, error) {
+	files := map[string]client.File{}
+	err := s.c.EachFile(ctx, client.FileFilter{}, client.ListOptions{Limit: 1000}, func(f client.File) error {
+		rel, ok := s.relative(path.Join(f.Folder, f.Name))
+		if !ok || ignored(f.Name) {
+			return nil
+		}
+
+		// Several files may have the same name, the newest one is synced.
+		if old, ok := files[rel]; ok && old.ID > f.ID {
+			return nil
+		}
+		files[rel] = f
+		return nil
+	})
+	return files, err
+}
+
+// relative returns the remote path relative to the remote folder,
+// and false when it is outside of it.
+func (s *Syncer) relative(p string) (string, bool) {
+	if s.remote == `/` {
+		return strings.TrimPrefix(p, `/`), true
+	}
+	rel := strings.TrimPrefix(p, s.remote+`/`)
+	return rel, rel != p
+}
+
+func (s *Syncer) localPath(rel string) string {
+	return filepath.Join(s.local, filepath.FromSlash(rel))
+}
+
+// unchanged returns errRetry when the local file is no longer as the
+// scan found it, so the pass doesn't overwrite what was just written.
+func (s *Syncer) unchanged(rel string, l localFile, exists bool) error {
+	info, err := os.Lstat(s.localPath(rel))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if exists {
+			return errRetry
+		}
+		return nil
+	case err != nil:
+		return err
+	case !exists || info.Size() != l.size || !info.ModTime().Equal(l.modTime):
+		return errRetry
+	}
+	return nil
+}
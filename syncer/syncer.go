@@ -0,0 +1,423 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package syncer keeps a local directory and a folder on the server in
+// step. Each pass compares both sides with the state they had after the
+// previous pass, which is kept in an index in the local directory, and
+// copies what changed on one side to the other. When a file changed on
+// both sides the server version wins and the local one is kept as a
+// conflict copy next to it.
+package syncer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"server/client"
+)
+
+// Op is what a pass did to a file.
+type Op string
+
+const (
+	Uploaded      Op = `upload`
+	Downloaded    Op = `download`
+	DeletedLocal  Op = `delete_local`
+	DeletedRemote Op = `delete_remote`
+	Conflicted    Op = `conflict`
+)
+
+// Change is a file a pass acted on. Path is relative to the synced
+// folders and Err is set if the action failed; it is retried on the
+// next pass. Watch reports passes that failed with an empty Path.
+type Change struct {
+	Op   Op
+	Path string
+	Err  error
+}
+
+// ErrOtherRemote is returned by New when the local directory
+// is already synced with another remote folder.
+var ErrOtherRemote = errors.New(`syncer: directory is synced with another folder`)
+
+// errRetry leaves a file for the next pass because it changed locally
+// while the pass was working on it.
+var errRetry = errors.New(`syncer: file changed during the pass`)
+
+type Syncer struct {
+	// Report, if set, is called with every change a pass makes.
+	Report func(Change)
+
+	c      *client.Client
+	local  string
+	remote string
+	host   string
+	index  *index
+}
+
+// New returns a syncer of the local directory and the remote folder.
+// The state of earlier passes is read from the directory, so a syncer
+// that was stopped continues where it left off.
+func New(c *client.Client, local, remote string) (*Syncer, error) {
+	local, err := filepath.Abs(local)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(local)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf(`syncer: %s is not a directory`, local)
+	}
+
+	remote = path.Clean(`/` + remote)
+	idx, err := loadIndex(local, remote)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _ := os.Hostname()
+	if host == `` {
+		host = `local`
+	}
+	return &Syncer{c: c, local: local, remote: remote, host: host, index: idx}, nil
+}
+
+// Sync makes one pass. Files that fail don't stop the others;
+// if any did, Sync returns an error after the pass.
+func (s *Syncer) Sync(ctx context.Context) error {
+	remote, err := s.scanRemote(ctx)
+	if err != nil {
+		return err
+	}
+	local, err := s.scanLocal()
+	if err != nil {
+		return err
+	}
+
+	paths := map[string]bool{}
+	for rel := range s.index.Files {
+		paths[rel] = true
+	}
+	for rel := range local {
+		paths[rel] = true
+	}
+	for rel := range remote {
+		paths[rel] = true
+	}
+
+	sorted := make([]string, 0, len(paths))
+	for rel := range paths {
+		sorted = append(sorted, rel)
+	}
+	sort.Strings(sorted)
+
+	failed := 0
+	for _, rel := range sorted {
+		l, hasL := local[rel]
+		r, hasR := remote[rel]
+
+		op, err := s.reconcile(ctx, rel, l, hasL, r, hasR)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, errRetry) || (op == `` && err == nil) {
+			continue
+		}
+
+		if saveErr := s.index.save(); saveErr != nil {
+			return saveErr
+		}
+		if err != nil {
+			failed++
+		}
+		s.report(Change{Op: op, Path: rel, Err: err})
+	}
+
+	// Uploads of files deleted before they were done won't be resumed.
+	for rel, p := range s.index.Uploads {
+		if _, ok := local[rel]; !ok {
+			_ = s.c.CancelUpload(ctx, p.UploadID)
+			delete(s.index.Uploads, rel)
+		}
+	}
+
+	if err = s.index.save(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf(`syncer: %d of %d files failed to sync`, failed, len(sorted))
+	}
+	return nil
+}
+
+func (s *Syncer) report(c Change) {
+	if s.Report != nil {
+		s.Report(c)
+	}
+}
+
+// reconcile compares the local and the remote file with the base the
+// index has, and copies the side that changed over the other one.
+func (s *Syncer) reconcile(ctx context.Context, rel string, l localFile, hasL bool, r client.File, hasR bool) (Op, error) {
+	base, hasBase := s.index.Files[rel]
+	localChanged := hasL != hasBase || hasL && l.checksum != base.Checksum
+	remoteChanged := hasR != hasBase || hasR && r.Checksum != base.Checksum
+
+	switch {
+	case !localChanged && !remoteChanged:
+		if hasBase {
+			// The file may have been touched or replaced by the same content.
+			s.record(rel, l, r)
+		}
+		return ``, nil
+
+	case hasL && hasR && l.checksum == r.Checksum:
+		// Both sides made the same change.
+		s.record(rel, l, r)
+		return ``, nil
+
+	case !hasL && !hasR:
+		delete(s.index.Files, rel)
+		return ``, nil
+
+	case !remoteChanged:
+		if hasL {
+			return Uploaded, s.upload(ctx, rel, l, r, hasR)
+		}
+		return DeletedRemote, s.deleteRemote(ctx, rel, r)
+
+	case !localChanged:
+		if hasR {
+			return Downloaded, s.download(ctx, rel, l, hasL, r)
+		}
+		return DeletedLocal, s.deleteLocal(rel, l)
+
+	// A file changed on one side and deleted on the other comes back.
+	case !hasR:
+		return Uploaded, s.upload(ctx, rel, l, r, false)
+	case !hasL:
+		return Downloaded, s.download(ctx, rel, l, false, r)
+	}
+
+	return Conflicted, s.conflict(ctx, rel, l, r)
+}
+
+// record remembers the file as synced.
+func (s *Syncer) record(rel string, l localFile, r client.File) {
+	s.index.Files[rel] = entry{Checksum: r.Checksum, Size: l.size, ModTime: l.modTime, RemoteID: r.ID}
+}
+
+// upload sends the local file to the server, where it replaces old if
+// replace is set. The new file is stored before the old one is deleted.
+func (s *Syncer) upload(ctx context.Context, rel string, l localFile, old client.File, replace bool) error {
+	f, err := os.Open(s.localPath(rel))
+	if errors.Is(err, fs.ErrNotExist) {
+		return errRetry
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	file, err := s.send(ctx, rel, f, l)
+	if err != nil {
+		return err
+	}
+
+	// Should the file have changed during the upload the server has
+	// another checksum than the scan, and the next pass uploads it again.
+	s.record(rel, l, file)
+	if replace && old.ID != file.ID {
+		return s.removeRemote(ctx, old.ID)
+	}
+	return nil
+}
+
+// send uploads the file, resuming the upload of an earlier pass
+// if the file didn't change since.
+func (s *Syncer) send(ctx context.Context, rel string, f *os.File, l localFile) (client.File, error) {
+	if p, ok := s.index.Uploads[rel]; ok {
+		if p.Checksum == l.checksum {
+			file, err := s.c.ResumeUpload(ctx, p.UploadID, f)
+			if client.ErrorCode(err) != client.CodeNotFound {
+				if err == nil {
+					delete(s.index.Uploads, rel)
+				}
+				return file, err
+			}
+		} else {
+			// Expired uploads are gone anyway.
+			_ = s.c.CancelUpload(ctx, p.UploadID)
+		}
+		delete(s.index.Uploads, rel)
+	}
+
+	u, err := s.c.CreateUpload(ctx, l.size, client.UploadOptions{
+		Folder: path.Join(s.remote, path.Dir(rel)),
+		Name:   path.Base(rel),
+	})
+	if err != nil {
+		return client.File{}, err
+	}
+
+	s.index.Uploads[rel] = pending{UploadID: u.ID, Checksum: l.checksum}
+	if err = s.index.save(); err != nil {
+		return client.File{}, err
+	}
+
+	file, err := s.c.ResumeUpload(ctx, u.ID, f)
+	if err != nil {
+		return client.File{}, err
+	}
+	delete(s.index.Uploads, rel)
+	return file, nil
+}
+
+// download replaces the local file, which the scan found as l,
+// with the remote file.
+func (s *Syncer) download(ctx context.Context, rel string, l localFile, exists bool, r client.File) error {
+	name := s.localPath(rel)
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), `.dexcloud-*.part`)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	if _, err = s.c.Download(ctx, r.ID, io.MultiWriter(tmp, h)); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != r.Checksum {
+		// Replaced on the server during the download.
+		return errRetry
+	}
+
+	if err = s.unchanged(rel, l, exists); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), name); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	s.record(rel, localFile{checksum: r.Checksum, size: info.Size(), modTime: info.ModTime()}, r)
+	return nil
+}
+
+func (s *Syncer) deleteLocal(rel string, l localFile) error {
+	if err := s.unchanged(rel, l, true); err != nil {
+		return err
+	}
+
+	name := s.localPath(rel)
+	if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	delete(s.index.Files, rel)
+
+	// Remove the directories the file leaves empty.
+	for dir := filepath.Dir(name); dir != s.local; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *Syncer) deleteRemote(ctx context.Context, rel string, r client.File) error {
+	if err := s.removeRemote(ctx, r.ID); err != nil {
+		return err
+	}
+	delete(s.index.Files, rel)
+
+	if p, ok := s.index.Uploads[rel]; ok {
+		_ = s.c.CancelUpload(ctx, p.UploadID)
+		delete(s.index.Uploads, rel)
+	}
+	return nil
+}
+
+// removeRemote deletes the remote file, which may be gone already.
+func (s *Syncer) removeRemote(ctx context.Context, id int64) error {
+	err := s.c.DeleteFile(ctx, id)
+	if client.ErrorCode(err) == client.CodeNotFound {
+		return nil
+	}
+	return err
+}
+
+// conflict keeps both versions of a file that changed on both sides:
+// the local one is renamed to a conflict copy and uploaded, and the
+// remote one is downloaded in its place.
+func (s *Syncer) conflict(ctx context.Context, rel string, l localFile, r client.File) error {
+	if err := s.unchanged(rel, l, true); err != nil {
+		return err
+	}
+
+	copyRel := s.conflictName(rel)
+	if err := os.Rename(s.localPath(rel), s.localPath(copyRel)); err != nil {
+		return err
+	}
+
+	// Should the upload fail, the next pass finds the copy as a new file.
+	if err := s.upload(ctx, copyRel, l, client.File{}, false); err != nil {
+		return err
+	}
+	return s.download(ctx, rel, localFile{}, false, r)
+}
+
+// conflictName returns a free name like "notes (conflict 2022-07-01
+// 150405 laptop).txt" for the local version of a conflicting file.
+func (s *Syncer) conflictName(rel string) string {
+	ext := path.Ext(rel)
+	base := strings.TrimSuffix(rel, ext)
+	stamp := time.Now().Format(`2006-01-02 150405`)
+
+	for i := 1; ; i++ {
+		name := fmt.Sprintf(`%s (conflict %s %s)%s`, base, stamp, s.host, ext)
+		if i > 1 {
+			name = fmt.Sprintf(`%s (conflict %s %s %d)%s`, base, stamp, s.host, i, ext)
+		}
+		if _, err := os.Lstat(s.localPath(name)); errors.Is(err, fs.ErrNotExist) {
+			return name
+		}
+	}
+}
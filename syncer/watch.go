@@ -0,0 +1,122 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package syncer
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// settleDelay is how long the local directory has to be quiet before a
+// pass starts. Programs often write a file in several steps.
+const settleDelay = 2 * time.Second
+
+// Watch makes a pass, and another one whenever something changes in the
+// local directory and every interval to pick up changes on the server.
+// Failed passes are reported and don't stop it; it returns when ctx is done.
+func (s *Syncer) Watch(ctx context.Context, interval time.Duration) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if err = watchDirs(w, s.local); err != nil {
+		return err
+	}
+
+	var poll <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	next := time.NewTimer(0)
+	defer next.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case ev, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if ignored(filepath.Base(ev.Name)) {
+				continue
+			}
+			if ev.Op&fsnotify.Create != 0 {
+				// New directories are watched too, with what was moved in.
+				if info, err := os.Lstat(ev.Name); err == nil && info.IsDir() {
+					_ = watchDirs(w, ev.Name)
+				}
+			}
+			reset(next, settleDelay)
+
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			// Events may have been lost, a pass finds what they were about.
+			s.report(Change{Err: err})
+			reset(next, settleDelay)
+
+		case <-poll:
+			reset(next, 0)
+
+		case <-next.C:
+			if err := s.Sync(ctx); err != nil && ctx.Err() == nil {
+				s.report(Change{Err: err})
+			}
+		}
+	}
+}
+
+// watchDirs adds root and the directories below it to the watcher.
+func watchDirs(w *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		if name != root && ignored(d.Name()) {
+			return filepath.SkipDir
+		}
+		return w.Add(name)
+	})
+}
+
+// reset restarts the timer, dropping a tick it may have pending.
+func reset(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
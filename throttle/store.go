@@ -0,0 +1,128 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package throttle
+
+import (
+	"context"
+	"server/database"
+	"sync"
+	"time"
+)
+
+// Store keeps failed attempt counters. Fail must be atomic,
+// since concurrent logins for the same key are expected.
+type Store interface {
+	Get(ctx context.Context, key string) (database.LoginAttempt, error)
+	Fail(ctx context.Context, key string, now, since time.Time) (database.LoginAttempt, error)
+	Lock(ctx context.Context, key string, until time.Time) error
+	Reset(ctx context.Context, key string) error
+}
+
+// MemoryStore keeps counters in the process memory.
+// They are lost on restart and not shared between instances.
+type MemoryStore struct {
+	mu        sync.Mutex
+	attempts  map[string]database.LoginAttempt
+	lastPrune time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{attempts: map[string]database.LoginAttempt{}}
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) (database.LoginAttempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.attempts[key]
+	if !ok {
+		a.Key = key
+	}
+	return a, nil
+}
+
+func (s *MemoryStore) Fail(ctx context.Context, key string, now, since time.Time) (database.LoginAttempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune(now, since)
+
+	a := s.attempts[key]
+	if a.LastFailure.Before(since) {
+		a.Failures = 0
+	}
+	a.Key = key
+	a.Failures++
+	a.LastFailure = now
+	s.attempts[key] = a
+	return a, nil
+}
+
+func (s *MemoryStore) Lock(ctx context.Context, key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if a, ok := s.attempts[key]; ok {
+		a.LockedUntil = until
+		s.attempts[key] = a
+	}
+	return nil
+}
+
+func (s *MemoryStore) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.attempts, key)
+	return nil
+}
+
+// prune forgets counters whose last failure happened before since
+// and that are not locked anymore, so the map doesn't grow forever.
+// It walks the whole map, so it runs at most once a minute.
+func (s *MemoryStore) prune(now, since time.Time) {
+	if now.Sub(s.lastPrune) < time.Minute {
+		return
+	}
+	s.lastPrune = now
+
+	for key, a := range s.attempts {
+		if a.LastFailure.Before(since) && a.LockedUntil.Before(since) {
+			delete(s.attempts, key)
+		}
+	}
+}
+
+// DatabaseStore keeps counters in the login_attempts table,
+// so they survive restarts and are shared between instances.
+type DatabaseStore struct{}
+
+func (DatabaseStore) Get(ctx context.Context, key string) (database.LoginAttempt, error) {
+	return database.GetLoginAttempt(ctx, key)
+}
+
+func (DatabaseStore) Fail(ctx context.Context, key string, now, since time.Time) (database.LoginAttempt, error) {
+	return database.FailLogin(ctx, key, now, since)
+}
+
+func (DatabaseStore) Lock(ctx context.Context, key string, until time.Time) error {
+	return database.LockLogin(ctx, key, until)
+}
+
+func (DatabaseStore) Reset(ctx context.Context, key string) error {
+	return database.ResetLoginAttempts(ctx, key)
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"server/audit"
+	"server/config"
+	"server/database"
+	"strings"
+	"time"
+)
+
+// Error is returned when the login has to wait before the next attempt.
+type Error struct {
+	RetryAfter time.Duration
+	Locked     bool
+}
+
+func (e *Error) Error() string {
+	if e.Locked {
+		return fmt.Sprintf(`account is locked, retry after %v`, e.RetryAfter)
+	}
+	return fmt.Sprintf(`too many failed attempts, retry after %v`, e.RetryAfter)
+}
+
+// Seconds returns RetryAfter rounded up, as used by the Retry-After header.
+func (e *Error) Seconds() int {
+	return int(math.Ceil(e.RetryAfter.Seconds()))
+}
+
+var store Store
+
+// Init selects the counter store from config.yml.
+func Init() error {
+	switch kind := config.String(config.ThrottleStore); kind {
+	case `memory`:
+		store = NewMemoryStore()
+	case `database`:
+		store = DatabaseStore{}
+	default:
+		return fmt.Errorf(`unknown throttle store %q`, kind)
+	}
+	return nil
+}
+
+// SetStore replaces the counter store.
+func SetStore(s Store) { store = s }
+
+type counter struct {
+	key         string
+	maxFailures int
+}
+
+func counters(login, ip string) []counter {
+	return []counter{
+		{key: loginKey(login), maxFailures: config.Int(config.ThrottleMaxFailures)},
+		{key: ipKey(ip), maxFailures: config.Int(config.ThrottleIPMaxFailures)},
+	}
+}
+
+func loginKey(login string) string { return `login:` + strings.ToLower(login) }
+func ipKey(ip string) string       { return `ip:` + ip }
+
+// Check returns an *Error if either the login or the address
+// has to wait before trying again.
+func Check(ctx context.Context, login, ip string) error {
+	now := time.Now()
+	var wait *Error
+	for _, c := range counters(login, ip) {
+		a, err := store.Get(ctx, c.key)
+		if err != nil {
+			return err
+		}
+
+		e := delay(a, now)
+		if e != nil && (wait == nil || e.RetryAfter > wait.RetryAfter) {
+			wait = e
+		}
+	}
+
+	if wait != nil {
+		return wait
+	}
+	return nil
+}
+
+// Failure counts a failed attempt for the login and the address,
+// locking whichever of them reached its limit. Once over the limit,
+// every further failure locks again until the counter is reset.
+func Failure(ctx context.Context, login, ip string) error {
+	var (
+		now     = time.Now()
+		since   = now.Add(-config.Duration(config.ThrottleResetAfter))
+		lockout = config.Duration(config.ThrottleLockout)
+	)
+
+	for _, c := range counters(login, ip) {
+		a, err := store.Fail(ctx, c.key, now, since)
+		if err != nil {
+			return err
+		}
+
+		if a.Failures < c.maxFailures {
+			continue
+		}
+
+		if err = store.Lock(ctx, c.key, now.Add(lockout)); err != nil {
+			return err
+		}
+
+		audit.Record(ctx, database.AuditEvent{
+			Type:    audit.LoginLockout,
+			Login:   login,
+			IP:      ip,
+			Details: fmt.Sprintf(`%s locked for %v after %d failures`, c.key, lockout, a.Failures),
+		})
+	}
+	return nil
+}
+
+// Success forgets the failures of the login. The address counter is kept,
+// so one valid account can't be used to reset it.
+func Success(ctx context.Context, login string) error {
+	return store.Reset(ctx, loginKey(login))
+}
+
+// Unlock clears the counters of the login and, if given, of the address.
+func Unlock(ctx context.Context, login, ip, admin string) error {
+	if err := store.Reset(ctx, loginKey(login)); err != nil {
+		return err
+	}
+
+	if ip != `` {
+		if err := store.Reset(ctx, ipKey(ip)); err != nil {
+			return err
+		}
+	}
+
+	audit.Record(ctx, database.AuditEvent{
+		Type:    audit.LoginUnlock,
+		Login:   login,
+		IP:      ip,
+		Details: fmt.Sprintf(`unlocked by %s`, admin),
+	})
+	return nil
+}
+
+// delay returns how long the counter still has to wait, if at all.
+// The wait doubles with every failure, starting at the backoff base.
+func delay(a database.LoginAttempt, now time.Time) *Error {
+	if now.Before(a.LockedUntil) {
+		return &Error{RetryAfter: a.LockedUntil.Sub(now), Locked: true}
+	}
+
+	if a.Failures == 0 || a.LastFailure.Before(now.Add(-config.Duration(config.ThrottleResetAfter))) {
+		return nil
+	}
+
+	var (
+		base    = config.Duration(config.ThrottleBackoffBase)
+		max     = config.Duration(config.ThrottleBackoffMax)
+		backoff = max
+	)
+	if a.Failures < 32 {
+		backoff = base << (a.Failures - 1)
+	}
+	if backoff > max || backoff <= 0 {
+		backoff = max
+	}
+
+	next := a.LastFailure.Add(backoff)
+	if now.Before(next) {
+		return &Error{RetryAfter: next.Sub(now)}
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package user
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/database"
+	"server/media"
+)
+
+// Archive formats, by the extension of the download.
+const (
+	ArchiveZip   = `zip`
+	ArchiveTarGz = `tar.gz`
+)
+
+// ArchiveTypes maps the archive formats to their media types.
+var ArchiveTypes = map[string]string{
+	ArchiveZip:   `application/zip`,
+	ArchiveTarGz: `application/gzip`,
+}
+
+// Archive is a set of files and folders to be downloaded at once.
+// Nothing is staged, the content is read from the blob store while
+// the archive is written. StripGPS leaves out the location of photos and
+// videos, and the files whose type would keep it.
+type Archive struct {
+	Name     string
+	Entries  []ArchiveEntry
+	StripGPS bool
+	paths    map[string]bool
+}
+
+// ArchiveEntry is a file or, without File, a folder at the slash
+// separated path relative to the root of the archive.
+type ArchiveEntry struct {
+	Path       string
+	File       *database.File
+	ModifiedAt time.Time
+}
+
+// FolderArchive returns the folder of the user at the path with everything
+// inside, kept in a folder of its name. The root has no name, its content
+// is at the top of the archive.
+func FolderArchive(ctx context.Context, uid int64, folderPath string) (Archive, error) {
+	folderPath = CleanFolder(folderPath)
+	a := Archive{Name: `files`}
+
+	root := `/`
+	if folderPath != `/` {
+		f, err := database.GetFolder(ctx, uid, folderPath)
+		if err != nil {
+			return Archive{}, err
+		}
+		a.Name, root = f.Name, f.Parent
+
+		a.add(root, f.Path, nil, f.CreatedAt)
+	}
+
+	folders, err := database.GetFoldersBelow(ctx, uid, folderPath)
+	if err != nil {
+		return Archive{}, err
+	}
+	for _, f := range folders {
+		a.add(root, f.Path, nil, f.CreatedAt)
+	}
+
+	files, err := database.GetFilesBelow(ctx, uid, folderPath)
+	if err != nil {
+		return Archive{}, err
+	}
+	for i := range files {
+		f := &files[i]
+		a.add(root, path.Join(f.Folder, f.Name), f, f.ModifiedAt)
+	}
+	return a, nil
+}
+
+// SelectionArchive returns the files of the user with the ids, relative to
+// the deepest folder they are all in. It fails with sql.ErrNoRows if one
+// of them doesn't exist.
+func SelectionArchive(ctx context.Context, uid int64, ids []int64) (Archive, error) {
+	files, err := database.GetFilesByID(ctx, uid, ids)
+	if err != nil {
+		return Archive{}, err
+	}
+	if len(files) == 0 || len(files) != len(unique(ids)) {
+		return Archive{}, sql.ErrNoRows
+	}
+
+	root := files[0].Folder
+	for _, f := range files {
+		for root != `/` && f.Folder != root && !strings.HasPrefix(f.Folder, root+`/`) {
+			root = path.Dir(root)
+		}
+	}
+
+	a := Archive{Name: `files`}
+	for i := range files {
+		f := &files[i]
+		a.add(root, path.Join(f.Folder, f.Name), f, f.ModifiedAt)
+	}
+	return a, nil
+}
+
+// add appends the entry at the absolute path p, relative to root. Files
+// with the same name are numbered after the first one, which is the newest.
+func (a *Archive) add(root, p string, f *database.File, modified time.Time) {
+	name := strings.TrimPrefix(strings.TrimPrefix(p, root), `/`)
+	if f != nil {
+		ext := path.Ext(f.Name)
+		base := strings.TrimSuffix(name, ext)
+		for n := 2; a.paths[name]; n++ {
+			name = base + ` (` + strconv.Itoa(n) + `)` + ext
+		}
+	}
+
+	if a.paths == nil {
+		a.paths = make(map[string]bool)
+	}
+	a.paths[name] = true
+	a.Entries = append(a.Entries, ArchiveEntry{Path: name, File: f, ModifiedAt: modified})
+}
+
+// Write streams the archive in the format to w.
+func (a Archive) Write(w io.Writer, format string) error {
+	if format == ArchiveTarGz {
+		return a.writeTarGz(w)
+	}
+	return a.writeZip(w)
+}
+
+// writeZip switches to ZIP64 by itself once the archive or
+// one of the files outgrows the 4 GiB of plain ZIP.
+func (a Archive) writeZip(w io.Writer) error {
+	zw := zip.NewWriter(w)
+	for _, e := range a.Entries {
+		if a.skip(e) {
+			continue
+		}
+		h := &zip.FileHeader{
+			Name:     e.Path,
+			Modified: e.ModifiedAt,
+			Method:   zip.Store,
+		}
+		if e.File == nil {
+			h.Name += `/`
+			h.SetMode(0o755 | fs.ModeDir)
+		} else {
+			h.SetMode(0o644)
+			if !compressed(e.File.MimeType) {
+				h.Method = zip.Deflate
+			}
+		}
+
+		fw, err := zw.CreateHeader(h)
+		if err != nil {
+			return err
+		}
+		if e.File != nil {
+			if err := a.copyFile(fw, *e.File); err != nil {
+				return err
+			}
+		}
+	}
+	return zw.Close()
+}
+
+func (a Archive) writeTarGz(w io.Writer) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, e := range a.Entries {
+		if a.skip(e) {
+			continue
+		}
+		h := &tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     e.Path + `/`,
+			Mode:     0o755,
+			ModTime:  e.ModifiedAt,
+		}
+		if e.File == nil {
+			if err := tw.WriteHeader(h); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Without the location a photo is smaller than its file.
+		c, err := OpenContent(*e.File, a.StripGPS)
+		if err != nil {
+			return err
+		}
+		h.Typeflag, h.Name, h.Mode, h.Size = tar.TypeReg, e.Path, 0o644, c.Size()
+		if err = tw.WriteHeader(h); err == nil {
+			_, err = io.Copy(tw, c)
+		}
+		c.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// skip tells whether the entry is left out of the archive.
+func (a Archive) skip(e ArchiveEntry) bool {
+	return a.StripGPS && e.File != nil && media.KeepsLocation(e.File.MimeType)
+}
+
+func (a Archive) copyFile(w io.Writer, f database.File) error {
+	c, err := OpenContent(f, a.StripGPS)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	_, err = io.Copy(w, c)
+	return err
+}
+
+// compressed tells whether content of the type is compressed already,
+// so deflating it again would only cost time.
+func compressed(mimeType string) bool {
+	switch {
+	case strings.HasPrefix(mimeType, `video/`), strings.HasPrefix(mimeType, `audio/`):
+		return true
+	case strings.HasPrefix(mimeType, `image/`):
+		return mimeType != `image/svg+xml` && mimeType != `image/bmp`
+	}
+	switch mimeType {
+	case `application/zip`, `application/gzip`, `application/x-gzip`, `application/x-7z-compressed`,
+		`application/x-bzip2`, `application/x-xz`, `application/zstd`, `application/vnd.rar`:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package user
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"io/fs"
+	"os"
+	"server/database"
+	"sync"
+)
+
+// stripes is a fixed set of mutexes picked by the hash of a key. Keys
+// that share a stripe wait for each other, but the set never grows.
+type stripes [256]sync.Mutex
+
+func (s *stripes) lock(key string) (unlock func()) {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	mu := &s[h.Sum32()%uint32(len(s))]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// blobLocks serializes storing and removing the blob of a checksum.
+// Writers rename the blob into place before they record the file, so
+// without it the collection could remove a blob between an upload of the
+// same content renaming it and recording the file that refers to it.
+var blobLocks stripes
+
+// storeBlob moves the file at src into the blob store under the checksum
+// and calls record to save what refers to it, both under the lock.
+func storeBlob(src, checksum string, record func() error) error {
+	unlock := blobLocks.lock(checksum)
+	defer unlock()
+
+	if err := os.Rename(src, blobPath(checksum)); err != nil {
+		return err
+	}
+	return record()
+}
+
+// referBlob calls record to save another reference to the blob with the
+// checksum. It fails with fs.ErrNotExist if the blob was removed since
+// the reference it is copied from was read.
+func referBlob(checksum string, record func() error) error {
+	unlock := blobLocks.lock(checksum)
+	defer unlock()
+
+	if _, err := os.Stat(blobPath(checksum)); err != nil {
+		return err
+	}
+	return record()
+}
+
+// RemoveUnusedFile deletes the blob unless another file record still uses it.
+func RemoveUnusedFile(ctx context.Context, checksum string) error {
+	return removeUnusedBlob(ctx, checksum, func() (bool, error) {
+		return database.ChecksumInUse(ctx, checksum)
+	})
+}
+
+func removeUnusedBlob(ctx context.Context, checksum string, inUse func() (bool, error)) error {
+	unlock := blobLocks.lock(checksum)
+	defer unlock()
+
+	used, err := inUse()
+	if err != nil || used {
+		return err
+	}
+
+	err = RemoveFile(ctx, checksum)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// RemoveUnusedFiles deletes the blobs of the removed files
+// no other file record uses.
+func RemoveUnusedFiles(ctx context.Context, files []database.File) error {
+	for _, f := range files {
+		if err := RemoveUnusedFile(ctx, f.Checksum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package user
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"server/directory"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chdir runs the test in a folder of its own, since the user data
+// folders are relative to the working directory.
+func chdir(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	if err = directory.Init(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// An upload of content whose blob is being collected must either find
+// the blob gone and store it anew, or keep the collection from removing
+// it. A record pointing at a missing blob is what the lock prevents.
+func TestStoreBlobWhileCollecting(t *testing.T) {
+	chdir(t)
+	ctx := context.Background()
+	const checksum = `5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03`
+
+	for i := 0; i < 100; i++ {
+		src := filepath.Join(directory.UserData(), `upload-`+strconv.Itoa(i))
+		if err := os.WriteFile(src, []byte("hello\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			mu       sync.Mutex
+			recorded bool
+			wg       sync.WaitGroup
+			errs     [2]error
+		)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs[0] = storeBlob(src, checksum, func() error {
+				mu.Lock()
+				recorded = true
+				mu.Unlock()
+				return nil
+			})
+		}()
+		go func() {
+			defer wg.Done()
+			errs[1] = removeUnusedBlob(ctx, checksum, func() (bool, error) {
+				mu.Lock()
+				used := recorded
+				mu.Unlock()
+				// Leave the upload time to slip in before the removal.
+				time.Sleep(time.Millisecond)
+				return used, nil
+			})
+		}()
+		wg.Wait()
+
+		for _, err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := os.Stat(blobPath(checksum)); errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf(`round %d: the file was recorded but its blob removed`, i)
+		}
+		if err := os.Remove(blobPath(checksum)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReferRemovedBlob(t *testing.T) {
+	chdir(t)
+	ctx := context.Background()
+	const checksum = `5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03`
+
+	if err := os.WriteFile(blobPath(checksum), []byte("hello\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	err := removeUnusedBlob(ctx, checksum, func() (bool, error) { return false, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	called := false
+	err = referBlob(checksum, func() error {
+		called = true
+		return nil
+	})
+	if !errors.Is(err, fs.ErrNotExist) || called {
+		t.Fatalf(`referring to a removed blob got %v, recorded %t`, err, called)
+	}
+}
@@ -0,0 +1,49 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package user
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"server/config"
+	"server/database"
+)
+
+// PruneChanges forgets changes older than change_retention. Clients
+// whose cursor points before them have to list their files again.
+func PruneChanges(ctx context.Context) error {
+	return database.DeleteChangesBefore(ctx, time.Now().Add(-config.Duration(config.ChangeRetention)))
+}
+
+// pruneChanges runs PruneChanges every interval until ctx is done.
+func pruneChanges(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := PruneChanges(ctx); err != nil {
+				log.Printf(`[ Sender: user.pruneChanges() ]: %v`, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,278 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package user
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"server/config"
+	"server/database"
+)
+
+var (
+	ErrArchiveInvalid  = errors.New(`not a ZIP or tar archive, or a broken one`)
+	ErrArchiveUnsafe   = errors.New(`archive has a path outside of its folder`)
+	ErrArchiveTooLarge = errors.New(`archive unpacks to more than allowed`)
+)
+
+// ExtractArchive unpacks the archive of size bytes into the folder of the
+// user. ZIP and tar archives are supported, the latter also compressed
+// with gzip or bzip2; the format is told by the content, not the name.
+// Links and other special entries are skipped.
+//
+// The files are staged first and only stored once all of them unpacked
+// within the extract_* limits of the config and fit into the quota.
+func ExtractArchive(ctx context.Context, u database.User, folder string, archive io.ReaderAt, size int64) ([]database.File, error) {
+	quota, err := remainingQuota(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+
+	x := &extractor{
+		u:        u,
+		folder:   CleanFolder(folder),
+		maxFiles: config.Int(config.ExtractMaxFiles),
+		limit:    config.Int64(config.ExtractMaxSize),
+		quota:    quota,
+	}
+	if ratio := config.Int64(config.ExtractMaxRatio); ratio > 0 && size*ratio < x.limit {
+		x.limit = size * ratio
+	}
+	defer x.abort()
+
+	head := make([]byte, 512)
+	n, _ := archive.ReadAt(head, 0)
+	head = head[:n]
+
+	r := io.NewSectionReader(archive, 0, size)
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		err = x.zip(r, size)
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		gz, gzErr := gzip.NewReader(r)
+		if gzErr != nil {
+			return nil, invalidArchive(gzErr)
+		}
+		err = x.tar(gz)
+	case bytes.HasPrefix(head, []byte(`BZh`)):
+		err = x.tar(bzip2.NewReader(r))
+	case len(head) >= 262 && string(head[257:262]) == `ustar`:
+		err = x.tar(r)
+	default:
+		err = ErrArchiveInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	return x.commit(ctx)
+}
+
+// extractor stages the entries of an archive.
+type extractor struct {
+	u        database.User
+	folder   string
+	maxFiles int
+	limit    int64 // bytes the archive may unpack to
+	quota    int64 // bytes the user can still store
+	size     int64 // bytes unpacked so far
+	entries  int
+	folders  []string
+	files    []*FileWriter
+}
+
+func (x *extractor) zip(r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return invalidArchive(err)
+	}
+
+	for _, f := range zr.File {
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			err = x.add(f.Name, f.Modified, nil)
+		case mode.IsRegular():
+			// Sizes in the headers may lie, so this only
+			// saves unpacking what is declared too large.
+			if f.UncompressedSize64 > uint64(x.limit-x.size) {
+				return ErrArchiveTooLarge
+			}
+			err = x.addZipFile(f)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *extractor) addZipFile(f *zip.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return invalidArchive(err)
+	}
+	defer rc.Close()
+
+	return x.add(f.Name, f.Modified, rc)
+}
+
+func (x *extractor) tar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return invalidArchive(err)
+		}
+
+		switch h.Typeflag {
+		case tar.TypeDir:
+			err = x.add(h.Name, h.ModTime, nil)
+		case tar.TypeReg, tar.TypeRegA:
+			err = x.add(h.Name, h.ModTime, tr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// add stages the file with the content of r, or the folder if r is nil.
+func (x *extractor) add(name string, modified time.Time, r io.Reader) error {
+	rel, err := entryPath(name)
+	if err != nil || rel == `` {
+		return err
+	}
+
+	if x.entries++; x.entries > x.maxFiles {
+		return ErrArchiveTooLarge
+	}
+
+	p := path.Join(x.folder, rel)
+	if r == nil {
+		x.folders = append(x.folders, p)
+		return nil
+	}
+
+	w, err := CreateFile(x.u, p)
+	if err != nil {
+		return err
+	}
+	x.files = append(x.files, w)
+	w.SetModTime(modified)
+
+	// One byte over the lower limit tells that it was hit.
+	left := x.limit
+	if x.quota < left {
+		left = x.quota
+	}
+	n, err := io.CopyN(w, archiveReader{r}, left-x.size+1)
+	x.size += n
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	switch {
+	case x.size > x.limit:
+		return ErrArchiveTooLarge
+	case x.size > x.quota:
+		return ErrQuotaExceeded
+	}
+	return w.Close()
+}
+
+// commit stores the staged files and folders.
+func (x *extractor) commit(ctx context.Context) ([]database.File, error) {
+	// Other files may have been stored while the archive was unpacked.
+	if err := CheckQuota(ctx, x.u, x.size); err != nil {
+		return nil, err
+	}
+
+	for _, p := range x.folders {
+		if err := database.EnsureFolder(ctx, x.u.ID, p); err != nil {
+			return nil, err
+		}
+	}
+
+	files := make([]database.File, 0, len(x.files))
+	for _, w := range x.files {
+		f, err := w.Commit(ctx)
+		if err != nil {
+			return files, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// abort throws away what wasn't committed.
+func (x *extractor) abort() {
+	for _, w := range x.files {
+		w.Abort()
+	}
+}
+
+// entryPath returns the slash separated path of an archive entry relative
+// to the folder it is unpacked into, empty for that folder itself. Paths
+// that would leave it fail with ErrArchiveUnsafe rather than being cleaned
+// up, the archive was most likely made to do harm.
+func entryPath(name string) (string, error) {
+	// Windows tools write backslashes.
+	name = strings.ReplaceAll(name, `\`, `/`)
+	if strings.HasPrefix(name, `/`) || strings.ContainsRune(name, 0) {
+		return ``, ErrArchiveUnsafe
+	}
+	for _, part := range strings.Split(name, `/`) {
+		if part == `..` {
+			return ``, ErrArchiveUnsafe
+		}
+	}
+
+	rel := path.Clean(name)
+	if rel == `.` {
+		return ``, nil
+	}
+	return rel, nil
+}
+
+// archiveReader tells errors reading the archive apart from errors
+// writing out its files.
+type archiveReader struct{ r io.Reader }
+
+func (a archiveReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = invalidArchive(err)
+	}
+	return n, err
+}
+
+func invalidArchive(err error) error {
+	return fmt.Errorf(`%w: %v`, ErrArchiveInvalid, err)
+}
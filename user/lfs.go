@@ -0,0 +1,76 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package user
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+
+	"server/database"
+	"server/directory"
+)
+
+var ErrLFSMismatch = errors.New(`content doesn't match the object id and size`)
+
+// SaveLFSObject stores the Git LFS object of the repository from the
+// body, which has to hash to the oid and have the size. Objects are kept
+// as blobs under their SHA-256 like files and count against the quota.
+func SaveLFSObject(ctx context.Context, u database.User, repo, oid string, size int64, body io.Reader) error {
+	_, err := database.GetLFSObject(ctx, u.ID, repo, oid)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	if err = CheckQuota(ctx, u, size); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(directory.UserData(), `stream-*`)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	sum := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, sum), io.LimitReader(body, size+1))
+	if err != nil {
+		return err
+	}
+	if n != size || hex.EncodeToString(sum.Sum(nil)) != oid {
+		return ErrLFSMismatch
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return storeBlob(tmp.Name(), oid, func() error {
+		return database.SaveLFSObject(ctx, database.LFSObject{
+			UserID: u.ID,
+			Repo:   repo,
+			OID:    oid,
+			Size:   size,
+		})
+	})
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package user
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"time"
+
+	"server/database"
+	"server/media"
+)
+
+var ErrNoMetadata = errors.New(`no metadata is read from files of this type`)
+
+// Metadata returns the metadata of the file, reading it first if the
+// background job hasn't got to it yet. It fails with ErrNoMetadata for
+// types media can't read.
+func Metadata(ctx context.Context, f database.File) (database.FileMetadata, error) {
+	if !media.Supported(f.MimeType) {
+		return database.FileMetadata{}, ErrNoMetadata
+	}
+
+	m, err := database.GetFileMetadata(ctx, f.ID)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return m, err
+	}
+	return ReadMetadata(ctx, f)
+}
+
+// ReadMetadata reads the metadata from the content of the file and stores
+// it, even if nothing was found.
+func ReadMetadata(ctx context.Context, f database.File) (database.FileMetadata, error) {
+	blob, err := OpenFile(f.Checksum)
+	if err != nil {
+		return database.FileMetadata{}, err
+	}
+	defer blob.Close()
+
+	md, err := media.Read(blob, f.Size, f.MimeType)
+	if errors.Is(err, media.ErrUnsupported) {
+		return database.FileMetadata{}, ErrNoMetadata
+	}
+	if err != nil {
+		return database.FileMetadata{}, err
+	}
+
+	m := database.FileMetadata{
+		FileID:      f.ID,
+		UserID:      f.UserID,
+		TakenAt:     md.TakenAt,
+		CameraMake:  md.CameraMake,
+		CameraModel: md.CameraModel,
+		Orientation: md.Orientation,
+		Latitude:    md.Latitude,
+		Longitude:   md.Longitude,
+		Width:       md.Width,
+		Height:      md.Height,
+		Title:       md.Title,
+		Artist:      md.Artist,
+		Album:       md.Album,
+		Year:        md.Year,
+		Duration:    md.Duration.Seconds(),
+	}
+	return m, database.SaveFileMetadata(ctx, m)
+}
+
+// ReadAllMetadata reads the metadata of every file that hasn't been read
+// yet and drops the metadata of files that are gone. Files that can't be
+// read are logged and stored without metadata, so they aren't tried again.
+func ReadAllMetadata(ctx context.Context) error {
+	const batch = 500
+
+	for after := int64(0); ; {
+		files, err := database.GetFilesWithoutMetadata(ctx, media.Types, after, batch)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			_, err = ReadMetadata(ctx, f)
+			// The file may have been removed since.
+			if err == nil || errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			log.Printf(`[ Sender: user.ReadAllMetadata() ]: file %d: %v`, f.ID, err)
+			err = database.SaveFileMetadata(ctx, database.FileMetadata{FileID: f.ID, UserID: f.UserID})
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(files) < batch {
+			break
+		}
+		after = files[len(files)-1].ID
+	}
+
+	return database.DeleteOrphanMetadata(ctx)
+}
+
+// readAllMetadata runs ReadAllMetadata every interval until ctx is done.
+func readAllMetadata(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ReadAllMetadata(ctx); err != nil {
+				log.Printf(`[ Sender: user.readAllMetadata() ]: %v`, err)
+			}
+		}
+	}
+}
+
+// Content is the content of a file as it is sent. Stripped tells
+// whether the location was taken out of it.
+type Content struct {
+	*io.SectionReader
+	Stripped bool
+	blob     *os.File
+}
+
+func (c Content) Close() error {
+	return c.blob.Close()
+}
+
+// OpenContent opens the content of the file. With stripGPS, photos and
+// videos lose their location, which may change their size and always
+// their checksum. It fails with ErrLocationKept for types that would
+// keep theirs.
+func OpenContent(f database.File, stripGPS bool) (Content, error) {
+	if stripGPS && media.KeepsLocation(f.MimeType) {
+		return Content{}, ErrLocationKept
+	}
+
+	blob, err := OpenFile(f.Checksum)
+	if err != nil {
+		return Content{}, err
+	}
+	if !stripGPS || !media.Strips(f.MimeType) {
+		return Content{SectionReader: io.NewSectionReader(blob, 0, f.Size), blob: blob}, nil
+	}
+
+	r, err := media.StripGPS(blob, f.Size, f.MimeType)
+	if err != nil {
+		blob.Close()
+		return Content{}, err
+	}
+	return Content{SectionReader: r, Stripped: true, blob: blob}, nil
+}
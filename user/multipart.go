@@ -0,0 +1,260 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package user
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/config"
+	"server/database"
+	"server/directory"
+)
+
+// MinPartSize is the smallest part of a multipart upload but the last, as on S3.
+const MinPartSize = 5 << 20
+
+var (
+	ErrInvalidPart      = errors.New(`part wasn't uploaded or its ETag doesn't match`)
+	ErrInvalidPartOrder = errors.New(`parts aren't in ascending order`)
+	ErrPartTooSmall     = errors.New(`part is smaller than the minimum size`)
+)
+
+// CompletedPart names a part the client wants in the file.
+type CompletedPart struct {
+	Number int
+	ETag   string
+}
+
+// CreateMultipartUpload starts an upload of the file at the slash
+// separated path, whose parts are sent separately and in any order.
+func CreateMultipartUpload(ctx context.Context, u database.User, filePath, mimeType string) (database.MultipartUpload, error) {
+	filePath = CleanFolder(filePath)
+	return database.CreateMultipartUpload(ctx, database.MultipartUpload{
+		UserID:    u.ID,
+		Folder:    path.Dir(filePath),
+		Name:      path.Base(filePath),
+		MimeType:  mimeType,
+		ExpiresAt: time.Now().Add(config.Duration(config.UploadTTL)),
+	})
+}
+
+// UploadPart stores part number of the upload, replacing a part sent
+// before with the number.
+func UploadPart(ctx context.Context, u database.User, id string, number int, body io.Reader) (database.MultipartPart, error) {
+	if _, err := database.GetMultipartUpload(ctx, u.ID, id); err != nil {
+		return database.MultipartPart{}, err
+	}
+
+	tmp, err := os.CreateTemp(directory.Parts(), id+`-*.tmp`)
+	if err != nil {
+		return database.MultipartPart{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	sum := md5.New()
+	size, err := io.Copy(io.MultiWriter(tmp, sum), body)
+	if err != nil {
+		return database.MultipartPart{}, err
+	}
+	if err = tmp.Close(); err != nil {
+		return database.MultipartPart{}, err
+	}
+
+	if err = os.Rename(tmp.Name(), partPath(id, number)); err != nil {
+		return database.MultipartPart{}, err
+	}
+
+	part := database.MultipartPart{
+		UploadID: id,
+		Number:   number,
+		ETag:     hex.EncodeToString(sum.Sum(nil)),
+		Size:     size,
+	}
+	return part, database.SaveMultipartPart(ctx, part)
+}
+
+// CompleteMultipartUpload joins the parts into the file, which replaces
+// the files at its path, and drops the upload.
+func CompleteMultipartUpload(ctx context.Context, u database.User, id string, parts []CompletedPart) (database.File, error) {
+	unlock := lockUpload(id)
+	defer unlock()
+
+	upload, err := database.GetMultipartUpload(ctx, u.ID, id)
+	if err != nil {
+		return database.File{}, err
+	}
+
+	stored, err := database.GetMultipartParts(ctx, id)
+	if err != nil {
+		return database.File{}, err
+	}
+
+	byNumber := make(map[int]database.MultipartPart, len(stored))
+	for _, p := range stored {
+		byNumber[p.Number] = p
+	}
+
+	for i, p := range parts {
+		s, ok := byNumber[p.Number]
+		switch {
+		case !ok || s.ETag != strings.Trim(p.ETag, `"`):
+			return database.File{}, ErrInvalidPart
+		case i > 0 && p.Number <= parts[i-1].Number:
+			return database.File{}, ErrInvalidPartOrder
+		case i < len(parts)-1 && s.Size < MinPartSize:
+			return database.File{}, ErrPartTooSmall
+		}
+	}
+	if len(parts) == 0 {
+		return database.File{}, ErrInvalidPart
+	}
+
+	w, err := CreateFile(u, path.Join(upload.Folder, upload.Name))
+	if err != nil {
+		return database.File{}, err
+	}
+	defer w.Abort()
+	w.SetMimeType(upload.MimeType)
+
+	for _, p := range parts {
+		if err = appendPart(w, partPath(id, p.Number)); err != nil {
+			return database.File{}, err
+		}
+	}
+
+	f, err := w.Commit(ctx)
+	if err != nil {
+		return database.File{}, err
+	}
+
+	if err = ReplaceFiles(ctx, f); err != nil {
+		return database.File{}, err
+	}
+	return f, dropMultipartUpload(ctx, id)
+}
+
+// AbortMultipartUpload drops the upload and the parts received for it.
+func AbortMultipartUpload(ctx context.Context, u database.User, id string) error {
+	unlock := lockUpload(id)
+	defer unlock()
+
+	if _, err := database.GetMultipartUpload(ctx, u.ID, id); err != nil {
+		return err
+	}
+	return dropMultipartUpload(ctx, id)
+}
+
+// PruneMultipartUploads deletes expired multipart uploads
+// and the part files no upload refers to.
+func PruneMultipartUploads(ctx context.Context) error {
+	active, err := database.DeleteExpiredMultipartUploads(ctx)
+	if err != nil {
+		return err
+	}
+
+	keep := make(map[string]bool, len(active))
+	for _, id := range active {
+		keep[id] = true
+	}
+
+	entries, err := os.ReadDir(directory.Parts())
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		id, _, _ := strings.Cut(e.Name(), `-`)
+		if keep[id] {
+			continue
+		}
+		if err = removePartFile(filepath.Join(directory.Parts(), e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneMultipartUploads runs PruneMultipartUploads every interval until ctx is done.
+func pruneMultipartUploads(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := PruneMultipartUploads(ctx); err != nil {
+				log.Printf(`[ Sender: user.pruneMultipartUploads() ]: %v`, err)
+			}
+		}
+	}
+}
+
+func dropMultipartUpload(ctx context.Context, id string) error {
+	parts, err := database.GetMultipartParts(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if err = database.DeleteMultipartUpload(ctx, id); err != nil {
+		return err
+	}
+
+	for _, p := range parts {
+		if err = removePartFile(partPath(id, p.Number)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendPart(w io.Writer, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func removePartFile(name string) error {
+	err := os.Remove(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func partPath(id string, number int) string {
+	return filepath.Join(directory.Parts(), id+`-`+strconv.Itoa(number))
+}
@@ -0,0 +1,245 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"server/config"
+	"server/database"
+	"server/directory"
+	"server/mailer"
+	"server/password"
+	"strings"
+	"time"
+)
+
+const (
+	tokenVerifyEmail   = `verify_email`
+	tokenResetPassword = `reset_password`
+)
+
+var (
+	ErrInvalidEmail = errors.New(`invalid email address`)
+	ErrInvalidToken = errors.New(`invalid or expired token`)
+)
+
+// ChangeEmail sets a new email address and sends a verification link to it.
+// An empty address removes the email from the account.
+func ChangeEmail(ctx context.Context, login, current, email string) error {
+	u, err := database.GetUser(ctx, login)
+	if err != nil {
+		return err
+	}
+
+	if err = comparsePasswords(ctx, current, u.Password); err != nil {
+		return err
+	}
+
+	if email != `` {
+		if email, err = normalizeEmail(email); err != nil {
+			return err
+		}
+	}
+
+	if err = database.UpdateEmail(ctx, u.ID, email); err != nil {
+		return err
+	}
+
+	if email == `` {
+		return nil
+	}
+	u.Email = email
+	return SendVerification(ctx, u)
+}
+
+// ResendVerification mails another verification link to the current address.
+func ResendVerification(ctx context.Context, login string) error {
+	u, err := database.GetUser(ctx, login)
+	if err != nil {
+		return err
+	}
+
+	if u.Email == `` || u.EmailVerified {
+		return ErrInvalidEmail
+	}
+	return SendVerification(ctx, u)
+}
+
+// SendVerification mails a link confirming the user owns the email address.
+func SendVerification(ctx context.Context, u database.User) error {
+	token, err := createUserToken(ctx, u, tokenVerifyEmail, config.Duration(config.EmailVerifyTTL))
+	if err != nil {
+		return err
+	}
+
+	const template = "Hello, %s!\n\n" +
+		"Please confirm your email address by opening the link below:\n\n%s\n\n" +
+		"If you didn't create a DexCloud account, ignore this message."
+	return mailer.Send(ctx, mailer.Message{
+		To:      u.Email,
+		Subject: `Confirm your email address`,
+		Body:    fmt.Sprintf(template, u.Login, link(directory.VerifyPage, token)),
+	})
+}
+
+func VerifyEmail(ctx context.Context, token string) error {
+	t, err := useUserToken(ctx, tokenVerifyEmail, token)
+	if err != nil {
+		return err
+	}
+	return database.VerifyEmail(ctx, t.UserID, t.Email)
+}
+
+// RequestPasswordReset mails a reset link to the verified email address
+// of the account. Unknown accounts are silently ignored, so the response
+// doesn't reveal which logins and addresses exist.
+func RequestPasswordReset(ctx context.Context, login, email string) error {
+	var (
+		u   database.User
+		err error
+	)
+	switch {
+	case login != ``:
+		u, err = database.GetUser(ctx, login)
+	case email != ``:
+		u, err = database.GetUserByEmail(ctx, email)
+	default:
+		return nil
+	}
+
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !u.EmailVerified) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, err := createUserToken(ctx, u, tokenResetPassword, config.Duration(config.PasswordResetTTL))
+	if err != nil {
+		return err
+	}
+
+	const template = "Hello, %s!\n\n" +
+		"Someone asked to reset the password of your account. " +
+		"To choose a new password open the link below:\n\n%s\n\n" +
+		"The link can be used once and expires in %v. " +
+		"If you didn't ask for it, ignore this message."
+	return mailer.Send(ctx, mailer.Message{
+		To:      u.Email,
+		Subject: `Reset your password`,
+		Body:    fmt.Sprintf(template, u.Login, link(directory.ResetPage, token), config.Duration(config.PasswordResetTTL)),
+	})
+}
+
+// ResetPassword sets a new password using a token from the reset email.
+// The token is spent only once the password was accepted, so a password
+// the policy rejects doesn't cost the user the link. Every session and
+// every other reset token of the user is revoked.
+func ResetPassword(ctx context.Context, token, newPassword string) error {
+	t, err := database.GetUserToken(ctx, tokenResetPassword, hashToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrInvalidToken
+	}
+	if err != nil {
+		return err
+	}
+
+	u, err := database.GetUserByID(ctx, t.UserID)
+	if err != nil {
+		return err
+	}
+
+	if err = password.Validate(u.Login, newPassword); err != nil {
+		return err
+	}
+
+	hash, err := generatePasswordHash(ctx, newPassword)
+	if err != nil {
+		return err
+	}
+
+	// Another reset with the same token may have won meanwhile.
+	err = database.ResetPassword(ctx, t, hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrInvalidToken
+	}
+	if err != nil {
+		return err
+	}
+	return database.RevokeSessions(ctx, u.ID, ``)
+}
+
+// createUserToken stores the hash of a new random token and returns the token.
+func createUserToken(ctx context.Context, u database.User, kind string, ttl time.Duration) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return ``, err
+	}
+
+	err = database.CreateUserToken(ctx, database.UserToken{
+		UserID:    u.ID,
+		Kind:      kind,
+		Hash:      hashToken(token),
+		Email:     u.Email,
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	return token, err
+}
+
+func useUserToken(ctx context.Context, kind, token string) (database.UserToken, error) {
+	t, err := database.UseUserToken(ctx, kind, hashToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return database.UserToken{}, ErrInvalidToken
+	}
+	return t, err
+}
+
+// newToken returns 32 random bytes encoded for use in links.
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return ``, err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func normalizeEmail(email string) (string, error) {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != `` {
+		return ``, ErrInvalidEmail
+	}
+	return strings.TrimSpace(addr.Address), nil
+}
+
+func link(path, token string) string {
+	base := strings.TrimSuffix(config.String(config.PublicURL), `/`)
+	return base + path + `?token=` + url.QueryEscape(token)
+}
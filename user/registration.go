@@ -0,0 +1,125 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"server/config"
+	"server/database"
+	"time"
+)
+
+const (
+	ModeOpen     = `open`
+	ModeInvite   = `invite`
+	ModeApproval = `approval`
+	ModeDisabled = `disabled`
+)
+
+var (
+	ErrRegistrationClosed = errors.New(`registration is disabled`)
+	ErrPendingApproval    = errors.New(`account is waiting for approval`)
+)
+
+// Init checks the registration mode, gives the admin role to the logins
+// listed in config.yml and starts pruning expired uploads and old changes,
+// collecting unreferenced container blobs, making missing thumbnails and
+// reading the metadata of new photos and media.
+func Init(ctx context.Context) error {
+	switch mode := config.String(config.RegistrationMode); mode {
+	case ModeOpen, ModeInvite, ModeApproval, ModeDisabled:
+	default:
+		return fmt.Errorf(`unknown registration mode %q`, mode)
+	}
+	if err := database.GrantRole(ctx, config.Strings(config.Admins), database.RoleAdmin); err != nil {
+		return err
+	}
+
+	go pruneUploads(ctx, time.Hour)
+	go pruneMultipartUploads(ctx, time.Hour)
+	go pruneChanges(ctx, time.Hour)
+	go collectRegistryGarbage(ctx, time.Hour)
+	go generateThumbnails(ctx, time.Hour)
+	go makeQueuedThumbnails(ctx)
+	go readAllMetadata(ctx, time.Hour)
+	return nil
+}
+
+// CreateInvite mints a registration code. The code is returned only here,
+// the database keeps its hash. A zero ttl means the code never expires.
+func CreateInvite(ctx context.Context, adminLogin string, maxUses int, ttl time.Duration) (code string, invite database.Invite, err error) {
+	admin, err := database.GetUser(ctx, adminLogin)
+	if err != nil {
+		return ``, database.Invite{}, err
+	}
+
+	b := make([]byte, 16)
+	if _, err = rand.Read(b); err != nil {
+		return ``, database.Invite{}, err
+	}
+	code = base64.RawURLEncoding.EncodeToString(b)
+
+	if maxUses < 1 {
+		maxUses = 1
+	}
+
+	invite = database.Invite{
+		Hash:      hashToken(code),
+		MaxUses:   maxUses,
+		CreatedBy: admin.ID,
+	}
+	if ttl > 0 {
+		invite.ExpiresAt = time.Now().Add(ttl)
+	}
+
+	invite, err = database.CreateInvite(ctx, invite)
+	return code, invite, err
+}
+
+// insertUser creates the user according to the registration mode.
+func insertUser(ctx context.Context, u database.User, invite string) (database.User, error) {
+	u.Status = database.StatusActive
+	u.Role = database.RoleUser
+	u.Quota = config.Int64(config.DefaultQuota)
+	if isConfiguredAdmin(u.Login) {
+		u.Role = database.RoleAdmin
+	}
+
+	switch config.String(config.RegistrationMode) {
+	case ModeInvite:
+		if invite == `` {
+			return database.User{}, database.ErrInvalidInvite
+		}
+		return database.RegisterInvitedUser(ctx, u, hashToken(invite))
+	case ModeApproval:
+		u.Status = database.StatusPending
+	}
+	return database.RegisterUser(ctx, u)
+}
+
+func isConfiguredAdmin(login string) bool {
+	for _, admin := range config.Strings(config.Admins) {
+		if admin == login {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,341 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package user
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"server/config"
+	"server/database"
+	"server/directory"
+)
+
+var (
+	ErrDigestMismatch      = errors.New(`content doesn't match the digest`)
+	ErrManifestBlobUnknown = errors.New(`manifest refers to a blob or manifest the repository doesn't have`)
+)
+
+// CreateRegistryUpload starts a blob upload to the container repository.
+// Blobs have no declared size, the quota limits how much can be sent.
+func CreateRegistryUpload(ctx context.Context, u database.User, repo string) (database.RegistryUpload, error) {
+	upload, err := database.CreateRegistryUpload(ctx, database.RegistryUpload{
+		UserID:    u.ID,
+		Repo:      repo,
+		ExpiresAt: time.Now().Add(config.Duration(config.UploadTTL)),
+	})
+	if err != nil {
+		return database.RegistryUpload{}, err
+	}
+
+	if err = os.WriteFile(registryUploadPath(upload.ID), nil, 0o600); err != nil {
+		return database.RegistryUpload{}, err
+	}
+	return upload, nil
+}
+
+func GetRegistryUpload(ctx context.Context, u database.User, repo, id string) (database.RegistryUpload, error) {
+	return database.GetRegistryUpload(ctx, u.ID, repo, id)
+}
+
+// AppendRegistryUpload writes the body at offset, which must equal the
+// bytes received so far. Bytes received before the body breaks off are
+// kept, so the client can resume from the returned offset.
+func AppendRegistryUpload(ctx context.Context, u database.User, repo, id string, offset int64, body io.Reader) (database.RegistryUpload, error) {
+	unlock := lockUpload(id)
+	defer unlock()
+
+	upload, err := database.GetRegistryUpload(ctx, u.ID, repo, id)
+	if err != nil {
+		return database.RegistryUpload{}, err
+	}
+
+	if offset != upload.Offset {
+		return upload, ErrUploadOffset
+	}
+	return appendRegistryUpload(ctx, u, upload, body)
+}
+
+// CompleteRegistryUpload appends the body, which may be empty, and stores
+// the received bytes as the blob with the checksum in the repository.
+func CompleteRegistryUpload(ctx context.Context, u database.User, repo, id, checksum string, body io.Reader) (database.RegistryBlob, error) {
+	unlock := lockUpload(id)
+	defer unlock()
+
+	upload, err := database.GetRegistryUpload(ctx, u.ID, repo, id)
+	if err != nil {
+		return database.RegistryBlob{}, err
+	}
+
+	if upload, err = appendRegistryUpload(ctx, u, upload, body); err != nil {
+		return database.RegistryBlob{}, err
+	}
+
+	// Other files may have been stored while this one was uploading.
+	if err = CheckQuota(ctx, u, upload.Offset); err != nil {
+		return database.RegistryBlob{}, err
+	}
+
+	src := registryUploadPath(id)
+	sum, err := fileChecksum(src)
+	if err != nil {
+		return database.RegistryBlob{}, err
+	}
+	if sum != checksum {
+		return database.RegistryBlob{}, ErrDigestMismatch
+	}
+
+	b := database.RegistryBlob{
+		UserID:    u.ID,
+		Repo:      repo,
+		Checksum:  checksum,
+		Size:      upload.Offset,
+		CreatedAt: time.Now(),
+	}
+	err = storeBlob(src, checksum, func() error {
+		return database.SaveRegistryBlob(ctx, b)
+	})
+	if err != nil {
+		return database.RegistryBlob{}, err
+	}
+	return b, database.DeleteRegistryUpload(ctx, id)
+}
+
+// CancelRegistryUpload drops the upload and the bytes received for it.
+func CancelRegistryUpload(ctx context.Context, u database.User, repo, id string) error {
+	unlock := lockUpload(id)
+	defer unlock()
+
+	if _, err := database.GetRegistryUpload(ctx, u.ID, repo, id); err != nil {
+		return err
+	}
+
+	if err := database.DeleteRegistryUpload(ctx, id); err != nil {
+		return err
+	}
+	return removeRegistryUploadFile(id)
+}
+
+// MountRegistryBlob adds the blob with the checksum of another
+// repository of the user to the repository without uploading it again.
+func MountRegistryBlob(ctx context.Context, u database.User, repo, from, checksum string) (database.RegistryBlob, error) {
+	b, err := database.GetRegistryBlob(ctx, u.ID, from, checksum)
+	if err != nil {
+		return database.RegistryBlob{}, err
+	}
+
+	if err = CheckQuota(ctx, u, b.Size); err != nil {
+		return database.RegistryBlob{}, err
+	}
+
+	b.ID, b.Repo, b.CreatedAt = 0, repo, time.Now()
+	return b, referBlob(checksum, func() error {
+		return database.SaveRegistryBlob(ctx, b)
+	})
+}
+
+// SaveRegistryManifest stores the manifest content with the checksum in
+// the repository and points the tag at it unless tag is empty. The blobs
+// and manifests it refers to have to be in the repository already.
+func SaveRegistryManifest(ctx context.Context, u database.User, m database.RegistryManifest, content []byte, tag string, blobs, manifests []string) error {
+	for _, refs := range []struct {
+		checksums []string
+		get       func(context.Context, int64, string, []string) ([]string, error)
+	}{
+		{blobs, database.GetRegistryBlobChecksums},
+		{manifests, database.GetRegistryManifestChecksums},
+	} {
+		found, err := refs.get(ctx, u.ID, m.Repo, refs.checksums)
+		if err != nil {
+			return err
+		}
+		if len(found) != len(unique(refs.checksums)) {
+			return ErrManifestBlobUnknown
+		}
+	}
+
+	m.UserID, m.Size = u.ID, int64(len(content))
+	record := func() error {
+		return database.SaveRegistryManifest(ctx, m, append(unique(blobs), unique(manifests)...), tag)
+	}
+
+	_, err := database.GetRegistryManifest(ctx, u.ID, m.Repo, m.Checksum)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return storeRegistryManifest(ctx, u, m.Checksum, content, record)
+	case err != nil:
+		return err
+	}
+	return referBlob(m.Checksum, record)
+}
+
+// DeleteRegistryManifest deletes the manifest with the tags naming it.
+// The blobs it referred to are left to the garbage collection.
+func DeleteRegistryManifest(ctx context.Context, u database.User, repo, checksum string) error {
+	if err := database.DeleteRegistryManifest(ctx, u.ID, repo, checksum); err != nil {
+		return err
+	}
+	return RemoveUnusedFile(ctx, checksum)
+}
+
+func DeleteRegistryBlob(ctx context.Context, u database.User, repo, checksum string) error {
+	if err := database.DeleteRegistryBlob(ctx, u.ID, repo, checksum); err != nil {
+		return err
+	}
+	return RemoveUnusedFile(ctx, checksum)
+}
+
+// CollectRegistryGarbage deletes expired blob uploads, the files no
+// upload refers to and the blobs no manifest refers to. Blobs are pushed
+// before their manifest, so only those older than upload_ttl are deleted.
+func CollectRegistryGarbage(ctx context.Context) error {
+	active, err := database.DeleteExpiredRegistryUploads(ctx)
+	if err != nil {
+		return err
+	}
+
+	keep := make(map[string]bool, len(active))
+	for _, id := range active {
+		keep[id] = true
+	}
+
+	entries, err := os.ReadDir(directory.RegistryUploads())
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if keep[e.Name()] {
+			continue
+		}
+		if err = removeRegistryUploadFile(e.Name()); err != nil {
+			return err
+		}
+	}
+
+	before := time.Now().Add(-config.Duration(config.UploadTTL))
+	checksums, err := database.DeleteUnreferencedRegistryBlobs(ctx, before)
+	if err != nil {
+		return err
+	}
+
+	for _, checksum := range checksums {
+		if err = RemoveUnusedFile(ctx, checksum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectRegistryGarbage runs CollectRegistryGarbage every interval until ctx is done.
+func collectRegistryGarbage(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := CollectRegistryGarbage(ctx); err != nil {
+				log.Printf(`[ Sender: user.collectRegistryGarbage() ]: %v`, err)
+			}
+		}
+	}
+}
+
+// appendRegistryUpload appends the body to the upload. It fails with
+// ErrQuotaExceeded, keeping nothing of the body, if the upload would
+// grow beyond the quota.
+func appendRegistryUpload(ctx context.Context, u database.User, upload database.RegistryUpload, body io.Reader) (database.RegistryUpload, error) {
+	limit, err := remainingQuota(ctx, u)
+	if err != nil {
+		return upload, err
+	}
+	if u.Quota > 0 {
+		limit -= upload.Offset
+		if limit < 0 {
+			limit = 0
+		}
+	}
+
+	n, copyErr := writeAt(registryUploadPath(upload.ID), upload.Offset, limit, body)
+	if errors.Is(copyErr, ErrUploadTooLarge) {
+		return upload, ErrQuotaExceeded
+	}
+
+	if n > 0 {
+		if err := database.AdvanceRegistryUpload(ctx, upload.ID, upload.Offset, upload.Offset+n); err != nil {
+			return upload, err
+		}
+		upload.Offset += n
+	}
+	return upload, copyErr
+}
+
+// storeRegistryManifest writes the content as the blob with the checksum
+// and calls record to save the manifest.
+func storeRegistryManifest(ctx context.Context, u database.User, checksum string, content []byte, record func() error) error {
+	if err := CheckQuota(ctx, u, int64(len(content))); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(directory.UserData(), `stream-*`)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err = tmp.Write(content); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return storeBlob(tmp.Name(), checksum, record)
+}
+
+func unique[T comparable](s []T) []T {
+	seen := make(map[T]bool, len(s))
+	out := make([]T, 0, len(s))
+	for _, v := range s {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func removeRegistryUploadFile(id string) error {
+	err := os.Remove(registryUploadPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func registryUploadPath(id string) string {
+	return filepath.Join(directory.RegistryUploads(), id)
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package user
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+
+	"server/database"
+	"server/directory"
+)
+
+// ResticConfig is the type and the name of the config of a restic
+// repository, the one object that isn't named after its checksum.
+const ResticConfig = `config`
+
+var (
+	ErrResticExists   = errors.New(`object exists already`)
+	ErrResticMismatch = errors.New(`content doesn't match the object name`)
+)
+
+// SaveResticObject stores the object of the type in the restic repository
+// from the body. Objects are never overwritten, and but for the config
+// they have to hash to their name. Like files they count against the quota.
+func SaveResticObject(ctx context.Context, u database.User, repo, typ, name string, body io.Reader) error {
+	_, err := database.GetResticObject(ctx, u.ID, repo, typ, name)
+	if err == nil {
+		return ErrResticExists
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	limit, err := remainingQuota(ctx, u)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(directory.UserData(), `stream-*`)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	sum := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, sum), io.LimitReader(body, limit+1))
+	if err != nil {
+		return err
+	}
+	if size > limit {
+		return ErrQuotaExceeded
+	}
+
+	checksum := hex.EncodeToString(sum.Sum(nil))
+	if typ != ResticConfig && checksum != name {
+		return ErrResticMismatch
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	err = storeBlob(tmp.Name(), checksum, func() error {
+		return database.CreateResticObject(ctx, database.ResticObject{
+			UserID:   u.ID,
+			Repo:     repo,
+			Type:     typ,
+			Name:     name,
+			Checksum: checksum,
+			Size:     size,
+		})
+	})
+	if errors.Is(err, database.ErrDuplicate) {
+		// Stored by a concurrent request in between.
+		if err = RemoveUnusedFile(ctx, checksum); err != nil {
+			return err
+		}
+		return ErrResticExists
+	}
+	return err
+}
+
+func DeleteResticObject(ctx context.Context, u database.User, repo, typ, name string) error {
+	o, err := database.DeleteResticObject(ctx, u.ID, repo, typ, name)
+	if err != nil {
+		return err
+	}
+	return RemoveUnusedFile(ctx, o.Checksum)
+}
+
+// DeleteResticRepo deletes every object of the restic repository.
+func DeleteResticRepo(ctx context.Context, u database.User, repo string) error {
+	checksums, err := database.DeleteResticRepo(ctx, u.ID, repo)
+	if err != nil {
+		return err
+	}
+
+	for _, checksum := range checksums {
+		if err = RemoveUnusedFile(ctx, checksum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
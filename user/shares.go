@@ -0,0 +1,96 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package user
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"server/config"
+	"server/database"
+	"server/directory"
+	"server/media"
+)
+
+// ErrLocationKept refuses shares without the location of files whose
+// type may carry one that can't be taken out, see media.KeepsLocation.
+var ErrLocationKept = errors.New(`the location can't be removed from files of this type`)
+
+// CreateShare makes a public link to the file of the user. The token is
+// returned only here, the database keeps its hash. A zero ttl means the
+// link never expires. With stripGPS, photos and videos are sent without
+// their location; it fails with ErrLocationKept for types that keep it.
+func CreateShare(ctx context.Context, u database.User, fileID int64, ttl time.Duration, stripGPS bool) (string, database.Share, error) {
+	f, err := database.GetFile(ctx, u.ID, fileID)
+	if err != nil {
+		return ``, database.Share{}, err
+	}
+	if stripGPS && media.KeepsLocation(f.MimeType) {
+		return ``, database.Share{}, ErrLocationKept
+	}
+	return createShare(ctx, database.Share{UserID: u.ID, FileID: fileID, StripGPS: stripGPS}, ttl)
+}
+
+// CreateFolderShare makes a public link to the folder of the user, which
+// downloads it as an archive. It is like CreateShare otherwise, files
+// added later whose type keeps the location are left out of the archive.
+func CreateFolderShare(ctx context.Context, u database.User, folderID int64, ttl time.Duration, stripGPS bool) (string, database.Share, error) {
+	folder, err := database.GetFolderByID(ctx, u.ID, folderID)
+	if err != nil {
+		return ``, database.Share{}, err
+	}
+	if stripGPS {
+		types, err := database.GetTypesBelow(ctx, u.ID, folder.Path)
+		if err != nil {
+			return ``, database.Share{}, err
+		}
+		for _, t := range types {
+			if media.KeepsLocation(t) {
+				return ``, database.Share{}, ErrLocationKept
+			}
+		}
+	}
+	return createShare(ctx, database.Share{UserID: u.ID, FolderID: folderID, StripGPS: stripGPS}, ttl)
+}
+
+func createShare(ctx context.Context, share database.Share, ttl time.Duration) (token string, _ database.Share, err error) {
+	token, err = newToken()
+	if err != nil {
+		return ``, database.Share{}, err
+	}
+
+	share.Hash = hashToken(token)
+	if ttl > 0 {
+		share.ExpiresAt = time.Now().Add(ttl)
+	}
+
+	share, err = database.CreateShare(ctx, share)
+	return token, share, err
+}
+
+// GetSharedFile returns the file or folder the token of a share links to.
+func GetSharedFile(ctx context.Context, token string) (database.SharedFile, error) {
+	return database.GetSharedFile(ctx, hashToken(token))
+}
+
+// ShareLink returns the public URL of the share with the token.
+func ShareLink(token string) string {
+	base := strings.TrimSuffix(config.String(config.PublicURL), `/`)
+	return base + strings.Replace(directory.APIShared, `{token}`, token, 1)
+}
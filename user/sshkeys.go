@@ -0,0 +1,45 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package user
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"server/database"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var ErrInvalidSSHKey = errors.New(`not a public key in authorized_keys format`)
+
+// AddSSHKey registers the public key, a line of authorized_keys, so the
+// user can sign in to the SFTP server with it. Options and the comment
+// of the line are dropped.
+func AddSSHKey(ctx context.Context, uid int64, name, authorizedKey string) (database.SSHKey, error) {
+	key, _, _, rest, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil || strings.TrimSpace(string(rest)) != `` {
+		return database.SSHKey{}, ErrInvalidSSHKey
+	}
+
+	return database.CreateSSHKey(ctx, database.SSHKey{
+		UserID:      uid,
+		Name:        name,
+		PublicKey:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+		Fingerprint: ssh.FingerprintSHA256(key),
+	})
+}
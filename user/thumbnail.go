@@ -0,0 +1,412 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // registers the formats thumbnails are made of
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/database"
+	"server/directory"
+	"server/media"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+var ErrNoThumbnail = errors.New(`file has no thumbnail`)
+
+// ThumbnailSizes are the bounding boxes thumbnails are made for, in pixels.
+var ThumbnailSizes = map[string]int{
+	`small`:  128,
+	`medium`: 320,
+	`large`:  1024,
+}
+
+// thumbnailTypes are the types of files that get thumbnails. WebP is
+// read, but thumbnails are only written as JPEG or PNG.
+var thumbnailTypes = []string{`image/jpeg`, `image/png`, `image/gif`, `image/webp`}
+
+const (
+	// thumbnailMaxPixels keeps images that would take gigabytes
+	// once decoded from being decoded at all.
+	thumbnailMaxPixels = 100_000_000
+	// maxDecodes is how many images are decoded at once. A large one
+	// takes hundreds of megabytes until its thumbnails are made.
+	maxDecodes = 2
+	// thumbnailQueueLength is how many new images wait for thumbnails.
+	// The hourly job catches those that didn't fit.
+	thumbnailQueueLength = 1024
+)
+
+var (
+	decodes        = make(chan struct{}, maxDecodes)
+	thumbnailQueue = make(chan string, thumbnailQueueLength)
+)
+
+// OpenThumbnail opens the thumbnail of the file in the named size, and
+// makes the thumbnails of the file first if they don't exist. It fails
+// with ErrNoThumbnail for files that aren't images or can't be decoded.
+func OpenThumbnail(f database.File, size string) (*os.File, error) {
+	px, ok := ThumbnailSizes[size]
+	if !ok || !HasThumbnail(f.MimeType) || thumbnailFailed(f.Checksum) {
+		return nil, ErrNoThumbnail
+	}
+
+	thumb, err := os.Open(thumbnailPath(f.Checksum, px))
+	if !errors.Is(err, fs.ErrNotExist) {
+		return thumb, err
+	}
+
+	if err = MakeThumbnails(f.Checksum); err != nil {
+		return nil, err
+	}
+	return os.Open(thumbnailPath(f.Checksum, px))
+}
+
+// QueueThumbnails has the thumbnails of a new file made in the background.
+func QueueThumbnails(f database.File) {
+	if !HasThumbnail(f.MimeType) {
+		return
+	}
+	select {
+	case thumbnailQueue <- f.Checksum:
+	default:
+	}
+}
+
+// makeQueuedThumbnails makes the thumbnails of queued files until ctx is done.
+func makeQueuedThumbnails(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case checksum := <-thumbnailQueue:
+			if thumbnailsTried(checksum) {
+				continue
+			}
+			err := MakeThumbnails(checksum)
+			if err != nil && !errors.Is(err, ErrNoThumbnail) && !errors.Is(err, fs.ErrNotExist) {
+				log.Printf(`[ Sender: user.makeQueuedThumbnails() ]: %v`, err)
+			}
+		}
+	}
+}
+
+// HasThumbnail tells whether files of the MIME type get thumbnails.
+func HasThumbnail(mimeType string) bool {
+	for _, t := range thumbnailTypes {
+		if t == mimeType {
+			return true
+		}
+	}
+	return false
+}
+
+// MakeThumbnails makes the thumbnails of every size of the image in the
+// blob with the checksum. Opaque images become JPEG, the others PNG so
+// they stay transparent. Images are never scaled up, and are turned the
+// way their EXIF orientation says. Images that can't be decoded are
+// remembered and fail with ErrNoThumbnail from then on.
+func MakeThumbnails(checksum string) error {
+	err := makeThumbnails(checksum)
+	if errors.Is(err, ErrNoThumbnail) {
+		if markErr := os.WriteFile(failedPath(checksum), nil, 0o644); markErr != nil {
+			return markErr
+		}
+	}
+	return err
+}
+
+func makeThumbnails(checksum string) error {
+	blob, err := OpenFile(checksum)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	cfg, format, err := image.DecodeConfig(blob)
+	if err != nil {
+		return fmt.Errorf(`%w: %v`, ErrNoThumbnail, err)
+	}
+	if cfg.Width*cfg.Height > thumbnailMaxPixels {
+		return fmt.Errorf(`%w: %dx%d pixels are too many`, ErrNoThumbnail, cfg.Width, cfg.Height)
+	}
+
+	info, err := blob.Stat()
+	if err != nil {
+		return err
+	}
+	md, err := media.Read(blob, info.Size(), `image/`+format)
+	if err != nil && !errors.Is(err, media.ErrUnsupported) {
+		return err
+	}
+
+	decodes <- struct{}{}
+	defer func() { <-decodes }()
+
+	img, _, err := image.Decode(io.NewSectionReader(blob, 0, info.Size()))
+	if err != nil {
+		return fmt.Errorf(`%w: %v`, ErrNoThumbnail, err)
+	}
+
+	sizes := make([]int, 0, len(ThumbnailSizes))
+	for _, px := range ThumbnailSizes {
+		sizes = append(sizes, px)
+	}
+	// Each size is scaled from the next larger one, which is much
+	// faster than scaling all of them from the original.
+	sort.Sort(sort.Reverse(sort.IntSlice(sizes)))
+	for _, px := range sizes {
+		img = scaleDown(img, px)
+		if err = saveThumbnail(thumbnailPath(checksum, px), orient(img, md.Orientation)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scaleDown fits the image into a square of px pixels.
+func scaleDown(img image.Image, px int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= px && h <= px {
+		return img
+	}
+
+	if w > h {
+		w, h = px, h*px/w
+	} else {
+		w, h = w*px/h, px
+	}
+	// Very long images still get a line of pixels.
+	if w == 0 {
+		w = 1
+	}
+	if h == 0 {
+		h = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// orient turns the image upright by its EXIF orientation, from 1, which
+// is upright already, to 8. 5 to 8 swap width and height.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			// Where the pixel at x, y of the result is in the image.
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // upside down
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirrored upside down
+				sx, sy = x, h-1-y
+			case 5: // mirrored along the top left to bottom right diagonal
+				sx, sy = y, x
+			case 6: // needs turning clockwise
+				sx, sy = y, h-1-x
+			case 7: // mirrored along the other diagonal
+				sx, sy = w-1-y, h-1-x
+			case 8: // needs turning counterclockwise
+				sx, sy = w-1-y, x
+			}
+			dst.Set(x, y, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// saveThumbnail writes the thumbnail next to its name first,
+// so requests never see one half written.
+func saveThumbnail(name string, img image.Image) error {
+	// Without a dash it can't be taken for an orphan.
+	tmp, err := os.CreateTemp(directory.Thumbnails(), `tmp*`)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if opaque(img) {
+		err = jpeg.Encode(tmp, img, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(tmp, img)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func opaque(img image.Image) bool {
+	o, ok := img.(interface{ Opaque() bool })
+	return ok && o.Opaque()
+}
+
+// RemoveThumbnails deletes the thumbnails of the blob with the checksum.
+func RemoveThumbnails(checksum string) error {
+	names := []string{failedPath(checksum)}
+	for _, px := range ThumbnailSizes {
+		names = append(names, thumbnailPath(checksum, px))
+	}
+	for _, name := range names {
+		err := os.Remove(name)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// GenerateThumbnails makes the missing thumbnails of every image and
+// deletes the thumbnails whose image is gone.
+func GenerateThumbnails(ctx context.Context) error {
+	const batch = 500
+
+	for after := ``; ; {
+		checksums, err := database.GetChecksumsOfType(ctx, thumbnailTypes, after, batch)
+		if err != nil {
+			return err
+		}
+
+		for _, checksum := range checksums {
+			if thumbnailsTried(checksum) {
+				continue
+			}
+			// A broken image shouldn't stop the others.
+			err = MakeThumbnails(checksum)
+			if errors.Is(err, ErrNoThumbnail) || errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(checksums) < batch {
+			break
+		}
+		after = checksums[len(checksums)-1]
+	}
+
+	return removeOrphanThumbnails()
+}
+
+// generateThumbnails runs GenerateThumbnails every interval until ctx is done.
+func generateThumbnails(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := GenerateThumbnails(ctx); err != nil {
+				log.Printf(`[ Sender: user.generateThumbnails() ]: %v`, err)
+			}
+		}
+	}
+}
+
+// thumbnailsTried tells whether the thumbnails of the blob were made,
+// or failed to be made.
+func thumbnailsTried(checksum string) bool {
+	if thumbnailFailed(checksum) {
+		return true
+	}
+	for _, px := range ThumbnailSizes {
+		if _, err := os.Stat(thumbnailPath(checksum, px)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// removeOrphanThumbnails catches thumbnails whose blob was
+// removed without them, e.g. while they were being made.
+func removeOrphanThumbnails() error {
+	entries, err := os.ReadDir(directory.Thumbnails())
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		checksum, _, ok := strings.Cut(e.Name(), `-`)
+		if !ok {
+			continue
+		}
+		if _, err = os.Stat(blobPath(checksum)); !errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(directory.Thumbnails(), e.Name()))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func thumbnailFailed(checksum string) bool {
+	_, err := os.Stat(failedPath(checksum))
+	return err == nil
+}
+
+func thumbnailPath(checksum string, px int) string {
+	return filepath.Join(directory.Thumbnails(), checksum+`-`+strconv.Itoa(px))
+}
+
+// failedPath is the empty file that marks the blob as an image
+// that can't be decoded.
+func failedPath(checksum string) string {
+	return filepath.Join(directory.Thumbnails(), checksum+`-failed`)
+}
@@ -0,0 +1,345 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package user
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"server/config"
+	"server/database"
+	"server/directory"
+)
+
+var (
+	ErrUploadOffset   = errors.New(`offset doesn't match the received bytes`)
+	ErrUploadTooLarge = errors.New(`more bytes than the declared size`)
+)
+
+// uploadLocks serializes appends to the same upload.
+var uploadLocks = keyLocks{locks: map[string]*keyLock{}}
+
+// keyLocks hands out a mutex per key for as long as someone holds or
+// waits for it. Appends hold it while the body streams in, so unlike
+// stripes unrelated keys never wait for each other.
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+func (l *keyLocks) lock(key string) (unlock func()) {
+	l.mu.Lock()
+	kl, ok := l.locks[key]
+	if !ok {
+		kl = new(keyLock)
+		l.locks[key] = kl
+	}
+	kl.refs++
+	l.mu.Unlock()
+
+	kl.Lock()
+	return func() {
+		kl.Unlock()
+
+		l.mu.Lock()
+		if kl.refs--; kl.refs == 0 {
+			delete(l.locks, key)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// CreateUpload starts a resumable upload of size bytes. The quota is
+// checked up front so the client doesn't send data that can't be stored.
+// With extract the upload is an archive that is unpacked into the folder.
+func CreateUpload(ctx context.Context, u database.User, folder, name, mimeType string, size int64, extract bool) (database.Upload, error) {
+	if err := ValidateName(name); err != nil {
+		return database.Upload{}, err
+	}
+	if err := CheckQuota(ctx, u, size); err != nil {
+		return database.Upload{}, err
+	}
+
+	if mimeType == `` {
+		mimeType = mime.TypeByExtension(path.Ext(name))
+	}
+	if mimeType == `` {
+		mimeType = `application/octet-stream`
+	}
+
+	upload, err := database.CreateUpload(ctx, database.Upload{
+		UserID:    u.ID,
+		Folder:    CleanFolder(folder),
+		Name:      name,
+		MimeType:  mimeType,
+		Size:      size,
+		Extract:   extract,
+		ExpiresAt: time.Now().Add(config.Duration(config.UploadTTL)),
+	})
+	if err != nil {
+		return database.Upload{}, err
+	}
+
+	if err = os.WriteFile(uploadPath(upload.ID), nil, 0o600); err != nil {
+		return database.Upload{}, err
+	}
+	return upload, nil
+}
+
+func GetUpload(ctx context.Context, u database.User, id string) (database.Upload, error) {
+	return database.GetUpload(ctx, u.ID, id)
+}
+
+// AppendUpload writes the body at offset, which must equal the bytes
+// received so far. Bytes received before the body breaks off are kept,
+// so the client can resume from the returned offset. Once the upload is
+// complete the file is stored and returned, or the files unpacked from
+// it if it is to be extracted.
+func AppendUpload(ctx context.Context, u database.User, id string, offset int64, body io.Reader) (upload database.Upload, files []database.File, err error) {
+	unlock := lockUpload(id)
+	defer unlock()
+
+	upload, err = database.GetUpload(ctx, u.ID, id)
+	if err != nil {
+		return database.Upload{}, nil, err
+	}
+
+	if offset != upload.Offset {
+		return upload, nil, ErrUploadOffset
+	}
+
+	n, copyErr := writeAt(uploadPath(id), offset, upload.Size-offset, body)
+	if errors.Is(copyErr, ErrUploadTooLarge) {
+		return upload, nil, copyErr
+	}
+
+	if n > 0 {
+		if err = database.AdvanceUpload(ctx, id, offset, offset+n); err != nil {
+			return upload, nil, err
+		}
+		upload.Offset += n
+	}
+
+	if copyErr != nil || upload.Offset < upload.Size {
+		return upload, nil, copyErr
+	}
+
+	if upload.Extract {
+		files, err = extractUpload(ctx, u, upload)
+		return upload, files, err
+	}
+
+	f, err := completeUpload(ctx, u, upload)
+	if err != nil {
+		return upload, nil, err
+	}
+	return upload, []database.File{f}, nil
+}
+
+// CancelUpload drops the upload and the bytes received for it.
+func CancelUpload(ctx context.Context, u database.User, id string) error {
+	unlock := lockUpload(id)
+	defer unlock()
+
+	if _, err := database.GetUpload(ctx, u.ID, id); err != nil {
+		return err
+	}
+
+	if err := database.DeleteUpload(ctx, id); err != nil {
+		return err
+	}
+	return removeUploadFile(id)
+}
+
+// PruneUploads deletes expired uploads and the files no upload refers to.
+func PruneUploads(ctx context.Context) error {
+	active, err := database.DeleteExpiredUploads(ctx)
+	if err != nil {
+		return err
+	}
+
+	keep := make(map[string]bool, len(active))
+	for _, id := range active {
+		keep[id] = true
+	}
+
+	entries, err := os.ReadDir(directory.Uploads())
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if keep[e.Name()] {
+			continue
+		}
+		if err = removeUploadFile(e.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneUploads runs PruneUploads every interval until ctx is done.
+func pruneUploads(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := PruneUploads(ctx); err != nil {
+				log.Printf(`[ Sender: user.pruneUploads() ]: %v`, err)
+			}
+		}
+	}
+}
+
+// completeUpload moves the received bytes into the blob store
+// and records the file.
+func completeUpload(ctx context.Context, u database.User, upload database.Upload) (database.File, error) {
+	// Other files may have been stored while this one was uploading.
+	if err := CheckQuota(ctx, u, upload.Size); err != nil {
+		return database.File{}, err
+	}
+
+	src := uploadPath(upload.ID)
+	checksum, err := fileChecksum(src)
+	if err != nil {
+		return database.File{}, err
+	}
+
+	if err = database.EnsureFolder(ctx, u.ID, upload.Folder); err != nil {
+		return database.File{}, err
+	}
+
+	var f database.File
+	err = storeBlob(src, checksum, func() (err error) {
+		f, err = database.SaveFileInfo(ctx, u.Login, database.File{
+			Folder:   upload.Folder,
+			Name:     upload.Name,
+			Checksum: checksum,
+			Size:     upload.Size,
+			MimeType: upload.MimeType,
+		})
+		return err
+	})
+	if err != nil {
+		return database.File{}, err
+	}
+	QueueThumbnails(f)
+	return f, database.DeleteUpload(ctx, upload.ID)
+}
+
+// extractUpload unpacks the received archive. Archives that can't be
+// unpacked are dropped, uploading them again won't help; after running
+// out of quota the client can free space and complete the upload again.
+func extractUpload(ctx context.Context, u database.User, upload database.Upload) ([]database.File, error) {
+	archive, err := os.Open(uploadPath(upload.ID))
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	files, err := ExtractArchive(ctx, u, upload.Folder, archive, upload.Size)
+	if err != nil && !errors.Is(err, ErrArchiveInvalid) && !errors.Is(err, ErrArchiveUnsafe) && !errors.Is(err, ErrArchiveTooLarge) {
+		return files, err
+	}
+
+	if dropErr := database.DeleteUpload(ctx, upload.ID); dropErr != nil {
+		return files, dropErr
+	}
+	if removeErr := removeUploadFile(upload.ID); removeErr != nil {
+		return files, removeErr
+	}
+	return files, err
+}
+
+// writeAt writes at most limit bytes of r to the file at offset.
+// It fails with ErrUploadTooLarge, writing nothing, if r holds more.
+func writeAt(name string, offset, limit int64, r io.Reader) (n int64, err error) {
+	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	// One byte over the limit tells that the client sent too much.
+	n, err = io.Copy(f, io.LimitReader(r, limit+1))
+	if n > limit {
+		if err = f.Truncate(offset); err != nil {
+			return 0, err
+		}
+		return 0, ErrUploadTooLarge
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+func fileChecksum(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return ``, err
+	}
+	defer f.Close()
+
+	checksum := sha256.New()
+	if _, err = io.Copy(checksum, f); err != nil {
+		return ``, err
+	}
+	return hex.EncodeToString(checksum.Sum(nil)), nil
+}
+
+func lockUpload(id string) (unlock func()) {
+	return uploadLocks.lock(id)
+}
+
+func removeUploadFile(id string) error {
+	err := os.Remove(uploadPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func uploadPath(id string) string {
+	return filepath.Join(directory.Uploads(), id)
+}
@@ -0,0 +1,49 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package user
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestKeyLocksDropUnused(t *testing.T) {
+	l := keyLocks{locks: map[string]*keyLock{}}
+	counts := make([]int, 4)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 400; i++ {
+		wg.Add(1)
+		go func(key int) {
+			defer wg.Done()
+			unlock := l.lock(strconv.Itoa(key))
+			defer unlock()
+			counts[key]++
+		}(i % len(counts))
+	}
+	wg.Wait()
+
+	for key, n := range counts {
+		if n != 100 {
+			t.Errorf(`key %d counted %d times, want 100`, key, n)
+		}
+	}
+	if len(l.locks) != 0 {
+		t.Errorf(`%d locks left after unlocking`, len(l.locks))
+	}
+}
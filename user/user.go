@@ -19,28 +19,103 @@ package user
 import (
 	"context"
 	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"io"
+	"log"
+	"math"
+	"mime"
 	"mime/multipart"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"server/auth"
+	"server/config"
 	"server/database"
 	"server/directory"
+	"server/password"
+	"strings"
+	"unicode"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
-func Register(ctx context.Context, u database.User) (token auth.Token, err error) {
+var (
+	ErrDisabled      = errors.New(`account is disabled`)
+	ErrQuotaExceeded = errors.New(`storage quota exceeded`)
+	ErrInvalidLogin  = errors.New(`login must not be blank or contain slashes or control characters`)
+	ErrInvalidName   = errors.New(`file name must not be blank, . or .., or contain slashes or NUL`)
+)
+
+// validateLogin rejects logins that can't be used as a path segment:
+// the login names the user's directory and appears in URLs.
+func validateLogin(login string) error {
+	if strings.TrimSpace(login) == `` || strings.ContainsRune(login, '/') {
+		return ErrInvalidLogin
+	}
+	if strings.IndexFunc(login, unicode.IsControl) >= 0 {
+		return ErrInvalidLogin
+	}
+	return nil
+}
+
+// ValidateName rejects file names that aren't a single path segment,
+// as they would end up in another folder or none at all.
+func ValidateName(name string) error {
+	if strings.TrimSpace(name) == `` || name == `.` || name == `..` {
+		return ErrInvalidName
+	}
+	if strings.ContainsAny(name, "/\x00") {
+		return ErrInvalidName
+	}
+	return nil
+}
+
+// Register creates the account and logs it in. In the approval mode
+// the account waits for an admin, so an empty token is returned.
+func Register(ctx context.Context, u database.User, invite string) (token auth.Token, err error) {
+	if config.String(config.RegistrationMode) == ModeDisabled {
+		return auth.Token{}, ErrRegistrationClosed
+	}
+
+	if err = validateLogin(u.Login); err != nil {
+		return auth.Token{}, err
+	}
+
+	if err = password.Validate(u.Login, u.Password); err != nil {
+		return auth.Token{}, err
+	}
+
+	if u.Email != `` {
+		if u.Email, err = normalizeEmail(u.Email); err != nil {
+			return auth.Token{}, err
+		}
+	}
+	u.EmailVerified = false
+
 	u.Password, err = generatePasswordHash(ctx, u.Password)
 	if err != nil {
 		return auth.Token{}, err
 	}
 
-	u, err = database.RegisterUser(ctx, u)
+	u, err = insertUser(ctx, u, invite)
 	if err != nil {
 		return auth.Token{}, err
 	}
 
+	// The account already exists at this point, so a mail failure
+	// is only logged. The user can ask for another link later.
+	if u.Email != `` {
+		if err = SendVerification(ctx, u); err != nil {
+			log.Printf(`[ Sender: user.Register() ]: can't send verification: %v`, err)
+		}
+	}
+
+	if u.Status == database.StatusPending {
+		return auth.Token{}, nil
+	}
+
 	token, err = auth.CreateToken(ctx, u.Login)
 	if err != nil {
 		return auth.Token{}, err
@@ -49,21 +124,181 @@ func Register(ctx context.Context, u database.User) (token auth.Token, err error
 }
 
 func Login(ctx context.Context, u database.User) (token auth.Token, err error) {
-	userInfo, err := database.GetUser(ctx, u.Login)
+	if _, err = CheckPassword(ctx, u.Login, u.Password); err != nil {
+		return auth.Token{}, err
+	}
+
+	token, err = auth.CreateToken(ctx, u.Login)
 	if err != nil {
 		return auth.Token{}, err
 	}
+	return token, nil
+}
+
+// CheckPassword returns the user with the login if the password is theirs
+// and the account may sign in, for logins that don't need a token.
+func CheckPassword(ctx context.Context, login, password string) (database.User, error) {
+	u, err := database.GetUser(ctx, login)
+	if err != nil {
+		return database.User{}, err
+	}
+
+	err = comparsePasswords(ctx, password, u.Password)
+	if err != nil {
+		return database.User{}, err
+	}
+
+	switch {
+	case u.Status == database.StatusPending:
+		return database.User{}, ErrPendingApproval
+	case u.Disabled:
+		return database.User{}, ErrDisabled
+	}
+	return u, nil
+}
 
-	err = comparsePasswords(ctx, u.Password, userInfo.Password)
+// ChangePassword replaces the password after verifying the current one
+// and revokes every session except the one the request was made with.
+func ChangePassword(ctx context.Context, login, current, newPassword, sessionID string) error {
+	u, err := database.GetUser(ctx, login)
 	if err != nil {
+		return err
+	}
+
+	if err = comparsePasswords(ctx, current, u.Password); err != nil {
+		return err
+	}
+
+	if err = password.Validate(login, newPassword); err != nil {
+		return err
+	}
+
+	hash, err := generatePasswordHash(ctx, newPassword)
+	if err != nil {
+		return err
+	}
+
+	if err = database.UpdatePassword(ctx, u.ID, hash); err != nil {
+		return err
+	}
+	return database.RevokeSessions(ctx, u.ID, sessionID)
+}
+
+// ChangeLogin renames the account. Tokens are bound to the login,
+// so all sessions are revoked and a fresh token is returned.
+func ChangeLogin(ctx context.Context, login, current, newLogin string) (token auth.Token, err error) {
+	if err = validateLogin(newLogin); err != nil {
 		return auth.Token{}, err
 	}
 
-	token, err = auth.CreateToken(ctx, u.Login)
+	u, err := database.GetUser(ctx, login)
 	if err != nil {
 		return auth.Token{}, err
 	}
-	return token, nil
+
+	if err = comparsePasswords(ctx, current, u.Password); err != nil {
+		return auth.Token{}, err
+	}
+
+	// The password was checked against the old login only. Other policy
+	// failures are left to the next password change, but a password that
+	// now spells the login must not survive the rename.
+	if err = password.Validate(newLogin, current); errors.Is(err, password.ErrSimilar) {
+		return auth.Token{}, err
+	}
+
+	if err = database.UpdateLogin(ctx, u.ID, newLogin); err != nil {
+		return auth.Token{}, err
+	}
+
+	if err = database.RevokeSessions(ctx, u.ID, ``); err != nil {
+		return auth.Token{}, err
+	}
+	return auth.CreateToken(ctx, newLogin)
+}
+
+// DeleteAccount removes the user, its sessions and file records,
+// and purges the blobs no other user refers to.
+func DeleteAccount(ctx context.Context, login, current string) error {
+	u, err := database.GetUser(ctx, login)
+	if err != nil {
+		return err
+	}
+
+	if err = comparsePasswords(ctx, current, u.Password); err != nil {
+		return err
+	}
+
+	checksums, err := database.DeleteUser(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, checksum := range checksums {
+		if err = RemoveUnusedFile(ctx, checksum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetPassword replaces the password without asking for the current one,
+// as admins do, and revokes every session of the user.
+func SetPassword(ctx context.Context, uid int64, newPassword string) error {
+	u, err := database.GetUserByID(ctx, uid)
+	if err != nil {
+		return err
+	}
+
+	if err = password.Validate(u.Login, newPassword); err != nil {
+		return err
+	}
+
+	hash, err := generatePasswordHash(ctx, newPassword)
+	if err != nil {
+		return err
+	}
+
+	if err = database.UpdatePassword(ctx, u.ID, hash); err != nil {
+		return err
+	}
+	return database.RevokeSessions(ctx, u.ID, ``)
+}
+
+// CheckQuota fails with ErrQuotaExceeded if storing size more bytes
+// would take the user over the quota.
+func CheckQuota(ctx context.Context, u database.User, size int64) error {
+	if u.Quota == 0 {
+		return nil
+	}
+
+	usage, err := database.GetUsage(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+
+	if usage.Bytes+size > u.Quota {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// remainingQuota returns how many more bytes the user can store,
+// math.MaxInt64 - 1 without a quota so one more byte still fits.
+func remainingQuota(ctx context.Context, u database.User) (int64, error) {
+	if u.Quota == 0 {
+		return math.MaxInt64 - 1, nil
+	}
+
+	usage, err := database.GetUsage(ctx, u.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	if usage.Bytes > u.Quota {
+		return 0, nil
+	}
+	return u.Quota - usage.Bytes, nil
 }
 
 func generatePasswordHash(ctx context.Context, password string) (hash string, err error) {
@@ -87,25 +322,122 @@ type FileData struct {
 	FileHeader *multipart.FileHeader
 }
 
-func SaveFile(ctx context.Context, f *multipart.FileHeader) (sha256sum string, err error) {
+// SaveFile stores the uploaded file in the user data folder under its
+// SHA-256 checksum and records it in the folder of the user.
+func SaveFile(ctx context.Context, login, folder string, f *multipart.FileHeader) (saved database.File, err error) {
 	if ctx.Err() != nil {
-		return ``, ctx.Err()
+		return database.File{}, ctx.Err()
+	}
+	if err = ValidateName(f.Filename); err != nil {
+		return database.File{}, err
 	}
 
 	file, err := f.Open()
 	if err != nil {
-		return ``, err
+		return database.File{}, err
 	}
 	defer file.Close()
 
+	tmp, err := os.CreateTemp(directory.UserData(), `upload-*`)
+	if err != nil {
+		return database.File{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
 	checksum := sha256.New()
-	_, err = io.Copy(checksum, file)
+	_, err = io.Copy(io.MultiWriter(checksum, tmp), file)
 	if err != nil {
-		return ``, err
+		return database.File{}, err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return database.File{}, err
+	}
+
+	sha256sum := hex.EncodeToString(checksum.Sum(nil))
+	err = storeBlob(tmp.Name(), sha256sum, func() (err error) {
+		// ToDo: delete the file if catch an error
+		saved, err = database.SaveFileInfo(ctx, login, database.File{
+			Folder:   folder,
+			Name:     f.Filename,
+			Checksum: sha256sum,
+			Size:     f.Size,
+			MimeType: MimeType(f),
+		})
+		return err
+	})
+	return saved, err
+}
+
+// CopyFile records a file in the folder with the content of src. It fails
+// with fs.ErrNotExist if src was deleted and its blob removed meanwhile.
+func CopyFile(ctx context.Context, login string, src database.File, folder, name, mimeType string) (f database.File, err error) {
+	if err = ValidateName(name); err != nil {
+		return database.File{}, err
+	}
+
+	err = referBlob(src.Checksum, func() (err error) {
+		f, err = database.SaveFileInfo(ctx, login, database.File{
+			Folder:   folder,
+			Name:     name,
+			Checksum: src.Checksum,
+			Size:     src.Size,
+			MimeType: mimeType,
+		})
+		return err
+	})
+	return f, err
+}
+
+// MoveFile renames the file of the user and moves it to another folder,
+// once the new name is known to be a single path segment.
+func MoveFile(ctx context.Context, uid, id int64, folder, name string) (database.File, error) {
+	if err := ValidateName(name); err != nil {
+		return database.File{}, err
+	}
+	return database.MoveFile(ctx, uid, id, folder, name)
+}
+
+// OpenFile opens the blob with the checksum for reading.
+func OpenFile(checksum string) (*os.File, error) {
+	return os.Open(blobPath(checksum))
+}
+
+func blobPath(checksum string) string {
+	return filepath.Join(directory.UserData(), checksum)
+}
+
+// CleanFolder turns a folder given by the client into an absolute
+// slash separated path, so "", "." and "/" all name the root.
+func CleanFolder(folder string) string {
+	return path.Clean(`/` + folder)
+}
+
+// MimeType returns the type of the uploaded file: the one sent by the
+// client, else the one of the extension, else the one sniffed from content.
+func MimeType(f *multipart.FileHeader) string {
+	const unknown = `application/octet-stream`
+
+	if t := f.Header.Get(`Content-Type`); t != `` && t != unknown {
+		if mediaType, params, err := mime.ParseMediaType(t); err == nil {
+			return mime.FormatMediaType(mediaType, params)
+		}
+	}
+
+	if t := mime.TypeByExtension(filepath.Ext(f.Filename)); t != `` {
+		return t
+	}
+
+	file, err := f.Open()
+	if err != nil {
+		return unknown
 	}
+	defer file.Close()
 
-	sha256sum = string(checksum.Sum(nil))
-	return sha256sum, nil
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	return http.DetectContentType(head[:n])
 }
 
 func RemoveFile(ctx context.Context, checksum string) error {
@@ -113,9 +445,18 @@ func RemoveFile(ctx context.Context, checksum string) error {
 		return ctx.Err()
 	}
 
-	path := filepath.Join(directory.UserData(), checksum)
-	if err := os.Remove(path); err != nil {
+	if err := os.Remove(blobPath(checksum)); err != nil {
 		return err
 	}
-	return nil
+	return RemoveThumbnails(checksum)
+}
+
+// ReplaceFiles deletes the other files at the path of f, for clients that
+// overwrite files rather than keep them side by side like uploads do.
+func ReplaceFiles(ctx context.Context, f database.File) error {
+	replaced, err := database.DeleteFilesAt(ctx, f.UserID, f.Folder, f.Name, f.ID)
+	if err != nil {
+		return err
+	}
+	return RemoveUnusedFiles(ctx, replaced)
 }
@@ -0,0 +1,40 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package user
+
+import "testing"
+
+func TestValidateName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		`notes.txt`:   true,
+		`.hidden`:     true,
+		`..notes`:     true,
+		`a\b`:         true,
+		``:            false,
+		` `:           false,
+		`.`:           false,
+		`..`:          false,
+		`a/b`:         false,
+		`/`:           false,
+		"a\x00b":      false,
+		`photo 1.jpg`: true,
+	} {
+		if err := ValidateName(name); (err == nil) != valid {
+			t.Errorf(`ValidateName(%q) = %v`, name, err)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2022 dexenrage
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package user
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"server/database"
+	"server/directory"
+	"time"
+)
+
+// FileWriter stores a file of the user from a stream, for clients that
+// send the content without a multipart form. Nothing is recorded before
+// Commit, Abort throws the written bytes away.
+type FileWriter struct {
+	u        database.User
+	folder   string
+	name     string
+	tmp      *os.File
+	sum      hash.Hash
+	size     int64
+	head     []byte
+	mime     string
+	modified time.Time
+}
+
+// CreateFile starts a file of the user at the slash separated path.
+func CreateFile(u database.User, filePath string) (*FileWriter, error) {
+	filePath = CleanFolder(filePath)
+	if err := ValidateName(path.Base(filePath)); err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(directory.UserData(), `stream-*`)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileWriter{
+		u:      u,
+		folder: path.Dir(filePath),
+		name:   path.Base(filePath),
+		tmp:    tmp,
+		sum:    sha256.New(),
+	}, nil
+}
+
+func (w *FileWriter) Write(p []byte) (int, error) {
+	n, err := w.tmp.Write(p)
+	w.sum.Write(p[:n])
+	w.size += int64(n)
+
+	// The start of the content tells the type when the name doesn't.
+	if rest := 512 - len(w.head); rest > 0 {
+		if rest > n {
+			rest = n
+		}
+		w.head = append(w.head, p[:rest]...)
+	}
+	return n, err
+}
+
+// Size returns the number of bytes written so far.
+func (w *FileWriter) Size() int64 { return w.size }
+
+// SetMimeType sets the type the client sent, which
+// otherwise comes from the name or the content.
+func (w *FileWriter) SetMimeType(mimeType string) { w.mime = mimeType }
+
+// SetModTime sets when the file was modified, the time of Commit otherwise.
+func (w *FileWriter) SetModTime(t time.Time) { w.modified = t }
+
+// Close ends writing without committing yet, so that writers waiting
+// for Commit in large numbers don't keep a descriptor open each.
+func (w *FileWriter) Close() error { return w.tmp.Close() }
+
+// Checksum returns the SHA-256 checksum of the bytes written so far.
+func (w *FileWriter) Checksum() string { return hex.EncodeToString(w.sum.Sum(nil)) }
+
+// Commit moves the content into the blob store and records the file,
+// creating its folder if needed.
+func (w *FileWriter) Commit(ctx context.Context) (database.File, error) {
+	defer w.Abort()
+
+	if err := w.tmp.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return database.File{}, err
+	}
+
+	if err := CheckQuota(ctx, w.u, w.size); err != nil {
+		return database.File{}, err
+	}
+
+	if err := database.EnsureFolder(ctx, w.u.ID, w.folder); err != nil {
+		return database.File{}, err
+	}
+
+	mimeType := w.mime
+	if mimeType == `` {
+		mimeType = mime.TypeByExtension(path.Ext(w.name))
+	}
+	if mimeType == `` {
+		mimeType = http.DetectContentType(w.head)
+	}
+
+	var f database.File
+	checksum := w.Checksum()
+	err := storeBlob(w.tmp.Name(), checksum, func() (err error) {
+		f, err = database.SaveFileInfo(ctx, w.u.Login, database.File{
+			Folder:     w.folder,
+			Name:       w.name,
+			Checksum:   checksum,
+			Size:       w.size,
+			MimeType:   mimeType,
+			ModifiedAt: w.modified,
+		})
+		return err
+	})
+	if err != nil {
+		return database.File{}, err
+	}
+	QueueThumbnails(f)
+	return f, nil
+}
+
+// Abort discards the file. It does nothing after Commit.
+func (w *FileWriter) Abort() error {
+	w.tmp.Close()
+	err := os.Remove(w.tmp.Name())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}